@@ -1,9 +1,13 @@
 package backend
 
 import (
+	"crypto/tls"
+	"encoding/binary"
 	"fmt"
 	"net"
+	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/miekg/dns"
@@ -20,29 +24,204 @@ type Backend struct {
 	LastFail           time.Time
 	TotalQueries       uint64
 	TotalFailures      uint64
+	RcodeCounts        [16]uint64         // Responses to live queries by response code
+	QtypeCounts        map[uint16]uint64  // Live queries by query type
+	ErrorStreak        int                // Consecutive live responses with an error response code
+	LatencyEWMA        time.Duration      // Smoothed response time, 0 until the first answer
+	EjectedUntil       time.Time          // Out of rotation until then after outlier detection ejected it
+	RecoveredAt        time.Time          // When the backend last turned healthy again, zero if it never failed
+	PreferFamily       string             // Address family tried first when Address is a host name
+	SourceAddress      string             // Local IP queries to this backend are sent from, empty for any
+	SourcePorts        *PortRandomization // Random source ports for UDP queries, nil for kernel-chosen
+	DNSCookies         bool               // Send DNS cookies (RFC 7873) to plain DNS backends
+	CaseRandomization  bool               // Randomize the query name's case over UDP and require it echoed (0x20)
+	Weight             int                // Relative share of queries under weighted balancing, 0 counts as 1
+	MaxInFlight        int64              // Queries allowed in flight at once, 0 = unlimited
+	Draining           bool               // Administratively out of rotation, queries in flight still complete
+	Disabled           bool               // Administratively down: sent no queries and not health checked
+	CheckType          string             // Health check type: CheckDNS (default), CheckDNSTCP, CheckTCPConnect or CheckExec
+	CheckCommand       []string           // Program and arguments run by CheckExec health checks
+	AcceptRcodes       map[int]bool       // Response codes passing DNS health checks, nil for NOERROR and NXDOMAIN
+	SlowStart          *SlowStartRamp     // Traffic ramp after recovery, nil for none
+	inFlight           int64
+	mismatched         uint64           // Answers dropped for not matching the query sent
+	histogram          latencyHistogram // Response times of live queries
+	quantiles          LatencyQuantiles // Recent response times of live queries, for percentiles
+	hostport           string
+	tlsConfig          *tls.Config // Client TLS settings of tls:// and https:// backends
+	cookies            *cookieJar
+	transport          transport
+	udp                *udpPool
+	tcp                *streamPool
 	mu                 sync.RWMutex
 }
 
-// NewBackend creates a new backend instance
-func NewBackend(address string) *Backend {
-	return &Backend{
+// NewBackend creates a new backend instance. The address may carry a
+// scheme selecting the transport: "udp://" (the default for plain
+// "host:port"), "tcp://", "tls://", "https://host/path" or "quic://".
+// tlsOpts applies to the encrypted schemes and may be nil.
+func NewBackend(address string, tlsOpts *TLSOptions) (*Backend, error) {
+	b := &Backend{
 		Address: address,
 		Healthy: true, // Start optimistic
 	}
+
+	scheme, hostport := splitScheme(address)
+	var path string
+	if scheme == SchemeHTTPS {
+		if i := strings.IndexByte(hostport, '/'); i >= 0 {
+			hostport, path = hostport[:i], hostport[i:]
+		}
+	}
+	b.hostport = hostport
+
+	host, _, err := net.SplitHostPort(hostport)
+	if err != nil {
+		return nil, fmt.Errorf("invalid backend address %q: %w", address, err)
+	}
+
+	switch scheme {
+	case SchemeUDP:
+		b.udp = newUDPPool(b)
+		b.tcp = newStreamPool(func(timeout time.Duration) (net.Conn, error) {
+			return b.dial("tcp", timeout)
+		}, &b.mismatched)
+		if b.cookies, err = newCookieJar(); err != nil {
+			return nil, err
+		}
+	case SchemeTCP:
+		b.tcp = newStreamPool(func(timeout time.Duration) (net.Conn, error) {
+			return b.dial("tcp", timeout)
+		}, &b.mismatched)
+		b.transport = b.tcp
+		if b.cookies, err = newCookieJar(); err != nil {
+			return nil, err
+		}
+	case SchemeTLS:
+		tlsConfig, err := tlsOpts.clientConfig(host)
+		if err != nil {
+			return nil, err
+		}
+		b.tlsConfig = tlsConfig
+		b.tcp = newStreamPool(func(timeout time.Duration) (net.Conn, error) {
+			return b.dialTLS(tlsConfig, timeout)
+		}, &b.mismatched)
+		b.transport = b.tcp
+	case SchemeHTTPS:
+		tlsConfig, err := tlsOpts.clientConfig(host, "h2", "http/1.1")
+		if err != nil {
+			return nil, err
+		}
+		b.tlsConfig = tlsConfig
+		b.transport = newDoHTransport(b, path, tlsConfig)
+	case SchemeQUIC:
+		tlsConfig, err := tlsOpts.clientConfig(host, "doq")
+		if err != nil {
+			return nil, err
+		}
+		b.transport = newDoQTransport(b, tlsConfig)
+	default:
+		return nil, fmt.Errorf("unsupported backend scheme %q", scheme)
+	}
+
+	return b, nil
 }
 
-// IsHealthy returns the current health status
+// IsHealthy reports whether the backend passes health checks and is
+// neither ejected as an outlier nor disabled
 func (b *Backend) IsHealthy() bool {
 	b.mu.RLock()
 	defer b.mu.RUnlock()
-	return b.Healthy
+	return b.Healthy && !b.ejected() && !b.Disabled
+}
+
+// Available reports whether the backend can take a new query: it is
+// healthy, not draining or disabled and below its in-flight cap
+func (b *Backend) Available() bool {
+	b.mu.RLock()
+	available := b.Healthy && !b.ejected() && !b.Draining && !b.Disabled
+	b.mu.RUnlock()
+	if !available {
+		return false
+	}
+	return b.MaxInFlight == 0 || b.InFlight() < b.MaxInFlight
+}
+
+// SetDraining puts the backend into or takes it out of maintenance. A
+// draining backend gets no new queries but keeps being health checked, so
+// it is back in rotation as soon as it is undrained.
+func (b *Backend) SetDraining(draining bool) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.Draining = draining
+}
+
+// IsDraining reports whether the backend is in maintenance
+func (b *Backend) IsDraining() bool {
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+	return b.Draining
+}
+
+// SetDisabled marks the backend administratively down or up. Unlike a
+// draining one, a disabled backend is no longer health checked and
+// doesn't count as healthy, as if it had been removed; enabled again, it
+// is back in rotation with the health it last had until its next check.
+func (b *Backend) SetDisabled(disabled bool) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.Disabled = disabled
+}
+
+// IsDisabled reports whether the backend is administratively down
+func (b *Backend) IsDisabled() bool {
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+	return b.Disabled
+}
+
+// Eject takes the backend out of rotation for d, whatever its health
+// checks say
+func (b *Backend) Eject(d time.Duration) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.EjectedUntil = time.Now().Add(d)
+}
+
+// Ejected reports whether the backend is currently ejected
+func (b *Backend) Ejected() bool {
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+	return b.ejected()
+}
+
+// ejected must be called with mu held
+func (b *Backend) ejected() bool {
+	return !b.EjectedUntil.IsZero() && time.Now().Before(b.EjectedUntil)
 }
 
 // MarkQueryAttempt increments query counter
+//
+// Deprecated: queries sent through the backend are counted already, by
+// their type as well.
 func (b *Backend) MarkQueryAttempt() {
+	b.markQuery(nil)
+}
+
+// markQuery counts a live query, in total and by its type
+func (b *Backend) markQuery(query []byte) {
+	question := rawQuestion(query)
+
 	b.mu.Lock()
 	defer b.mu.Unlock()
 	b.TotalQueries++
+	if question == nil {
+		return
+	}
+	if b.QtypeCounts == nil {
+		b.QtypeCounts = make(map[uint16]uint64)
+	}
+	b.QtypeCounts[binary.BigEndian.Uint16(question[len(question)-4:])]++
 }
 
 // MarkFailure records a query failure
@@ -53,6 +232,47 @@ func (b *Backend) MarkFailure() {
 	b.LastFail = time.Now()
 }
 
+// latencyEWMAWeight is the weight of each new sample in LatencyEWMA
+const latencyEWMAWeight = 0.2
+
+// RecordLatency folds a response time into the moving average
+func (b *Backend) RecordLatency(rtt time.Duration) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if b.LatencyEWMA == 0 {
+		b.LatencyEWMA = rtt
+		return
+	}
+	b.LatencyEWMA += time.Duration(latencyEWMAWeight * float64(rtt-b.LatencyEWMA))
+}
+
+// Latency returns the smoothed response time, 0 if none was measured yet
+func (b *Backend) Latency() time.Duration {
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+	return b.LatencyEWMA
+}
+
+// InFlight returns the number of queries waiting for an answer
+func (b *Backend) InFlight() int64 {
+	return atomic.LoadInt64(&b.inFlight)
+}
+
+// Close shuts the backend's sockets and connections once it is no longer
+// in use; queries still sent to it fail
+func (b *Backend) Close() {
+	if b.udp != nil {
+		b.udp.close()
+	}
+	if b.tcp != nil {
+		b.tcp.close()
+	}
+	if b.transport != nil {
+		b.transport.close()
+	}
+}
+
 // UpdateHealth updates the health status and logs changes
 func (b *Backend) UpdateHealth(healthy bool, logger *logrus.Logger) {
 	b.mu.Lock()
@@ -60,6 +280,9 @@ func (b *Backend) UpdateHealth(healthy bool, logger *logrus.Logger) {
 
 	oldHealth := b.Healthy
 	b.Healthy = healthy
+	if healthy && !oldHealth {
+		b.RecoveredAt = time.Now()
+	}
 
 	if oldHealth != healthy {
 		if healthy {
@@ -90,6 +313,7 @@ func (b *Backend) RecordHealthCheck(success bool, failThreshold, successThreshol
 
 		if !b.Healthy && b.ConsecutiveSuccess >= successThreshold {
 			b.Healthy = true
+			b.RecoveredAt = time.Now()
 			healthChanged = true
 			newHealth = true
 		}
@@ -108,18 +332,65 @@ func (b *Backend) RecordHealthCheck(success bool, failThreshold, successThreshol
 	return healthChanged, b.Healthy
 }
 
+// RecordRcode records the response code of an answer to a live query.
+// Error codes extend the backend's error streak, and a streak reaching
+// streakThreshold marks it unhealthy like failed health checks would, so a
+// backend refusing real traffic while passing its probe still leaves
+// rotation. A threshold of 0 only counts.
+func (b *Backend) RecordRcode(rcode int, isError bool, streakThreshold int) (markedUnhealthy bool) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.RcodeCounts[rcode&0x0f]++
+	if !isError {
+		b.ErrorStreak = 0
+		return false
+	}
+
+	b.ErrorStreak++
+	if streakThreshold > 0 && b.Healthy && b.ErrorStreak >= streakThreshold {
+		b.Healthy = false
+		b.ConsecutiveSuccess = 0
+		b.ErrorStreak = 0
+		return true
+	}
+	return false
+}
+
 // Stats returns current backend statistics
 func (b *Backend) Stats() map[string]interface{} {
 	b.mu.RLock()
 	defer b.mu.RUnlock()
 
+	rcodes := make(map[string]uint64)
+	for rcode, count := range b.RcodeCounts {
+		if count > 0 {
+			rcodes[dns.RcodeToString[rcode]] = count
+		}
+	}
+	qtypes := make(map[string]uint64, len(b.QtypeCounts))
+	for qtype, count := range b.QtypeCounts {
+		qtypes[dns.Type(qtype).String()] = count
+	}
+
 	return map[string]interface{}{
 		"address":             b.Address,
 		"healthy":             b.Healthy,
 		"total_queries":       b.TotalQueries,
 		"total_failures":      b.TotalFailures,
+		"qtypes":              qtypes,
+		"rcodes":              rcodes,
+		"error_streak":        b.ErrorStreak,
+		"mismatched":          atomic.LoadUint64(&b.mismatched),
 		"consecutive_fails":   b.ConsecutiveFails,
 		"consecutive_success": b.ConsecutiveSuccess,
+		"latency_ewma":        b.LatencyEWMA,
+		"latency_histogram":   b.histogram.snapshot(),
+		"latency_percentiles": b.quantiles.Snapshot(),
+		"in_flight":           b.InFlight(),
+		"ejected":             b.ejected(),
+		"draining":            b.Draining,
+		"disabled":            b.Disabled,
 		"last_check":          b.LastCheck,
 		"last_fail":           b.LastFail,
 	}
@@ -127,96 +398,102 @@ func (b *Backend) Stats() map[string]interface{} {
 
 // ForwardQuery forwards a DNS query to this backend
 func (b *Backend) ForwardQuery(query []byte, timeout time.Duration) ([]byte, error) {
-	b.MarkQueryAttempt()
+	return b.forward(query, timeout, false)
+}
 
-	conn, err := net.DialTimeout("udp", b.Address, timeout)
-	if err != nil {
-		b.MarkFailure()
-		return nil, fmt.Errorf("failed to connect to backend: %w", err)
-	}
-	defer conn.Close()
+// ForwardQueryTCP forwards a DNS query from a stream client, so plain
+// DNS backends are queried over TCP for answers too large for UDP
+func (b *Backend) ForwardQueryTCP(query []byte, timeout time.Duration) ([]byte, error) {
+	return b.forward(query, timeout, true)
+}
 
-	// Set deadline for the entire operation
-	if err := conn.SetDeadline(time.Now().Add(timeout)); err != nil {
-		b.MarkFailure()
-		return nil, fmt.Errorf("failed to set deadline: %w", err)
-	}
+// forward exchanges a query with the backend and records the attempt and
+// its response time
+func (b *Backend) forward(query []byte, timeout time.Duration, stream bool) ([]byte, error) {
+	b.markQuery(query)
+	atomic.AddInt64(&b.inFlight, 1)
+	defer atomic.AddInt64(&b.inFlight, -1)
 
-	// Send query
-	if _, err := conn.Write(query); err != nil {
+	start := time.Now()
+	response, err := b.exchange(query, timeout, stream)
+	if err != nil {
 		b.MarkFailure()
-		return nil, fmt.Errorf("failed to send query: %w", err)
+		return nil, err
 	}
-
-	// Read response (DNS messages are typically < 512 bytes for UDP)
-	buffer := make([]byte, 4096)
-	n, err := conn.Read(buffer)
-	if err != nil {
+	// Pooled plain DNS sockets already drop mismatched answers and keep
+	// waiting; DoH and DoQ answer on the query's own stream, so a wrong
+	// answer there can only be refused
+	if !answers(query, response) {
+		atomic.AddUint64(&b.mismatched, 1)
 		b.MarkFailure()
-		return nil, fmt.Errorf("failed to read response: %w", err)
+		return nil, errMismatch
 	}
+	rtt := time.Since(start)
+	b.RecordLatency(rtt)
+	b.histogram.observe(rtt)
+	b.quantiles.Observe(rtt)
 
-	return buffer[:n], nil
+	return response, nil
 }
 
-// HealthCheck performs a DNS health check query
+// HealthCheck performs a health check of the backend's CheckType: a DNS
+// query over the backend's transport, a DNS query over a new connection,
+// only opening a connection, or running an external command. Encrypted
+// backends are always checked over their own protocol, certificate and
+// pin verification included, so a backend is never marked healthy by a
+// probe it would not serve.
 func (b *Backend) HealthCheck(queryName, queryType string, timeout time.Duration) error {
+	switch b.CheckType {
+	case CheckTCPConnect:
+		return b.checkConnect(timeout)
+	case CheckExec:
+		return b.checkExec(timeout)
+	}
+
 	// Create DNS query message
 	m := new(dns.Msg)
 	
-	var qtype uint16
-	switch queryType {
-	case "A":
-		qtype = dns.TypeA
-	case "AAAA":
-		qtype = dns.TypeAAAA
-	case "NS":
-		qtype = dns.TypeNS
-	case "ANY":
-		qtype = dns.TypeANY
-	default:
+	qtype, ok := dns.StringToType[strings.ToUpper(queryType)]
+	if !ok {
 		qtype = dns.TypeNS
 	}
 
 	m.SetQuestion(dns.Fqdn(queryName), qtype)
 	m.RecursionDesired = true
 
-	// Pack the message
-	query, err := m.Pack()
-	if err != nil {
-		return fmt.Errorf("failed to pack DNS query: %w", err)
-	}
-
-	// Send to backend
-	conn, err := net.DialTimeout("udp", b.Address, timeout)
-	if err != nil {
-		return fmt.Errorf("failed to connect: %w", err)
-	}
-	defer conn.Close()
-
-	if err := conn.SetDeadline(time.Now().Add(timeout)); err != nil {
-		return fmt.Errorf("failed to set deadline: %w", err)
-	}
-
-	if _, err := conn.Write(query); err != nil {
-		return fmt.Errorf("failed to send query: %w", err)
-	}
+	var response *dns.Msg
+	if b.CheckType == CheckDNSTCP && (b.transport == nil || b.transport == b.tcp) {
+		var err error
+		response, err = b.exchangeNewConn(m, timeout)
+		if err != nil {
+			return err
+		}
+	} else {
+		// Pack the message
+		query, err := m.Pack()
+		if err != nil {
+			return fmt.Errorf("failed to pack DNS query: %w", err)
+		}
 
-	// Read response
-	buffer := make([]byte, 4096)
-	n, err := conn.Read(buffer)
-	if err != nil {
-		return fmt.Errorf("failed to read response: %w", err)
-	}
+		// Send to backend
+		answer, err := b.exchange(query, timeout, false)
+		if err != nil {
+			return err
+		}
 
-	// Verify it's a valid DNS response
-	response := new(dns.Msg)
-	if err := response.Unpack(buffer[:n]); err != nil {
-		return fmt.Errorf("invalid DNS response: %w", err)
+		// Verify it's a valid DNS response
+		response = new(dns.Msg)
+		if err := response.Unpack(answer); err != nil {
+			return fmt.Errorf("invalid DNS response: %w", err)
+		}
 	}
 
 	// Check if response has error
-	if response.Rcode != dns.RcodeSuccess && response.Rcode != dns.RcodeNameError {
+	if b.AcceptRcodes != nil {
+		if !b.AcceptRcodes[response.Rcode] {
+			return fmt.Errorf("DNS error response: %s", dns.RcodeToString[response.Rcode])
+		}
+	} else if response.Rcode != dns.RcodeSuccess && response.Rcode != dns.RcodeNameError {
 		return fmt.Errorf("DNS error response: %s", dns.RcodeToString[response.Rcode])
 	}
 
@@ -0,0 +1,152 @@
+package backend
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// cookieJar holds the DNS cookie state (RFC 7873) for one backend: our
+// client cookie and the last server cookie the backend issued for it
+type cookieJar struct {
+	client string // Hex encoded, 8 bytes
+	mu     sync.Mutex
+	server string // Hex encoded, 8 to 32 bytes
+}
+
+func newCookieJar() (*cookieJar, error) {
+	var client [8]byte
+	if _, err := rand.Read(client[:]); err != nil {
+		return nil, fmt.Errorf("failed to generate DNS client cookie: %w", err)
+	}
+	return &cookieJar{client: hex.EncodeToString(client[:])}, nil
+}
+
+// option returns the COOKIE option to send, with the cached server cookie
+// when there is one
+func (j *cookieJar) option() *dns.EDNS0_COOKIE {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	return &dns.EDNS0_COOKIE{Code: dns.EDNS0COOKIE, Cookie: j.client + j.server}
+}
+
+// update caches the server cookie from a response, reporting false if the
+// response carries somebody else's client cookie
+func (j *cookieJar) update(cookie string) bool {
+	if len(cookie) < len(j.client) || cookie[:len(j.client)] != j.client {
+		return false
+	}
+
+	j.mu.Lock()
+	j.server = cookie[len(j.client):]
+	j.mu.Unlock()
+	return true
+}
+
+// exchangeWithCookies sends a query carrying our DNS cookie and caches the
+// server cookie from the answer. A BADCOOKIE answer hands us a fresh server
+// cookie, so the query is retried once with it. Cookie data is removed
+// from the answer again before it is returned.
+func (b *Backend) exchangeWithCookies(query []byte, timeout time.Duration, stream bool) ([]byte, error) {
+	msg := new(dns.Msg)
+	if err := msg.Unpack(query); err != nil {
+		return b.roundTrip(query, timeout, stream)
+	}
+
+	addedOPT := false
+	opt := msg.IsEdns0()
+	if opt == nil {
+		// Keep the client's classic 512 byte limit
+		msg.SetEdns0(dns.MinMsgSize, false)
+		opt = msg.IsEdns0()
+		addedOPT = true
+	}
+
+	for attempt := 0; ; attempt++ {
+		// Whatever cookie the client sent is meant for us, not the backend
+		removeOption(opt, dns.EDNS0COOKIE)
+		opt.Option = append(opt.Option, b.cookies.option())
+
+		packed, err := msg.Pack()
+		if err != nil {
+			return b.roundTrip(query, timeout, stream)
+		}
+
+		answer, err := b.roundTrip(packed, timeout, stream)
+		if err != nil {
+			return nil, err
+		}
+
+		response := new(dns.Msg)
+		if err := response.Unpack(answer); err != nil {
+			return answer, nil
+		}
+
+		respOpt := response.IsEdns0()
+		if respOpt != nil {
+			for _, option := range respOpt.Option {
+				if cookie, ok := option.(*dns.EDNS0_COOKIE); ok && !b.cookies.update(cookie.Cookie) {
+					return nil, errors.New("backend answered with a mismatched client cookie")
+				}
+			}
+		}
+
+		if response.Rcode == dns.RcodeBadCookie && attempt == 0 {
+			continue
+		}
+
+		if respOpt == nil {
+			return answer, nil
+		}
+		if addedOPT {
+			return stripEDNS(response, answer), nil
+		}
+		if !removeOption(respOpt, dns.EDNS0COOKIE) {
+			return answer, nil
+		}
+		if repacked, err := response.Pack(); err == nil {
+			return repacked, nil
+		}
+		return answer, nil
+	}
+}
+
+// removeOption drops every EDNS0 option with the given code, reporting
+// whether there were any
+func removeOption(opt *dns.OPT, code uint16) bool {
+	options := opt.Option[:0]
+	for _, option := range opt.Option {
+		if option.Option() != code {
+			options = append(options, option)
+		}
+	}
+	removed := len(options) != len(opt.Option)
+	opt.Option = options
+	return removed
+}
+
+// stripEDNS removes the OPT record we added from an unpacked response,
+// returning the original bytes if it can't be repacked
+func stripEDNS(response *dns.Msg, answer []byte) []byte {
+	extra := response.Extra[:0]
+	for _, rr := range response.Extra {
+		if rr.Header().Rrtype != dns.TypeOPT {
+			extra = append(extra, rr)
+		}
+	}
+	response.Extra = extra
+
+	// Extended RCODE bits lived in the OPT record
+	response.Rcode &= 0x0f
+
+	packed, err := response.Pack()
+	if err != nil {
+		return answer
+	}
+	return packed
+}
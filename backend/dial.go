@@ -0,0 +1,118 @@
+package backend
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"sort"
+	"time"
+)
+
+// Address family preferences for outgoing connections
+const (
+	FamilyAny  = "any"
+	FamilyIPv4 = "ipv4"
+	FamilyIPv6 = "ipv6"
+)
+
+// dial connects to the backend over the given network ("udp" or "tcp").
+// Backends given as IP literals are dialed directly; host names are
+// resolved and their addresses tried in the configured family order.
+func (b *Backend) dial(network string, timeout time.Duration) (net.Conn, error) {
+	return b.dialFrom(network, 0, timeout)
+}
+
+// dialFrom is dial with a fixed local port, 0 letting the kernel choose
+func (b *Backend) dialFrom(network string, port int, timeout time.Duration) (net.Conn, error) {
+	dialer := &net.Dialer{Timeout: timeout}
+	if ip := b.sourceIP(); ip != nil || port != 0 {
+		if network == "udp" {
+			dialer.LocalAddr = &net.UDPAddr{IP: ip, Port: port}
+		} else {
+			dialer.LocalAddr = &net.TCPAddr{IP: ip, Port: port}
+		}
+	}
+
+	addrs, err := b.resolve(timeout)
+	if err != nil {
+		return nil, err
+	}
+
+	var lastErr error
+	for _, addr := range addrs {
+		conn, err := dialer.Dial(network, addr)
+		if err == nil {
+			return conn, nil
+		}
+		lastErr = err
+	}
+
+	return nil, lastErr
+}
+
+// resolve returns the backend's dial addresses in the order they should be
+// tried. Host names are left to the dialer unless a family is preferred,
+// or required because queries must leave from a fixed source address.
+func (b *Backend) resolve(timeout time.Duration) ([]string, error) {
+	host, port, err := net.SplitHostPort(b.hostport)
+	if err != nil {
+		return nil, fmt.Errorf("invalid backend address %q: %w", b.Address, err)
+	}
+
+	family, strict := b.PreferFamily, false
+	if ip := b.sourceIP(); ip != nil {
+		family, strict = FamilyIPv6, true
+		if ip.To4() != nil {
+			family = FamilyIPv4
+		}
+	}
+
+	if net.ParseIP(host) != nil || family == "" || family == FamilyAny {
+		return []string{b.hostport}, nil
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	ips, err := net.DefaultResolver.LookupIPAddr(ctx, host)
+	if err != nil {
+		return nil, fmt.Errorf("failed to resolve backend %s: %w", host, err)
+	}
+	sortByFamily(ips, family)
+
+	addrs := make([]string, 0, len(ips))
+	for _, ip := range ips {
+		if strict && (ip.IP.To4() != nil) != (family == FamilyIPv4) {
+			continue
+		}
+		addrs = append(addrs, net.JoinHostPort(ip.String(), port))
+	}
+	if len(addrs) == 0 {
+		return nil, fmt.Errorf("backend %s has no %s address to match source address %s", host, family, b.SourceAddress)
+	}
+
+	return addrs, nil
+}
+
+// sourceIP returns the configured source address, or nil to let the
+// kernel choose
+func (b *Backend) sourceIP() net.IP {
+	if b.SourceAddress == "" {
+		return nil
+	}
+	return net.ParseIP(b.SourceAddress)
+}
+
+// sortByFamily orders addresses so the preferred family comes first,
+// keeping the resolver's order within each family
+func sortByFamily(addrs []net.IPAddr, prefer string) {
+	preferV4 := prefer == FamilyIPv4
+	sort.SliceStable(addrs, func(i, j int) bool {
+		iV4 := addrs[i].IP.To4() != nil
+		jV4 := addrs[j].IP.To4() != nil
+		if iV4 == jV4 {
+			return false
+		}
+		return iV4 == preferV4
+	})
+}
@@ -0,0 +1,265 @@
+package backend
+
+import (
+	"context"
+	"crypto/tls"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/quic-go/quic-go"
+)
+
+const (
+	// doqIdleTimeout is how long an unused QUIC connection is kept open.
+	// Connections closed by either side after this are redialed on the
+	// next query.
+	doqIdleTimeout = 30 * time.Second
+
+	// doqNoError is the application error code for a graceful close
+	doqNoError = 0x0
+)
+
+// doqTransport forwards queries over DNS-over-QUIC, opening one stream per
+// query on a shared connection. The connection is redialed when it times
+// out or its path breaks, e.g. after a NAT rebinding the server can't
+// follow.
+type doqTransport struct {
+	backend   *Backend
+	tlsConfig *tls.Config
+	mu        sync.Mutex
+	conn      quic.Connection
+	closed    bool
+}
+
+func newDoQTransport(b *Backend, tlsConfig *tls.Config) *doqTransport {
+	tlsConfig.MinVersion = tls.VersionTLS13
+	return &doqTransport{backend: b, tlsConfig: tlsConfig}
+}
+
+// exchange sends a query on a new stream, retrying once on a fresh
+// connection if the cached one turns out to be dead. A stream error only
+// fails its own query; the connection is kept for the others.
+func (t *doqTransport) exchange(query []byte, timeout time.Duration) ([]byte, error) {
+	if len(query) < 2 {
+		return nil, errors.New("query too short")
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	// The message ID must be zero on DoQ streams (RFC 9250 section 4.2.1)
+	id := binary.BigEndian.Uint16(query)
+	msg := make([]byte, len(query))
+	copy(msg, query)
+	binary.BigEndian.PutUint16(msg, 0)
+
+	conn, reused, err := t.connection(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	// A cached connection may have died silently, e.g. when the server
+	// restarted or a NAT rebinding moved our path, so it only gets half
+	// the timeout and a fresh connection gets the rest
+	attemptCtx := ctx
+	if reused {
+		var attemptCancel context.CancelFunc
+		attemptCtx, attemptCancel = context.WithTimeout(ctx, timeout/2)
+		defer attemptCancel()
+	}
+
+	response, err := t.roundTrip(attemptCtx, conn, msg)
+	if err != nil {
+		// A cached connection the query timed out on is set aside rather
+		// than closed, so the queries still on it may complete
+		broken := connectionFailed(conn, err)
+		stalled := reused && attemptCtx.Err() != nil && ctx.Err() == nil
+		if broken {
+			t.reset(conn)
+		} else if stalled {
+			t.forget(conn)
+		}
+		if !reused || !(broken || stalled) || ctx.Err() != nil {
+			return nil, err
+		}
+		if conn, _, err = t.connection(ctx); err != nil {
+			return nil, err
+		}
+		if response, err = t.roundTrip(ctx, conn, msg); err != nil {
+			if connectionFailed(conn, err) {
+				t.reset(conn)
+			}
+			return nil, err
+		}
+	}
+
+	if len(response) < 2 {
+		return nil, errors.New("DoQ response too short")
+	}
+	binary.BigEndian.PutUint16(response, id)
+
+	return response, nil
+}
+
+// roundTrip writes a query on its own stream and reads the answer
+func (t *doqTransport) roundTrip(ctx context.Context, conn quic.Connection, msg []byte) ([]byte, error) {
+	stream, err := conn.OpenStreamSync(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open DoQ stream: %w", err)
+	}
+	defer stream.CancelRead(doqNoError)
+
+	if deadline, ok := ctx.Deadline(); ok {
+		stream.SetDeadline(deadline)
+	}
+
+	// The client signals the end of the query by closing its side
+	if err := writeStreamMessage(stream, msg); err != nil {
+		return nil, fmt.Errorf("failed to send query: %w", err)
+	}
+	if err := stream.Close(); err != nil {
+		return nil, fmt.Errorf("failed to send query: %w", err)
+	}
+
+	response, err := readStreamMessage(stream)
+	if err != nil {
+		if errors.Is(err, io.EOF) {
+			err = io.ErrUnexpectedEOF
+		}
+		return nil, fmt.Errorf("failed to read response: %w", err)
+	}
+
+	return response, nil
+}
+
+// connection returns the cached connection if it is still alive, dialing a
+// new one otherwise. reused reports whether the connection was cached.
+func (t *doqTransport) connection(ctx context.Context) (conn quic.Connection, reused bool, err error) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if t.closed {
+		return nil, false, errClosed
+	}
+	if t.conn != nil {
+		select {
+		case <-t.conn.Context().Done():
+			// Idle timeout or closed by the server
+			t.conn = nil
+		default:
+			return t.conn, true, nil
+		}
+	}
+
+	conn, err = t.dial(ctx)
+	if err != nil {
+		return nil, false, err
+	}
+	t.conn = conn
+
+	return conn, false, nil
+}
+
+// connectionFailed reports whether an error took the whole connection
+// down, rather than only the query's stream
+func connectionFailed(conn quic.Connection, err error) bool {
+	var streamErr *quic.StreamError
+	if errors.As(err, &streamErr) {
+		return false
+	}
+	if conn.Context().Err() != nil {
+		return true
+	}
+
+	var transportErr *quic.TransportError
+	var appErr *quic.ApplicationError
+	var idleErr *quic.IdleTimeoutError
+	var resetErr *quic.StatelessResetError
+	return errors.As(err, &transportErr) || errors.As(err, &appErr) ||
+		errors.As(err, &idleErr) || errors.As(err, &resetErr)
+}
+
+// reset drops a broken connection so the next query dials a new one
+func (t *doqTransport) reset(conn quic.Connection) {
+	t.forget(conn)
+	conn.CloseWithError(doqNoError, "")
+}
+
+// forget stops handing out a connection, leaving it open for the queries
+// still on it until it times out
+func (t *doqTransport) forget(conn quic.Connection) {
+	t.mu.Lock()
+	if t.conn == conn {
+		t.conn = nil
+	}
+	t.mu.Unlock()
+}
+
+// close shuts the connection for good
+func (t *doqTransport) close() {
+	t.mu.Lock()
+	conn := t.conn
+	t.conn = nil
+	t.closed = true
+	t.mu.Unlock()
+
+	if conn != nil {
+		conn.CloseWithError(doqNoError, "")
+	}
+}
+
+// dial opens a QUIC connection to the first reachable backend address
+func (t *doqTransport) dial(ctx context.Context) (quic.Connection, error) {
+	deadline, _ := ctx.Deadline()
+	addrs, err := t.backend.resolve(time.Until(deadline))
+	if err != nil {
+		return nil, err
+	}
+
+	quicConfig := &quic.Config{
+		MaxIdleTimeout: doqIdleTimeout,
+	}
+
+	var lastErr error
+	for _, addr := range addrs {
+		conn, err := t.dialAddr(ctx, addr, quicConfig)
+		if err == nil {
+			return conn, nil
+		}
+		lastErr = err
+	}
+
+	return nil, fmt.Errorf("failed to connect to backend: %w", lastErr)
+}
+
+// dialAddr opens a QUIC connection from a socket bound to the backend's
+// source address. The socket is closed along with the connection.
+func (t *doqTransport) dialAddr(ctx context.Context, addr string, quicConfig *quic.Config) (quic.Connection, error) {
+	raddr, err := net.ResolveUDPAddr("udp", addr)
+	if err != nil {
+		return nil, err
+	}
+
+	pconn, err := net.ListenUDP("udp", &net.UDPAddr{IP: t.backend.sourceIP()})
+	if err != nil {
+		return nil, err
+	}
+
+	conn, err := quic.Dial(ctx, pconn, raddr, t.tlsConfig, quicConfig)
+	if err != nil {
+		pconn.Close()
+		return nil, err
+	}
+
+	go func() {
+		<-conn.Context().Done()
+		pconn.Close()
+	}()
+
+	return conn, nil
+}
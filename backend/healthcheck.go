@@ -0,0 +1,127 @@
+package backend
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"net"
+	"os"
+	"os/exec"
+	"strings"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// Health check types
+const (
+	CheckDNS        = "dns"         // DNS query over the backend's own transport
+	CheckDNSTCP     = "dns_tcp"     // DNS query over a new stream connection
+	CheckTCPConnect = "tcp_connect" // Connection setup only
+	CheckExec       = "exec"        // External command, exit status 0 is healthy
+)
+
+// checkExec runs the backend's CheckCommand with its address as the last
+// argument and in DNSBALANCER_BACKEND, killing it after timeout
+func (b *Backend) checkExec(timeout time.Duration) error {
+	if len(b.CheckCommand) == 0 {
+		return fmt.Errorf("no health check command configured")
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	args := append(append([]string(nil), b.CheckCommand[1:]...), b.Address)
+	cmd := exec.CommandContext(ctx, b.CheckCommand[0], args...)
+	cmd.Env = append(os.Environ(), "DNSBALANCER_BACKEND="+b.Address)
+	var output bytes.Buffer
+	cmd.Stdout = &output
+	cmd.Stderr = &output
+	// Don't wait on children of a killed command still holding its output
+	cmd.WaitDelay = 100 * time.Millisecond
+
+	if err := cmd.Run(); err != nil {
+		if ctx.Err() != nil {
+			return fmt.Errorf("health check command timed out")
+		}
+		if msg := firstLine(output.String()); msg != "" {
+			return fmt.Errorf("health check command failed: %w: %s", err, msg)
+		}
+		return fmt.Errorf("health check command failed: %w", err)
+	}
+	return nil
+}
+
+// firstLine returns the first non-empty line of a command's output,
+// shortened to fit a log line
+func firstLine(output string) string {
+	for _, line := range strings.Split(output, "\n") {
+		if line = strings.TrimSpace(line); line != "" {
+			if len(line) > 200 {
+				line = line[:200]
+			}
+			return line
+		}
+	}
+	return ""
+}
+
+// checkConnect reports whether a new connection to the backend can be set
+// up: a TCP handshake for plain DNS backends, followed by the TLS
+// handshake for tls:// and https:// ones, or a QUIC handshake for quic://
+// ones
+func (b *Backend) checkConnect(timeout time.Duration) error {
+	if doq, ok := b.transport.(*doqTransport); ok {
+		ctx, cancel := context.WithTimeout(context.Background(), timeout)
+		defer cancel()
+
+		conn, err := doq.dial(ctx)
+		if err != nil {
+			return err
+		}
+		return conn.CloseWithError(doqNoError, "")
+	}
+
+	conn, err := b.dialCheck(timeout)
+	if err != nil {
+		return err
+	}
+	return conn.Close()
+}
+
+// dialCheck opens a new stream connection for a health check, over TLS for
+// backends that require it
+func (b *Backend) dialCheck(timeout time.Duration) (net.Conn, error) {
+	if b.tlsConfig != nil {
+		return b.dialTLS(b.tlsConfig, timeout)
+	}
+	return b.dial("tcp", timeout)
+}
+
+// exchangeNewConn sends a query over a new stream connection, so the check
+// covers the whole path (TCP, and TLS for tls:// backends) instead of a
+// pooled connection that may have been opened before it broke
+func (b *Backend) exchangeNewConn(query *dns.Msg, timeout time.Duration) (*dns.Msg, error) {
+	conn, err := b.dialCheck(timeout)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+
+	if err := conn.SetDeadline(time.Now().Add(timeout)); err != nil {
+		return nil, err
+	}
+
+	co := &dns.Conn{Conn: conn}
+	if err := co.WriteMsg(query); err != nil {
+		return nil, err
+	}
+	response, err := co.ReadMsg()
+	if err != nil {
+		return nil, err
+	}
+	if response.Id != query.Id {
+		return nil, fmt.Errorf("response ID mismatch")
+	}
+	return response, nil
+}
@@ -0,0 +1,66 @@
+package backend
+
+import (
+	"sync/atomic"
+	"time"
+)
+
+// latencyBuckets are the upper bounds of the latency histogram buckets,
+// from cache hits on a nearby resolver to answers close to timing out
+var latencyBuckets = [...]time.Duration{
+	time.Millisecond,
+	2 * time.Millisecond,
+	5 * time.Millisecond,
+	10 * time.Millisecond,
+	25 * time.Millisecond,
+	50 * time.Millisecond,
+	100 * time.Millisecond,
+	250 * time.Millisecond,
+	500 * time.Millisecond,
+	time.Second,
+	2500 * time.Millisecond,
+	5 * time.Second,
+}
+
+// latencyHistogram counts response times into fixed buckets, so the
+// spread of a backend's latency shows and not only its average. The last
+// count is of the times above every bucket.
+type latencyHistogram struct {
+	counts [len(latencyBuckets) + 1]uint64
+	sum    int64 // Nanoseconds
+}
+
+// observe counts a response time in its bucket
+func (h *latencyHistogram) observe(rtt time.Duration) {
+	i := 0
+	for i < len(latencyBuckets) && rtt > latencyBuckets[i] {
+		i++
+	}
+	atomic.AddUint64(&h.counts[i], 1)
+	atomic.AddInt64(&h.sum, int64(rtt))
+}
+
+// snapshot returns the buckets with cumulative counts, Prometheus style:
+// each bucket counts the response times up to its bound ("le"), and the
+// "+Inf" one all of them
+func (h *latencyHistogram) snapshot() map[string]interface{} {
+	buckets := make([]map[string]interface{}, 0, len(h.counts))
+	var count uint64
+	for i := range h.counts {
+		count += atomic.LoadUint64(&h.counts[i])
+		le := "+Inf"
+		if i < len(latencyBuckets) {
+			le = latencyBuckets[i].String()
+		}
+		buckets = append(buckets, map[string]interface{}{
+			"le":    le,
+			"count": count,
+		})
+	}
+
+	return map[string]interface{}{
+		"buckets":     buckets,
+		"count":       count,
+		"sum_seconds": time.Duration(atomic.LoadInt64(&h.sum)).Seconds(),
+	}
+}
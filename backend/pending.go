@@ -0,0 +1,208 @@
+package backend
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"os"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// errMismatch is returned for an answer that doesn't match its query
+var errMismatch = errors.New("response does not match the query")
+
+// pendingQueries tracks the queries outstanding on one upstream socket or
+// connection, keyed by the random transaction ID each was sent with
+type pendingQueries struct {
+	mu         sync.Mutex
+	waiters    map[uint16]*queryWaiter
+	err        error
+	mismatched *uint64 // Counts answers dropped for not matching their query
+}
+
+// queryWaiter receives the response for one outstanding query
+type queryWaiter struct {
+	question []byte
+	exact    []byte // Question that must be echoed byte for byte, case included
+	response chan []byte
+}
+
+func newPendingQueries(mismatched *uint64) *pendingQueries {
+	return &pendingQueries{
+		waiters:    make(map[uint16]*queryWaiter),
+		mismatched: mismatched,
+	}
+}
+
+// register reserves an unused random transaction ID for a query. With
+// exactCase the answer must echo the question name's case as sent.
+func (p *pendingQueries) register(query []byte, exactCase bool) (uint16, *queryWaiter, error) {
+	waiter := &queryWaiter{
+		question: questionSection(query),
+		response: make(chan []byte, 1),
+	}
+	if exactCase {
+		waiter.exact = rawQuestion(query)
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if p.err != nil {
+		return 0, nil, p.err
+	}
+	if len(p.waiters) > 0xffff {
+		return 0, nil, errors.New("too many outstanding queries on backend connection")
+	}
+
+	var buf [2]byte
+	for {
+		if _, err := rand.Read(buf[:]); err != nil {
+			return 0, nil, fmt.Errorf("failed to generate query ID: %w", err)
+		}
+		id := binary.BigEndian.Uint16(buf[:])
+		if _, taken := p.waiters[id]; !taken {
+			p.waiters[id] = waiter
+			return id, waiter, nil
+		}
+	}
+}
+
+// unregister releases a transaction ID once its query is done
+func (p *pendingQueries) unregister(id uint16) {
+	p.mu.Lock()
+	delete(p.waiters, id)
+	p.mu.Unlock()
+}
+
+// deliver hands a response to the query waiting for it. Stale, duplicate
+// or spoofed answers that match no outstanding query are dropped, leaving
+// the query waiting for the real answer.
+func (p *pendingQueries) deliver(response []byte) {
+	if len(response) < 12 {
+		return
+	}
+	id := binary.BigEndian.Uint16(response)
+
+	p.mu.Lock()
+	waiter, ok := p.waiters[id]
+	if ok && !waiter.matches(response) {
+		// Right ID, wrong answer: most likely a spoofing attempt
+		if p.mismatched != nil {
+			atomic.AddUint64(p.mismatched, 1)
+		}
+		ok = false
+	}
+	if ok {
+		delete(p.waiters, id)
+	}
+	p.mu.Unlock()
+
+	if ok {
+		waiter.response <- response
+	}
+}
+
+// matches reports whether a message is a response to the waiter's query:
+// the QR flag is set, so it isn't the query reflected back, and the
+// question is the one asked
+func (w *queryWaiter) matches(response []byte) bool {
+	if len(response) < 12 || response[2]&0x80 == 0 {
+		return false
+	}
+	if w.exact != nil {
+		return bytes.Equal(rawQuestion(response), w.exact)
+	}
+	return w.question == nil || bytes.Equal(questionSection(response), w.question)
+}
+
+// answers reports whether response answers query, by the same rules
+func answers(query, response []byte) bool {
+	waiter := queryWaiter{question: questionSection(query)}
+	return waiter.matches(response)
+}
+
+// failure returns the error that closed the connection, if any
+func (p *pendingQueries) failure() error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.err
+}
+
+// fail records why the connection closed and wakes every waiting query
+func (p *pendingQueries) fail(err error) {
+	p.mu.Lock()
+	if p.err != nil {
+		p.mu.Unlock()
+		return
+	}
+	p.err = err
+	waiters := p.waiters
+	p.waiters = make(map[uint16]*queryWaiter)
+	p.mu.Unlock()
+
+	for _, waiter := range waiters {
+		close(waiter.response)
+	}
+}
+
+// wait blocks until the response for a registered query arrives, the
+// connection fails or the timer fires. The client's own ID is restored.
+func (p *pendingQueries) wait(waiter *queryWaiter, query []byte, timeout <-chan time.Time) ([]byte, error) {
+	select {
+	case response, ok := <-waiter.response:
+		if !ok {
+			return nil, fmt.Errorf("failed to read response: %w", p.failure())
+		}
+		copy(response, query[:2])
+		return response, nil
+	case <-timeout:
+		return nil, fmt.Errorf("failed to read response: %w", os.ErrDeadlineExceeded)
+	}
+}
+
+// questionSection returns the question section of a message carrying one
+// uncompressed question with the name lowercased, or nil if it can't be
+// located
+func questionSection(msg []byte) []byte {
+	raw := rawQuestion(msg)
+	if raw == nil {
+		return nil
+	}
+
+	// Compare names case-insensitively; some servers echo the case back
+	// differently than it was sent
+	question := bytes.ToLower(raw[:len(raw)-4])
+	return append(question, raw[len(raw)-4:]...)
+}
+
+// rawQuestion returns the question section of a message carrying one
+// uncompressed question as it is on the wire, or nil if it can't be
+// located
+func rawQuestion(msg []byte) []byte {
+	if len(msg) < 12 || binary.BigEndian.Uint16(msg[4:6]) != 1 {
+		return nil
+	}
+
+	off := 12
+	for off < len(msg) {
+		length := int(msg[off])
+		if length == 0 {
+			off++
+			break
+		}
+		if length&0xc0 != 0 {
+			return nil
+		}
+		off += 1 + length
+	}
+	if off+4 > len(msg) {
+		return nil
+	}
+
+	return msg[12 : off+4]
+}
@@ -0,0 +1,143 @@
+package backend
+
+import (
+	"math"
+	"math/bits"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Latency percentile settings. Response times are counted in microseconds
+// into log-linear buckets, HDR histogram style: exact below 32µs, then 32
+// buckets per power of two, so an estimate is within 1/64 of the true
+// value. Times from 67s up share the last bucket.
+const (
+	quantileSubBuckets = 32
+	quantileBuckets    = quantileSubBuckets * 22
+
+	// QuantileWindow is how often the counts start over; percentiles are
+	// of the current and the previous window, the last one to two
+	// minutes, so they follow a backend getting slower
+	QuantileWindow = time.Minute
+)
+
+// quantileCounts is one window's bucket counts
+type quantileCounts [quantileBuckets]uint64
+
+// LatencyQuantiles estimates the percentiles of recent response times
+// with constant memory and a lock-free observe. The zero value is ready
+// to use.
+type LatencyQuantiles struct {
+	windows  [2]quantileCounts
+	current  int32 // Index of the window being counted into
+	rotateAt int64 // Unix nanoseconds when the older window is cleared and becomes current
+	mu       sync.Mutex
+}
+
+// Observe counts a response time
+func (q *LatencyQuantiles) Observe(rtt time.Duration) {
+	now := time.Now().UnixNano()
+	if now >= atomic.LoadInt64(&q.rotateAt) {
+		q.rotate(now)
+	}
+	window := &q.windows[atomic.LoadInt32(&q.current)]
+	atomic.AddUint64(&window[quantileBucket(rtt)], 1)
+}
+
+// rotate clears the older window and makes it the current one. Times
+// counted while it is cleared may be lost; percentiles don't suffer from
+// a few.
+func (q *LatencyQuantiles) rotate(now int64) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if now < atomic.LoadInt64(&q.rotateAt) {
+		return
+	}
+
+	next := 1 - atomic.LoadInt32(&q.current)
+	window := &q.windows[next]
+	for i := range window {
+		atomic.StoreUint64(&window[i], 0)
+	}
+	atomic.StoreInt32(&q.current, next)
+	atomic.StoreInt64(&q.rotateAt, now+int64(QuantileWindow))
+}
+
+// quantileBucket returns the bucket counting a response time
+func quantileBucket(rtt time.Duration) int {
+	us := uint64(max(rtt.Microseconds(), 0))
+	if us < quantileSubBuckets {
+		return int(us)
+	}
+	shift := bits.Len64(us) - 6 // Keeps the top 6 bits, 32 to 63
+	i := quantileSubBuckets*(shift+1) + int(us>>shift) - quantileSubBuckets
+	return min(i, quantileBuckets-1)
+}
+
+// quantileValue returns the middle of a bucket's range
+func quantileValue(i int) time.Duration {
+	if i < quantileSubBuckets {
+		return time.Duration(i) * time.Microsecond
+	}
+	shift := i/quantileSubBuckets - 1
+	lower := uint64(i%quantileSubBuckets+quantileSubBuckets) << shift
+	return time.Duration(lower+(uint64(1)<<shift)/2) * time.Microsecond
+}
+
+// Quantiles returns the estimates of the given quantiles (0-1) and the
+// number of response times they are of; the estimates are 0 when there
+// are none. Windows only rotate as times are observed, so those that
+// have since gone out of date are left out here.
+func (q *LatencyQuantiles) Quantiles(quantiles ...float64) ([]time.Duration, uint64) {
+	current := atomic.LoadInt32(&q.current)
+	windows := []int32{current, 1 - current}
+	switch overdue := time.Now().UnixNano() - atomic.LoadInt64(&q.rotateAt); {
+	case overdue >= int64(QuantileWindow):
+		windows = nil
+	case overdue >= 0:
+		windows = windows[:1]
+	}
+
+	var counts quantileCounts
+	var total uint64
+	for _, w := range windows {
+		for i := range counts {
+			count := atomic.LoadUint64(&q.windows[w][i])
+			counts[i] += count
+			total += count
+		}
+	}
+
+	estimates := make([]time.Duration, len(quantiles))
+	if total == 0 {
+		return estimates, 0
+	}
+	for n, quantile := range quantiles {
+		rank := uint64(math.Ceil(quantile * float64(total)))
+		var seen uint64
+		for i, count := range counts {
+			seen += count
+			if seen >= max(rank, 1) {
+				estimates[n] = quantileValue(i)
+				break
+			}
+		}
+	}
+	return estimates, total
+}
+
+// Snapshot returns the p50, p95 and p99 response times in milliseconds
+// and the number of times they are of
+func (q *LatencyQuantiles) Snapshot() map[string]interface{} {
+	estimates, count := q.Quantiles(0.5, 0.95, 0.99)
+	ms := func(d time.Duration) float64 {
+		return math.Round(float64(d)/float64(time.Microsecond)) / 1000
+	}
+	return map[string]interface{}{
+		"p50_ms": ms(estimates[0]),
+		"p95_ms": ms(estimates[1]),
+		"p99_ms": ms(estimates[2]),
+		"count":  count,
+	}
+}
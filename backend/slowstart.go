@@ -0,0 +1,41 @@
+package backend
+
+import "time"
+
+// SlowStartRamp configures how a recovered backend's share of traffic
+// grows back to normal
+type SlowStartRamp struct {
+	Window    time.Duration // Time to reach the full share
+	MinWeight float64       // Share right after recovery, 0-1
+}
+
+// Warmth returns the fraction of its normal share of queries the backend
+// should get: 1 normally, ramping up linearly from the ramp's MinWeight
+// over its Window after the backend recovers or returns from ejection
+func (b *Backend) Warmth() float64 {
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+
+	if b.SlowStart == nil || b.SlowStart.Window <= 0 {
+		return 1
+	}
+
+	since := b.RecoveredAt
+	if b.EjectedUntil.After(since) {
+		since = b.EjectedUntil
+	}
+	if since.IsZero() {
+		return 1
+	}
+
+	elapsed := time.Since(since)
+	if elapsed >= b.SlowStart.Window {
+		return 1
+	}
+
+	warmth := float64(elapsed) / float64(b.SlowStart.Window)
+	if warmth < b.SlowStart.MinWeight {
+		warmth = b.SlowStart.MinWeight
+	}
+	return warmth
+}
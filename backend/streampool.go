@@ -0,0 +1,176 @@
+package backend
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	// streamPoolSize is the number of warm connections kept per backend
+	streamPoolSize = 2
+
+	// streamIdleTimeout closes pooled connections with no outstanding
+	// queries, ahead of the idle timeouts servers commonly apply
+	streamIdleTimeout = 8 * time.Second
+)
+
+// errIdle closes a pooled connection that has not been used for a while
+var errIdle = errors.New("idle connection closed")
+
+// streamPool keeps a few warm TCP (or TLS) connections per backend and
+// pipelines queries over them, matching answers by transaction ID so the
+// server may reply out of order (RFC 7766 section 6.2.1.1)
+type streamPool struct {
+	dial       func(timeout time.Duration) (net.Conn, error)
+	next       uint32
+	conns      [streamPoolSize]*streamConn
+	mismatched *uint64 // Counts answers dropped for not matching their query
+	closed     bool
+	mu         sync.Mutex
+}
+
+// streamConn is one pooled connection and the queries outstanding on it
+type streamConn struct {
+	conn    net.Conn
+	writeMu sync.Mutex
+	pending *pendingQueries
+}
+
+func newStreamPool(dial func(timeout time.Duration) (net.Conn, error), mismatched *uint64) *streamPool {
+	return &streamPool{dial: dial, mismatched: mismatched}
+}
+
+// exchange sends a query on a pooled connection and waits for its answer.
+// Servers may close idle connections at any time, so a query that fails on
+// a reused connection is retried once on a new one.
+func (p *streamPool) exchange(query []byte, timeout time.Duration) ([]byte, error) {
+	if len(query) < 12 {
+		return nil, errors.New("query too short")
+	}
+
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+
+	conn, reused, err := p.connection(timeout)
+	if err != nil {
+		return nil, fmt.Errorf("failed to connect to backend: %w", err)
+	}
+
+	response, err := conn.exchange(query, timer.C)
+	if err != nil && reused && conn.pending.failure() != nil {
+		if conn, _, err = p.connection(timeout); err != nil {
+			return nil, fmt.Errorf("failed to connect to backend: %w", err)
+		}
+		response, err = conn.exchange(query, timer.C)
+	}
+
+	return response, err
+}
+
+// connection returns the next pooled connection in turn, dialing it if it
+// has not been opened yet or was closed. reused reports whether the
+// connection was already open.
+func (p *streamPool) connection(timeout time.Duration) (conn *streamConn, reused bool, err error) {
+	idx := atomic.AddUint32(&p.next, 1) % streamPoolSize
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if p.closed {
+		return nil, false, errClosed
+	}
+	if conn := p.conns[idx]; conn != nil && conn.pending.failure() == nil {
+		return conn, true, nil
+	}
+
+	raw, err := p.dial(timeout)
+	if err != nil {
+		return nil, false, err
+	}
+
+	conn = &streamConn{
+		conn:    raw,
+		pending: newPendingQueries(p.mismatched),
+	}
+	p.conns[idx] = conn
+	conn.touch()
+	go conn.readLoop()
+
+	return conn, false, nil
+}
+
+// close shuts the pooled connections for good, failing the queries
+// still outstanding on them
+func (p *streamPool) close() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	p.closed = true
+	for i, conn := range p.conns {
+		if conn != nil {
+			conn.close(errClosed)
+			p.conns[i] = nil
+		}
+	}
+}
+
+// exchange writes one query under a fresh ID and waits for its answer
+func (c *streamConn) exchange(query []byte, timeout <-chan time.Time) ([]byte, error) {
+	id, waiter, err := c.pending.register(query, false)
+	if err != nil {
+		return nil, err
+	}
+	defer c.pending.unregister(id)
+
+	msg := make([]byte, len(query))
+	copy(msg, query)
+	binary.BigEndian.PutUint16(msg, id)
+
+	c.writeMu.Lock()
+	c.touch()
+	err = writeStreamMessage(c.conn, msg)
+	c.writeMu.Unlock()
+	if err != nil {
+		c.close(err)
+		return nil, fmt.Errorf("failed to send query: %w", err)
+	}
+
+	return c.pending.wait(waiter, query, timeout)
+}
+
+// touch pushes the idle deadline out after activity on the connection
+func (c *streamConn) touch() {
+	c.conn.SetReadDeadline(time.Now().Add(streamIdleTimeout))
+}
+
+// readLoop delivers answers to their waiting queries until the connection
+// is closed by either side or sits idle
+func (c *streamConn) readLoop() {
+	for {
+		response, err := readStreamMessage(c.conn)
+		if err != nil {
+			// Writes push the deadline out too, so a timeout means nothing
+			// was sent or received for the whole idle period
+			var netErr net.Error
+			if errors.As(err, &netErr) && netErr.Timeout() {
+				err = errIdle
+			}
+			c.close(err)
+			return
+		}
+
+		c.touch()
+		c.pending.deliver(response)
+	}
+}
+
+// close shuts the connection and fails every query outstanding on it
+func (c *streamConn) close(err error) {
+	c.pending.fail(err)
+	c.conn.Close()
+}
@@ -0,0 +1,127 @@
+package backend
+
+import (
+	"context"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"time"
+)
+
+// TLSOptions configures certificate verification and client
+// authentication for encrypted backends (tls://, https:// and quic://)
+type TLSOptions struct {
+	ServerName         string   // Name verified against the server certificate, defaults to the address host
+	CAFile             string   // PEM bundle of trusted roots, defaults to the system pool
+	InsecureSkipVerify bool     // Skip certificate chain and name verification
+	CertFile           string   // Client certificate presented for mutual TLS
+	KeyFile            string   // Private key for CertFile
+	SPKIPins           []string // Base64 SHA-256 digests of accepted server public keys
+}
+
+// clientConfig builds the TLS client configuration for a backend host
+func (o *TLSOptions) clientConfig(host string, alpn ...string) (*tls.Config, error) {
+	cfg := &tls.Config{
+		ServerName: host,
+		NextProtos: alpn,
+		MinVersion: tls.VersionTLS12,
+	}
+	if o == nil {
+		return cfg, nil
+	}
+
+	if o.ServerName != "" {
+		cfg.ServerName = o.ServerName
+	}
+	cfg.InsecureSkipVerify = o.InsecureSkipVerify
+
+	if o.CAFile != "" {
+		pem, err := os.ReadFile(o.CAFile)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read CA file: %w", err)
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("no certificates found in CA file %s", o.CAFile)
+		}
+		cfg.RootCAs = pool
+	}
+
+	if o.CertFile != "" {
+		cert, err := tls.LoadX509KeyPair(o.CertFile, o.KeyFile)
+		if err != nil {
+			return nil, fmt.Errorf("failed to load client certificate: %w", err)
+		}
+		cfg.Certificates = []tls.Certificate{cert}
+	}
+
+	if len(o.SPKIPins) > 0 {
+		pins, err := parseSPKIPins(o.SPKIPins)
+		if err != nil {
+			return nil, err
+		}
+		cfg.VerifyConnection = func(state tls.ConnectionState) error {
+			return verifySPKIPins(state.PeerCertificates, pins)
+		}
+	}
+
+	return cfg, nil
+}
+
+// ClientConfig builds the TLS client configuration for a connection to
+// host made outside a backend, such as the GELF log output
+func (o *TLSOptions) ClientConfig(host string) (*tls.Config, error) {
+	return o.clientConfig(host)
+}
+
+// parseSPKIPins decodes base64 SHA-256 SPKI digests, as produced by
+//
+//	openssl x509 -pubkey -noout | openssl pkey -pubin -outform der |
+//	openssl dgst -sha256 -binary | base64
+func parseSPKIPins(pins []string) (map[[sha256.Size]byte]bool, error) {
+	set := make(map[[sha256.Size]byte]bool, len(pins))
+	for _, pin := range pins {
+		digest, err := base64.StdEncoding.DecodeString(pin)
+		if err != nil || len(digest) != sha256.Size {
+			return nil, fmt.Errorf("invalid SPKI pin %q: must be a base64 SHA-256 digest", pin)
+		}
+		set[[sha256.Size]byte(digest)] = true
+	}
+	return set, nil
+}
+
+// verifySPKIPins accepts the connection if any certificate the server sent
+// carries a pinned public key, so either the leaf or an intermediate may
+// be pinned. A mismatch suggests the connection is being intercepted.
+func verifySPKIPins(certs []*x509.Certificate, pins map[[sha256.Size]byte]bool) error {
+	for _, cert := range certs {
+		if pins[sha256.Sum256(cert.RawSubjectPublicKeyInfo)] {
+			return nil
+		}
+	}
+	return errors.New("server public key does not match any SPKI pin")
+}
+
+// dialTLS opens a DNS-over-TLS connection to the backend
+func (b *Backend) dialTLS(cfg *tls.Config, timeout time.Duration) (net.Conn, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	raw, err := b.dial("tcp", timeout)
+	if err != nil {
+		return nil, err
+	}
+
+	conn := tls.Client(raw, cfg)
+	if err := conn.HandshakeContext(ctx); err != nil {
+		raw.Close()
+		return nil, fmt.Errorf("TLS handshake failed: %w", err)
+	}
+
+	return conn, nil
+}
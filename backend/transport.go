@@ -0,0 +1,106 @@
+package backend
+
+import (
+	"encoding/binary"
+	"errors"
+	"io"
+	"strings"
+	"time"
+)
+
+// Address schemes selecting a backend transport
+const (
+	SchemeUDP   = "udp"
+	SchemeTCP   = "tcp"
+	SchemeTLS   = "tls"
+	SchemeHTTPS = "https"
+	SchemeQUIC  = "quic"
+)
+
+// errClosed fails queries to a backend that was closed
+var errClosed = errors.New("backend closed")
+
+// transport exchanges DNS messages with a backend over a single protocol.
+// Plain udp:// backends have no transport; they use UDP with a TCP
+// fallback for truncated answers.
+type transport interface {
+	exchange(query []byte, timeout time.Duration) ([]byte, error)
+	// close shuts the transport's connections; queries sent afterwards
+	// fail with errClosed
+	close()
+}
+
+// splitScheme separates an optional "scheme://" prefix from an address
+func splitScheme(address string) (scheme, hostport string) {
+	if scheme, hostport, ok := strings.Cut(address, "://"); ok {
+		return strings.ToLower(scheme), hostport
+	}
+	return SchemeUDP, address
+}
+
+// exchange sends a query to the backend and returns the raw answer, adding
+// DNS cookies for plain DNS backends when enabled
+func (b *Backend) exchange(query []byte, timeout time.Duration, stream bool) ([]byte, error) {
+	if b.DNSCookies && b.cookies != nil {
+		return b.exchangeWithCookies(query, timeout, stream)
+	}
+	return b.roundTrip(query, timeout, stream)
+}
+
+// roundTrip sends a query to the backend and returns the raw answer. Plain
+// DNS queries go over the pooled UDP sockets unless the client is a stream
+// client, whose queries are pipelined over pooled TCP connections; truncated
+// UDP answers are fetched again over TCP so the full response is returned.
+func (b *Backend) roundTrip(query []byte, timeout time.Duration, stream bool) ([]byte, error) {
+	if b.transport != nil {
+		return b.transport.exchange(query, timeout)
+	}
+
+	if stream {
+		return b.tcp.exchange(query, timeout)
+	}
+
+	response, err := b.udp.exchange(query, timeout)
+	if err != nil || !isTruncated(response) {
+		return response, err
+	}
+
+	full, err := b.tcp.exchange(query, timeout)
+	if err != nil {
+		// Relay the truncated answer; the client can still retry over
+		// TCP itself
+		return response, nil
+	}
+
+	return full, nil
+}
+
+// isTruncated reports whether the TC flag is set in a DNS message
+func isTruncated(msg []byte) bool {
+	return len(msg) > 2 && msg[2]&0x02 != 0
+}
+
+// readStreamMessage reads a two-byte length-prefixed DNS message
+func readStreamMessage(r io.Reader) ([]byte, error) {
+	var length [2]byte
+	if _, err := io.ReadFull(r, length[:]); err != nil {
+		return nil, err
+	}
+
+	msg := make([]byte, binary.BigEndian.Uint16(length[:]))
+	if _, err := io.ReadFull(r, msg); err != nil {
+		return nil, err
+	}
+
+	return msg, nil
+}
+
+// writeStreamMessage writes a DNS message with its two-byte length prefix
+func writeStreamMessage(w io.Writer, msg []byte) error {
+	buf := make([]byte, 2+len(msg))
+	binary.BigEndian.PutUint16(buf, uint16(len(msg)))
+	copy(buf[2:], msg)
+
+	_, err := w.Write(buf)
+	return err
+}
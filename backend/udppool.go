@@ -0,0 +1,258 @@
+package backend
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"math/big"
+	"net"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+const (
+	// udpPoolSize is the number of long-lived UDP sockets kept per backend
+	udpPoolSize = 4
+
+	// portBindAttempts bounds the random ports tried before giving up when
+	// they are already in use
+	portBindAttempts = 16
+)
+
+// PortRandomization spreads upstream UDP queries over sockets bound to
+// random source ports, moving each socket to a new port after a number of
+// queries, so an off-path attacker has to guess the port as well as the
+// transaction ID and question to spoof an answer
+type PortRandomization struct {
+	Sockets    int // Sockets kept per backend
+	PortMin    int // Lowest source port, inclusive
+	PortMax    int // Highest source port, inclusive
+	MaxQueries int // Queries sent from a port before it is replaced
+}
+
+// udpPool spreads plain DNS queries over a few connected UDP sockets per
+// backend instead of dialing one per query. Each query gets a fresh random
+// transaction ID on its socket; responses are matched back to the waiting
+// caller by that ID and the question they echo, and the connected socket
+// only accepts datagrams from the backend's address and port.
+type udpPool struct {
+	backend *Backend
+	next    uint32
+	sockets []*udpSocket
+	closed  bool
+	mu      sync.Mutex
+}
+
+// udpSocket is one pooled socket and the queries outstanding on it
+type udpSocket struct {
+	conn    net.Conn
+	pending *pendingQueries
+	queries uint32
+}
+
+func newUDPPool(b *Backend) *udpPool {
+	return &udpPool{backend: b}
+}
+
+// exchange sends a query on one of the pooled sockets and waits for the
+// matching response
+func (p *udpPool) exchange(query []byte, timeout time.Duration) ([]byte, error) {
+	if len(query) < 12 {
+		return nil, errors.New("query too short")
+	}
+
+	sock, err := p.socket(timeout)
+	if err != nil {
+		return nil, fmt.Errorf("failed to connect to backend: %w", err)
+	}
+
+	msg := make([]byte, len(query))
+	copy(msg, query)
+	randomized := p.backend.CaseRandomization && randomizeCase(msg)
+
+	id, waiter, err := sock.pending.register(msg, randomized)
+	if err != nil {
+		return nil, err
+	}
+	defer sock.pending.unregister(id)
+
+	binary.BigEndian.PutUint16(msg, id)
+
+	if _, err := sock.conn.Write(msg); err != nil {
+		return nil, fmt.Errorf("failed to send query: %w", err)
+	}
+
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+
+	response, err := sock.pending.wait(waiter, query, timer.C)
+	if err == nil && randomized {
+		restoreCase(response, waiter.exact, rawQuestion(query))
+	}
+	return response, err
+}
+
+// randomizeCase flips the case of each letter of the question name at
+// random (draft-vixie-dnsext-dns0x20), so a spoofed answer also has to
+// guess the case the name was sent with. It reports whether the name
+// could be randomized.
+func randomizeCase(query []byte) bool {
+	question := rawQuestion(query)
+	if question == nil {
+		return false
+	}
+	name := question[:len(question)-4]
+
+	bits := make([]byte, len(name))
+	if _, err := rand.Read(bits); err != nil {
+		return false
+	}
+	for i, c := range name {
+		if c|0x20 < 'a' || c|0x20 > 'z' {
+			continue
+		}
+		if bits[i]&1 != 0 {
+			name[i] = c ^ 0x20
+		}
+	}
+	return true
+}
+
+// restoreCase gives the client back the name as it asked it: every copy of
+// the name in the case it was sent, in the question and in uncompressed
+// owner names echoing it, is rewritten to the original. Names compressed
+// against the question follow.
+func restoreCase(response, sent, original []byte) {
+	sent = sent[:len(sent)-4]
+	original = original[:len(original)-4]
+
+	for off := 12; off < len(response); {
+		i := bytes.Index(response[off:], sent)
+		if i < 0 {
+			return
+		}
+		copy(response[off+i:], original)
+		off += i + len(sent)
+	}
+}
+
+// socket returns the next pooled socket in turn, (re)dialing it if it has
+// not been opened yet, its read loop failed or it has used up its port
+func (p *udpPool) socket(timeout time.Duration) (*udpSocket, error) {
+	ports := p.backend.SourcePorts
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if p.closed {
+		return nil, errClosed
+	}
+	if p.sockets == nil {
+		size := udpPoolSize
+		if ports != nil && ports.Sockets > 0 {
+			size = ports.Sockets
+		}
+		p.sockets = make([]*udpSocket, size)
+	}
+
+	idx := atomic.AddUint32(&p.next, 1) % uint32(len(p.sockets))
+
+	if sock := p.sockets[idx]; sock != nil && sock.pending.failure() == nil {
+		if ports == nil || ports.MaxQueries <= 0 || int(atomic.AddUint32(&sock.queries, 1)) <= ports.MaxQueries {
+			return sock, nil
+		}
+		// Queries still in flight on the old port get until their
+		// timeout to complete
+		time.AfterFunc(timeout, func() { sock.conn.Close() })
+	}
+
+	conn, err := p.dial(timeout)
+	if err != nil {
+		return nil, err
+	}
+
+	sock := &udpSocket{
+		conn:    conn,
+		pending: newPendingQueries(&p.backend.mismatched),
+		queries: 1,
+	}
+	p.sockets[idx] = sock
+	go sock.readLoop()
+
+	return sock, nil
+}
+
+// close shuts the pooled sockets for good; their read loops fail the
+// queries still outstanding and exit
+func (p *udpPool) close() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	p.closed = true
+	for i, sock := range p.sockets {
+		if sock != nil {
+			sock.conn.Close()
+			p.sockets[i] = nil
+		}
+	}
+}
+
+// dial opens a socket to the backend, from a random port in the configured
+// range when port randomization is enabled
+func (p *udpPool) dial(timeout time.Duration) (net.Conn, error) {
+	ports := p.backend.SourcePorts
+	if ports == nil {
+		return p.backend.dial("udp", timeout)
+	}
+
+	span := big.NewInt(int64(ports.PortMax - ports.PortMin + 1))
+
+	var lastErr error
+	for i := 0; i < portBindAttempts; i++ {
+		n, err := rand.Int(rand.Reader, span)
+		if err != nil {
+			return nil, fmt.Errorf("failed to pick source port: %w", err)
+		}
+
+		conn, err := p.backend.dialFrom("udp", ports.PortMin+int(n.Int64()), timeout)
+		if err == nil {
+			return conn, nil
+		}
+		if !errors.Is(err, syscall.EADDRINUSE) {
+			return nil, err
+		}
+		lastErr = err
+	}
+
+	return nil, fmt.Errorf("no free source port after %d attempts: %w", portBindAttempts, lastErr)
+}
+
+// readLoop delivers responses to their waiting queries until the socket
+// fails, then wakes every query still outstanding on it
+func (s *udpSocket) readLoop() {
+	buffer := make([]byte, dns.MaxMsgSize)
+
+	for {
+		n, err := s.conn.Read(buffer)
+		if err != nil {
+			// ICMP port unreachable surfaces as a read error on connected
+			// sockets; the affected query simply times out
+			if errors.Is(err, syscall.ECONNREFUSED) {
+				continue
+			}
+			s.conn.Close()
+			s.pending.fail(err)
+			return
+		}
+
+		response := make([]byte, n)
+		copy(response, buffer[:n])
+		s.pending.deliver(response)
+	}
+}
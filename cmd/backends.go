@@ -0,0 +1,279 @@
+package cmd
+
+import (
+	"fmt"
+	"net/url"
+	"os"
+	"text/tabwriter"
+	"time"
+
+	"github.com/spf13/cobra"
+)
+
+// backendsCmd represents the backends command
+var backendsCmd = &cobra.Command{
+	Use:   "backends",
+	Short: "List and control the backends of a running instance",
+	Long: `List the backends of a running dnsbalancer with their state and
+statistics, take one out of rotation and put it back, mark one
+administratively down and up, or add and remove backends.
+
+Commands reach the instance over the control socket or the admin address
+in the config unless --socket or --admin is given.
+
+Example:
+  dnsbalancer backends list
+  dnsbalancer backends drain 192.168.1.2:53 --wait
+  dnsbalancer backends undrain 192.168.1.2:53
+  dnsbalancer backends disable 192.168.1.2:53
+  dnsbalancer backends enable 192.168.1.2:53
+  dnsbalancer backends add 192.168.1.5:53 --weight 2
+  dnsbalancer backends remove 192.168.1.5:53`,
+}
+
+var backendsListCmd = &cobra.Command{
+	Use:   "list",
+	Short: "List the backends with their state and statistics",
+	Args:  cobra.NoArgs,
+	RunE:  runBackendsList,
+}
+
+var backendsDrainCmd = &cobra.Command{
+	Use:   "drain <address>",
+	Short: "Stop sending new queries to a backend",
+	Long: `Stop sending new queries to a backend, letting those in flight complete,
+so the resolver behind it can be taken down once in_flight reaches 0.
+
+With --wait the command only returns once no queries are in flight to the
+backend, failing if that takes longer than --timeout or the drain is
+ended meanwhile, so a rolling upgrade can go on as soon as it returns:
+
+  dnsbalancer backends drain 192.168.1.2:53 --wait && systemctl restart unbound`,
+	Args: cobra.ExactArgs(1),
+	RunE: runBackendsDrain,
+}
+
+var backendsUndrainCmd = &cobra.Command{
+	Use:   "undrain <address>",
+	Short: "Put a drained backend back in rotation",
+	Args:  cobra.ExactArgs(1),
+	RunE:  runBackendsChange("/backends/undrain"),
+}
+
+var backendsDisableCmd = &cobra.Command{
+	Use:   "disable <address>",
+	Short: "Mark a backend administratively down",
+	Long: `Mark a backend administratively down: it is sent no queries, no longer
+health checked and doesn't count toward the quorum until it is enabled.`,
+	Args: cobra.ExactArgs(1),
+	RunE: runBackendsChange("/backends/disable"),
+}
+
+var backendsEnableCmd = &cobra.Command{
+	Use:   "enable <address>",
+	Short: "Put a disabled backend back in rotation",
+	Args:  cobra.ExactArgs(1),
+	RunE:  runBackendsChange("/backends/enable"),
+}
+
+var backendsAddCmd = &cobra.Command{
+	Use:   "add <address>",
+	Short: "Add a backend to the default backends",
+	Long: `Add a backend to the default backends of a running instance. It takes
+queries right away and is health checked from the next round on. The
+configuration file is not changed.`,
+	Args: cobra.ExactArgs(1),
+	RunE: runBackendsAdd,
+}
+
+var backendsRemoveCmd = &cobra.Command{
+	Use:   "remove <address>",
+	Short: "Remove a backend from the default backends",
+	Long: `Remove a backend from the default backends of a running instance. It
+gets no new queries while those it already has complete. The
+configuration file is not changed.`,
+	Args: cobra.ExactArgs(1),
+	RunE: runBackendsChange("/backends/remove"),
+}
+
+// Options of backends added with backends add
+var (
+	addWeight      int
+	addPriority    int
+	addMaxInflight int
+)
+
+// Options of backends drain
+var (
+	drainWait    bool
+	drainTimeout time.Duration
+)
+
+// drainPollInterval is how often backends drain --wait checks the queries
+// in flight
+const drainPollInterval = 200 * time.Millisecond
+
+func init() {
+	rootCmd.AddCommand(backendsCmd)
+	for _, cmd := range []*cobra.Command{backendsListCmd, backendsDrainCmd, backendsUndrainCmd, backendsDisableCmd, backendsEnableCmd, backendsAddCmd, backendsRemoveCmd} {
+		addRuntimeFlags(cmd)
+		backendsCmd.AddCommand(cmd)
+	}
+
+	backendsAddCmd.Flags().IntVar(&addWeight, "weight", 0, "relative share of queries under the weighted strategy (default 1)")
+	backendsAddCmd.Flags().IntVar(&addPriority, "priority", 0, "failover pool, lower is preferred (default 1)")
+	backendsAddCmd.Flags().IntVar(&addMaxInflight, "max-inflight", 0, "queries in flight before the backend is skipped, 0 = unlimited")
+	backendsDrainCmd.Flags().BoolVar(&drainWait, "wait", false, "wait for the queries in flight to complete")
+	backendsDrainCmd.Flags().DurationVar(&drainTimeout, "timeout", time.Minute, "longest to wait with --wait, 0 = no limit")
+}
+
+// backendStatus is a backend in the runtime API's backend lists
+type backendStatus struct {
+	Address     string        `json:"address"`
+	Healthy     bool          `json:"healthy"`
+	Ejected     bool          `json:"ejected"`
+	Draining    bool          `json:"draining"`
+	Disabled    bool          `json:"disabled"`
+	InFlight    int64         `json:"in_flight"`
+	Queries     uint64        `json:"total_queries"`
+	Failures    uint64        `json:"total_failures"`
+	LatencyEWMA time.Duration `json:"latency_ewma"`
+	Percentiles struct {
+		P50 float64 `json:"p50_ms"`
+		P99 float64 `json:"p99_ms"`
+	} `json:"latency_percentiles"`
+}
+
+// state names a backend's state as the runtime API's stream does
+func (b backendStatus) state() string {
+	switch {
+	case b.Disabled:
+		return "disabled"
+	case b.Draining:
+		return "draining"
+	case b.Ejected:
+		return "ejected"
+	case !b.Healthy:
+		return "unhealthy"
+	}
+	return "healthy"
+}
+
+func runBackendsList(cmd *cobra.Command, args []string) error {
+	client, err := newRuntimeClient()
+	if err != nil {
+		return err
+	}
+
+	var backends []backendStatus
+	if err := client.get("/backends", &backends); err != nil {
+		return err
+	}
+	printBackends(backends)
+	return nil
+}
+
+// runBackendsChange returns the command changing the state of the backend
+// given through a runtime API path
+func runBackendsChange(path string) func(*cobra.Command, []string) error {
+	return func(cmd *cobra.Command, args []string) error {
+		client, err := newRuntimeClient()
+		if err != nil {
+			return err
+		}
+
+		var backends []backendStatus
+		if err := client.post(path+"?address="+url.QueryEscape(args[0]), &backends); err != nil {
+			return err
+		}
+		printBackends(backends)
+		return nil
+	}
+}
+
+func runBackendsDrain(cmd *cobra.Command, args []string) error {
+	if err := runBackendsChange("/backends/drain")(cmd, args); err != nil {
+		return err
+	}
+	if !drainWait {
+		return nil
+	}
+
+	client, err := newRuntimeClient()
+	if err != nil {
+		return err
+	}
+	address := args[0]
+	started := time.Now()
+	ticker := time.NewTicker(drainPollInterval)
+	defer ticker.Stop()
+
+	// The first check comes an interval after the drain, so a query the
+	// backend was picked for just before is counted in flight by then
+	waiting := int64(-1)
+	for range ticker.C {
+		var backends []backendStatus
+		if err := client.get("/backends", &backends); err != nil {
+			return err
+		}
+		var inFlight int64
+		for _, b := range backends {
+			if b.Address != address {
+				continue
+			}
+			if !b.Draining {
+				return fmt.Errorf("backend %s is no longer draining, the drain was ended", address)
+			}
+			inFlight += b.InFlight
+		}
+		if inFlight == 0 {
+			fmt.Printf("Backend %s drained, no queries in flight\n", address)
+			return nil
+		}
+		if drainTimeout > 0 && time.Since(started) >= drainTimeout {
+			return fmt.Errorf("backend %s still has %d queries in flight after %s", address, inFlight, drainTimeout)
+		}
+		if inFlight != waiting {
+			fmt.Printf("Waiting for %d queries in flight to %s\n", inFlight, address)
+			waiting = inFlight
+		}
+	}
+	return nil
+}
+
+func runBackendsAdd(cmd *cobra.Command, args []string) error {
+	client, err := newRuntimeClient()
+	if err != nil {
+		return err
+	}
+
+	// The backend in the configuration's format
+	bcfg := map[string]interface{}{"address": args[0]}
+	if addWeight != 0 {
+		bcfg["weight"] = addWeight
+	}
+	if addPriority != 0 {
+		bcfg["priority"] = addPriority
+	}
+	if addMaxInflight != 0 {
+		bcfg["max_inflight"] = addMaxInflight
+	}
+	var backends []backendStatus
+	if err := client.postJSON("/backends/add", bcfg, &backends); err != nil {
+		return err
+	}
+	printBackends(backends)
+	return nil
+}
+
+// printBackends prints backends as a table
+func printBackends(backends []backendStatus) {
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "ADDRESS\tSTATE\tIN FLIGHT\tQUERIES\tFAILURES\tLATENCY\tP50\tP99")
+	for _, b := range backends {
+		fmt.Fprintf(w, "%s\t%s\t%d\t%d\t%d\t%s\t%gms\t%gms\n",
+			b.Address, b.state(), b.InFlight, b.Queries, b.Failures,
+			b.LatencyEWMA.Round(time.Microsecond), b.Percentiles.P50, b.Percentiles.P99)
+	}
+	w.Flush()
+}
@@ -0,0 +1,119 @@
+package cmd
+
+import (
+	"fmt"
+	"net/url"
+
+	"github.com/spf13/cobra"
+)
+
+var (
+	cachePurgeName   string
+	cachePurgeSuffix string
+	cachePurgeAll    bool
+)
+
+// cacheCmd represents the cache command
+var cacheCmd = &cobra.Command{
+	Use:   "cache",
+	Short: "Inspect and purge the response cache of a running instance",
+	Long: `Show the response cache statistics of a running dnsbalancer, or drop
+cached answers so the next queries for them go to the backends.
+
+Commands reach the instance over the control socket or the admin address
+in the config unless --socket or --admin is given.
+
+Example:
+  dnsbalancer cache stats
+  dnsbalancer cache purge --name www.example.com
+  dnsbalancer cache purge --suffix example.com
+  dnsbalancer cache purge --all`,
+}
+
+var cacheStatsCmd = &cobra.Command{
+	Use:   "stats",
+	Short: "Show the cache size and hit ratio",
+	Args:  cobra.NoArgs,
+	RunE:  runCacheStats,
+}
+
+var cachePurgeCmd = &cobra.Command{
+	Use:   "purge",
+	Short: "Drop cached answers for a name, a domain or everything",
+	Args:  cobra.NoArgs,
+	RunE:  runCachePurge,
+}
+
+func init() {
+	rootCmd.AddCommand(cacheCmd)
+	for _, cmd := range []*cobra.Command{cacheStatsCmd, cachePurgeCmd} {
+		addRuntimeFlags(cmd)
+		cacheCmd.AddCommand(cmd)
+	}
+
+	cachePurgeCmd.Flags().StringVar(&cachePurgeName, "name", "", "drop the answers for this name")
+	cachePurgeCmd.Flags().StringVar(&cachePurgeSuffix, "suffix", "", "drop the answers for this domain and its subdomains")
+	cachePurgeCmd.Flags().BoolVar(&cachePurgeAll, "all", false, "drop every cached answer")
+	cachePurgeCmd.MarkFlagsMutuallyExclusive("name", "suffix", "all")
+}
+
+func runCacheStats(cmd *cobra.Command, args []string) error {
+	client, err := newRuntimeClient()
+	if err != nil {
+		return err
+	}
+
+	var stats struct {
+		Entries    int     `json:"entries"`
+		Bytes      int     `json:"bytes"`
+		MaxEntries int     `json:"max_entries"`
+		MaxBytes   int     `json:"max_bytes"`
+		Hits       uint64  `json:"hits"`
+		Misses     uint64  `json:"misses"`
+		HitRatio   float64 `json:"hit_ratio"`
+		Evictions  uint64  `json:"evictions"`
+	}
+	if err := client.get("/cache", &stats); err != nil {
+		return err
+	}
+
+	fmt.Printf("Entries:     %d of %d\n", stats.Entries, stats.MaxEntries)
+	if stats.MaxBytes > 0 {
+		fmt.Printf("Memory:      %d of %d bytes\n", stats.Bytes, stats.MaxBytes)
+	} else {
+		fmt.Printf("Memory:      %d bytes\n", stats.Bytes)
+	}
+	fmt.Printf("Hits:        %d\n", stats.Hits)
+	fmt.Printf("Misses:      %d\n", stats.Misses)
+	fmt.Printf("Hit Ratio:   %.1f%%\n", stats.HitRatio*100)
+	fmt.Printf("Evictions:   %d\n", stats.Evictions)
+	return nil
+}
+
+func runCachePurge(cmd *cobra.Command, args []string) error {
+	var query string
+	switch {
+	case cachePurgeName != "":
+		query = "name=" + url.QueryEscape(cachePurgeName)
+	case cachePurgeSuffix != "":
+		query = "suffix=" + url.QueryEscape(cachePurgeSuffix)
+	case cachePurgeAll:
+		query = "all=true"
+	default:
+		return fmt.Errorf("give --name, --suffix or --all")
+	}
+
+	client, err := newRuntimeClient()
+	if err != nil {
+		return err
+	}
+
+	var result struct {
+		Purged int `json:"purged"`
+	}
+	if err := client.post("/cache/purge?"+query, &result); err != nil {
+		return err
+	}
+	fmt.Printf("Purged %d cached answers\n", result.Purged)
+	return nil
+}
@@ -7,12 +7,14 @@ import (
 	"github.com/spf13/cobra"
 	"github.com/aram535/dnsbalancer/backend"
 	"github.com/aram535/dnsbalancer/config"
+	"github.com/aram535/dnsbalancer/lb"
 )
 
 var (
 	testTimeout time.Duration
 	testQuery   string
 	testType    string
+	testCheck   string
 )
 
 // healthcheckCmd represents the healthcheck command
@@ -29,7 +31,8 @@ This is useful for:
 Example:
   dnsbalancer healthcheck
   dnsbalancer healthcheck --config /etc/dnsbalancer/config.yaml
-  dnsbalancer healthcheck --timeout 5s --query example.com --type A`,
+  dnsbalancer healthcheck --timeout 5s --query example.com --type A
+  dnsbalancer healthcheck --check-type dns_tcp`,
 	RunE: runHealthcheck,
 }
 
@@ -39,6 +42,7 @@ func init() {
 	healthcheckCmd.Flags().DurationVar(&testTimeout, "timeout", 3*time.Second, "timeout for health check query")
 	healthcheckCmd.Flags().StringVar(&testQuery, "query", ".", "DNS query name to test")
 	healthcheckCmd.Flags().StringVar(&testType, "type", "NS", "DNS query type (A, AAAA, NS, ANY)")
+	healthcheckCmd.Flags().StringVar(&testCheck, "check-type", "", "check type (dns, dns_tcp, tcp_connect, exec), defaults to the configured one")
 }
 
 func runHealthcheck(cmd *cobra.Command, args []string) error {
@@ -54,18 +58,53 @@ func runHealthcheck(cmd *cobra.Command, args []string) error {
 		fmt.Printf("Using default configuration\n")
 	}
 
-	fmt.Printf("Testing %d backends with query: %s (%s)\n", len(cfg.Backends), testQuery, testType)
+	if testCheck != "" {
+		switch testCheck {
+		case backend.CheckDNS, backend.CheckDNSTCP, backend.CheckTCPConnect:
+		case backend.CheckExec:
+			if len(cfg.HealthCheck.Command) == 0 {
+				return fmt.Errorf("exec checks need health_check.command in the config")
+			}
+		default:
+			return fmt.Errorf("check type must be one of 'dns', 'dns_tcp', 'tcp_connect' or 'exec'")
+		}
+		cfg.HealthCheck.CheckType = testCheck
+	}
+
+	// Route backends and the dark launch candidate are tested along with
+	// the default ones
+	backends := append([]config.BackendConfig{}, cfg.Backends...)
+	for _, route := range cfg.Routes {
+		backends = append(backends, route.Backends...)
+	}
+	for _, route := range cfg.ClientRoutes {
+		backends = append(backends, route.Backends...)
+	}
+	for _, route := range cfg.GeoRoutes {
+		backends = append(backends, route.Backends...)
+	}
+	if cfg.DarkLaunch != nil && cfg.DarkLaunch.Enabled {
+		backends = append(backends, cfg.DarkLaunch.Candidate)
+	}
+
+	fmt.Printf("Testing %d backends with query: %s (%s)\n", len(backends), testQuery, testType)
 	fmt.Printf("Timeout: %s\n\n", testTimeout)
 
 	allHealthy := true
 
-	for i, backendCfg := range cfg.Backends {
-		b := backend.NewBackend(backendCfg.Address)
-		
-		fmt.Printf("[%d/%d] Testing %s ... ", i+1, len(cfg.Backends), b.Address)
-		
+	for i, backendCfg := range backends {
+		fmt.Printf("[%d/%d] Testing %s ... ", i+1, len(backends), backendCfg.Address)
+
+		b, err := lb.NewBackend(cfg, backendCfg)
+		if err != nil {
+			fmt.Printf("❌ FAILED\n")
+			fmt.Printf("      Error: %v\n", err)
+			allHealthy = false
+			continue
+		}
+
 		start := time.Now()
-		err := b.HealthCheck(testQuery, testType, testTimeout)
+		err = b.HealthCheck(testQuery, testType, testTimeout)
 		elapsed := time.Since(start)
 
 		if err != nil {
@@ -0,0 +1,103 @@
+package cmd
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/spf13/cobra"
+)
+
+// reloadCmd represents the reload command
+var reloadCmd = &cobra.Command{
+	Use:   "reload",
+	Short: "Have a running instance reload its configuration",
+	Long: `Have a running dnsbalancer read its configuration file again and apply
+it, the same as sending it SIGHUP, and report what changed. A
+configuration that can't be applied is rejected, the running one is kept
+and the command fails with the reason.
+
+With --dry-run the instance only reports what the reload would change,
+or why it would reject the configuration, so an edited configuration
+file can be reviewed before it is applied.
+
+The instance is reached over the control socket or the admin address in
+the config unless --socket or --admin is given.`,
+	Args: cobra.NoArgs,
+	RunE: runReload,
+}
+
+var reloadDryRun bool
+
+func init() {
+	rootCmd.AddCommand(reloadCmd)
+	addRuntimeFlags(reloadCmd)
+	reloadCmd.Flags().BoolVar(&reloadDryRun, "dry-run", false, "only show what the reload would change")
+}
+
+// reloadSummary is the runtime API's account of a reload
+type reloadSummary struct {
+	Changes []reloadChange `json:"changes"`
+	Restart []string       `json:"restart"`
+}
+
+// reloadChange is one change of a reload
+type reloadChange struct {
+	Setting string `json:"setting"`
+	Backend string `json:"backend"`
+	Action  string `json:"action"`
+	From    string `json:"from"`
+	To      string `json:"to"`
+}
+
+// String shows the change as a line of a diff: "+" for what is added,
+// "-" for what is removed and "~" for what changes
+func (c reloadChange) String() string {
+	marker := "~"
+	switch c.Action {
+	case "added":
+		marker = "+"
+	case "removed":
+		marker = "-"
+	}
+	switch {
+	case c.Backend != "":
+		return fmt.Sprintf("%s backend %s", marker, c.Backend)
+	case c.From != "" || c.To != "":
+		return fmt.Sprintf("%s %s: %s -> %s", marker, c.Setting, c.From, c.To)
+	}
+	return fmt.Sprintf("%s %s", marker, c.Setting)
+}
+
+func runReload(cmd *cobra.Command, args []string) error {
+	client, err := newRuntimeClient()
+	if err != nil {
+		return err
+	}
+
+	path := "/reload"
+	if reloadDryRun {
+		path += "?dry_run=true"
+	}
+	var summary reloadSummary
+	if err := client.post(path, &summary); err != nil {
+		return err
+	}
+
+	switch {
+	case reloadDryRun && len(summary.Changes) == 0:
+		fmt.Println("Configuration valid, a reload would change nothing")
+	case reloadDryRun:
+		fmt.Println("Configuration valid, a reload would apply:")
+	case len(summary.Changes) == 0:
+		fmt.Println("Configuration reloaded, nothing changed")
+	default:
+		fmt.Println("Configuration reloaded, changes applied:")
+	}
+	for _, change := range summary.Changes {
+		fmt.Printf("  %s\n", change)
+	}
+	if len(summary.Restart) > 0 {
+		fmt.Printf("Changed but only applied on restart: %s\n", strings.Join(summary.Restart, ", "))
+	}
+	return nil
+}
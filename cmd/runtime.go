@@ -0,0 +1,138 @@
+package cmd
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/aram535/dnsbalancer/config"
+	"github.com/spf13/cobra"
+)
+
+// Runtime API flags, shared by the commands that talk to a running
+// instance
+var (
+	runtimeAdmin  string
+	runtimeSocket string
+)
+
+// addRuntimeFlags adds the flags choosing how a command reaches the
+// running instance
+func addRuntimeFlags(cmd *cobra.Command) {
+	cmd.Flags().StringVar(&runtimeAdmin, "admin", "", "runtime API address, instead of the one in the config")
+	cmd.Flags().StringVar(&runtimeSocket, "socket", "", "control socket path, instead of the one in the config")
+}
+
+// runtimeClient makes requests to a running instance's runtime API, over
+// the control socket or the admin address
+type runtimeClient struct {
+	client *http.Client
+	base   string
+}
+
+// newRuntimeClient connects to the instance given by --socket or --admin,
+// or else the control socket or the admin address in the config, in that
+// order
+func newRuntimeClient() (*runtimeClient, error) {
+	socket, address := runtimeSocket, runtimeAdmin
+	if socket == "" && address == "" {
+		cfg, err := config.LoadConfig(findConfigFile())
+		if err != nil {
+			return nil, fmt.Errorf("failed to load config: %w", err)
+		}
+		switch {
+		case cfg.ControlSocket != nil && cfg.ControlSocket.Enabled:
+			socket = cfg.ControlSocket.Path
+		case cfg.Admin != nil && cfg.Admin.Enabled:
+			address = adminDialAddress(cfg.Admin.Listen)
+		default:
+			return nil, fmt.Errorf("neither the control socket nor the runtime API is enabled in the config, give one with --socket or --admin")
+		}
+	}
+
+	if socket != "" {
+		// The host in the URL is only a placeholder; every request goes
+		// to the socket
+		transport := &http.Transport{
+			DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+				var d net.Dialer
+				return d.DialContext(ctx, "unix", socket)
+			},
+		}
+		return &runtimeClient{
+			client: &http.Client{Transport: transport, Timeout: 10 * time.Second},
+			base:   "http://dnsbalancer",
+		}, nil
+	}
+	return &runtimeClient{
+		client: &http.Client{Timeout: 10 * time.Second},
+		base:   "http://" + address,
+	}, nil
+}
+
+// get requests a runtime API path and decodes its JSON answer into result
+func (c *runtimeClient) get(path string, result interface{}) error {
+	return c.do(http.MethodGet, path, nil, result)
+}
+
+// post makes a change through a runtime API path and decodes its JSON
+// answer into result, unless result is nil
+func (c *runtimeClient) post(path string, result interface{}) error {
+	return c.do(http.MethodPost, path, nil, result)
+}
+
+// postJSON is post with a request body, encoded as JSON
+func (c *runtimeClient) postJSON(path string, body, result interface{}) error {
+	encoded, err := json.Marshal(body)
+	if err != nil {
+		return err
+	}
+	return c.do(http.MethodPost, path, encoded, result)
+}
+
+// do makes a runtime API request, turning an error answer into an error
+func (c *runtimeClient) do(method, path string, body []byte, result interface{}) error {
+	req, err := http.NewRequest(method, c.base+path, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	resp, err := c.client.Do(req)
+	if err != nil {
+		return fmt.Errorf("failed to reach the running instance: %w", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		body, _ := io.ReadAll(io.LimitReader(resp.Body, 512))
+		return fmt.Errorf("runtime API: %s", strings.TrimSpace(string(body)))
+	}
+	if result == nil {
+		return nil
+	}
+	if err := json.NewDecoder(resp.Body).Decode(result); err != nil {
+		return fmt.Errorf("failed to read the runtime API response: %w", err)
+	}
+	return nil
+}
+
+// adminDialAddress turns the runtime API's listen address into one to
+// connect to, using loopback when it listens on every address
+func adminDialAddress(listen string) string {
+	host, port, err := net.SplitHostPort(listen)
+	if err != nil {
+		return listen
+	}
+	if ip := net.ParseIP(host); host == "" || ip != nil && ip.IsUnspecified() {
+		host = "127.0.0.1"
+	}
+	return net.JoinHostPort(host, port)
+}
@@ -42,24 +42,17 @@ func init() {
 func runServe(cmd *cobra.Command, args []string) error {
 	// Find and load config
 	configFile := findConfigFile()
-	cfg, err := config.LoadConfig(configFile)
+	cfg, err := loadServeConfig(configFile)
 	if err != nil {
 		return fmt.Errorf("failed to load config: %w", err)
 	}
 
-	// Override config with command-line flags
-	if listenAddr != "" {
-		cfg.Listen = listenAddr
-	}
-	if logLevel != "" {
-		cfg.LogLevel = logLevel
-	}
-
 	// Setup logger
 	logger, err := logging.SetupLogger(cfg, debug)
 	if err != nil {
 		return fmt.Errorf("failed to setup logger: %w", err)
 	}
+	defer logging.Close(logger)
 
 	logger.WithFields(map[string]interface{}{
 		"version":       "1.0.0",
@@ -75,6 +68,9 @@ func runServe(cmd *cobra.Command, args []string) error {
 	if err != nil {
 		return fmt.Errorf("failed to create load balancer: %w", err)
 	}
+	loadBalancer.SetConfigLoader(func() (*config.Config, error) {
+		return loadServeConfig(configFile)
+	})
 
 	// Start the server
 	if err := loadBalancer.Start(cfg.Listen); err != nil {
@@ -84,9 +80,23 @@ func runServe(cmd *cobra.Command, args []string) error {
 	// Setup signal handling for graceful shutdown
 	sigChan := make(chan os.Signal, 1)
 	signal.Notify(sigChan, syscall.SIGINT, syscall.SIGTERM)
-
-	// Wait for shutdown signal
-	sig := <-sigChan
+	dumpChan := make(chan os.Signal, 1)
+	notifyDump(dumpChan)
+	reloadChan := make(chan os.Signal, 1)
+	notifyReload(reloadChan)
+
+	// Wait for shutdown signal, dumping statistics and reloading the
+	// configuration when asked meanwhile
+	var sig os.Signal
+	for sig == nil {
+		select {
+		case <-dumpChan:
+			loadBalancer.DumpStats()
+		case <-reloadChan:
+			loadBalancer.ReloadConfig()
+		case sig = <-sigChan:
+		}
+	}
 	logger.WithField("signal", sig.String()).Info("Received shutdown signal")
 
 	// Graceful shutdown
@@ -98,3 +108,24 @@ func runServe(cmd *cobra.Command, args []string) error {
 	logger.Info("Shutdown complete")
 	return nil
 }
+
+// loadServeConfig loads the configuration file with the command-line
+// overrides applied
+func loadServeConfig(configFile string) (*config.Config, error) {
+	cfg, err := config.LoadConfig(configFile)
+	if err != nil {
+		return nil, err
+	}
+
+	// Override config with command-line flags
+	if listenAddr != "" {
+		cfg.Listen = listenAddr
+	}
+	if logLevel != "" {
+		cfg.LogLevel = logLevel
+	}
+	if debug {
+		cfg.LogLevel = "debug"
+	}
+	return cfg, nil
+}
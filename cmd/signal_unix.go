@@ -0,0 +1,20 @@
+//go:build !windows
+
+package cmd
+
+import (
+	"os"
+	"os/signal"
+	"syscall"
+)
+
+// notifyDump relays SIGUSR1, which asks for a statistics dump
+func notifyDump(c chan<- os.Signal) {
+	signal.Notify(c, syscall.SIGUSR1)
+}
+
+// notifyReload relays SIGHUP, which asks for the configuration to be
+// reloaded
+func notifyReload(c chan<- os.Signal) {
+	signal.Notify(c, syscall.SIGHUP)
+}
@@ -0,0 +1,11 @@
+//go:build windows
+
+package cmd
+
+import "os"
+
+// notifyDump does nothing: Windows has no SIGUSR1
+func notifyDump(c chan<- os.Signal) {}
+
+// notifyReload does nothing: Windows has no SIGHUP
+func notifyReload(c chan<- os.Signal) {}
@@ -0,0 +1,94 @@
+package cmd
+
+import (
+	"fmt"
+
+	"github.com/spf13/cobra"
+)
+
+// statusCmd represents the status command
+var statusCmd = &cobra.Command{
+	Use:   "status",
+	Short: "Show the state of a running instance",
+	Long: `Show the uptime, query rate, latency, cache hit ratio and the state of
+every backend of a running dnsbalancer.
+
+The instance is reached over the control socket or the admin address in
+the config unless --socket or --admin is given.`,
+	Args: cobra.NoArgs,
+	RunE: runStatus,
+}
+
+func init() {
+	rootCmd.AddCommand(statusCmd)
+	addRuntimeFlags(statusCmd)
+}
+
+// instanceStatus is the runtime API's status
+type instanceStatus struct {
+	Started string   `json:"started"`
+	Uptime  string   `json:"uptime"`
+	Ready   bool     `json:"ready"`
+	Queries uint64   `json:"queries"`
+	QPS     *float64 `json:"qps"`
+	Healthy int      `json:"healthy_backends"`
+	Quorum  *bool    `json:"quorum"`
+	Latency struct {
+		P50   float64 `json:"p50_ms"`
+		P95   float64 `json:"p95_ms"`
+		P99   float64 `json:"p99_ms"`
+		Count uint64  `json:"count"`
+	} `json:"latency"`
+	Cache *struct {
+		Entries  int     `json:"entries"`
+		Hits     uint64  `json:"hits"`
+		Misses   uint64  `json:"misses"`
+		HitRatio float64 `json:"hit_ratio"`
+	} `json:"cache"`
+	Backends []backendStatus `json:"backends"`
+}
+
+func runStatus(cmd *cobra.Command, args []string) error {
+	client, err := newRuntimeClient()
+	if err != nil {
+		return err
+	}
+
+	var status instanceStatus
+	if err := client.get("/status", &status); err != nil {
+		return err
+	}
+
+	fmt.Printf("Uptime:      %s (since %s)\n", status.Uptime, status.Started)
+	if status.Ready {
+		fmt.Printf("Ready:       yes\n")
+	} else {
+		fmt.Printf("Ready:       no, waiting on the startup gate\n")
+	}
+	if status.QPS != nil {
+		fmt.Printf("Queries:     %d (%.1f/s)\n", status.Queries, *status.QPS)
+	} else {
+		fmt.Printf("Queries:     %d\n", status.Queries)
+	}
+	if status.Latency.Count > 0 {
+		fmt.Printf("Latency:     p50 %gms, p95 %gms, p99 %gms\n",
+			status.Latency.P50, status.Latency.P95, status.Latency.P99)
+	} else {
+		fmt.Printf("Latency:     no recent queries\n")
+	}
+	if status.Cache != nil {
+		fmt.Printf("Cache:       %.1f%% hit ratio, %d hits, %d misses, %d entries\n",
+			status.Cache.HitRatio*100, status.Cache.Hits, status.Cache.Misses, status.Cache.Entries)
+	} else {
+		fmt.Printf("Cache:       not enabled\n")
+	}
+	backends := fmt.Sprintf("%d of %d healthy", status.Healthy, len(status.Backends))
+	if status.Quorum != nil && !*status.Quorum {
+		backends += ", below quorum"
+	}
+	fmt.Printf("Backends:    %s\n", backends)
+
+	fmt.Println()
+	printBackends(status.Backends)
+	return nil
+}
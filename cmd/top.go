@@ -0,0 +1,90 @@
+package cmd
+
+import (
+	"fmt"
+
+	"github.com/spf13/cobra"
+)
+
+var topCount int
+
+// topCmd represents the top command
+var topCmd = &cobra.Command{
+	Use:   "top",
+	Short: "Show the busiest clients and most queried names",
+	Long: `Show the clients sending the most queries and the names queried most,
+as counted by a running dnsbalancer with top_talkers enabled.
+
+The counts are read from the runtime API, over the control socket or the
+admin address in the config unless --socket or --admin is given. They
+halve every top_talkers window, so they reflect recent traffic rather
+than totals since startup.
+
+Example:
+  dnsbalancer top
+  dnsbalancer top --config /etc/dnsbalancer/config.yaml -n 20
+  dnsbalancer top --admin 127.0.0.1:8080`,
+	RunE: runTop,
+}
+
+func init() {
+	rootCmd.AddCommand(topCmd)
+
+	addRuntimeFlags(topCmd)
+	topCmd.Flags().IntVarP(&topCount, "count", "n", 10, "number of clients and names to show")
+}
+
+// topEntry is a client or name in the runtime API's top talker lists
+type topEntry struct {
+	Client string `json:"client"`
+	Name   string `json:"name"`
+	Count  uint64 `json:"count"`
+	Error  uint64 `json:"error"`
+}
+
+func runTop(cmd *cobra.Command, args []string) error {
+	if topCount <= 0 {
+		return fmt.Errorf("count must be a positive number")
+	}
+
+	client, err := newRuntimeClient()
+	if err != nil {
+		return err
+	}
+
+	var top struct {
+		Window  string     `json:"window"`
+		Clients []topEntry `json:"clients"`
+		Names   []topEntry `json:"names"`
+	}
+	if err := client.get(fmt.Sprintf("/top?n=%d", topCount), &top); err != nil {
+		return err
+	}
+
+	fmt.Printf("Counts halve every %s\n", top.Window)
+	fmt.Printf("\nTop clients:\n")
+	printTop(top.Clients, func(e topEntry) string { return e.Client })
+	fmt.Printf("\nTop names:\n")
+	printTop(top.Names, func(e topEntry) string { return e.Name })
+	return nil
+}
+
+// printTop prints a top talker list, marking counts that may be too high
+func printTop(entries []topEntry, key func(topEntry) string) {
+	if len(entries) == 0 {
+		fmt.Printf("  (none yet)\n")
+		return
+	}
+
+	width := 0
+	for _, e := range entries {
+		width = max(width, len(key(e)))
+	}
+	for i, e := range entries {
+		fmt.Printf("  %3d. %-*s %10d", i+1, width, key(e), e.Count)
+		if e.Error > 0 {
+			fmt.Printf("  (may be up to %d over)", e.Error)
+		}
+		fmt.Println()
+	}
+}
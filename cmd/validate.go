@@ -2,6 +2,9 @@ package cmd
 
 import (
 	"fmt"
+	"net/url"
+	"path/filepath"
+	"strings"
 
 	"github.com/spf13/cobra"
 	"github.com/aram535/dnsbalancer/config"
@@ -48,14 +51,179 @@ func runValidate(cmd *cobra.Command, args []string) error {
 	fmt.Printf("✅ Configuration is VALID\n\n")
 	fmt.Printf("Summary:\n")
 	fmt.Printf("  Listen Address:    %s\n", cfg.Listen)
+	fmt.Printf("  UDP Sockets:       %d\n", cfg.UDPSockets)
 	fmt.Printf("  Timeout:           %s\n", cfg.Timeout)
+	fmt.Printf("  EDNS UDP Size:     %d\n", cfg.EDNSUDPSize)
 	fmt.Printf("  Log Level:         %s\n", cfg.LogLevel)
 	fmt.Printf("  Log Directory:     %s\n", cfg.LogDir)
 	fmt.Printf("  Fail Behavior:     %s\n", cfg.FailBehavior)
+	fmt.Printf("  Strategy:          %s\n", cfg.Strategy)
+	fmt.Printf("  Prefer Family:     %s\n", cfg.PreferFamily)
+	if cfg.SourceAddress != "" {
+		fmt.Printf("  Source Address:    %s\n", cfg.SourceAddress)
+	}
+	if cfg.DNSCookies {
+		fmt.Printf("  DNS Cookies:       enabled\n")
+	}
+	if cfg.CaseRandomization {
+		fmt.Printf("  Case Randomization: enabled\n")
+	}
 	fmt.Printf("  Backends:          %d\n", len(cfg.Backends))
 	
 	for i, backend := range cfg.Backends {
 		fmt.Printf("    %d. %s\n", i+1, backend.Address)
+		if backend.Weight > 1 {
+			fmt.Printf("       Weight:       %d\n", backend.Weight)
+		}
+		if backend.Priority > 1 {
+			fmt.Printf("       Priority:     %d\n", backend.Priority)
+		}
+		if backend.MaxInflight > 0 {
+			fmt.Printf("       Max Inflight: %d\n", backend.MaxInflight)
+		}
+		if backend.Drain {
+			fmt.Printf("       Draining:     yes\n")
+		}
+		if backend.TLS != nil {
+			if backend.TLS.ServerName != "" {
+				fmt.Printf("       TLS Name:     %s\n", backend.TLS.ServerName)
+			}
+			if backend.TLS.CAFile != "" {
+				fmt.Printf("       TLS CA:       %s\n", backend.TLS.CAFile)
+			}
+			if backend.TLS.InsecureSkipVerify {
+				fmt.Printf("       TLS Verify:   disabled\n")
+			}
+			if backend.TLS.CertFile != "" {
+				fmt.Printf("       TLS Client:   %s\n", backend.TLS.CertFile)
+			}
+			if len(backend.TLS.SPKIPins) > 0 {
+				fmt.Printf("       SPKI Pins:    %d\n", len(backend.TLS.SPKIPins))
+			}
+		}
+		if backend.SourceAddress != "" {
+			fmt.Printf("       Source:       %s\n", backend.SourceAddress)
+		}
+		if backend.ECS != nil && backend.ECS.Mode != "" {
+			fmt.Printf("       ECS:          %s\n", backend.ECS.Mode)
+		}
+		if backend.CaseRandomization != nil {
+			fmt.Printf("       0x20:         %t\n", *backend.CaseRandomization)
+		}
+	}
+
+	if len(cfg.LocalRecords) > 0 {
+		fmt.Printf("\n  Local Records:\n")
+		for _, record := range cfg.LocalRecords {
+			fmt.Printf("    %s -> %s\n", record.Name, strings.Join(record.Addresses, ", "))
+		}
+	}
+
+	if len(cfg.SearchDomains) > 0 {
+		fmt.Printf("\n  Search Domains:\n")
+		fmt.Printf("    Domains:         %s\n", strings.Join(cfg.SearchDomains, ", "))
+	}
+
+	if len(cfg.Zones) > 0 {
+		fmt.Printf("\n  Zones:\n")
+		for _, zone := range cfg.Zones {
+			fmt.Printf("    %s (%s)\n", zone.Name, zone.File)
+		}
+	}
+
+	if len(cfg.NXDomainRedirects) > 0 {
+		fmt.Printf("\n  NXDOMAIN Redirects:\n")
+		for _, redirect := range cfg.NXDomainRedirects {
+			target := redirect.Name
+			if target == "" {
+				target = strings.Join(redirect.Addresses, ", ")
+			}
+			fmt.Printf("    %s -> %s\n", redirect.Domain, target)
+		}
+	}
+
+	if len(cfg.TTLRules) > 0 {
+		fmt.Printf("\n  TTL Rules:\n")
+		for _, rule := range cfg.TTLRules {
+			bounds := []string{}
+			if rule.MinTTL != 0 {
+				bounds = append(bounds, fmt.Sprintf("min %s", rule.MinTTL))
+			}
+			if rule.MaxTTL != 0 {
+				bounds = append(bounds, fmt.Sprintf("max %s", rule.MaxTTL))
+			}
+			fmt.Printf("    %s: %s\n", rule.Domain, strings.Join(bounds, ", "))
+		}
+	}
+
+	if len(cfg.Routes) > 0 {
+		fmt.Printf("\n  Routes:\n")
+		for _, route := range cfg.Routes {
+			fmt.Printf("    %s\n", route.Domain)
+			for i, backend := range route.Backends {
+				fmt.Printf("      %d. %s\n", i+1, backend.Address)
+				if backend.Priority > 1 {
+					fmt.Printf("         Priority:   %d\n", backend.Priority)
+				}
+			}
+		}
+	}
+
+	if len(cfg.ClientRoutes) > 0 {
+		fmt.Printf("\n  Client Routes:\n")
+		for _, route := range cfg.ClientRoutes {
+			fmt.Printf("    %s\n", strings.Join(route.Clients, ", "))
+			for i, backend := range route.Backends {
+				fmt.Printf("      %d. %s\n", i+1, backend.Address)
+				if backend.Priority > 1 {
+					fmt.Printf("         Priority:   %d\n", backend.Priority)
+				}
+			}
+		}
+	}
+
+	if cfg.GeoIP != nil && cfg.GeoIP.Enabled {
+		fmt.Printf("\n  GeoIP:\n")
+		if cfg.GeoIP.Database != "" {
+			fmt.Printf("    Database:        %s\n", cfg.GeoIP.Database)
+		}
+		if cfg.GeoIP.ASNDatabase != "" {
+			fmt.Printf("    ASN Database:    %s\n", cfg.GeoIP.ASNDatabase)
+		}
+		for _, route := range cfg.GeoRoutes {
+			var regions []string
+			regions = append(regions, route.Countries...)
+			regions = append(regions, route.Continents...)
+			for _, asn := range route.ASNs {
+				regions = append(regions, fmt.Sprintf("AS%d", asn))
+			}
+			fmt.Printf("    %s\n", strings.Join(regions, ", "))
+			for i, backend := range route.Backends {
+				fmt.Printf("      %d. %s\n", i+1, backend.Address)
+				if backend.Priority > 1 {
+					fmt.Printf("         Priority:   %d\n", backend.Priority)
+				}
+			}
+		}
+	}
+
+	if cfg.OutlierDetection != nil && cfg.OutlierDetection.Enabled {
+		fmt.Printf("\n  Outlier Detection:\n")
+		fmt.Printf("    Enabled:         yes\n")
+		if cfg.OutlierDetection.Interval != 0 {
+			fmt.Printf("    Interval:        %s\n", cfg.OutlierDetection.Interval)
+		}
+		if cfg.OutlierDetection.EjectionTime != 0 {
+			fmt.Printf("    Ejection Time:   %s\n", cfg.OutlierDetection.EjectionTime)
+		}
+	}
+
+	if cfg.SlowStart != nil && cfg.SlowStart.Enabled {
+		fmt.Printf("\n  Slow Start:\n")
+		fmt.Printf("    Enabled:         yes\n")
+		if cfg.SlowStart.Window != 0 {
+			fmt.Printf("    Window:          %s\n", cfg.SlowStart.Window)
+		}
 	}
 
 	fmt.Printf("\n  Health Check:\n")
@@ -65,16 +233,469 @@ func runValidate(cmd *cobra.Command, args []string) error {
 		fmt.Printf("    Timeout:         %s\n", cfg.HealthCheck.Timeout)
 		fmt.Printf("    Fail Threshold:  %d\n", cfg.HealthCheck.FailureThreshold)
 		fmt.Printf("    Success Threshold: %d\n", cfg.HealthCheck.SuccessThreshold)
-		fmt.Printf("    Query:           %s (%s)\n", cfg.HealthCheck.QueryName, cfg.HealthCheck.QueryType)
+		if len(cfg.HealthCheck.Queries) > 0 {
+			for _, q := range cfg.HealthCheck.Queries {
+				fmt.Printf("    Query:           %s (%s)\n", q.Name, q.Type)
+			}
+		} else {
+			fmt.Printf("    Query:           %s (%s)\n", cfg.HealthCheck.QueryName, cfg.HealthCheck.QueryType)
+		}
+		if cfg.HealthCheck.CheckType != "" {
+			fmt.Printf("    Check Type:      %s\n", cfg.HealthCheck.CheckType)
+		}
+		if len(cfg.HealthCheck.Command) > 0 {
+			fmt.Printf("    Command:         %s\n", strings.Join(cfg.HealthCheck.Command, " "))
+		}
+		if len(cfg.HealthCheck.AcceptRcodes) > 0 {
+			fmt.Printf("    Accept Rcodes:   %s\n", strings.Join(cfg.HealthCheck.AcceptRcodes, ", "))
+		}
+		if cfg.HealthCheck.Concurrency != 0 {
+			fmt.Printf("    Concurrency:     %d\n", cfg.HealthCheck.Concurrency)
+		}
+		if cfg.HealthCheck.Jitter != 0 {
+			fmt.Printf("    Jitter:          %s\n", cfg.HealthCheck.Jitter)
+		}
+		if cfg.HealthCheck.MaxBackoff != 0 {
+			fmt.Printf("    Max Backoff:     %s\n", cfg.HealthCheck.MaxBackoff)
+		}
+		if cfg.HealthCheck.ErrorStreak != 0 {
+			fmt.Printf("    Error Streak:    %d\n", cfg.HealthCheck.ErrorStreak)
+		}
 	} else {
 		fmt.Printf("    Enabled:         no\n")
 	}
 
+	if cfg.Quorum != nil && cfg.Quorum.Enabled {
+		fmt.Printf("\n  Quorum:\n")
+		fmt.Printf("    Min Healthy:     %d\n", cfg.Quorum.MinHealthy)
+		if cfg.Quorum.FailBehavior != "" {
+			fmt.Printf("    Fail Behavior:   %s\n", cfg.Quorum.FailBehavior)
+		}
+	}
+
+	if cfg.Webhooks != nil && cfg.Webhooks.Enabled {
+		fmt.Printf("\n  Webhooks:\n")
+		for _, target := range cfg.Webhooks.Targets {
+			format := target.Format
+			if format == "" {
+				format = "generic"
+			}
+			host := "events.pagerduty.com"
+			if u, err := url.Parse(target.URL); err == nil && target.URL != "" {
+				host = u.Host
+			}
+			fmt.Printf("    Target:          %s (%s)\n", host, format)
+		}
+		if cfg.Webhooks.Timeout != 0 {
+			fmt.Printf("    Timeout:         %s\n", cfg.Webhooks.Timeout)
+		}
+		if cfg.Webhooks.Retries != 0 {
+			fmt.Printf("    Retries:         %d\n", cfg.Webhooks.Retries)
+		}
+	}
+
+	if cfg.Cache != nil && cfg.Cache.Enabled {
+		fmt.Printf("\n  Cache:\n")
+		if cfg.Cache.Size != 0 {
+			fmt.Printf("    Size:            %d\n", cfg.Cache.Size)
+		}
+		if cfg.Cache.MaxMemoryMB != 0 {
+			fmt.Printf("    Max Memory:      %d MB\n", cfg.Cache.MaxMemoryMB)
+		}
+		if cfg.Cache.Eviction != "" {
+			fmt.Printf("    Eviction:        %s\n", cfg.Cache.Eviction)
+		}
+		if cfg.Cache.Shards != 0 {
+			fmt.Printf("    Shards:          %d\n", cfg.Cache.Shards)
+		}
+		if len(cfg.Cache.Bypass) > 0 {
+			fmt.Printf("    Bypass:          %s\n", strings.Join(cfg.Cache.Bypass, ", "))
+		}
+		if cfg.Cache.MinTTL != 0 {
+			fmt.Printf("    Min TTL:         %s\n", cfg.Cache.MinTTL)
+		}
+		if cfg.Cache.MaxTTL != 0 {
+			fmt.Printf("    Max TTL:         %s\n", cfg.Cache.MaxTTL)
+		}
+		if cfg.Cache.WarmUp != "" {
+			fmt.Printf("    Warm-up:         %s\n", cfg.Cache.WarmUp)
+		}
+		if cfg.Cache.WarmUpTop != 0 {
+			fmt.Printf("    Warm-up Top:     %d\n", cfg.Cache.WarmUpTop)
+		}
+		if shared := cfg.Cache.Shared; shared != nil {
+			sharedType := shared.Type
+			if sharedType == "" {
+				sharedType = "redis"
+			}
+			fmt.Printf("    Shared:          %s at %s\n", sharedType, shared.Address)
+		}
+	}
+
+	if cfg.StartupGate != nil && cfg.StartupGate.Enabled {
+		fmt.Printf("\n  Startup Gate:\n")
+		if cfg.StartupGate.Timeout != 0 {
+			fmt.Printf("    Timeout:         %s\n", cfg.StartupGate.Timeout)
+		} else {
+			fmt.Printf("    Timeout:         none\n")
+		}
+	}
+
 	if cfg.GELF != nil && cfg.GELF.Enabled {
 		fmt.Printf("\n  GELF Logging:\n")
 		fmt.Printf("    Enabled:         yes\n")
 		fmt.Printf("    Address:         %s\n", cfg.GELF.Address)
 		fmt.Printf("    Protocol:        %s\n", cfg.GELF.Protocol)
+		if cfg.GELF.TLS != nil {
+			fmt.Printf("    TLS:             yes\n")
+		}
+		if cfg.GELF.Host != "" {
+			fmt.Printf("    Host:            %s\n", cfg.GELF.Host)
+		}
+		if len(cfg.GELF.Fields) > 0 {
+			fmt.Printf("    Extra Fields:    %d\n", len(cfg.GELF.Fields))
+		}
+	}
+
+	if cfg.Syslog != nil && cfg.Syslog.Enabled {
+		fmt.Printf("\n  Syslog:\n")
+		fmt.Printf("    Protocol:        %s\n", cfg.Syslog.Protocol)
+		fmt.Printf("    Address:         %s\n", cfg.Syslog.Address)
+		if cfg.Syslog.TLS != nil {
+			fmt.Printf("    TLS:             yes\n")
+		}
+		fmt.Printf("    Facility:        %s\n", cfg.Syslog.Facility)
+		if cfg.Syslog.Tag != "" {
+			fmt.Printf("    Tag:             %s\n", cfg.Syslog.Tag)
+		}
+	}
+
+	if cfg.StatsD != nil && cfg.StatsD.Enabled {
+		fmt.Printf("\n  StatsD:\n")
+		fmt.Printf("    Address:         %s\n", cfg.StatsD.Address)
+		format := cfg.StatsD.Format
+		if format == "" {
+			format = "statsd"
+		}
+		fmt.Printf("    Format:          %s\n", format)
+		if cfg.StatsD.Prefix != "" {
+			fmt.Printf("    Prefix:          %s\n", cfg.StatsD.Prefix)
+		}
+		if len(cfg.StatsD.Tags) > 0 {
+			fmt.Printf("    Tags:            %s\n", strings.Join(cfg.StatsD.Tags, ", "))
+		}
+		if cfg.StatsD.Interval != 0 {
+			fmt.Printf("    Interval:        %s\n", cfg.StatsD.Interval)
+		}
+	}
+
+	if cfg.QueryLog != nil && cfg.QueryLog.Enabled {
+		fmt.Printf("\n  Query Log:\n")
+		file := cfg.QueryLog.File
+		if file == "" {
+			file = filepath.Join(cfg.LogDir, "queries.log")
+		}
+		fmt.Printf("    File:            %s\n", file)
+		if cfg.QueryLog.SampleRate != 0 {
+			fmt.Printf("    Sample Rate:     %g\n", cfg.QueryLog.SampleRate)
+		}
+		if cfg.QueryLog.Level != "" {
+			fmt.Printf("    Level:           %s\n", cfg.QueryLog.Level)
+		}
+		if cfg.QueryLog.Permissions != "" {
+			fmt.Printf("    Permissions:     %s\n", cfg.QueryLog.Permissions)
+		}
+		if cfg.QueryLog.MaxSizeMB != 0 {
+			fmt.Printf("    Max Size:        %d MB\n", cfg.QueryLog.MaxSizeMB)
+		}
+		if cfg.QueryLog.RotateEvery != 0 {
+			fmt.Printf("    Rotate Every:    %s\n", cfg.QueryLog.RotateEvery)
+		}
+		if cfg.QueryLog.MaxBackups != 0 {
+			fmt.Printf("    Max Backups:     %d\n", cfg.QueryLog.MaxBackups)
+		}
+	}
+
+	if cfg.TopTalkers != nil && cfg.TopTalkers.Enabled {
+		fmt.Printf("\n  Top Talkers:\n")
+		if cfg.TopTalkers.Capacity > 0 {
+			fmt.Printf("    Capacity:        %d\n", cfg.TopTalkers.Capacity)
+		}
+		if cfg.TopTalkers.Window > 0 {
+			fmt.Printf("    Window:          %s\n", cfg.TopTalkers.Window)
+		}
+	}
+
+	if cfg.DoH != nil && cfg.DoH.Enabled {
+		fmt.Printf("\n  DNS-over-HTTPS:\n")
+		fmt.Printf("    Listen:          %s\n", cfg.DoH.Listen)
+		if cfg.DoH.Path != "" {
+			fmt.Printf("    Path:            %s\n", cfg.DoH.Path)
+		}
+		if cfg.DoH.CertFile != "" {
+			fmt.Printf("    TLS:             yes\n")
+		} else {
+			fmt.Printf("    TLS:             no (plain HTTP)\n")
+		}
+		if cfg.DoH.ClientCAFile != "" {
+			fmt.Printf("    Client CA:       %s\n", cfg.DoH.ClientCAFile)
+		}
+		if len(cfg.DoH.Tokens) > 0 {
+			fmt.Printf("    Tokens:          %d\n", len(cfg.DoH.Tokens))
+		}
+	}
+
+	if cfg.DNSCrypt != nil && cfg.DNSCrypt.Enabled {
+		fmt.Printf("\n  DNSCrypt:\n")
+		fmt.Printf("    Listen:          %s\n", cfg.DNSCrypt.Listen)
+		fmt.Printf("    Provider:        %s\n", cfg.DNSCrypt.ProviderName)
+		fmt.Printf("    Key File:        %s\n", cfg.DNSCrypt.ProviderKeyFile)
+	}
+
+	if cfg.ProxyProto != nil && cfg.ProxyProto.Enabled {
+		fmt.Printf("\n  PROXY Protocol:\n")
+		fmt.Printf("    Trusted Proxies: %s\n", strings.Join(cfg.ProxyProto.TrustedProxies, ", "))
+	}
+
+	if cfg.ACL != nil && cfg.ACL.Enabled {
+		fmt.Printf("\n  ACL:\n")
+		if len(cfg.ACL.Allow) > 0 {
+			fmt.Printf("    Allow:           %s\n", strings.Join(cfg.ACL.Allow, ", "))
+		}
+		if len(cfg.ACL.Deny) > 0 {
+			fmt.Printf("    Deny:            %s\n", strings.Join(cfg.ACL.Deny, ", "))
+		}
+		action := cfg.ACL.Action
+		if action == "" {
+			action = "refuse"
+		}
+		fmt.Printf("    Action:          %s\n", action)
+	}
+
+	if cfg.RateLimit != nil && cfg.RateLimit.Enabled {
+		fmt.Printf("\n  Rate Limit:\n")
+		fmt.Printf("    QPS:             %g\n", cfg.RateLimit.QPS)
+		if cfg.RateLimit.Burst != 0 {
+			fmt.Printf("    Burst:           %d\n", cfg.RateLimit.Burst)
+		}
+		if cfg.RateLimit.Clients != 0 {
+			fmt.Printf("    Clients:         %d\n", cfg.RateLimit.Clients)
+		}
+		if cfg.RateLimit.Action != "" {
+			fmt.Printf("    Action:          %s\n", cfg.RateLimit.Action)
+		}
+	}
+
+	if cfg.Overload != nil && cfg.Overload.Enabled {
+		fmt.Printf("\n  Overload:\n")
+		if cfg.Overload.QPS != 0 {
+			fmt.Printf("    QPS:             %g\n", cfg.Overload.QPS)
+		}
+		if cfg.Overload.InFlight != 0 {
+			fmt.Printf("    In Flight:       %d\n", cfg.Overload.InFlight)
+		}
+		if cfg.Overload.Action != "" {
+			fmt.Printf("    Action:          %s\n", cfg.Overload.Action)
+		}
+	}
+
+	if g := cfg.NXDomainGuard; g != nil && g.Enabled {
+		fmt.Printf("\n  NXDOMAIN Guard:\n")
+		if g.Window != 0 {
+			fmt.Printf("    Window:          %s\n", g.Window)
+		}
+		if g.ZoneThreshold != 0 {
+			fmt.Printf("    Zone Threshold:  %d\n", g.ZoneThreshold)
+		}
+		if g.ClientThreshold != 0 {
+			fmt.Printf("    Client Threshold: %d\n", g.ClientThreshold)
+		}
+		if g.Duration != 0 {
+			fmt.Printf("    Duration:        %s\n", g.Duration)
+		}
+		if g.ZoneQPS != 0 {
+			fmt.Printf("    Zone QPS:        %g\n", g.ZoneQPS)
+		}
+		if g.Action != "" {
+			fmt.Printf("    Action:          %s\n", g.Action)
+		}
+	}
+
+	if cfg.Privacy != nil && cfg.Privacy.ClientIP != "" {
+		fmt.Printf("\n  Privacy:\n")
+		fmt.Printf("    Client IP:       %s\n", cfg.Privacy.ClientIP)
+		if cfg.Privacy.ClientIP == "truncate" {
+			if cfg.Privacy.IPv4Prefix != 0 {
+				fmt.Printf("    IPv4 Prefix:     /%d\n", cfg.Privacy.IPv4Prefix)
+			}
+			if cfg.Privacy.IPv6Prefix != 0 {
+				fmt.Printf("    IPv6 Prefix:     /%d\n", cfg.Privacy.IPv6Prefix)
+			}
+		}
+		if cfg.Privacy.ClientIP == "hash" && cfg.Privacy.HashKey == "" {
+			fmt.Printf("    Hash Key:        random at each start\n")
+		}
+	}
+
+	if cfg.FilterAAAA != nil && cfg.FilterAAAA.Enabled {
+		fmt.Printf("\n  AAAA Filter:\n")
+		if len(cfg.FilterAAAA.Clients) > 0 {
+			fmt.Printf("    Clients:         %s\n", strings.Join(cfg.FilterAAAA.Clients, ", "))
+		} else {
+			fmt.Printf("    Clients:         all\n")
+		}
+	}
+
+	if cfg.ZoneOperations != nil && len(cfg.ZoneOperations.Allow) > 0 {
+		fmt.Printf("\n  Zone Operations:\n")
+		fmt.Printf("    Allow:           %s\n", strings.Join(cfg.ZoneOperations.Allow, ", "))
+	}
+
+	if cfg.QueryTypes != nil && cfg.QueryTypes.Enabled {
+		fmt.Printf("\n  Query Types:\n")
+		if len(cfg.QueryTypes.Refuse) > 0 {
+			fmt.Printf("    Refuse:          %s\n", strings.Join(cfg.QueryTypes.Refuse, ", "))
+		}
+		if cfg.QueryTypes.ForwardAny {
+			fmt.Printf("    ANY:             forward\n")
+		} else {
+			fmt.Printf("    ANY:             HINFO (RFC 8482)\n")
+		}
+	}
+
+	if cfg.Allowlist != nil && cfg.Allowlist.Enabled {
+		fmt.Printf("\n  Allowlist:\n")
+		for _, domain := range cfg.Allowlist.Domains {
+			fmt.Printf("    Domain:          %s\n", domain)
+		}
+		if cfg.Allowlist.Response != "" {
+			fmt.Printf("    Response:        %s\n", cfg.Allowlist.Response)
+		}
+	}
+
+	if cfg.Blocklist != nil && cfg.Blocklist.Enabled {
+		fmt.Printf("\n  Blocklist:\n")
+		for _, list := range cfg.Blocklist.Lists {
+			fmt.Printf("    List:            %s\n", list)
+		}
+		if cfg.Blocklist.Refresh != 0 {
+			fmt.Printf("    Refresh:         %s\n", cfg.Blocklist.Refresh)
+		}
+		if cfg.Blocklist.Response != "" {
+			fmt.Printf("    Response:        %s\n", cfg.Blocklist.Response)
+		}
+	}
+
+	if cfg.DNSSEC != nil && cfg.DNSSEC.Enabled {
+		fmt.Printf("\n  DNSSEC Validation:\n")
+		if cfg.DNSSEC.TrustAnchors != "" {
+			fmt.Printf("    Trust Anchors:   %s\n", cfg.DNSSEC.TrustAnchors)
+		} else {
+			fmt.Printf("    Trust Anchors:   root (built in)\n")
+		}
+	}
+
+	if cfg.UnixSocket != nil && cfg.UnixSocket.Enabled {
+		fmt.Printf("\n  Unix Socket:\n")
+		fmt.Printf("    Path:            %s\n", cfg.UnixSocket.Path)
+		if cfg.UnixSocket.Type != "" {
+			fmt.Printf("    Type:            %s\n", cfg.UnixSocket.Type)
+		}
+	}
+
+	if cfg.SourcePorts != nil && cfg.SourcePorts.Enabled {
+		fmt.Printf("\n  Source Ports:\n")
+		fmt.Printf("    Enabled:         yes\n")
+		if cfg.SourcePorts.PortMin != 0 || cfg.SourcePorts.PortMax != 0 {
+			fmt.Printf("    Range:           %d-%d\n", cfg.SourcePorts.PortMin, cfg.SourcePorts.PortMax)
+		}
+		if cfg.SourcePorts.MaxQueries != 0 {
+			fmt.Printf("    Max Queries:     %d\n", cfg.SourcePorts.MaxQueries)
+		}
+	}
+
+	if cfg.ECS != nil && cfg.ECS.Mode != "" {
+		fmt.Printf("\n  Client Subnet:\n")
+		fmt.Printf("    Mode:            %s\n", cfg.ECS.Mode)
+		if cfg.ECS.IPv4Prefix != 0 {
+			fmt.Printf("    IPv4 Prefix:     %d\n", cfg.ECS.IPv4Prefix)
+		}
+		if cfg.ECS.IPv6Prefix != 0 {
+			fmt.Printf("    IPv6 Prefix:     %d\n", cfg.ECS.IPv6Prefix)
+		}
+	}
+
+	if cfg.FanOut != nil && cfg.FanOut.Enabled {
+		fmt.Printf("\n  Fan-out:\n")
+		fmt.Printf("    Enabled:         yes\n")
+		if cfg.FanOut.Backends != 0 {
+			fmt.Printf("    Backends:        %d\n", cfg.FanOut.Backends)
+		}
+	}
+
+	if cfg.Hedge != nil && cfg.Hedge.Enabled {
+		fmt.Printf("\n  Hedging:\n")
+		fmt.Printf("    Enabled:         yes\n")
+		if cfg.Hedge.Delay != 0 {
+			fmt.Printf("    Delay:           %s\n", cfg.Hedge.Delay)
+		}
+		if cfg.Hedge.MaxHedges != 0 {
+			fmt.Printf("    Max Hedges:      %d\n", cfg.Hedge.MaxHedges)
+		}
+	}
+
+	if cfg.Retry != nil && cfg.Retry.Enabled {
+		fmt.Printf("\n  Retry:\n")
+		fmt.Printf("    Enabled:         yes\n")
+		if cfg.Retry.Attempts != 0 {
+			fmt.Printf("    Attempts:        %d\n", cfg.Retry.Attempts)
+		}
+		if len(cfg.Retry.Rcodes) > 0 {
+			fmt.Printf("    Rcodes:          %s\n", strings.Join(cfg.Retry.Rcodes, ", "))
+		}
+		if cfg.Retry.PerTryTimeout != 0 {
+			fmt.Printf("    Per-try Timeout: %s\n", cfg.Retry.PerTryTimeout)
+		}
+		if cfg.Retry.Deadline != 0 {
+			fmt.Printf("    Deadline:        %s\n", cfg.Retry.Deadline)
+		}
+		if cfg.Retry.Budget != 0 {
+			fmt.Printf("    Budget:          %g\n", cfg.Retry.Budget)
+		}
+	}
+
+	if cfg.DarkLaunch != nil && cfg.DarkLaunch.Enabled {
+		fmt.Printf("\n  Dark Launch:\n")
+		fmt.Printf("    Candidate:       %s\n", cfg.DarkLaunch.Candidate.Address)
+		if cfg.DarkLaunch.SampleRate != 0 {
+			fmt.Printf("    Sample Rate:     %g\n", cfg.DarkLaunch.SampleRate)
+		}
+	}
+
+	if cfg.Admin != nil && cfg.Admin.Enabled {
+		fmt.Printf("\n  Admin API:\n")
+		fmt.Printf("    Listen:          %s\n", cfg.Admin.Listen)
+		if cfg.Admin.Dashboard {
+			fmt.Printf("    Dashboard:       http://%s/\n", adminDialAddress(cfg.Admin.Listen))
+		}
+	}
+
+	if cfg.ControlSocket != nil && cfg.ControlSocket.Enabled {
+		fmt.Printf("\n  Control Socket:\n")
+		fmt.Printf("    Path:            %s\n", cfg.ControlSocket.Path)
+		if cfg.ControlSocket.Permissions != "" {
+			fmt.Printf("    Permissions:     %s\n", cfg.ControlSocket.Permissions)
+		}
+	}
+
+	if cfg.GRPC != nil && cfg.GRPC.Enabled {
+		fmt.Printf("\n  gRPC Control API:\n")
+		fmt.Printf("    Listen:          %s\n", cfg.GRPC.Listen)
+	}
+
+	if cfg.DebugServer != nil && cfg.DebugServer.Enabled {
+		fmt.Printf("\n  Debug Server:\n")
+		fmt.Printf("    Listen:          %s\n", cfg.DebugServer.Listen)
 	}
 
 	return nil
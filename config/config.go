@@ -1,57 +1,555 @@
 package config
 
 import (
+	"encoding/base64"
 	"fmt"
+	"net"
+	"net/url"
 	"os"
+	"strconv"
+	"strings"
 	"time"
 
+	"github.com/miekg/dns"
 	"gopkg.in/yaml.v3"
 )
 
 // Config represents the complete application configuration
 type Config struct {
-	Listen      string              `yaml:"listen"`
-	Timeout     time.Duration       `yaml:"timeout"`
-	LogLevel    string              `yaml:"log_level"`
-	LogDir      string              `yaml:"log_dir"`
-	FailBehavior string             `yaml:"fail_behavior"` // "closed" or "open"
-	HealthCheck HealthCheckConfig   `yaml:"health_check"`
-	GELF        *GELFConfig         `yaml:"gelf,omitempty"`
-	Backends    []BackendConfig     `yaml:"backends"`
+	Listen            string                  `yaml:"listen"`
+	UDPSockets        int                     `yaml:"udp_sockets"` // >1 opens that many SO_REUSEPORT sockets, 0 = one per CPU
+	Timeout           time.Duration           `yaml:"timeout"`
+	EDNSUDPSize       int                     `yaml:"edns_udp_size"` // Payload size advertised upstream, 0 = pass through
+	LogLevel          string                  `yaml:"log_level"`
+	LogDir            string                  `yaml:"log_dir"`
+	FailBehavior      string                  `yaml:"fail_behavior"`            // "closed" or "open"
+	Strategy          string                  `yaml:"strategy"`                 // Backend selection: "round_robin", "weighted", "least_requests", "latency", "hash_client", "hash_qname" or "random"
+	PreferFamily      string                  `yaml:"prefer_family"`            // "any", "ipv4" or "ipv6" for outgoing sockets
+	SourceAddress     string                  `yaml:"source_address,omitempty"` // Default local IP for upstream queries
+	SourcePorts       *SourcePortsConfig      `yaml:"source_ports,omitempty"`
+	DNSCookies        bool                    `yaml:"dns_cookies"`        // Send DNS cookies (RFC 7873) to plain DNS backends
+	CaseRandomization bool                    `yaml:"case_randomization"` // Randomize query name case toward UDP backends (0x20)
+	HealthCheck       HealthCheckConfig       `yaml:"health_check"`
+	Quorum            *QuorumConfig           `yaml:"quorum,omitempty"`
+	Webhooks          *WebhooksConfig         `yaml:"webhooks,omitempty"`
+	StartupGate       *StartupGateConfig      `yaml:"startup_gate,omitempty"`
+	Cache             *CacheConfig            `yaml:"cache,omitempty"`
+	GELF              *GELFConfig             `yaml:"gelf,omitempty"`
+	Syslog            *SyslogConfig           `yaml:"syslog,omitempty"`
+	StatsD            *StatsDConfig           `yaml:"statsd,omitempty"`
+	QueryLog          *QueryLogConfig         `yaml:"query_log,omitempty"`
+	TopTalkers        *TopTalkersConfig       `yaml:"top_talkers,omitempty"`
+	DoH               *DoHConfig              `yaml:"doh,omitempty"`
+	DNSCrypt          *DNSCryptConfig         `yaml:"dnscrypt,omitempty"`
+	ProxyProto        *ProxyProtoConfig       `yaml:"proxy_protocol,omitempty"`
+	UnixSocket        *UnixSocketConfig       `yaml:"unix_socket,omitempty"`
+	ACL               *ACLConfig              `yaml:"acl,omitempty"`
+	RateLimit         *RateLimitConfig        `yaml:"rate_limit,omitempty"`
+	Overload          *OverloadConfig         `yaml:"overload,omitempty"`
+	NXDomainGuard     *NXDomainGuardConfig    `yaml:"nxdomain_guard,omitempty"`
+	Privacy           *PrivacyConfig          `yaml:"privacy,omitempty"`
+	QueryTypes        *QueryTypesConfig       `yaml:"query_types,omitempty"`
+	FilterAAAA        *FilterAAAAConfig       `yaml:"filter_aaaa,omitempty"`
+	ZoneOperations    *ZoneOperationsConfig   `yaml:"zone_operations,omitempty"`
+	Allowlist         *AllowlistConfig        `yaml:"allowlist,omitempty"`
+	Blocklist         *BlocklistConfig        `yaml:"blocklist,omitempty"`
+	DNSSEC            *DNSSECConfig           `yaml:"dnssec,omitempty"`
+	ECS               *ECSConfig              `yaml:"ecs,omitempty"` // Default EDNS Client Subnet policy for backends
+	FanOut            *FanOutConfig           `yaml:"fan_out,omitempty"`
+	Hedge             *HedgeConfig            `yaml:"hedge,omitempty"`
+	Retry             *RetryConfig            `yaml:"retry,omitempty"`
+	OutlierDetection  *OutlierDetectionConfig `yaml:"outlier_detection,omitempty"`
+	SlowStart         *SlowStartConfig        `yaml:"slow_start,omitempty"`
+	Admin             *AdminConfig            `yaml:"admin,omitempty"`
+	ControlSocket     *ControlSocketConfig    `yaml:"control_socket,omitempty"`
+	GRPC              *GRPCConfig             `yaml:"grpc,omitempty"`
+	DebugServer       *DebugServerConfig      `yaml:"debug_server,omitempty"`
+	DarkLaunch        *DarkLaunchConfig       `yaml:"dark_launch,omitempty"`
+	Backends          []BackendConfig         `yaml:"backends"`
+	LocalRecords      []LocalRecordConfig     `yaml:"local_records,omitempty"`      // Addresses answered locally, exact names before "*." patterns
+	SearchDomains     []string                `yaml:"search_domains,omitempty"`     // Suffixes tried in order for single-label names answered NXDOMAIN
+	Zones             []ZoneConfig            `yaml:"zones,omitempty"`              // Zones answered authoritatively from zone files
+	NXDomainRedirects []NXRedirectConfig      `yaml:"nxdomain_redirects,omitempty"` // Rewrites of NXDOMAIN answers, longest suffix wins
+	TTLRules          []TTLRuleConfig         `yaml:"ttl_rules,omitempty"`          // Per-domain TTL bounds, longest suffix wins
+	Routes            []RouteConfig           `yaml:"routes,omitempty"`             // Per-domain backends, longest suffix wins
+	ClientRoutes      []ClientRouteConfig     `yaml:"client_routes,omitempty"`      // Per-client-network default backends, longest prefix wins
+	GeoIP             *GeoIPConfig            `yaml:"geoip,omitempty"`
+	GeoRoutes         []GeoRouteConfig        `yaml:"geo_routes,omitempty"` // Per-region default backends, ASN before country before continent
 }
 
 // BackendConfig represents a single DNS backend server
 type BackendConfig struct {
-	Address string `yaml:"address"`
-	Weight  int    `yaml:"weight,omitempty"` // For future weighted load balancing
+	Address           string            `yaml:"address"`
+	Weight            int               `yaml:"weight,omitempty"`       // Relative share of queries under the weighted strategy (default 1)
+	Priority          int               `yaml:"priority,omitempty"`     // Failover pool, lower is preferred (default 1)
+	MaxInflight       int               `yaml:"max_inflight,omitempty"` // Queries in flight before the backend is skipped, 0 = unlimited
+	Drain             bool              `yaml:"drain,omitempty"`        // Start in maintenance: health checked but sent no queries
+	TLS               *BackendTLSConfig `yaml:"tls,omitempty"`
+	ECS               *ECSConfig        `yaml:"ecs,omitempty"`                // Overrides the global ECS policy
+	SourceAddress     string            `yaml:"source_address,omitempty"`     // Overrides the global source address
+	CaseRandomization *bool             `yaml:"case_randomization,omitempty"` // Overrides the global case randomization
+}
+
+// LocalRecordConfig represents the addresses answered locally for a name,
+// or with a "*." pattern for every name below a domain
+type LocalRecordConfig struct {
+	Name      string   `yaml:"name"`          // e.g. "nas.home" or "*.lab.home"
+	Addresses []string `yaml:"addresses"`     // A and AAAA records answered
+	TTL       uint32   `yaml:"ttl,omitempty"` // TTL of the records answered (default 300)
+}
+
+// ZoneConfig represents a zone answered authoritatively from a zone file
+// instead of being forwarded
+type ZoneConfig struct {
+	Name string `yaml:"name"` // Zone origin, e.g. "corp.example.com"
+	File string `yaml:"file"` // Zone file in the standard master file format
+}
+
+// NXRedirectConfig rewrites the NXDOMAIN answers backends give for
+// names under a domain into fixed addresses or a CNAME to another name
+type NXRedirectConfig struct {
+	Domain    string   `yaml:"domain"`              // Applies to the domain and its subdomains, "." for every name
+	Addresses []string `yaml:"addresses,omitempty"` // A and AAAA records answered instead
+	Name      string   `yaml:"name,omitempty"`      // Or a CNAME to this name, resolved as usual
+	TTL       uint32   `yaml:"ttl,omitempty"`       // TTL of the records answered (default 60)
+}
+
+// TTLRuleConfig represents the TTL floor and ceiling of the answers for a
+// domain and its subdomains
+type TTLRuleConfig struct {
+	Domain string        `yaml:"domain"`
+	MinTTL time.Duration `yaml:"min_ttl"` // TTLs below are raised to it
+	MaxTTL time.Duration `yaml:"max_ttl"` // TTLs above are lowered to it, 0 = no ceiling
+}
+
+// RouteConfig sends queries for a domain and its subdomains to their own
+// backends instead of the default ones
+type RouteConfig struct {
+	Domain   string          `yaml:"domain"`
+	Backends []BackendConfig `yaml:"backends"`
+}
+
+// ClientRouteConfig sends queries from client networks to their own
+// backends instead of the default ones
+type ClientRouteConfig struct {
+	Clients  []string        `yaml:"clients"` // CIDRs or addresses
+	Backends []BackendConfig `yaml:"backends"`
+}
+
+// GeoIPConfig represents the MaxMind DB files client addresses are looked
+// up in for geo_routes
+type GeoIPConfig struct {
+	Enabled     bool   `yaml:"enabled"`
+	Database    string `yaml:"database"`               // Country or City database, for countries and continents
+	ASNDatabase string `yaml:"asn_database,omitempty"` // ASN database, for asns
+}
+
+// GeoRouteConfig sends queries from clients in the listed countries,
+// continents or autonomous systems to their own backends instead of the
+// default ones
+type GeoRouteConfig struct {
+	Countries  []string        `yaml:"countries,omitempty"`  // ISO 3166-1 alpha-2 codes, e.g. "DE"
+	Continents []string        `yaml:"continents,omitempty"` // AF, AN, AS, EU, NA, OC or SA
+	ASNs       []uint          `yaml:"asns,omitempty"`
+	Backends   []BackendConfig `yaml:"backends"`
+}
+
+// continentCodes are the continent codes used by GeoIP databases
+var continentCodes = map[string]bool{
+	"AF": true, "AN": true, "AS": true, "EU": true, "NA": true, "OC": true, "SA": true,
+}
+
+// BackendTLSConfig represents certificate verification and client
+// authentication settings for tls://, https:// and quic:// backends
+type BackendTLSConfig struct {
+	ServerName         string   `yaml:"server_name,omitempty"`
+	CAFile             string   `yaml:"ca_file,omitempty"`
+	InsecureSkipVerify bool     `yaml:"insecure_skip_verify,omitempty"`
+	CertFile           string   `yaml:"cert_file,omitempty"`
+	KeyFile            string   `yaml:"key_file,omitempty"`
+	SPKIPins           []string `yaml:"spki_pins,omitempty"`
 }
 
 // HealthCheckConfig represents health check settings
 type HealthCheckConfig struct {
-	Enabled           bool          `yaml:"enabled"`
-	Interval          time.Duration `yaml:"interval"`
-	Timeout           time.Duration `yaml:"timeout"`
-	FailureThreshold  int           `yaml:"failure_threshold"`
-	SuccessThreshold  int           `yaml:"success_threshold"`
-	QueryName         string        `yaml:"query_name"`
-	QueryType         string        `yaml:"query_type"`
+	Enabled          bool               `yaml:"enabled"`
+	Interval         time.Duration      `yaml:"interval"`
+	Timeout          time.Duration      `yaml:"timeout"`
+	FailureThreshold int                `yaml:"failure_threshold"`
+	SuccessThreshold int                `yaml:"success_threshold"`
+	QueryName        string             `yaml:"query_name"`
+	QueryType        string             `yaml:"query_type"`
+	Queries          []HealthCheckQuery `yaml:"queries,omitempty"`       // Rotated through, one per probe, instead of query_name/query_type
+	CheckType        string             `yaml:"check_type,omitempty"`    // "dns" (default), "dns_tcp", "tcp_connect" or "exec"
+	Command          []string           `yaml:"command,omitempty"`       // Program and arguments of exec checks, the backend address is appended
+	Concurrency      int                `yaml:"concurrency,omitempty"`   // Checks running at once (default 10)
+	Jitter           time.Duration      `yaml:"jitter,omitempty"`        // Random delay before each check (default interval/10)
+	AcceptRcodes     []string           `yaml:"accept_rcodes,omitempty"` // Response codes a healthy backend may answer with (default NOERROR, NXDOMAIN)
+	MaxBackoff       time.Duration      `yaml:"max_backoff,omitempty"`   // Longest time between probes of an unhealthy backend, 0 = every interval
+	ErrorStreak      int                `yaml:"error_streak,omitempty"`  // Consecutive live SERVFAIL/REFUSED answers marking a backend unhealthy, 0 = off
+}
+
+// HealthCheckQuery is one of the queries health checks rotate through
+type HealthCheckQuery struct {
+	Name string `yaml:"name"`
+	Type string `yaml:"type"` // Any query type, e.g. "A" or "SOA" (default NS)
 }
 
 // GELFConfig represents GELF logging configuration
 type GELFConfig struct {
+	Enabled  bool              `yaml:"enabled"`
+	Address  string            `yaml:"address"`
+	Protocol string            `yaml:"protocol"`      // "tcp" or "udp"
+	TLS      *BackendTLSConfig `yaml:"tls,omitempty"` // Connect over TLS, tcp only
+	Host     string            `yaml:"host"`          // Source host of the messages (default the hostname)
+	Fields   map[string]string `yaml:"fields"`        // Extra fields added to every message
+}
+
+// SyslogConfig represents syslog logging configuration
+type SyslogConfig struct {
+	Enabled  bool              `yaml:"enabled"`
+	Protocol string            `yaml:"protocol"`      // "unix" (default, the local socket), "udp" or "tcp"
+	Address  string            `yaml:"address"`       // Socket path for unix (default /dev/log), host:port otherwise
+	TLS      *BackendTLSConfig `yaml:"tls,omitempty"` // Connect over TLS, tcp only
+	Facility string            `yaml:"facility"`      // Default "daemon"
+	Tag      string            `yaml:"tag"`           // App name of the messages (default "dnsbalancer")
+}
+
+// SyslogFacilities maps syslog facility names to their codes
+var SyslogFacilities = map[string]int{
+	"kern": 0, "user": 1, "mail": 2, "daemon": 3, "auth": 4, "syslog": 5,
+	"lpr": 6, "news": 7, "uucp": 8, "cron": 9, "authpriv": 10, "ftp": 11,
+	"local0": 16, "local1": 17, "local2": 18, "local3": 19,
+	"local4": 20, "local5": 21, "local6": 22, "local7": 23,
+}
+
+// StatsDConfig represents the StatsD server metrics are pushed to
+type StatsDConfig struct {
+	Enabled  bool          `yaml:"enabled"`
+	Address  string        `yaml:"address"`  // host:port of the server, over UDP
+	Prefix   string        `yaml:"prefix"`   // Prepended to every metric name (default "dnsbalancer")
+	Format   string        `yaml:"format"`   // "statsd" (default) or "dogstatsd"
+	Tags     []string      `yaml:"tags"`     // "key:value" tags added to every metric, dogstatsd only
+	Interval time.Duration `yaml:"interval"` // How often metrics are pushed (default 10s)
+}
+
+// QueryLogConfig represents the JSON lines log of a sample of the queries
+// answered
+type QueryLogConfig struct {
+	Enabled     bool          `yaml:"enabled"`
+	File        string        `yaml:"file"`         // Default queries.log in log_dir
+	SampleRate  float64       `yaml:"sample_rate"`  // Share of queries logged, 0-1 (default 1)
+	Level       string        `yaml:"level"`        // "all" (default) or "errors": dropped queries and answers other than NOERROR and NXDOMAIN
+	Permissions string        `yaml:"permissions"`  // Octal file mode, e.g. "0640" (default "0644")
+	MaxSizeMB   int           `yaml:"max_size_mb"`  // Rotate once the file reaches this size, 0 = never
+	RotateEvery time.Duration `yaml:"rotate_every"` // Rotate this often, 0 = never
+	MaxBackups  int           `yaml:"max_backups"`  // Rotated files kept, file.1 the newest (default 5)
+}
+
+// TopTalkersConfig represents the tracking of the busiest clients and the
+// most queried names
+type TopTalkersConfig struct {
+	Enabled  bool          `yaml:"enabled"`
+	Capacity int           `yaml:"capacity"` // Clients and names tracked, each (default 1000)
+	Window   time.Duration `yaml:"window"`   // Counts halve every window, so recent traffic weighs most (default 1m)
+}
+
+// DoHConfig represents the DNS-over-HTTPS listener settings
+type DoHConfig struct {
 	Enabled  bool   `yaml:"enabled"`
-	Address  string `yaml:"address"`
-	Protocol string `yaml:"protocol"` // "tcp" or "udp"
+	Listen   string `yaml:"listen"`
+	Path     string `yaml:"path"`
+	CertFile string `yaml:"cert_file"` // Leave cert/key empty to serve plain HTTP behind a TLS proxy
+	KeyFile  string `yaml:"key_file"`
+
+	// Client authentication; with both set, either a certificate or a
+	// token is enough
+	ClientCAFile string   `yaml:"client_ca_file,omitempty"` // CA that signs the client certificates accepted (mutual TLS)
+	Tokens       []string `yaml:"tokens,omitempty"`         // Bearer tokens accepted in the Authorization header
+}
+
+// DarkLaunchConfig represents a candidate backend that is sent copies of
+// client queries so its answers can be compared with those of the live
+// backends, without ever being returned to clients
+type DarkLaunchConfig struct {
+	Enabled    bool          `yaml:"enabled"`
+	Candidate  BackendConfig `yaml:"candidate"`
+	SampleRate float64       `yaml:"sample_rate"` // Share of queries mirrored, 0-1 (default 1)
+}
+
+// QuorumConfig represents the minimum number of healthy backends this
+// instance needs to keep serving as usual
+type QuorumConfig struct {
+	Enabled      bool   `yaml:"enabled"`
+	MinHealthy   int    `yaml:"min_healthy"`
+	FailBehavior string `yaml:"fail_behavior,omitempty"` // Replaces fail_behavior while below quorum, empty to keep it
+}
+
+// WebhooksConfig represents the URLs notified when a backend changes
+// health or the quorum is lost or restored
+type WebhooksConfig struct {
+	Enabled bool            `yaml:"enabled"`
+	Timeout time.Duration   `yaml:"timeout"` // Per delivery attempt (default 5s)
+	Retries int             `yaml:"retries"` // Attempts after the first that failed (default 3)
+	Targets []WebhookConfig `yaml:"targets"`
+}
+
+// WebhookConfig represents one URL events are posted to
+type WebhookConfig struct {
+	URL        string            `yaml:"url"`                   // Optional for pagerduty, which defaults to the Events API v2
+	Format     string            `yaml:"format"`                // "generic" (default), "slack" or "pagerduty"
+	RoutingKey string            `yaml:"routing_key,omitempty"` // Integration key, pagerduty only
+	Headers    map[string]string `yaml:"headers,omitempty"`     // Added to every request, e.g. Authorization
+}
+
+// StartupGateConfig represents holding off serving at startup until a
+// backend passes a health check
+type StartupGateConfig struct {
+	Enabled bool          `yaml:"enabled"`
+	Timeout time.Duration `yaml:"timeout"` // Give up and exit after this long, 0 = wait indefinitely
+}
+
+// CacheConfig represents the response cache settings
+type CacheConfig struct {
+	Enabled     bool               `yaml:"enabled"`
+	Size        int                `yaml:"size"`          // Most responses kept (default 10000)
+	MaxMemoryMB int                `yaml:"max_memory_mb"` // Most memory responses take, 0 = no limit
+	Eviction    string             `yaml:"eviction"`      // "lru" (default) or "lfu"
+	Shards      int                `yaml:"shards"`        // Independently locked parts of the cache (default 16)
+	Bypass      []string           `yaml:"bypass"`        // Domains, with their subdomains, never cached
+	MinTTL      time.Duration      `yaml:"min_ttl"`       // Responses are kept at least this long
+	MaxTTL      time.Duration      `yaml:"max_ttl"`       // and at most this long, 0 = their own TTL
+	WarmUp      string             `yaml:"warm_up"`       // File of names to resolve at startup
+	WarmUpTop   int                `yaml:"warm_up_top"`   // Save the most requested names to warm_up at shutdown, 0 = never
+	Shared      *SharedCacheConfig `yaml:"shared,omitempty"`
+}
+
+// SharedCacheConfig represents a Redis or memcached server that a fleet of
+// instances shares cached responses through, behind each one's own cache
+type SharedCacheConfig struct {
+	Type     string        `yaml:"type"`     // "redis" (default) or "memcached"
+	Address  string        `yaml:"address"`  // host:port of the server
+	Password string        `yaml:"password"` // Redis AUTH password, if any
+	Prefix   string        `yaml:"prefix"`   // Prepended to every key (default "dnsbalancer:")
+	Timeout  time.Duration `yaml:"timeout"`  // Per request, before answering without it (default 100ms)
+}
+
+// ACLConfig represents the client networks allowed and denied service
+type ACLConfig struct {
+	Enabled bool     `yaml:"enabled"`
+	Allow   []string `yaml:"allow"`  // Client CIDRs served; when set, all others are denied
+	Deny    []string `yaml:"deny"`   // Client CIDRs denied, the most specific match winning
+	Action  string   `yaml:"action"` // "refuse" (default) answers denied queries REFUSED, "drop" ignores them
+}
+
+// RateLimitConfig represents the per-client query rate limits
+type RateLimitConfig struct {
+	Enabled bool    `yaml:"enabled"`
+	QPS     float64 `yaml:"qps"`     // Queries a second each client IP may send
+	Burst   int     `yaml:"burst"`   // Queries a client may send at once after a quiet spell (default qps)
+	Clients int     `yaml:"clients"` // Most recently seen clients tracked (default 100000)
+	Action  string  `yaml:"action"`  // "drop" (default), "truncate" or "refuse" queries over the limit
+}
+
+// OverloadConfig represents the process-wide ceilings beyond which
+// queries are shed instead of resolved
+type OverloadConfig struct {
+	Enabled  bool    `yaml:"enabled"`
+	QPS      float64 `yaml:"qps"`       // Queries a second from all clients together, 0 = no limit
+	InFlight int     `yaml:"in_flight"` // Queries being resolved at once, 0 = no limit
+	Action   string  `yaml:"action"`    // "servfail" (default), "truncate" or "drop" queries shed
+}
+
+// NXDomainGuardConfig represents the NXDOMAIN rates per zone and per
+// client beyond which a random subdomain attack is assumed and its queries
+// are held back
+type NXDomainGuardConfig struct {
+	Enabled         bool          `yaml:"enabled"`
+	Window          time.Duration `yaml:"window"`           // Period NXDOMAIN answers are counted over (default 10s)
+	ZoneThreshold   int           `yaml:"zone_threshold"`   // NXDOMAIN answers under one zone per window before it is limited, 0 = zones not watched
+	ClientThreshold int           `yaml:"client_threshold"` // NXDOMAIN answers to one client per window before it is blocked, 0 = clients not watched
+	Duration        time.Duration `yaml:"duration"`         // How long a zone is limited or a client blocked (default 1m)
+	ZoneQPS         float64       `yaml:"zone_qps"`         // Uncached queries a second still forwarded to a limited zone, 0 = none
+	Action          string        `yaml:"action"`           // "refuse" (default), "servfail" or "drop" queries held back
+}
+
+// PrivacyConfig represents how client addresses are recorded in logs and
+// statistics
+type PrivacyConfig struct {
+	ClientIP   string `yaml:"client_ip"`   // "full" (default), "truncate" or "hash"
+	IPv4Prefix int    `yaml:"ipv4_prefix"` // Bits of IPv4 addresses kept when truncating (default 24)
+	IPv6Prefix int    `yaml:"ipv6_prefix"` // Bits of IPv6 addresses kept when truncating (default 48)
+	HashKey    string `yaml:"hash_key"`    // HMAC key for hashing, random at each start if empty
+}
+
+// QueryTypesConfig represents the query types answered locally instead of
+// being forwarded
+type QueryTypesConfig struct {
+	Enabled    bool     `yaml:"enabled"`
+	Refuse     []string `yaml:"refuse"`      // Types answered REFUSED, e.g. "AXFR"
+	ForwardAny bool     `yaml:"forward_any"` // Forward ANY instead of answering HINFO (RFC 8482)
+}
+
+// FilterAAAAConfig represents the clients whose answers lose their AAAA
+// records, for networks with broken IPv6
+type FilterAAAAConfig struct {
+	Enabled bool     `yaml:"enabled"`
+	Clients []string `yaml:"clients"` // Client CIDRs filtered; when empty, every client is
+}
+
+// ZoneOperationsConfig represents the clients whose zone transfers,
+// dynamic updates and notifies are forwarded; everyone else's are refused
+type ZoneOperationsConfig struct {
+	Allow []string `yaml:"allow"` // Client networks whose AXFR, IXFR, UPDATE and NOTIFY are forwarded
+}
+
+// AllowlistConfig represents the only domains resolved; queries for any
+// other name are answered locally
+type AllowlistConfig struct {
+	Enabled  bool     `yaml:"enabled"`
+	Domains  []string `yaml:"domains"`  // Allowed domains, each with its subdomains
+	Response string   `yaml:"response"` // "nxdomain" (default) or "refused" for other names
+}
+
+// BlocklistConfig represents the lists of domains answered locally
+// instead of being resolved
+type BlocklistConfig struct {
+	Enabled  bool          `yaml:"enabled"`
+	Lists    []string      `yaml:"lists"`    // Files or http(s) URLs of hosts, domain or adblock lists
+	Refresh  time.Duration `yaml:"refresh"`  // How often lists are reloaded (default 24h)
+	Response string        `yaml:"response"` // "nxdomain" (default), "null" (0.0.0.0 and ::) or "refused"
+	TTL      time.Duration `yaml:"ttl"`      // TTL of null answers (default 60s)
+}
+
+// DNSSECConfig represents the validation of answers before they are
+// returned to clients
+type DNSSECConfig struct {
+	Enabled      bool   `yaml:"enabled"`
+	TrustAnchors string `yaml:"trust_anchors"` // File of DS or DNSKEY records replacing the built-in root anchors
+}
+
+// AdminConfig represents the HTTP runtime API used to inspect backends and
+// change their administrative state
+type AdminConfig struct {
+	Enabled   bool   `yaml:"enabled"`
+	Listen    string `yaml:"listen"`    // Keep on loopback or a management network, there is no authentication
+	Dashboard bool   `yaml:"dashboard"` // Serve the web dashboard at /
+}
+
+// ControlSocketConfig represents the runtime API served on a unix socket
+// for the local CLI, where file permissions decide who may use it
+type ControlSocketConfig struct {
+	Enabled     bool   `yaml:"enabled"`
+	Path        string `yaml:"path"`        // Default /run/dnsbalancer/control.sock
+	Permissions string `yaml:"permissions"` // Octal file mode, e.g. "0660" (default "0600")
+}
+
+// GRPCConfig represents the control API served over gRPC, for external
+// controllers automating the balancer
+type GRPCConfig struct {
+	Enabled bool   `yaml:"enabled"`
+	Listen  string `yaml:"listen"` // Keep on loopback or a management network, there is no authentication
+}
+
+// DebugServerConfig represents the pprof and expvar debug server
+type DebugServerConfig struct {
+	Enabled bool   `yaml:"enabled"`
+	Listen  string `yaml:"listen"` // Loopback only (default 127.0.0.1:6060)
+}
+
+// DNSCryptConfig represents the DNSCrypt listener settings
+type DNSCryptConfig struct {
+	Enabled         bool          `yaml:"enabled"`
+	Listen          string        `yaml:"listen"`
+	ProviderName    string        `yaml:"provider_name"`     // e.g. "2.dnscrypt-cert.example.com"
+	ProviderKeyFile string        `yaml:"provider_key_file"` // Ed25519 secret key, generated if missing
+	CertLifetime    time.Duration `yaml:"cert_lifetime"`     // Resolver certificates rotate at half this
+}
+
+// ProxyProtoConfig represents PROXY protocol settings for stream listeners
+type ProxyProtoConfig struct {
+	Enabled        bool     `yaml:"enabled"`
+	TrustedProxies []string `yaml:"trusted_proxies"` // CIDRs allowed to send PROXY headers
+}
+
+// SourcePortsConfig represents source port randomization for upstream UDP
+type SourcePortsConfig struct {
+	Enabled    bool `yaml:"enabled"`
+	Sockets    int  `yaml:"sockets"`     // Sockets kept per backend
+	PortMin    int  `yaml:"port_min"`    // Source port range, inclusive
+	PortMax    int  `yaml:"port_max"`
+	MaxQueries int  `yaml:"max_queries"` // Queries sent from a port before moving to a new one
+}
+
+// ECSConfig represents an EDNS Client Subnet (RFC 7871) policy
+type ECSConfig struct {
+	Mode       string `yaml:"mode"`        // "forward", "strip" or "inject"
+	IPv4Prefix int    `yaml:"ipv4_prefix"` // Client address bits sent when injecting
+	IPv6Prefix int    `yaml:"ipv6_prefix"`
+}
+
+// FanOutConfig represents racing each query across several backends
+type FanOutConfig struct {
+	Enabled  bool `yaml:"enabled"`
+	Backends int  `yaml:"backends"` // Backends queried at once, including the selected one
+}
+
+// HedgeConfig represents querying another backend when the first is slow
+type HedgeConfig struct {
+	Enabled   bool          `yaml:"enabled"`
+	Delay     time.Duration `yaml:"delay"`      // Wait for an answer before querying the next backend
+	MaxHedges int           `yaml:"max_hedges"` // Extra backends queried per request
+}
+
+// RetryConfig represents retrying failed queries on another backend
+type RetryConfig struct {
+	Enabled       bool          `yaml:"enabled"`
+	Attempts      int           `yaml:"attempts"`        // Backends tried per query, including the first
+	Rcodes        []string      `yaml:"rcodes"`          // Response codes retried, e.g. "SERVFAIL"
+	PerTryTimeout time.Duration `yaml:"per_try_timeout"` // Timeout of each attempt, defaults to timeout
+	Deadline      time.Duration `yaml:"deadline"`        // Time allowed for all attempts together, 0 = none
+	Budget        float64       `yaml:"budget"`          // Retries and hedges allowed as a fraction of queries
+}
+
+// OutlierDetectionConfig represents ejecting backends whose live traffic
+// is much worse than that of their pool peers
+type OutlierDetectionConfig struct {
+	Enabled            bool          `yaml:"enabled"`
+	Interval           time.Duration `yaml:"interval"`             // How often backends are compared
+	MinRequests        int           `yaml:"min_requests"`         // Queries a backend needs in an interval to be judged
+	ErrorRateThreshold float64       `yaml:"error_rate_threshold"` // Error rate above the peers' median that ejects
+	LatencyFactor      float64       `yaml:"latency_factor"`       // Multiple of the peers' median p95 latency that ejects
+	EjectionTime       time.Duration `yaml:"ejection_time"`
+	MaxEjectionPercent int           `yaml:"max_ejection_percent"` // Share of a pool that may be ejected at once
+}
+
+// SlowStartConfig represents ramping up traffic to recovered backends
+type SlowStartConfig struct {
+	Enabled   bool          `yaml:"enabled"`
+	Window    time.Duration `yaml:"window"`     // Time to reach the full share of queries
+	MinWeight float64       `yaml:"min_weight"` // Share of queries right after recovery, 0-1
+}
+
+// UnixSocketConfig represents the local unix domain socket listener
+type UnixSocketConfig struct {
+	Enabled     bool   `yaml:"enabled"`
+	Path        string `yaml:"path"`
+	Type        string `yaml:"type"`        // "stream" or "datagram"
+	Permissions string `yaml:"permissions"` // Octal file mode, e.g. "0660"
 }
 
 // DefaultConfig returns a configuration with sensible defaults
 func DefaultConfig() *Config {
 	return &Config{
 		Listen:       "0.0.0.0:53",
+		UDPSockets:   1,
 		Timeout:      3 * time.Second,
+		EDNSUDPSize:  1232,
 		LogLevel:     "info",
 		LogDir:       "/var/log/dnsbalancer",
 		FailBehavior: "closed",
+		Strategy:     "round_robin",
+		PreferFamily: "any",
 		HealthCheck: HealthCheckConfig{
 			Enabled:          false,
 			Interval:         10 * time.Second,
@@ -86,6 +584,8 @@ func LoadConfig(path string) (*Config, error) {
 		return nil, fmt.Errorf("failed to parse config file: %w", err)
 	}
 
+	cfg.normalize()
+
 	// Validate configuration
 	if err := cfg.Validate(); err != nil {
 		return nil, fmt.Errorf("invalid configuration: %w", err)
@@ -94,30 +594,671 @@ func LoadConfig(path string) (*Config, error) {
 	return cfg, nil
 }
 
+// backendSchemes maps the supported backend address schemes to their
+// default ports
+var backendSchemes = map[string]string{
+	"udp":   "53",
+	"tcp":   "53",
+	"tls":   "853",
+	"https": "443",
+	"quic":  "853",
+}
+
+// normalize fills in the default DNS port on backend addresses and adds
+// the brackets IPv6 literals need, so "2001:db8::1" and "10.0.0.1" are
+// accepted as well as "[2001:db8::1]:53" and "10.0.0.1:53". Addresses
+// with a scheme get that scheme's port, e.g. 853 for "tls://"; the URL
+// path of "https://" addresses is kept as is. Strategy names from earlier
+// releases are replaced by their current ones and retry response codes are
+// upper-cased.
+func (c *Config) normalize() {
+	if name, ok := strategyAliases[c.Strategy]; ok {
+		c.Strategy = name
+	}
+
+	for i := range c.HealthCheck.Queries {
+		c.HealthCheck.Queries[i].Type = strings.ToUpper(c.HealthCheck.Queries[i].Type)
+	}
+	for i, rcode := range c.HealthCheck.AcceptRcodes {
+		c.HealthCheck.AcceptRcodes[i] = strings.ToUpper(rcode)
+	}
+
+	if c.QueryTypes != nil {
+		for i, qtype := range c.QueryTypes.Refuse {
+			c.QueryTypes.Refuse[i] = strings.ToUpper(qtype)
+		}
+	}
+
+	if c.Webhooks != nil {
+		for i := range c.Webhooks.Targets {
+			c.Webhooks.Targets[i].Format = strings.ToLower(c.Webhooks.Targets[i].Format)
+		}
+	}
+
+	if c.ControlSocket != nil && c.ControlSocket.Path == "" {
+		c.ControlSocket.Path = "/run/dnsbalancer/control.sock"
+	}
+
+	if c.DebugServer != nil && c.DebugServer.Listen == "" {
+		c.DebugServer.Listen = "127.0.0.1:6060"
+	}
+
+	if c.Retry != nil {
+		for i, rcode := range c.Retry.Rcodes {
+			c.Retry.Rcodes[i] = strings.ToUpper(rcode)
+		}
+	}
+
+	if c.GELF != nil {
+		c.GELF.Protocol = strings.ToLower(c.GELF.Protocol)
+		if c.GELF.Protocol == "" {
+			c.GELF.Protocol = "tcp"
+		}
+	}
+
+	if c.Syslog != nil {
+		c.Syslog.Protocol = strings.ToLower(c.Syslog.Protocol)
+		c.Syslog.Facility = strings.ToLower(c.Syslog.Facility)
+		switch c.Syslog.Protocol {
+		case "":
+			c.Syslog.Protocol = "unix"
+			if c.Syslog.Address == "" {
+				c.Syslog.Address = "/dev/log"
+			}
+		case "udp", "tcp":
+			port := "514"
+			if c.Syslog.TLS != nil {
+				port = "6514"
+			}
+			c.Syslog.Address = normalizeAddress(c.Syslog.Address, port)
+		}
+		if c.Syslog.Facility == "" {
+			c.Syslog.Facility = "daemon"
+		}
+	}
+
+	normalizeBackends(c.Backends)
+	for i := range c.Routes {
+		normalizeBackends(c.Routes[i].Backends)
+	}
+	for i := range c.ClientRoutes {
+		normalizeBackends(c.ClientRoutes[i].Backends)
+	}
+	if c.DarkLaunch != nil {
+		candidate := []BackendConfig{c.DarkLaunch.Candidate}
+		normalizeBackends(candidate)
+		c.DarkLaunch.Candidate = candidate[0]
+	}
+	for i := range c.GeoRoutes {
+		route := &c.GeoRoutes[i]
+		for j, country := range route.Countries {
+			route.Countries[j] = strings.ToUpper(country)
+		}
+		for j, continent := range route.Continents {
+			route.Continents[j] = strings.ToUpper(continent)
+		}
+		normalizeBackends(route.Backends)
+	}
+}
+
+// normalizeBackends normalizes the addresses of a backend list in place
+func normalizeBackends(backends []BackendConfig) {
+	for i := range backends {
+		scheme, hostport, ok := strings.Cut(backends[i].Address, "://")
+		if !ok {
+			backends[i].Address = normalizeAddress(backends[i].Address, "53")
+			continue
+		}
+		port, known := backendSchemes[strings.ToLower(scheme)]
+		if !known {
+			continue
+		}
+		hostport, path := splitURLPath(strings.ToLower(scheme), hostport)
+		backends[i].Address = scheme + "://" + normalizeAddress(hostport, port) + path
+	}
+}
+
+// splitURLPath separates the path from an https:// backend address
+func splitURLPath(scheme, hostport string) (string, string) {
+	if scheme != "https" {
+		return hostport, ""
+	}
+	if i := strings.IndexByte(hostport, '/'); i >= 0 {
+		return hostport[:i], hostport[i:]
+	}
+	return hostport, ""
+}
+
+// strategyAliases maps earlier strategy names to their current ones
+var strategyAliases = map[string]string{
+	"lowest_latency": "latency",
+	"qname_hash":     "hash_qname",
+}
+
+// normalizeAddress adds defaultPort to an address that has none
+func normalizeAddress(addr, defaultPort string) string {
+	if addr == "" {
+		return addr
+	}
+	if _, _, err := net.SplitHostPort(addr); err == nil {
+		return addr
+	}
+
+	host := strings.TrimSuffix(strings.TrimPrefix(addr, "["), "]")
+	if strings.Contains(host, ":") && net.ParseIP(host) == nil {
+		// Not an IPv6 literal, leave it for Validate to reject
+		return addr
+	}
+
+	return net.JoinHostPort(host, defaultPort)
+}
+
 // Validate checks if the configuration is valid
 func (c *Config) Validate() error {
 	if c.Listen == "" {
 		return fmt.Errorf("listen address cannot be empty")
 	}
 
+	if c.UDPSockets < 0 {
+		return fmt.Errorf("udp_sockets cannot be negative")
+	}
+
 	if c.Timeout <= 0 {
 		return fmt.Errorf("timeout must be positive")
 	}
 
+	if c.EDNSUDPSize != 0 && (c.EDNSUDPSize < 512 || c.EDNSUDPSize > 65535) {
+		return fmt.Errorf("edns_udp_size must be 0 or between 512 and 65535")
+	}
+
 	if len(c.Backends) == 0 {
 		return fmt.Errorf("at least one backend must be configured")
 	}
 
 	for i, backend := range c.Backends {
-		if backend.Address == "" {
-			return fmt.Errorf("backend %d: address cannot be empty", i)
+		if err := c.ValidateBackend(backend); err != nil {
+			return fmt.Errorf("backend %d: %w", i, err)
 		}
 	}
 
+	records := make(map[string]bool)
+	for i, record := range c.LocalRecords {
+		name := strings.ToLower(dns.Fqdn(record.Name))
+		if record.Name == "" {
+			return fmt.Errorf("local record %d: name cannot be empty", i)
+		}
+		if _, ok := dns.IsDomainName(name); !ok || strings.Contains(strings.TrimPrefix(name, "*."), "*") {
+			return fmt.Errorf("local record %d: invalid name %q, wildcards must be a leading \"*.\"", i, record.Name)
+		}
+		if records[name] {
+			return fmt.Errorf("local record %d: duplicate name %q", i, record.Name)
+		}
+		records[name] = true
+		if len(record.Addresses) == 0 {
+			return fmt.Errorf("local record %q: at least one address must be configured", record.Name)
+		}
+		for _, address := range record.Addresses {
+			if net.ParseIP(address) == nil {
+				return fmt.Errorf("local record %q: invalid address %q", record.Name, address)
+			}
+		}
+	}
+
+	searchDomains := make(map[string]bool)
+	for i, domain := range c.SearchDomains {
+		name := strings.ToLower(dns.Fqdn(domain))
+		if _, ok := dns.IsDomainName(name); !ok || domain == "" || name == "." {
+			return fmt.Errorf("search domain %d: invalid domain %q", i, domain)
+		}
+		if searchDomains[name] {
+			return fmt.Errorf("search domain %d: duplicate domain %q", i, domain)
+		}
+		searchDomains[name] = true
+	}
+
+	zones := make(map[string]bool)
+	for i, zone := range c.Zones {
+		name := strings.ToLower(dns.Fqdn(zone.Name))
+		if zone.Name == "" {
+			return fmt.Errorf("zone %d: name cannot be empty", i)
+		}
+		if _, ok := dns.IsDomainName(name); !ok {
+			return fmt.Errorf("zone %d: invalid name %q", i, zone.Name)
+		}
+		if zones[name] {
+			return fmt.Errorf("zone %d: duplicate name %q", i, zone.Name)
+		}
+		zones[name] = true
+		if zone.File == "" {
+			return fmt.Errorf("zone %q: file cannot be empty", zone.Name)
+		}
+	}
+
+	redirects := make(map[string]bool)
+	for i, redirect := range c.NXDomainRedirects {
+		domain := strings.ToLower(dns.Fqdn(redirect.Domain))
+		if redirect.Domain == "" {
+			return fmt.Errorf("nxdomain_redirect %d: domain cannot be empty", i)
+		}
+		if _, ok := dns.IsDomainName(domain); !ok {
+			return fmt.Errorf("nxdomain_redirect %d: invalid domain %q", i, redirect.Domain)
+		}
+		if redirects[domain] {
+			return fmt.Errorf("nxdomain_redirect %d: duplicate domain %q", i, redirect.Domain)
+		}
+		redirects[domain] = true
+		if (len(redirect.Addresses) == 0) == (redirect.Name == "") {
+			return fmt.Errorf("nxdomain_redirect %q: requires either addresses or name", redirect.Domain)
+		}
+		for _, address := range redirect.Addresses {
+			if net.ParseIP(address) == nil {
+				return fmt.Errorf("nxdomain_redirect %q: invalid address %q", redirect.Domain, address)
+			}
+		}
+		if _, ok := dns.IsDomainName(redirect.Name); redirect.Name != "" && !ok {
+			return fmt.Errorf("nxdomain_redirect %q: invalid name %q", redirect.Domain, redirect.Name)
+		}
+	}
+
+	ttlRules := make(map[string]bool)
+	for i, rule := range c.TTLRules {
+		domain := strings.ToLower(dns.Fqdn(rule.Domain))
+		if rule.Domain == "" {
+			return fmt.Errorf("ttl_rule %d: domain cannot be empty", i)
+		}
+		if _, ok := dns.IsDomainName(domain); !ok {
+			return fmt.Errorf("ttl_rule %d: invalid domain %q", i, rule.Domain)
+		}
+		if ttlRules[domain] {
+			return fmt.Errorf("ttl_rule %d: duplicate domain %q", i, rule.Domain)
+		}
+		ttlRules[domain] = true
+		if rule.MinTTL < 0 || rule.MaxTTL < 0 {
+			return fmt.Errorf("ttl_rule %q: min_ttl and max_ttl cannot be negative", rule.Domain)
+		}
+		if rule.MinTTL == 0 && rule.MaxTTL == 0 {
+			return fmt.Errorf("ttl_rule %q: requires min_ttl or max_ttl", rule.Domain)
+		}
+		if rule.MaxTTL != 0 && rule.MaxTTL < rule.MinTTL {
+			return fmt.Errorf("ttl_rule %q: max_ttl cannot be less than min_ttl", rule.Domain)
+		}
+	}
+
+	domains := make(map[string]bool)
+	for i, route := range c.Routes {
+		domain := strings.ToLower(dns.Fqdn(route.Domain))
+		if route.Domain == "" {
+			return fmt.Errorf("route %d: domain cannot be empty", i)
+		}
+		if _, ok := dns.IsDomainName(domain); !ok {
+			return fmt.Errorf("route %d: invalid domain %q", i, route.Domain)
+		}
+		if domains[domain] {
+			return fmt.Errorf("route %d: duplicate domain %q", i, route.Domain)
+		}
+		domains[domain] = true
+		if len(route.Backends) == 0 {
+			return fmt.Errorf("route %q: at least one backend must be configured", route.Domain)
+		}
+		for j, backend := range route.Backends {
+			if err := c.ValidateBackend(backend); err != nil {
+				return fmt.Errorf("route %q: backend %d: %w", route.Domain, j, err)
+			}
+		}
+	}
+
+	for i, route := range c.ClientRoutes {
+		if len(route.Clients) == 0 {
+			return fmt.Errorf("client_route %d: clients cannot be empty", i)
+		}
+		if _, err := ParseCIDRs(route.Clients); err != nil {
+			return fmt.Errorf("client_route %d: clients: %w", i, err)
+		}
+		if len(route.Backends) == 0 {
+			return fmt.Errorf("client_route %d: at least one backend must be configured", i)
+		}
+		for j, backend := range route.Backends {
+			if err := c.ValidateBackend(backend); err != nil {
+				return fmt.Errorf("client_route %d: backend %d: %w", i, j, err)
+			}
+		}
+	}
+
+	if err := c.validateGeoIP(); err != nil {
+		return err
+	}
+
 	if c.FailBehavior != "closed" && c.FailBehavior != "open" {
 		return fmt.Errorf("fail_behavior must be either 'closed' or 'open'")
 	}
 
+	switch c.Strategy {
+	case "", "round_robin", "weighted", "least_requests", "latency", "hash_client", "hash_qname", "random":
+	default:
+		return fmt.Errorf("strategy must be one of 'round_robin', 'weighted', 'least_requests', 'latency', 'hash_client', 'hash_qname' or 'random'")
+	}
+
+	switch c.PreferFamily {
+	case "", "any", "ipv4", "ipv6":
+	default:
+		return fmt.Errorf("prefer_family must be one of 'any', 'ipv4' or 'ipv6'")
+	}
+
+	if c.SourcePorts != nil && c.SourcePorts.Enabled {
+		if c.SourcePorts.Sockets < 0 {
+			return fmt.Errorf("source_ports sockets cannot be negative")
+		}
+		if (c.SourcePorts.PortMin == 0) != (c.SourcePorts.PortMax == 0) {
+			return fmt.Errorf("source_ports port_min and port_max must be set together")
+		}
+		if c.SourcePorts.PortMin < 0 || c.SourcePorts.PortMax > 65535 || c.SourcePorts.PortMin > c.SourcePorts.PortMax {
+			return fmt.Errorf("source_ports port range must be within 1-65535 with port_min <= port_max")
+		}
+		if c.SourcePorts.MaxQueries < 0 {
+			return fmt.Errorf("source_ports max_queries cannot be negative")
+		}
+	}
+
+	if c.ECS != nil {
+		if err := c.ECS.validate(); err != nil {
+			return err
+		}
+	}
+
+	if c.FanOut != nil && c.FanOut.Enabled {
+		if c.FanOut.Backends < 0 || c.FanOut.Backends == 1 {
+			return fmt.Errorf("fan_out backends must be at least 2")
+		}
+	}
+
+	if c.Hedge != nil && c.Hedge.Enabled {
+		if c.FanOut != nil && c.FanOut.Enabled {
+			return fmt.Errorf("hedge and fan_out cannot both be enabled")
+		}
+		if c.Hedge.Delay < 0 {
+			return fmt.Errorf("hedge delay cannot be negative")
+		}
+		if c.Hedge.MaxHedges < 0 {
+			return fmt.Errorf("hedge max_hedges cannot be negative")
+		}
+	}
+
+	if c.Retry != nil && c.Retry.Enabled {
+		if c.Retry.Attempts < 0 || c.Retry.Attempts == 1 {
+			return fmt.Errorf("retry attempts must be at least 2")
+		}
+		for _, rcode := range c.Retry.Rcodes {
+			if _, ok := dns.StringToRcode[rcode]; !ok {
+				return fmt.Errorf("retry rcodes: unknown response code %q", rcode)
+			}
+			if rcode == "NOERROR" || rcode == "NXDOMAIN" {
+				return fmt.Errorf("retry rcodes cannot include %s", rcode)
+			}
+		}
+		if c.Retry.PerTryTimeout < 0 || c.Retry.Deadline < 0 {
+			return fmt.Errorf("retry per_try_timeout and deadline cannot be negative")
+		}
+		if c.Retry.Budget < 0 {
+			return fmt.Errorf("retry budget cannot be negative")
+		}
+	}
+
+	if c.Quorum != nil && c.Quorum.Enabled {
+		if !c.HealthCheck.Enabled {
+			return fmt.Errorf("quorum requires health_check to be enabled")
+		}
+		if c.Quorum.MinHealthy <= 0 {
+			return fmt.Errorf("quorum min_healthy must be positive")
+		}
+		if c.Quorum.FailBehavior != "" && c.Quorum.FailBehavior != "closed" && c.Quorum.FailBehavior != "open" {
+			return fmt.Errorf("quorum fail_behavior must be either 'closed' or 'open'")
+		}
+	}
+
+	if c.Webhooks != nil && c.Webhooks.Enabled {
+		if c.Webhooks.Timeout < 0 {
+			return fmt.Errorf("webhooks timeout cannot be negative")
+		}
+		if c.Webhooks.Retries < 0 {
+			return fmt.Errorf("webhooks retries cannot be negative")
+		}
+		if len(c.Webhooks.Targets) == 0 {
+			return fmt.Errorf("webhooks requires at least one target")
+		}
+		for i, target := range c.Webhooks.Targets {
+			switch target.Format {
+			case "", "generic", "slack":
+				if target.URL == "" {
+					return fmt.Errorf("webhook %d: url is required", i)
+				}
+				if target.RoutingKey != "" {
+					return fmt.Errorf("webhook %d: routing_key requires format 'pagerduty'", i)
+				}
+			case "pagerduty":
+				if target.RoutingKey == "" {
+					return fmt.Errorf("webhook %d: routing_key is required for format 'pagerduty'", i)
+				}
+			default:
+				return fmt.Errorf("webhook %d: format must be one of 'generic', 'slack' or 'pagerduty'", i)
+			}
+			if target.URL != "" {
+				u, err := url.Parse(target.URL)
+				if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+					return fmt.Errorf("webhook %d: url must be an http or https URL", i)
+				}
+			}
+		}
+	}
+
+	if c.StartupGate != nil && c.StartupGate.Enabled {
+		if !c.HealthCheck.Enabled {
+			return fmt.Errorf("startup_gate requires health_check to be enabled")
+		}
+		if c.StartupGate.Timeout < 0 {
+			return fmt.Errorf("startup_gate timeout cannot be negative")
+		}
+	}
+
+	if c.ACL != nil && c.ACL.Enabled {
+		if _, err := ParseCIDRs(c.ACL.Allow); err != nil {
+			return fmt.Errorf("acl allow: %w", err)
+		}
+		if _, err := ParseCIDRs(c.ACL.Deny); err != nil {
+			return fmt.Errorf("acl deny: %w", err)
+		}
+		if c.ACL.Action != "" && c.ACL.Action != "refuse" && c.ACL.Action != "drop" {
+			return fmt.Errorf("acl action must be either 'refuse' or 'drop'")
+		}
+	}
+
+	if c.RateLimit != nil && c.RateLimit.Enabled {
+		if c.RateLimit.QPS <= 0 {
+			return fmt.Errorf("rate_limit qps must be positive")
+		}
+		if c.RateLimit.Burst < 0 {
+			return fmt.Errorf("rate_limit burst cannot be negative")
+		}
+		if c.RateLimit.Clients < 0 {
+			return fmt.Errorf("rate_limit clients cannot be negative")
+		}
+		switch c.RateLimit.Action {
+		case "", "drop", "truncate", "refuse":
+		default:
+			return fmt.Errorf("rate_limit action must be one of 'drop', 'truncate' or 'refuse'")
+		}
+	}
+
+	if c.Overload != nil && c.Overload.Enabled {
+		if c.Overload.QPS < 0 {
+			return fmt.Errorf("overload qps cannot be negative")
+		}
+		if c.Overload.InFlight < 0 {
+			return fmt.Errorf("overload in_flight cannot be negative")
+		}
+		if c.Overload.QPS == 0 && c.Overload.InFlight == 0 {
+			return fmt.Errorf("overload requires qps or in_flight")
+		}
+		switch c.Overload.Action {
+		case "", "servfail", "truncate", "drop":
+		default:
+			return fmt.Errorf("overload action must be one of 'servfail', 'truncate' or 'drop'")
+		}
+	}
+
+	if g := c.NXDomainGuard; g != nil && g.Enabled {
+		if g.Window < 0 || g.Duration < 0 {
+			return fmt.Errorf("nxdomain_guard window and duration cannot be negative")
+		}
+		if g.ZoneThreshold < 0 || g.ClientThreshold < 0 {
+			return fmt.Errorf("nxdomain_guard thresholds cannot be negative")
+		}
+		if g.ZoneThreshold == 0 && g.ClientThreshold == 0 {
+			return fmt.Errorf("nxdomain_guard requires zone_threshold or client_threshold")
+		}
+		if g.ZoneQPS < 0 {
+			return fmt.Errorf("nxdomain_guard zone_qps cannot be negative")
+		}
+		switch g.Action {
+		case "", "refuse", "servfail", "drop":
+		default:
+			return fmt.Errorf("nxdomain_guard action must be one of 'refuse', 'servfail' or 'drop'")
+		}
+	}
+
+	if c.Privacy != nil {
+		switch c.Privacy.ClientIP {
+		case "", "full", "truncate", "hash":
+		default:
+			return fmt.Errorf("privacy client_ip must be one of 'full', 'truncate' or 'hash'")
+		}
+		if c.Privacy.IPv4Prefix < 0 || c.Privacy.IPv4Prefix > 32 {
+			return fmt.Errorf("privacy ipv4_prefix must be between 0 and 32")
+		}
+		if c.Privacy.IPv6Prefix < 0 || c.Privacy.IPv6Prefix > 128 {
+			return fmt.Errorf("privacy ipv6_prefix must be between 0 and 128")
+		}
+	}
+
+	if c.ZoneOperations != nil {
+		if _, err := ParseCIDRs(c.ZoneOperations.Allow); err != nil {
+			return fmt.Errorf("zone_operations allow: %w", err)
+		}
+	}
+
+	if c.QueryTypes != nil && c.QueryTypes.Enabled {
+		for _, qtype := range c.QueryTypes.Refuse {
+			if _, ok := dns.StringToType[qtype]; !ok {
+				return fmt.Errorf("query_types refuse: unknown record type %q", qtype)
+			}
+		}
+	}
+
+	if c.FilterAAAA != nil && c.FilterAAAA.Enabled {
+		if _, err := ParseCIDRs(c.FilterAAAA.Clients); err != nil {
+			return fmt.Errorf("filter_aaaa clients: %w", err)
+		}
+	}
+
+	if c.Allowlist != nil && c.Allowlist.Enabled {
+		if len(c.Allowlist.Domains) == 0 {
+			return fmt.Errorf("allowlist requires at least one domain")
+		}
+		for _, domain := range c.Allowlist.Domains {
+			if _, ok := dns.IsDomainName(domain); !ok {
+				return fmt.Errorf("allowlist domain %q is not a valid domain name", domain)
+			}
+		}
+		if c.Allowlist.Response != "" && c.Allowlist.Response != "nxdomain" && c.Allowlist.Response != "refused" {
+			return fmt.Errorf("allowlist response must be either 'nxdomain' or 'refused'")
+		}
+	}
+
+	if c.Blocklist != nil && c.Blocklist.Enabled {
+		if len(c.Blocklist.Lists) == 0 {
+			return fmt.Errorf("blocklist requires at least one list")
+		}
+		if c.Blocklist.Refresh < 0 {
+			return fmt.Errorf("blocklist refresh cannot be negative")
+		}
+		if c.Blocklist.TTL < 0 {
+			return fmt.Errorf("blocklist ttl cannot be negative")
+		}
+		switch c.Blocklist.Response {
+		case "", "nxdomain", "null", "refused":
+		default:
+			return fmt.Errorf("blocklist response must be one of 'nxdomain', 'null' or 'refused'")
+		}
+	}
+
+	if c.Cache != nil && c.Cache.Enabled {
+		if c.Cache.Size < 0 {
+			return fmt.Errorf("cache size cannot be negative")
+		}
+		if c.Cache.Shards < 0 {
+			return fmt.Errorf("cache shards cannot be negative")
+		}
+		if c.Cache.MaxMemoryMB < 0 {
+			return fmt.Errorf("cache max_memory_mb cannot be negative")
+		}
+		if c.Cache.Eviction != "" && c.Cache.Eviction != "lru" && c.Cache.Eviction != "lfu" {
+			return fmt.Errorf("cache eviction must be either 'lru' or 'lfu'")
+		}
+		if c.Cache.MinTTL < 0 || c.Cache.MaxTTL < 0 {
+			return fmt.Errorf("cache min_ttl and max_ttl cannot be negative")
+		}
+		if c.Cache.MaxTTL != 0 && c.Cache.MaxTTL < c.Cache.MinTTL {
+			return fmt.Errorf("cache max_ttl cannot be less than min_ttl")
+		}
+		if c.Cache.WarmUpTop < 0 {
+			return fmt.Errorf("cache warm_up_top cannot be negative")
+		}
+		if c.Cache.WarmUpTop > 0 && c.Cache.WarmUp == "" {
+			return fmt.Errorf("cache warm_up_top requires warm_up")
+		}
+		if shared := c.Cache.Shared; shared != nil {
+			if shared.Address == "" {
+				return fmt.Errorf("cache shared address is required")
+			}
+			if shared.Type != "" && shared.Type != "redis" && shared.Type != "memcached" {
+				return fmt.Errorf("cache shared type must be either 'redis' or 'memcached'")
+			}
+			if shared.Password != "" && shared.Type == "memcached" {
+				return fmt.Errorf("cache shared password is only supported with redis")
+			}
+			if shared.Timeout < 0 {
+				return fmt.Errorf("cache shared timeout cannot be negative")
+			}
+		}
+	}
+
+	if c.OutlierDetection != nil && c.OutlierDetection.Enabled {
+		od := c.OutlierDetection
+		if od.Interval < 0 || od.EjectionTime < 0 {
+			return fmt.Errorf("outlier_detection interval and ejection_time cannot be negative")
+		}
+		if od.MinRequests < 0 {
+			return fmt.Errorf("outlier_detection min_requests cannot be negative")
+		}
+		if od.ErrorRateThreshold < 0 || od.ErrorRateThreshold > 1 {
+			return fmt.Errorf("outlier_detection error_rate_threshold must be between 0 and 1")
+		}
+		if od.LatencyFactor != 0 && od.LatencyFactor <= 1 {
+			return fmt.Errorf("outlier_detection latency_factor must be greater than 1")
+		}
+		if od.MaxEjectionPercent < 0 || od.MaxEjectionPercent > 100 {
+			return fmt.Errorf("outlier_detection max_ejection_percent must be between 0 and 100")
+		}
+	}
+
+	if c.SlowStart != nil && c.SlowStart.Enabled {
+		if c.SlowStart.Window < 0 {
+			return fmt.Errorf("slow_start window cannot be negative")
+		}
+		if c.SlowStart.MinWeight < 0 || c.SlowStart.MinWeight > 1 {
+			return fmt.Errorf("slow_start min_weight must be between 0 and 1")
+		}
+	}
+
 	if c.HealthCheck.Enabled {
 		if c.HealthCheck.Interval <= 0 {
 			return fmt.Errorf("health check interval must be positive")
@@ -131,11 +1272,427 @@ func (c *Config) Validate() error {
 		if c.HealthCheck.SuccessThreshold <= 0 {
 			return fmt.Errorf("health check success threshold must be positive")
 		}
+		switch c.HealthCheck.CheckType {
+		case "", "dns", "dns_tcp", "tcp_connect", "exec":
+		default:
+			return fmt.Errorf("health check check_type must be one of 'dns', 'dns_tcp', 'tcp_connect' or 'exec'")
+		}
+		if c.HealthCheck.CheckType == "exec" && (len(c.HealthCheck.Command) == 0 || c.HealthCheck.Command[0] == "") {
+			return fmt.Errorf("health check command is required for exec checks")
+		}
+		for i, query := range c.HealthCheck.Queries {
+			if query.Name == "" {
+				return fmt.Errorf("health check query %d: name cannot be empty", i)
+			}
+			if _, ok := dns.StringToType[query.Type]; query.Type != "" && !ok {
+				return fmt.Errorf("health check query %d: unknown type %q", i, query.Type)
+			}
+		}
+		for _, rcode := range c.HealthCheck.AcceptRcodes {
+			if _, ok := dns.StringToRcode[rcode]; !ok {
+				return fmt.Errorf("health check accept_rcodes: unknown response code %q", rcode)
+			}
+		}
+		if c.HealthCheck.Concurrency < 0 {
+			return fmt.Errorf("health check concurrency cannot be negative")
+		}
+		if c.HealthCheck.Jitter < 0 || c.HealthCheck.Jitter >= c.HealthCheck.Interval {
+			return fmt.Errorf("health check jitter must be between 0 and the interval")
+		}
+		if c.HealthCheck.MaxBackoff != 0 && c.HealthCheck.MaxBackoff < c.HealthCheck.Interval {
+			return fmt.Errorf("health check max_backoff must be at least the interval")
+		}
+		if c.HealthCheck.ErrorStreak < 0 {
+			return fmt.Errorf("health check error_streak cannot be negative")
+		}
+	}
+
+	if c.GELF != nil && c.GELF.Enabled {
+		if c.GELF.Address == "" {
+			return fmt.Errorf("gelf address cannot be empty")
+		}
+		if c.GELF.Protocol != "tcp" && c.GELF.Protocol != "udp" {
+			return fmt.Errorf("gelf protocol must be either 'tcp' or 'udp'")
+		}
+		if c.GELF.TLS != nil {
+			if c.GELF.Protocol != "tcp" {
+				return fmt.Errorf("gelf tls requires protocol 'tcp'")
+			}
+			if c.GELF.TLS.CAFile != "" {
+				if _, err := os.Stat(c.GELF.TLS.CAFile); err != nil {
+					return fmt.Errorf("gelf tls ca_file: %w", err)
+				}
+			}
+			if (c.GELF.TLS.CertFile == "") != (c.GELF.TLS.KeyFile == "") {
+				return fmt.Errorf("gelf tls cert_file and key_file must be set together")
+			}
+		}
+		for name := range c.GELF.Fields {
+			if !validGELFField(name) {
+				return fmt.Errorf("gelf field name %q must be letters, digits, '_', '-' or '.', and not 'id'", name)
+			}
+		}
+	}
+
+	if c.Syslog != nil && c.Syslog.Enabled {
+		if c.Syslog.Protocol != "unix" && c.Syslog.Protocol != "udp" && c.Syslog.Protocol != "tcp" {
+			return fmt.Errorf("syslog protocol must be 'unix', 'udp' or 'tcp'")
+		}
+		if c.Syslog.Address == "" {
+			return fmt.Errorf("syslog address cannot be empty")
+		}
+		if c.Syslog.TLS != nil {
+			if c.Syslog.Protocol != "tcp" {
+				return fmt.Errorf("syslog tls requires protocol 'tcp'")
+			}
+			if c.Syslog.TLS.CAFile != "" {
+				if _, err := os.Stat(c.Syslog.TLS.CAFile); err != nil {
+					return fmt.Errorf("syslog tls ca_file: %w", err)
+				}
+			}
+			if (c.Syslog.TLS.CertFile == "") != (c.Syslog.TLS.KeyFile == "") {
+				return fmt.Errorf("syslog tls cert_file and key_file must be set together")
+			}
+		}
+		if _, ok := SyslogFacilities[c.Syslog.Facility]; !ok {
+			return fmt.Errorf("syslog facility %q is not a syslog facility name", c.Syslog.Facility)
+		}
+		if strings.ContainsAny(c.Syslog.Tag, " \t\n") {
+			return fmt.Errorf("syslog tag cannot contain spaces")
+		}
+	}
+
+	if c.StatsD != nil && c.StatsD.Enabled {
+		if c.StatsD.Address == "" {
+			return fmt.Errorf("statsd address is required")
+		}
+		if c.StatsD.Format != "" && c.StatsD.Format != "statsd" && c.StatsD.Format != "dogstatsd" {
+			return fmt.Errorf("statsd format must be either 'statsd' or 'dogstatsd'")
+		}
+		if len(c.StatsD.Tags) > 0 && c.StatsD.Format != "dogstatsd" {
+			return fmt.Errorf("statsd tags require format 'dogstatsd'")
+		}
+		if c.StatsD.Interval < 0 {
+			return fmt.Errorf("statsd interval cannot be negative")
+		}
+	}
+
+	if c.QueryLog != nil && c.QueryLog.Enabled {
+		if c.QueryLog.SampleRate < 0 || c.QueryLog.SampleRate > 1 {
+			return fmt.Errorf("query_log sample_rate must be between 0 and 1")
+		}
+		if c.QueryLog.Level != "" && c.QueryLog.Level != "all" && c.QueryLog.Level != "errors" {
+			return fmt.Errorf("query_log level must be either 'all' or 'errors'")
+		}
+		if c.QueryLog.Permissions != "" {
+			if _, err := strconv.ParseUint(c.QueryLog.Permissions, 8, 32); err != nil {
+				return fmt.Errorf("query_log permissions must be an octal mode like '0640'")
+			}
+		}
+		if c.QueryLog.MaxSizeMB < 0 {
+			return fmt.Errorf("query_log max_size_mb cannot be negative")
+		}
+		if c.QueryLog.RotateEvery < 0 {
+			return fmt.Errorf("query_log rotate_every cannot be negative")
+		}
+		if c.QueryLog.MaxBackups < 0 {
+			return fmt.Errorf("query_log max_backups cannot be negative")
+		}
+	}
+
+	if c.TopTalkers != nil && c.TopTalkers.Enabled {
+		if c.TopTalkers.Capacity < 0 {
+			return fmt.Errorf("top_talkers capacity cannot be negative")
+		}
+		if c.TopTalkers.Window < 0 {
+			return fmt.Errorf("top_talkers window cannot be negative")
+		}
+	}
+
+	if c.DoH != nil && c.DoH.Enabled {
+		if c.DoH.Listen == "" {
+			return fmt.Errorf("doh listen address cannot be empty")
+		}
+		if c.DoH.Path != "" && c.DoH.Path[0] != '/' {
+			return fmt.Errorf("doh path must start with '/'")
+		}
+		if (c.DoH.CertFile == "") != (c.DoH.KeyFile == "") {
+			return fmt.Errorf("doh cert_file and key_file must be set together")
+		}
+		if c.DoH.ClientCAFile != "" && c.DoH.CertFile == "" {
+			return fmt.Errorf("doh client_ca_file requires cert_file and key_file")
+		}
+		for _, token := range c.DoH.Tokens {
+			if token == "" {
+				return fmt.Errorf("doh tokens cannot be empty")
+			}
+		}
+	}
+
+	if c.DarkLaunch != nil && c.DarkLaunch.Enabled {
+		if err := c.ValidateBackend(c.DarkLaunch.Candidate); err != nil {
+			return fmt.Errorf("dark_launch candidate: %w", err)
+		}
+		if c.DarkLaunch.SampleRate < 0 || c.DarkLaunch.SampleRate > 1 {
+			return fmt.Errorf("dark_launch sample_rate must be between 0 and 1")
+		}
+	}
+
+	if c.Admin != nil && c.Admin.Enabled && c.Admin.Listen == "" {
+		return fmt.Errorf("admin listen address cannot be empty")
+	}
+
+	if c.ControlSocket != nil && c.ControlSocket.Enabled {
+		if c.UnixSocket != nil && c.UnixSocket.Enabled && c.UnixSocket.Path == c.ControlSocket.Path {
+			return fmt.Errorf("control_socket path cannot be the unix_socket path")
+		}
+		if c.ControlSocket.Permissions != "" {
+			if _, err := strconv.ParseUint(c.ControlSocket.Permissions, 8, 32); err != nil {
+				return fmt.Errorf("control_socket permissions must be an octal mode like '0660'")
+			}
+		}
+	}
+
+	if c.GRPC != nil && c.GRPC.Enabled {
+		if c.GRPC.Listen == "" {
+			return fmt.Errorf("grpc listen address cannot be empty")
+		}
+		if c.Admin != nil && c.Admin.Enabled && c.Admin.Listen == c.GRPC.Listen {
+			return fmt.Errorf("grpc listen address cannot be the admin listen address")
+		}
+	}
+
+	if c.DebugServer != nil && c.DebugServer.Enabled {
+		host, _, err := net.SplitHostPort(c.DebugServer.Listen)
+		if err != nil {
+			return fmt.Errorf("invalid debug_server listen address: %w", err)
+		}
+		if ip := net.ParseIP(host); host != "localhost" && (ip == nil || !ip.IsLoopback()) {
+			return fmt.Errorf("debug_server listen address must be on loopback")
+		}
+	}
+
+	if c.DNSCrypt != nil && c.DNSCrypt.Enabled {
+		if c.DNSCrypt.Listen == "" {
+			return fmt.Errorf("dnscrypt listen address cannot be empty")
+		}
+		if !strings.HasPrefix(strings.ToLower(c.DNSCrypt.ProviderName), "2.dnscrypt-cert.") {
+			return fmt.Errorf("dnscrypt provider_name must start with '2.dnscrypt-cert.'")
+		}
+		if c.DNSCrypt.ProviderKeyFile == "" {
+			return fmt.Errorf("dnscrypt provider_key_file cannot be empty")
+		}
+		if c.DNSCrypt.CertLifetime != 0 && c.DNSCrypt.CertLifetime < time.Hour {
+			return fmt.Errorf("dnscrypt cert_lifetime must be at least 1h")
+		}
+	}
+
+	if c.ProxyProto != nil && c.ProxyProto.Enabled {
+		if len(c.ProxyProto.TrustedProxies) == 0 {
+			return fmt.Errorf("proxy_protocol trusted_proxies cannot be empty")
+		}
+		if _, err := ParseCIDRs(c.ProxyProto.TrustedProxies); err != nil {
+			return fmt.Errorf("proxy_protocol trusted_proxies: %w", err)
+		}
+	}
+
+	if c.UnixSocket != nil && c.UnixSocket.Enabled {
+		if c.UnixSocket.Path == "" {
+			return fmt.Errorf("unix_socket path cannot be empty")
+		}
+		switch c.UnixSocket.Type {
+		case "", "stream", "datagram":
+		default:
+			return fmt.Errorf("unix_socket type must be either 'stream' or 'datagram'")
+		}
+		if c.UnixSocket.Permissions != "" {
+			if _, err := strconv.ParseUint(c.UnixSocket.Permissions, 8, 32); err != nil {
+				return fmt.Errorf("unix_socket permissions must be an octal mode like '0660'")
+			}
+		}
 	}
 
 	return nil
 }
 
+// validateSourceAddress checks that a source address is an IP literal of
+// the same family as the backend, when the backend is an IP literal too
+func validateSourceAddress(source, hostport string) error {
+	ip := net.ParseIP(source)
+	if ip == nil {
+		return fmt.Errorf("source_address %q must be an IP address", source)
+	}
+
+	host, _, _ := net.SplitHostPort(hostport)
+	if target := net.ParseIP(host); target != nil && (target.To4() != nil) != (ip.To4() != nil) {
+		return fmt.Errorf("source_address %s and backend %s are different address families", source, host)
+	}
+
+	return nil
+}
+
+// validGELFField reports whether a name can be used for a GELF additional
+// field: letters, digits, '_', '-' and '.', except the reserved "id"
+func validGELFField(name string) bool {
+	if name == "" || name == "id" {
+		return false
+	}
+	for _, r := range name {
+		if !(r >= 'a' && r <= 'z' || r >= 'A' && r <= 'Z' || r >= '0' && r <= '9' || r == '_' || r == '-' || r == '.') {
+			return false
+		}
+	}
+	return true
+}
+
+// ValidateBackend checks a backend's address and options
+func (c *Config) ValidateBackend(backend BackendConfig) error {
+	if backend.Address == "" {
+		return fmt.Errorf("address cannot be empty")
+	}
+	scheme, hostport := "udp", backend.Address
+	if prefix, rest, ok := strings.Cut(backend.Address, "://"); ok {
+		scheme = strings.ToLower(prefix)
+		if _, known := backendSchemes[scheme]; !known {
+			return fmt.Errorf("unsupported scheme %q (use udp, tcp, tls, https or quic)", prefix)
+		}
+		hostport, _ = splitURLPath(scheme, rest)
+	}
+	if _, port, err := net.SplitHostPort(hostport); err != nil || port == "" {
+		return fmt.Errorf("invalid address %q (use host:port, [ipv6]:port)", backend.Address)
+	}
+	if backend.Weight < 0 {
+		return fmt.Errorf("weight cannot be negative")
+	}
+	if backend.Priority < 0 {
+		return fmt.Errorf("priority cannot be negative")
+	}
+	if backend.MaxInflight < 0 {
+		return fmt.Errorf("max_inflight cannot be negative")
+	}
+	if backend.SourceAddress != "" {
+		if err := validateSourceAddress(backend.SourceAddress, hostport); err != nil {
+			return err
+		}
+	} else if c.SourceAddress != "" {
+		if err := validateSourceAddress(c.SourceAddress, hostport); err != nil {
+			return err
+		}
+	}
+	if backend.ECS != nil {
+		if err := backend.ECS.validate(); err != nil {
+			return err
+		}
+	}
+	if backend.TLS != nil {
+		if scheme != "tls" && scheme != "https" && scheme != "quic" {
+			return fmt.Errorf("tls options require a tls://, https:// or quic:// address")
+		}
+		if backend.TLS.CAFile != "" {
+			if _, err := os.Stat(backend.TLS.CAFile); err != nil {
+				return fmt.Errorf("tls ca_file: %w", err)
+			}
+		}
+		if (backend.TLS.CertFile == "") != (backend.TLS.KeyFile == "") {
+			return fmt.Errorf("tls cert_file and key_file must be set together")
+		}
+		for _, pin := range backend.TLS.SPKIPins {
+			if digest, err := base64.StdEncoding.DecodeString(pin); err != nil || len(digest) != 32 {
+				return fmt.Errorf("tls spki_pins entry %q is not a base64 SHA-256 digest", pin)
+			}
+		}
+	}
+
+	return nil
+}
+
+// validateGeoIP checks the geoip section and every geo route
+func (c *Config) validateGeoIP() error {
+	geoip := c.GeoIP
+	if geoip != nil && geoip.Enabled && geoip.Database == "" && geoip.ASNDatabase == "" {
+		return fmt.Errorf("geoip needs a database or asn_database")
+	}
+	if len(c.GeoRoutes) > 0 && (geoip == nil || !geoip.Enabled) {
+		return fmt.Errorf("geo_routes require geoip to be enabled")
+	}
+
+	for i, route := range c.GeoRoutes {
+		if len(route.Countries) == 0 && len(route.Continents) == 0 && len(route.ASNs) == 0 {
+			return fmt.Errorf("geo_route %d: at least one of countries, continents or asns must be set", i)
+		}
+		if (len(route.Countries) > 0 || len(route.Continents) > 0) && geoip.Database == "" {
+			return fmt.Errorf("geo_route %d: countries and continents require geoip database", i)
+		}
+		if len(route.ASNs) > 0 && geoip.ASNDatabase == "" {
+			return fmt.Errorf("geo_route %d: asns require geoip asn_database", i)
+		}
+		for _, country := range route.Countries {
+			if len(country) != 2 {
+				return fmt.Errorf("geo_route %d: invalid country code %q (use ISO 3166-1 alpha-2, e.g. DE)", i, country)
+			}
+		}
+		for _, continent := range route.Continents {
+			if !continentCodes[continent] {
+				return fmt.Errorf("geo_route %d: invalid continent code %q (use AF, AN, AS, EU, NA, OC or SA)", i, continent)
+			}
+		}
+		if len(route.Backends) == 0 {
+			return fmt.Errorf("geo_route %d: at least one backend must be configured", i)
+		}
+		for j, backend := range route.Backends {
+			if err := c.ValidateBackend(backend); err != nil {
+				return fmt.Errorf("geo_route %d: backend %d: %w", i, j, err)
+			}
+		}
+	}
+
+	return nil
+}
+
+// validate checks an ECS policy
+func (e *ECSConfig) validate() error {
+	switch e.Mode {
+	case "", "forward", "strip", "inject":
+	default:
+		return fmt.Errorf("ecs mode must be one of 'forward', 'strip' or 'inject'")
+	}
+	if e.IPv4Prefix < 0 || e.IPv4Prefix > 32 {
+		return fmt.Errorf("ecs ipv4_prefix must be between 0 and 32")
+	}
+	if e.IPv6Prefix < 0 || e.IPv6Prefix > 128 {
+		return fmt.Errorf("ecs ipv6_prefix must be between 0 and 128")
+	}
+	return nil
+}
+
+// ParseCIDRs parses a list of CIDR blocks; bare IP addresses are treated
+// as single-host networks
+func ParseCIDRs(list []string) ([]*net.IPNet, error) {
+	networks := make([]*net.IPNet, 0, len(list))
+	for _, entry := range list {
+		if !strings.Contains(entry, "/") {
+			ip := net.ParseIP(entry)
+			if ip == nil {
+				return nil, fmt.Errorf("invalid address %q", entry)
+			}
+			bits := 128
+			if ip.To4() != nil {
+				ip = ip.To4()
+				bits = 32
+			}
+			networks = append(networks, &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)})
+			continue
+		}
+
+		_, network, err := net.ParseCIDR(entry)
+		if err != nil {
+			return nil, fmt.Errorf("invalid CIDR %q", entry)
+		}
+		networks = append(networks, network)
+	}
+	return networks, nil
+}
+
 // SaveExample saves an example configuration file
 func SaveExample(path string) error {
 	cfg := DefaultConfig()
@@ -145,6 +1702,20 @@ func SaveExample(path string) error {
 		Address:  "graylog.example.com:12201",
 		Protocol: "tcp",
 	}
+	cfg.DoH = &DoHConfig{
+		Enabled:  false,
+		Listen:   "0.0.0.0:443",
+		Path:     "/dns-query",
+		CertFile: "/etc/dnsbalancer/tls/cert.pem",
+		KeyFile:  "/etc/dnsbalancer/tls/key.pem",
+	}
+	cfg.DNSCrypt = &DNSCryptConfig{
+		Enabled:         false,
+		Listen:          "0.0.0.0:8443",
+		ProviderName:    "2.dnscrypt-cert.example.com",
+		ProviderKeyFile: "/etc/dnsbalancer/dnscrypt/provider.key",
+		CertLifetime:    24 * time.Hour,
+	}
 
 	data, err := yaml.Marshal(cfg)
 	if err != nil {
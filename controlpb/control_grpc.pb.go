@@ -0,0 +1,580 @@
+// The dnsbalancer control API: the runtime API served over HTTP on the
+// admin address and the control socket, for controllers and operators
+// automating the balancer over gRPC.
+
+// Code generated by protoc-gen-go-grpc. DO NOT EDIT.
+// versions:
+// - protoc-gen-go-grpc v1.3.0
+// - protoc             (unknown)
+// source: control.proto
+
+package controlpb
+
+import (
+	context "context"
+	grpc "google.golang.org/grpc"
+	codes "google.golang.org/grpc/codes"
+	status "google.golang.org/grpc/status"
+)
+
+// This is a compile-time assertion to ensure that this generated file
+// is compatible with the grpc package it is being compiled against.
+// Requires gRPC-Go v1.32.0 or later.
+const _ = grpc.SupportPackageIsVersion7
+
+const (
+	Control_GetStatus_FullMethodName      = "/dnsbalancer.control.v1.Control/GetStatus"
+	Control_ListBackends_FullMethodName   = "/dnsbalancer.control.v1.Control/ListBackends"
+	Control_DrainBackend_FullMethodName   = "/dnsbalancer.control.v1.Control/DrainBackend"
+	Control_UndrainBackend_FullMethodName = "/dnsbalancer.control.v1.Control/UndrainBackend"
+	Control_DisableBackend_FullMethodName = "/dnsbalancer.control.v1.Control/DisableBackend"
+	Control_EnableBackend_FullMethodName  = "/dnsbalancer.control.v1.Control/EnableBackend"
+	Control_AddBackend_FullMethodName     = "/dnsbalancer.control.v1.Control/AddBackend"
+	Control_RemoveBackend_FullMethodName  = "/dnsbalancer.control.v1.Control/RemoveBackend"
+	Control_Reload_FullMethodName         = "/dnsbalancer.control.v1.Control/Reload"
+	Control_GetCacheStats_FullMethodName  = "/dnsbalancer.control.v1.Control/GetCacheStats"
+	Control_PurgeCache_FullMethodName     = "/dnsbalancer.control.v1.Control/PurgeCache"
+	Control_StreamEvents_FullMethodName   = "/dnsbalancer.control.v1.Control/StreamEvents"
+)
+
+// ControlClient is the client API for Control service.
+//
+// For semantics around ctx use and closing/ending streaming RPCs, please refer to https://pkg.go.dev/google.golang.org/grpc/?tab=doc#ClientConn.NewStream.
+type ControlClient interface {
+	// GetStatus returns the state of the instance at a glance
+	GetStatus(ctx context.Context, in *GetStatusRequest, opts ...grpc.CallOption) (*Status, error)
+	// ListBackends returns every backend with its state and statistics
+	ListBackends(ctx context.Context, in *ListBackendsRequest, opts ...grpc.CallOption) (*BackendsResponse, error)
+	// DrainBackend stops sending new queries to the backends with an
+	// address, letting those in flight complete
+	DrainBackend(ctx context.Context, in *BackendRequest, opts ...grpc.CallOption) (*BackendsResponse, error)
+	// UndrainBackend puts drained backends back in rotation
+	UndrainBackend(ctx context.Context, in *BackendRequest, opts ...grpc.CallOption) (*BackendsResponse, error)
+	// DisableBackend marks the backends with an address administratively
+	// down: they are sent no queries and no longer health checked
+	DisableBackend(ctx context.Context, in *BackendRequest, opts ...grpc.CallOption) (*BackendsResponse, error)
+	// EnableBackend puts disabled backends back in rotation
+	EnableBackend(ctx context.Context, in *BackendRequest, opts ...grpc.CallOption) (*BackendsResponse, error)
+	// AddBackend adds a backend to the default backends
+	AddBackend(ctx context.Context, in *AddBackendRequest, opts ...grpc.CallOption) (*BackendsResponse, error)
+	// RemoveBackend removes the default backends with an address
+	RemoveBackend(ctx context.Context, in *BackendRequest, opts ...grpc.CallOption) (*BackendsResponse, error)
+	// Reload reads the configuration file again and applies it, or with
+	// dry_run only reports what would change
+	Reload(ctx context.Context, in *ReloadRequest, opts ...grpc.CallOption) (*ReloadResponse, error)
+	// GetCacheStats returns the response cache statistics
+	GetCacheStats(ctx context.Context, in *GetCacheStatsRequest, opts ...grpc.CallOption) (*CacheStats, error)
+	// PurgeCache drops cached answers
+	PurgeCache(ctx context.Context, in *PurgeCacheRequest, opts ...grpc.CallOption) (*PurgeCacheResponse, error)
+	// StreamEvents sends the counts of every second and backend state
+	// changes until the client cancels
+	StreamEvents(ctx context.Context, in *StreamEventsRequest, opts ...grpc.CallOption) (Control_StreamEventsClient, error)
+}
+
+type controlClient struct {
+	cc grpc.ClientConnInterface
+}
+
+func NewControlClient(cc grpc.ClientConnInterface) ControlClient {
+	return &controlClient{cc}
+}
+
+func (c *controlClient) GetStatus(ctx context.Context, in *GetStatusRequest, opts ...grpc.CallOption) (*Status, error) {
+	out := new(Status)
+	err := c.cc.Invoke(ctx, Control_GetStatus_FullMethodName, in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *controlClient) ListBackends(ctx context.Context, in *ListBackendsRequest, opts ...grpc.CallOption) (*BackendsResponse, error) {
+	out := new(BackendsResponse)
+	err := c.cc.Invoke(ctx, Control_ListBackends_FullMethodName, in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *controlClient) DrainBackend(ctx context.Context, in *BackendRequest, opts ...grpc.CallOption) (*BackendsResponse, error) {
+	out := new(BackendsResponse)
+	err := c.cc.Invoke(ctx, Control_DrainBackend_FullMethodName, in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *controlClient) UndrainBackend(ctx context.Context, in *BackendRequest, opts ...grpc.CallOption) (*BackendsResponse, error) {
+	out := new(BackendsResponse)
+	err := c.cc.Invoke(ctx, Control_UndrainBackend_FullMethodName, in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *controlClient) DisableBackend(ctx context.Context, in *BackendRequest, opts ...grpc.CallOption) (*BackendsResponse, error) {
+	out := new(BackendsResponse)
+	err := c.cc.Invoke(ctx, Control_DisableBackend_FullMethodName, in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *controlClient) EnableBackend(ctx context.Context, in *BackendRequest, opts ...grpc.CallOption) (*BackendsResponse, error) {
+	out := new(BackendsResponse)
+	err := c.cc.Invoke(ctx, Control_EnableBackend_FullMethodName, in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *controlClient) AddBackend(ctx context.Context, in *AddBackendRequest, opts ...grpc.CallOption) (*BackendsResponse, error) {
+	out := new(BackendsResponse)
+	err := c.cc.Invoke(ctx, Control_AddBackend_FullMethodName, in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *controlClient) RemoveBackend(ctx context.Context, in *BackendRequest, opts ...grpc.CallOption) (*BackendsResponse, error) {
+	out := new(BackendsResponse)
+	err := c.cc.Invoke(ctx, Control_RemoveBackend_FullMethodName, in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *controlClient) Reload(ctx context.Context, in *ReloadRequest, opts ...grpc.CallOption) (*ReloadResponse, error) {
+	out := new(ReloadResponse)
+	err := c.cc.Invoke(ctx, Control_Reload_FullMethodName, in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *controlClient) GetCacheStats(ctx context.Context, in *GetCacheStatsRequest, opts ...grpc.CallOption) (*CacheStats, error) {
+	out := new(CacheStats)
+	err := c.cc.Invoke(ctx, Control_GetCacheStats_FullMethodName, in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *controlClient) PurgeCache(ctx context.Context, in *PurgeCacheRequest, opts ...grpc.CallOption) (*PurgeCacheResponse, error) {
+	out := new(PurgeCacheResponse)
+	err := c.cc.Invoke(ctx, Control_PurgeCache_FullMethodName, in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *controlClient) StreamEvents(ctx context.Context, in *StreamEventsRequest, opts ...grpc.CallOption) (Control_StreamEventsClient, error) {
+	stream, err := c.cc.NewStream(ctx, &Control_ServiceDesc.Streams[0], Control_StreamEvents_FullMethodName, opts...)
+	if err != nil {
+		return nil, err
+	}
+	x := &controlStreamEventsClient{stream}
+	if err := x.ClientStream.SendMsg(in); err != nil {
+		return nil, err
+	}
+	if err := x.ClientStream.CloseSend(); err != nil {
+		return nil, err
+	}
+	return x, nil
+}
+
+type Control_StreamEventsClient interface {
+	Recv() (*Event, error)
+	grpc.ClientStream
+}
+
+type controlStreamEventsClient struct {
+	grpc.ClientStream
+}
+
+func (x *controlStreamEventsClient) Recv() (*Event, error) {
+	m := new(Event)
+	if err := x.ClientStream.RecvMsg(m); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+// ControlServer is the server API for Control service.
+// All implementations must embed UnimplementedControlServer
+// for forward compatibility
+type ControlServer interface {
+	// GetStatus returns the state of the instance at a glance
+	GetStatus(context.Context, *GetStatusRequest) (*Status, error)
+	// ListBackends returns every backend with its state and statistics
+	ListBackends(context.Context, *ListBackendsRequest) (*BackendsResponse, error)
+	// DrainBackend stops sending new queries to the backends with an
+	// address, letting those in flight complete
+	DrainBackend(context.Context, *BackendRequest) (*BackendsResponse, error)
+	// UndrainBackend puts drained backends back in rotation
+	UndrainBackend(context.Context, *BackendRequest) (*BackendsResponse, error)
+	// DisableBackend marks the backends with an address administratively
+	// down: they are sent no queries and no longer health checked
+	DisableBackend(context.Context, *BackendRequest) (*BackendsResponse, error)
+	// EnableBackend puts disabled backends back in rotation
+	EnableBackend(context.Context, *BackendRequest) (*BackendsResponse, error)
+	// AddBackend adds a backend to the default backends
+	AddBackend(context.Context, *AddBackendRequest) (*BackendsResponse, error)
+	// RemoveBackend removes the default backends with an address
+	RemoveBackend(context.Context, *BackendRequest) (*BackendsResponse, error)
+	// Reload reads the configuration file again and applies it, or with
+	// dry_run only reports what would change
+	Reload(context.Context, *ReloadRequest) (*ReloadResponse, error)
+	// GetCacheStats returns the response cache statistics
+	GetCacheStats(context.Context, *GetCacheStatsRequest) (*CacheStats, error)
+	// PurgeCache drops cached answers
+	PurgeCache(context.Context, *PurgeCacheRequest) (*PurgeCacheResponse, error)
+	// StreamEvents sends the counts of every second and backend state
+	// changes until the client cancels
+	StreamEvents(*StreamEventsRequest, Control_StreamEventsServer) error
+	mustEmbedUnimplementedControlServer()
+}
+
+// UnimplementedControlServer must be embedded to have forward compatible implementations.
+type UnimplementedControlServer struct {
+}
+
+func (UnimplementedControlServer) GetStatus(context.Context, *GetStatusRequest) (*Status, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method GetStatus not implemented")
+}
+func (UnimplementedControlServer) ListBackends(context.Context, *ListBackendsRequest) (*BackendsResponse, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method ListBackends not implemented")
+}
+func (UnimplementedControlServer) DrainBackend(context.Context, *BackendRequest) (*BackendsResponse, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method DrainBackend not implemented")
+}
+func (UnimplementedControlServer) UndrainBackend(context.Context, *BackendRequest) (*BackendsResponse, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method UndrainBackend not implemented")
+}
+func (UnimplementedControlServer) DisableBackend(context.Context, *BackendRequest) (*BackendsResponse, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method DisableBackend not implemented")
+}
+func (UnimplementedControlServer) EnableBackend(context.Context, *BackendRequest) (*BackendsResponse, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method EnableBackend not implemented")
+}
+func (UnimplementedControlServer) AddBackend(context.Context, *AddBackendRequest) (*BackendsResponse, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method AddBackend not implemented")
+}
+func (UnimplementedControlServer) RemoveBackend(context.Context, *BackendRequest) (*BackendsResponse, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method RemoveBackend not implemented")
+}
+func (UnimplementedControlServer) Reload(context.Context, *ReloadRequest) (*ReloadResponse, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method Reload not implemented")
+}
+func (UnimplementedControlServer) GetCacheStats(context.Context, *GetCacheStatsRequest) (*CacheStats, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method GetCacheStats not implemented")
+}
+func (UnimplementedControlServer) PurgeCache(context.Context, *PurgeCacheRequest) (*PurgeCacheResponse, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method PurgeCache not implemented")
+}
+func (UnimplementedControlServer) StreamEvents(*StreamEventsRequest, Control_StreamEventsServer) error {
+	return status.Errorf(codes.Unimplemented, "method StreamEvents not implemented")
+}
+func (UnimplementedControlServer) mustEmbedUnimplementedControlServer() {}
+
+// UnsafeControlServer may be embedded to opt out of forward compatibility for this service.
+// Use of this interface is not recommended, as added methods to ControlServer will
+// result in compilation errors.
+type UnsafeControlServer interface {
+	mustEmbedUnimplementedControlServer()
+}
+
+func RegisterControlServer(s grpc.ServiceRegistrar, srv ControlServer) {
+	s.RegisterService(&Control_ServiceDesc, srv)
+}
+
+func _Control_GetStatus_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(GetStatusRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(ControlServer).GetStatus(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: Control_GetStatus_FullMethodName,
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(ControlServer).GetStatus(ctx, req.(*GetStatusRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _Control_ListBackends_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(ListBackendsRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(ControlServer).ListBackends(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: Control_ListBackends_FullMethodName,
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(ControlServer).ListBackends(ctx, req.(*ListBackendsRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _Control_DrainBackend_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(BackendRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(ControlServer).DrainBackend(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: Control_DrainBackend_FullMethodName,
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(ControlServer).DrainBackend(ctx, req.(*BackendRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _Control_UndrainBackend_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(BackendRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(ControlServer).UndrainBackend(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: Control_UndrainBackend_FullMethodName,
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(ControlServer).UndrainBackend(ctx, req.(*BackendRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _Control_DisableBackend_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(BackendRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(ControlServer).DisableBackend(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: Control_DisableBackend_FullMethodName,
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(ControlServer).DisableBackend(ctx, req.(*BackendRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _Control_EnableBackend_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(BackendRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(ControlServer).EnableBackend(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: Control_EnableBackend_FullMethodName,
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(ControlServer).EnableBackend(ctx, req.(*BackendRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _Control_AddBackend_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(AddBackendRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(ControlServer).AddBackend(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: Control_AddBackend_FullMethodName,
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(ControlServer).AddBackend(ctx, req.(*AddBackendRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _Control_RemoveBackend_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(BackendRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(ControlServer).RemoveBackend(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: Control_RemoveBackend_FullMethodName,
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(ControlServer).RemoveBackend(ctx, req.(*BackendRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _Control_Reload_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(ReloadRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(ControlServer).Reload(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: Control_Reload_FullMethodName,
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(ControlServer).Reload(ctx, req.(*ReloadRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _Control_GetCacheStats_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(GetCacheStatsRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(ControlServer).GetCacheStats(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: Control_GetCacheStats_FullMethodName,
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(ControlServer).GetCacheStats(ctx, req.(*GetCacheStatsRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _Control_PurgeCache_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(PurgeCacheRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(ControlServer).PurgeCache(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: Control_PurgeCache_FullMethodName,
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(ControlServer).PurgeCache(ctx, req.(*PurgeCacheRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _Control_StreamEvents_Handler(srv interface{}, stream grpc.ServerStream) error {
+	m := new(StreamEventsRequest)
+	if err := stream.RecvMsg(m); err != nil {
+		return err
+	}
+	return srv.(ControlServer).StreamEvents(m, &controlStreamEventsServer{stream})
+}
+
+type Control_StreamEventsServer interface {
+	Send(*Event) error
+	grpc.ServerStream
+}
+
+type controlStreamEventsServer struct {
+	grpc.ServerStream
+}
+
+func (x *controlStreamEventsServer) Send(m *Event) error {
+	return x.ServerStream.SendMsg(m)
+}
+
+// Control_ServiceDesc is the grpc.ServiceDesc for Control service.
+// It's only intended for direct use with grpc.RegisterService,
+// and not to be introspected or modified (even as a copy)
+var Control_ServiceDesc = grpc.ServiceDesc{
+	ServiceName: "dnsbalancer.control.v1.Control",
+	HandlerType: (*ControlServer)(nil),
+	Methods: []grpc.MethodDesc{
+		{
+			MethodName: "GetStatus",
+			Handler:    _Control_GetStatus_Handler,
+		},
+		{
+			MethodName: "ListBackends",
+			Handler:    _Control_ListBackends_Handler,
+		},
+		{
+			MethodName: "DrainBackend",
+			Handler:    _Control_DrainBackend_Handler,
+		},
+		{
+			MethodName: "UndrainBackend",
+			Handler:    _Control_UndrainBackend_Handler,
+		},
+		{
+			MethodName: "DisableBackend",
+			Handler:    _Control_DisableBackend_Handler,
+		},
+		{
+			MethodName: "EnableBackend",
+			Handler:    _Control_EnableBackend_Handler,
+		},
+		{
+			MethodName: "AddBackend",
+			Handler:    _Control_AddBackend_Handler,
+		},
+		{
+			MethodName: "RemoveBackend",
+			Handler:    _Control_RemoveBackend_Handler,
+		},
+		{
+			MethodName: "Reload",
+			Handler:    _Control_Reload_Handler,
+		},
+		{
+			MethodName: "GetCacheStats",
+			Handler:    _Control_GetCacheStats_Handler,
+		},
+		{
+			MethodName: "PurgeCache",
+			Handler:    _Control_PurgeCache_Handler,
+		},
+	},
+	Streams: []grpc.StreamDesc{
+		{
+			StreamName:    "StreamEvents",
+			Handler:       _Control_StreamEvents_Handler,
+			ServerStreams: true,
+		},
+	},
+	Metadata: "control.proto",
+}
@@ -0,0 +1,6 @@
+// Package controlpb is the gRPC control API of dnsbalancer, generated from
+// control.proto. Controllers in other languages generate their client from
+// the same file.
+package controlpb
+
+//go:generate protoc --go_out=. --go_opt=paths=source_relative --go-grpc_out=. --go-grpc_opt=paths=source_relative control.proto
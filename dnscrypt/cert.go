@@ -0,0 +1,127 @@
+package dnscrypt
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"golang.org/x/crypto/curve25519"
+)
+
+// ESVersion identifies the encryption system a certificate advertises
+type ESVersion uint16
+
+const (
+	// XSalsa20Poly1305 is the X25519-XSalsa20Poly1305 construction
+	XSalsa20Poly1305 ESVersion = 0x0001
+	// XChacha20Poly1305 is the X25519-XChacha20Poly1305 construction
+	XChacha20Poly1305 ESVersion = 0x0002
+)
+
+// certMagic prefixes every DNSCrypt certificate
+var certMagic = [4]byte{'D', 'N', 'S', 'C'}
+
+// certSize is the size of a certificate without extensions
+const certSize = 124
+
+// Cert is a short-term resolver certificate signed by the provider key
+type Cert struct {
+	ESVersion   ESVersion
+	Serial      uint32
+	NotBefore   time.Time
+	NotAfter    time.Time
+	PublicKey   [32]byte
+	ClientMagic [8]byte
+
+	secretKey [32]byte
+	raw       []byte
+}
+
+// NewCert generates a fresh resolver key pair and returns a certificate
+// for it signed with the provider's long-term Ed25519 key
+func NewCert(providerKey ed25519.PrivateKey, es ESVersion, serial uint32, notBefore, notAfter time.Time) (*Cert, error) {
+	c := &Cert{
+		ESVersion: es,
+		Serial:    serial,
+		NotBefore: notBefore,
+		NotAfter:  notAfter,
+	}
+
+	if _, err := rand.Read(c.secretKey[:]); err != nil {
+		return nil, fmt.Errorf("failed to generate resolver key: %w", err)
+	}
+	pub, err := curve25519.X25519(c.secretKey[:], curve25519.Basepoint)
+	if err != nil {
+		return nil, fmt.Errorf("failed to derive resolver public key: %w", err)
+	}
+	copy(c.PublicKey[:], pub)
+	copy(c.ClientMagic[:], c.PublicKey[:8])
+
+	// Signed part: resolver-pk client-magic serial ts-start ts-end
+	signed := make([]byte, 0, 52)
+	signed = append(signed, c.PublicKey[:]...)
+	signed = append(signed, c.ClientMagic[:]...)
+	signed = binary.BigEndian.AppendUint32(signed, serial)
+	signed = binary.BigEndian.AppendUint32(signed, uint32(notBefore.Unix()))
+	signed = binary.BigEndian.AppendUint32(signed, uint32(notAfter.Unix()))
+
+	c.raw = make([]byte, 0, certSize)
+	c.raw = append(c.raw, certMagic[:]...)
+	c.raw = binary.BigEndian.AppendUint16(c.raw, uint16(es))
+	c.raw = append(c.raw, 0, 0) // protocol minor version
+	c.raw = append(c.raw, ed25519.Sign(providerKey, signed)...)
+	c.raw = append(c.raw, signed...)
+
+	return c, nil
+}
+
+// Bytes returns the binary certificate as served in TXT records
+func (c *Cert) Bytes() []byte {
+	return c.raw
+}
+
+// Valid reports whether the certificate is valid at the given time
+func (c *Cert) Valid(now time.Time) bool {
+	return !now.Before(c.NotBefore) && now.Before(c.NotAfter)
+}
+
+// LoadProviderKey reads the provider's Ed25519 secret key from path. The
+// file may hold the 64-byte key raw or hex encoded. If the file does not
+// exist a new key is generated and written there; generated reports
+// whether that happened.
+func LoadProviderKey(path string) (key ed25519.PrivateKey, generated bool, err error) {
+	data, err := os.ReadFile(path)
+	if os.IsNotExist(err) {
+		_, key, err := ed25519.GenerateKey(rand.Reader)
+		if err != nil {
+			return nil, false, fmt.Errorf("failed to generate provider key: %w", err)
+		}
+		if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+			return nil, false, fmt.Errorf("failed to create key directory: %w", err)
+		}
+		if err := os.WriteFile(path, []byte(hex.EncodeToString(key)+"\n"), 0600); err != nil {
+			return nil, false, fmt.Errorf("failed to write provider key: %w", err)
+		}
+		return key, true, nil
+	}
+	if err != nil {
+		return nil, false, fmt.Errorf("failed to read provider key: %w", err)
+	}
+
+	if len(data) == ed25519.PrivateKeySize {
+		return ed25519.PrivateKey(data), false, nil
+	}
+
+	decoded, err := hex.DecodeString(strings.TrimSpace(string(data)))
+	if err != nil || len(decoded) != ed25519.PrivateKeySize {
+		return nil, false, fmt.Errorf("provider key must be %d bytes, raw or hex encoded", ed25519.PrivateKeySize)
+	}
+
+	return ed25519.PrivateKey(decoded), false, nil
+}
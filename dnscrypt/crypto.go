@@ -0,0 +1,128 @@
+package dnscrypt
+
+import (
+	"errors"
+
+	"golang.org/x/crypto/chacha20"
+	"golang.org/x/crypto/curve25519"
+	"golang.org/x/crypto/nacl/box"
+	"golang.org/x/crypto/poly1305"
+)
+
+// tagSize is the Poly1305 authenticator size prepended to every box
+const tagSize = poly1305.TagSize
+
+var errOpen = errors.New("dnscrypt: message authentication failed")
+
+// sharedKey derives the symmetric key for a client public key
+func sharedKey(es ESVersion, secretKey, clientKey *[32]byte) ([32]byte, error) {
+	var key [32]byte
+
+	if es == XSalsa20Poly1305 {
+		box.Precompute(&key, clientKey, secretKey)
+		return key, nil
+	}
+
+	dh, err := curve25519.X25519(secretKey[:], clientKey[:])
+	if err != nil {
+		return key, err
+	}
+	subKey, err := chacha20.HChaCha20(dh, make([]byte, 16))
+	if err != nil {
+		return key, err
+	}
+	copy(key[:], subKey)
+
+	return key, nil
+}
+
+// seal encrypts and authenticates msg, returning tag || ciphertext
+func seal(es ESVersion, key *[32]byte, nonce *[24]byte, msg []byte) []byte {
+	if es == XSalsa20Poly1305 {
+		return box.SealAfterPrecomputation(nil, msg, nonce, key)
+	}
+
+	cipher, polyKey := xchachaInit(key, nonce)
+
+	out := make([]byte, tagSize+len(msg))
+	cipher.XORKeyStream(out[tagSize:], msg)
+
+	var tag [tagSize]byte
+	poly1305.Sum(&tag, out[tagSize:], &polyKey)
+	copy(out, tag[:])
+
+	return out
+}
+
+// open verifies and decrypts a box produced by seal
+func open(es ESVersion, key *[32]byte, nonce *[24]byte, boxed []byte) ([]byte, error) {
+	if len(boxed) < tagSize {
+		return nil, errOpen
+	}
+
+	if es == XSalsa20Poly1305 {
+		msg, ok := box.OpenAfterPrecomputation(nil, boxed, nonce, key)
+		if !ok {
+			return nil, errOpen
+		}
+		return msg, nil
+	}
+
+	cipher, polyKey := xchachaInit(key, nonce)
+
+	var tag [tagSize]byte
+	copy(tag[:], boxed[:tagSize])
+	if !poly1305.Verify(&tag, boxed[tagSize:], &polyKey) {
+		return nil, errOpen
+	}
+
+	msg := make([]byte, len(boxed)-tagSize)
+	cipher.XORKeyStream(msg, boxed[tagSize:])
+
+	return msg, nil
+}
+
+// xchachaInit sets up the secretbox-style XChaCha20 construction: the
+// first 32 bytes of keystream become the Poly1305 key and the message is
+// encrypted with the keystream that follows
+func xchachaInit(key *[32]byte, nonce *[24]byte) (*chacha20.Cipher, [32]byte) {
+	cipher, _ := chacha20.NewUnauthenticatedCipher(key[:], nonce[:])
+
+	var block [32]byte
+	cipher.XORKeyStream(block[:], block[:])
+
+	var polyKey [32]byte
+	copy(polyKey[:], block[:])
+
+	return cipher, polyKey
+}
+
+// pad appends ISO/IEC 7816-4 padding up to a multiple of 64 bytes and
+// at least minSize bytes
+func pad(msg []byte, minSize int) []byte {
+	size := (len(msg) + 1 + 63) &^ 63
+	if size < minSize {
+		size = minSize
+	}
+
+	padded := make([]byte, size)
+	copy(padded, msg)
+	padded[len(msg)] = 0x80
+
+	return padded
+}
+
+// unpad strips ISO/IEC 7816-4 padding
+func unpad(padded []byte) ([]byte, error) {
+	for i := len(padded) - 1; i >= 0; i-- {
+		switch padded[i] {
+		case 0x00:
+			continue
+		case 0x80:
+			return padded[:i], nil
+		default:
+			return nil, errors.New("dnscrypt: invalid padding")
+		}
+	}
+	return nil, errors.New("dnscrypt: invalid padding")
+}
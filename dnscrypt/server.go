@@ -0,0 +1,307 @@
+// Package dnscrypt implements the server side of the DNSCrypt v2 protocol:
+// resolver certificates, query decryption and response encryption.
+package dnscrypt
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"net"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+const (
+	// clientMagicSize, publicKeySize and halfNonceSize make up the
+	// unencrypted prefix of every client query
+	clientMagicSize = 8
+	publicKeySize   = 32
+	halfNonceSize   = 12
+
+	queryHeaderSize = clientMagicSize + publicKeySize + halfNonceSize
+
+	// ResponseOverhead is the number of bytes encryption adds to a
+	// response besides padding
+	ResponseOverhead = len(resolverMagic) + 2*halfNonceSize + tagSize
+
+	// certTTL is the TTL of certificate TXT records
+	certTTL = 600
+)
+
+// resolverMagic prefixes every encrypted response
+var resolverMagic = [8]byte{0x72, 0x36, 0x66, 0x6e, 0x76, 0x57, 0x6a, 0x38}
+
+// ErrNotDNSCrypt is returned for packets that don't match any current
+// certificate
+var ErrNotDNSCrypt = errors.New("dnscrypt: packet does not match any certificate")
+
+// Server holds the provider identity and the rotating set of resolver
+// certificates
+type Server struct {
+	providerName string
+	providerKey  ed25519.PrivateKey
+	lifetime     time.Duration
+
+	mu    sync.RWMutex
+	certs []*Cert
+}
+
+// Session carries the state needed to encrypt the response to a query
+type Session struct {
+	es          ESVersion
+	key         [32]byte
+	clientNonce [halfNonceSize]byte
+}
+
+// NewServer creates a server for the given provider and issues its
+// first set of certificates
+func NewServer(providerName string, providerKey ed25519.PrivateKey, lifetime time.Duration) (*Server, error) {
+	s := &Server{
+		providerName: dns.Fqdn(strings.ToLower(providerName)),
+		providerKey:  providerKey,
+		lifetime:     lifetime,
+	}
+
+	if err := s.Rotate(time.Now()); err != nil {
+		return nil, err
+	}
+
+	return s, nil
+}
+
+// Rotate issues a new certificate for each supported construction and
+// drops expired ones. Previous certificates stay valid until they expire
+// so clients holding them keep working.
+func (s *Server) Rotate(now time.Time) error {
+	// Allow for some clock skew on the client side
+	notBefore := now.Add(-5 * time.Minute)
+	notAfter := now.Add(s.lifetime)
+	serial := uint32(now.Unix())
+
+	var issued []*Cert
+	for _, es := range []ESVersion{XChacha20Poly1305, XSalsa20Poly1305} {
+		cert, err := NewCert(s.providerKey, es, serial, notBefore, notAfter)
+		if err != nil {
+			return err
+		}
+		issued = append(issued, cert)
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	certs := issued
+	for _, cert := range s.certs {
+		if cert.Valid(now) {
+			certs = append(certs, cert)
+		}
+	}
+	s.certs = certs
+
+	return nil
+}
+
+// NeedsRotation reports whether the newest certificate is past half of
+// its lifetime
+func (s *Server) NeedsRotation(now time.Time) bool {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	if len(s.certs) == 0 {
+		return true
+	}
+	return now.After(s.certs[0].NotAfter.Add(-s.lifetime / 2))
+}
+
+// CertResponse answers plain-DNS certificate requests (TXT queries for
+// the provider name). ok is false if the packet is not such a request.
+func (s *Server) CertResponse(packet []byte) (response []byte, ok bool) {
+	query := new(dns.Msg)
+	if err := query.Unpack(packet); err != nil || len(query.Question) != 1 {
+		return nil, false
+	}
+
+	q := query.Question[0]
+	if q.Qtype != dns.TypeTXT || !strings.EqualFold(q.Name, s.providerName) {
+		return nil, false
+	}
+
+	reply := new(dns.Msg)
+	reply.SetReply(query)
+	reply.Authoritative = true
+
+	now := time.Now()
+	s.mu.RLock()
+	for _, cert := range s.certs {
+		if !cert.Valid(now) {
+			continue
+		}
+		reply.Answer = append(reply.Answer, &dns.TXT{
+			Hdr: dns.RR_Header{Name: q.Name, Rrtype: dns.TypeTXT, Class: dns.ClassINET, Ttl: certTTL},
+			Txt: []string{escapeTXT(cert.Bytes())},
+		})
+	}
+	s.mu.RUnlock()
+
+	packed, err := reply.Pack()
+	if err != nil {
+		return nil, false
+	}
+
+	return packed, true
+}
+
+// Decrypt authenticates and decrypts a client query, returning the plain
+// DNS message and the session for encrypting the response
+func (s *Server) Decrypt(packet []byte) ([]byte, *Session, error) {
+	if len(packet) < queryHeaderSize+tagSize {
+		return nil, nil, ErrNotDNSCrypt
+	}
+
+	cert := s.certForMagic(packet[:clientMagicSize])
+	if cert == nil {
+		return nil, nil, ErrNotDNSCrypt
+	}
+
+	var clientKey [32]byte
+	copy(clientKey[:], packet[clientMagicSize:clientMagicSize+publicKeySize])
+
+	key, err := sharedKey(cert.ESVersion, &cert.secretKey, &clientKey)
+	if err != nil {
+		return nil, nil, fmt.Errorf("dnscrypt: invalid client key: %w", err)
+	}
+
+	session := &Session{es: cert.ESVersion, key: key}
+	copy(session.clientNonce[:], packet[clientMagicSize+publicKeySize:queryHeaderSize])
+
+	var nonce [24]byte
+	copy(nonce[:], session.clientNonce[:])
+
+	padded, err := open(cert.ESVersion, &key, &nonce, packet[queryHeaderSize:])
+	if err != nil {
+		return nil, nil, err
+	}
+
+	query, err := unpad(padded)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	return query, session, nil
+}
+
+// Encrypt pads and encrypts a response. If maxSize is positive (UDP) and
+// the encrypted response would exceed it, a truncated response is sent
+// instead so the client retries over TCP.
+func (s *Session) Encrypt(response []byte, maxSize int) ([]byte, error) {
+	minSize := 0
+	if maxSize > 0 {
+		if len(pad(response, 0))+ResponseOverhead > maxSize {
+			truncated, err := truncate(response)
+			if err != nil {
+				return nil, err
+			}
+			response = truncated
+		}
+	} else {
+		// Over TCP pad to a random size to hide the response length
+		var r [1]byte
+		rand.Read(r[:])
+		minSize = len(response) + int(r[0])
+	}
+
+	var nonce [24]byte
+	copy(nonce[:], s.clientNonce[:])
+	if _, err := rand.Read(nonce[halfNonceSize:]); err != nil {
+		return nil, err
+	}
+
+	out := make([]byte, 0, ResponseOverhead+len(response)+64)
+	out = append(out, resolverMagic[:]...)
+	out = append(out, nonce[:]...)
+	out = append(out, seal(s.es, &s.key, &nonce, pad(response, minSize))...)
+
+	return out, nil
+}
+
+// Stamp returns the sdns:// stamp clients use to reach this server at
+// the given address
+func (s *Server) Stamp(addr string) string {
+	var stamp bytes.Buffer
+	stamp.WriteByte(0x01)        // DNSCrypt
+	stamp.Write(make([]byte, 8)) // no DNSSEC/no-log/no-filter properties
+
+	writeLP := func(b []byte) {
+		stamp.WriteByte(byte(len(b)))
+		stamp.Write(b)
+	}
+	writeLP([]byte(addr))
+	writeLP(s.providerKey.Public().(ed25519.PublicKey))
+	writeLP([]byte(strings.TrimSuffix(s.providerName, ".")))
+
+	return "sdns://" + base64.RawURLEncoding.EncodeToString(stamp.Bytes())
+}
+
+// PublicKey returns the provider's long-term public key
+func (s *Server) PublicKey() ed25519.PublicKey {
+	return s.providerKey.Public().(ed25519.PublicKey)
+}
+
+// certForMagic finds the current certificate matching a client magic
+func (s *Server) certForMagic(magic []byte) *Cert {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	now := time.Now()
+	for _, cert := range s.certs {
+		if bytes.Equal(cert.ClientMagic[:], magic) && cert.Valid(now) {
+			return cert
+		}
+	}
+	return nil
+}
+
+// truncate replaces a response with an empty one carrying the TC flag
+func truncate(response []byte) ([]byte, error) {
+	msg := new(dns.Msg)
+	if err := msg.Unpack(response); err != nil {
+		return nil, err
+	}
+
+	msg.Truncated = true
+	msg.Answer = nil
+	msg.Ns = nil
+	msg.Extra = nil
+
+	return msg.Pack()
+}
+
+// escapeTXT encodes binary data so it survives as a TXT character string
+func escapeTXT(data []byte) string {
+	var sb strings.Builder
+	for _, b := range data {
+		if (b >= 'a' && b <= 'z') || (b >= 'A' && b <= 'Z') || (b >= '0' && b <= '9') {
+			sb.WriteByte(b)
+			continue
+		}
+		fmt.Fprintf(&sb, "\\%03d", b)
+	}
+	return sb.String()
+}
+
+// IsSpecifiedHost reports whether addr names a concrete host rather than
+// a wildcard address, i.e. whether it can be published in a stamp
+func IsSpecifiedHost(addr string) bool {
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		return false
+	}
+	ip := net.ParseIP(host)
+	return host != "" && (ip == nil || !ip.IsUnspecified())
+}
@@ -0,0 +1,107 @@
+package lb
+
+import (
+	"fmt"
+	"net"
+	"sync/atomic"
+
+	"github.com/aram535/dnsbalancer/config"
+	"github.com/miekg/dns"
+	"github.com/sirupsen/logrus"
+)
+
+// aaaaFilter strips the AAAA records from answers to clients on networks
+// with broken IPv6, leaving them an empty answer (NODATA) so they fall
+// back to IPv4 at once instead of timing out on the address first. It is
+// applied to each response rather than in the cache, which keeps the
+// backends' answers for the clients that aren't filtered.
+type aaaaFilter struct {
+	clients  []*net.IPNet // nil = every client
+	filtered uint64       // Answers whose AAAA records were removed
+}
+
+// newAAAAFilter creates the AAAA filter, or returns nil when it is not
+// enabled
+func newAAAAFilter(cfg *config.FilterAAAAConfig) (*aaaaFilter, error) {
+	if cfg == nil || !cfg.Enabled {
+		return nil, nil
+	}
+
+	clients, err := config.ParseCIDRs(cfg.Clients)
+	if err != nil {
+		return nil, fmt.Errorf("filter_aaaa clients: %w", err)
+	}
+	return &aaaaFilter{clients: clients}, nil
+}
+
+// applies reports whether a client's answers are filtered: everyone's
+// when no networks are listed, otherwise those of clients in them
+func (f *aaaaFilter) applies(clientAddr net.Addr) bool {
+	if len(f.clients) == 0 {
+		return true
+	}
+
+	ip := addrIP(clientAddr)
+	if ip == nil {
+		return false
+	}
+	if ip4 := ip.To4(); ip4 != nil {
+		ip = ip4
+	}
+	return longestMatch(f.clients, ip) >= 0
+}
+
+// filterAAAA removes the AAAA records, and the signatures over them, from
+// the answer to an AAAA query for a filtered client. CNAMEs leading to the
+// name are kept.
+func (lb *LoadBalancer) filterAAAA(query, response []byte, clientAddr net.Addr, logger *logrus.Entry) []byte {
+	f := lb.aaaaFilter
+	if f == nil || len(response) < 4 || response[3]&0x0f != dns.RcodeSuccess {
+		return response
+	}
+	if qtype, ok := questionType(query); !ok || qtype != dns.TypeAAAA || !f.applies(clientAddr) {
+		return response
+	}
+
+	reply := new(dns.Msg)
+	if err := reply.Unpack(response); err != nil {
+		return response
+	}
+	answer := reply.Answer[:0]
+	for _, rr := range reply.Answer {
+		if sig, ok := rr.(*dns.RRSIG); rr.Header().Rrtype == dns.TypeAAAA || ok && sig.TypeCovered == dns.TypeAAAA {
+			continue
+		}
+		answer = append(answer, rr)
+	}
+	if len(answer) == len(reply.Answer) {
+		return response
+	}
+	reply.Answer = answer
+
+	filtered, err := reply.Pack()
+	if err != nil {
+		return response
+	}
+	atomic.AddUint64(&f.filtered, 1)
+	logger.Debug("Removed AAAA records from answer")
+	return filtered
+}
+
+// AAAAFilterStats returns the number of answers whose AAAA records were
+// removed, or nil if the AAAA filter is not enabled
+func (lb *LoadBalancer) AAAAFilterStats() map[string]interface{} {
+	f := lb.aaaaFilter
+	if f == nil {
+		return nil
+	}
+
+	clients := make([]string, len(f.clients))
+	for i, network := range f.clients {
+		clients[i] = network.String()
+	}
+	return map[string]interface{}{
+		"clients":  clients,
+		"filtered": atomic.LoadUint64(&f.filtered),
+	}
+}
@@ -0,0 +1,116 @@
+package lb
+
+import (
+	"fmt"
+	"net"
+	"sync/atomic"
+
+	"github.com/aram535/dnsbalancer/config"
+	"github.com/miekg/dns"
+	"github.com/sirupsen/logrus"
+)
+
+// acl decides which clients are served. The most specific network
+// containing a client decides, deny winning ties; clients in no listed
+// network are served unless an allow list is set.
+type acl struct {
+	allow   []*net.IPNet
+	deny    []*net.IPNet
+	drop    bool   // Drop denied queries instead of answering REFUSED
+	refused uint64 // Denied queries answered REFUSED
+	dropped uint64 // Denied queries dropped
+}
+
+// newACL parses the client ACL, or returns nil when none is enabled
+func newACL(cfg *config.ACLConfig) (*acl, error) {
+	if cfg == nil || !cfg.Enabled {
+		return nil, nil
+	}
+
+	allow, err := config.ParseCIDRs(cfg.Allow)
+	if err != nil {
+		return nil, fmt.Errorf("acl allow: %w", err)
+	}
+	deny, err := config.ParseCIDRs(cfg.Deny)
+	if err != nil {
+		return nil, fmt.Errorf("acl deny: %w", err)
+	}
+
+	return &acl{
+		allow: allow,
+		deny:  deny,
+		drop:  cfg.Action == "drop",
+	}, nil
+}
+
+// permits reports whether a client may be served. Clients without an IP
+// address (unix sockets) are local and always are, as is everyone when
+// there is no ACL.
+func (a *acl) permits(clientAddr net.Addr) bool {
+	if a == nil {
+		return true
+	}
+
+	ip := addrIP(clientAddr)
+	if ip == nil {
+		return true
+	}
+	if ip4 := ip.To4(); ip4 != nil {
+		ip = ip4
+	}
+
+	allowBits := longestMatch(a.allow, ip)
+	denyBits := longestMatch(a.deny, ip)
+	if allowBits < 0 && denyBits < 0 {
+		return len(a.allow) == 0
+	}
+	return allowBits > denyBits
+}
+
+// longestMatch returns the prefix length of the most specific network
+// containing ip, or -1 if none does
+func longestMatch(networks []*net.IPNet, ip net.IP) int {
+	best := -1
+	for _, network := range networks {
+		if !network.Contains(ip) {
+			continue
+		}
+		if bits, _ := network.Mask.Size(); bits > best {
+			best = bits
+		}
+	}
+	return best
+}
+
+// denied answers a query from a client the ACL denies: REFUSED, or
+// nothing at all when denied queries are dropped
+func (lb *LoadBalancer) denied(query []byte, logger *logrus.Entry) []byte {
+	if lb.acl.drop {
+		atomic.AddUint64(&lb.acl.dropped, 1)
+		logger.Debug("Client denied by ACL, dropping query")
+		return nil
+	}
+
+	atomic.AddUint64(&lb.acl.refused, 1)
+	logger.Debug("Client denied by ACL, refusing query")
+	return rcodeResponse(query, dns.RcodeRefused)
+}
+
+// ACLStats returns the number of queries refused and dropped by the
+// client ACL, or nil if no ACL is enabled
+func (lb *LoadBalancer) ACLStats() map[string]interface{} {
+	a := lb.acl
+	if a == nil {
+		return nil
+	}
+
+	action := "refuse"
+	if a.drop {
+		action = "drop"
+	}
+	return map[string]interface{}{
+		"action":  action,
+		"refused": atomic.LoadUint64(&a.refused),
+		"dropped": atomic.LoadUint64(&a.dropped),
+	}
+}
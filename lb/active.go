@@ -0,0 +1,354 @@
+package lb
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/aram535/dnsbalancer/backend"
+	"github.com/aram535/dnsbalancer/config"
+	"github.com/sirupsen/logrus"
+)
+
+// errLastBackend refuses removing the only default backend left
+var errLastBackend = errors.New("cannot remove the last backend")
+
+// errQuorumBackends refuses removing backends the quorum can't do without
+var errQuorumBackends = errors.New("cannot remove backends needed for the quorum")
+
+// closePollInterval is how often backends taken out of use are checked
+// for queries still in flight before they are closed
+const closePollInterval = 100 * time.Millisecond
+
+// activeBackends is the backends in use and how queries are sent to them.
+// It is replaced as a whole when backends are added or removed at runtime
+// or the configuration is reloaded, so a query sees either the set before
+// the change or the one after, never one half changed.
+type activeBackends struct {
+	backends     []*backend.Backend             // Every backend, those of routes included
+	pools        []*backendPool                 // Pools of the default backends
+	routes       routeTable                     // Pools of domain routes
+	clientRoutes []clientRoute                  // Pools of client routes
+	ecs          map[*backend.Backend]ecsPolicy // Policies of the backends overriding the global ECS policy
+	keys         map[*backend.Backend]string    // Fingerprint of each backend's configuration
+	timeout      time.Duration
+	failBehavior string // "closed" or "open"
+}
+
+// newActiveBackends creates the default backends and those of domain and
+// client routes from the configuration. Those of geo routes are added by
+// the caller.
+func newActiveBackends(cfg *config.Config, registry *backendRegistry, factory BalancerFactory, logger *logrus.Logger) (*activeBackends, error) {
+	backends, pools, err := newBackendSet(cfg, cfg.Backends, registry, factory, logger)
+	if err != nil {
+		return nil, err
+	}
+
+	routes, routeBackends, err := newRouteTable(cfg, registry, factory, logger)
+	if err != nil {
+		return nil, err
+	}
+	backends = append(backends, routeBackends...)
+
+	clientRoutes, clientBackends, err := newClientRoutes(cfg, registry, factory, logger)
+	if err != nil {
+		return nil, err
+	}
+	backends = append(backends, clientBackends...)
+
+	return &activeBackends{
+		backends:     backends,
+		pools:        pools,
+		routes:       routes,
+		clientRoutes: clientRoutes,
+		ecs:          registry.ecs,
+		keys:         registry.keys,
+		timeout:      cfg.Timeout,
+		failBehavior: cfg.FailBehavior,
+	}, nil
+}
+
+// backendRegistry records what the backend lists built from a
+// configuration need to know of each backend: its ECS policy and the
+// fingerprint of its configuration. On reload it also holds the running
+// backends, handed back out to the lists they are still configured in
+// with the same options so they keep their health and statistics.
+type backendRegistry struct {
+	ecs     map[*backend.Backend]ecsPolicy
+	keys    map[*backend.Backend]string
+	running map[string][]*backend.Backend // Backends that may be reused, by fingerprint
+	reused  map[*backend.Backend]bool
+}
+
+// newBackendRegistry creates a registry offering the running backends
+// given for reuse, with their fingerprints in keys
+func newBackendRegistry(keys map[*backend.Backend]string, running []*backend.Backend) *backendRegistry {
+	r := &backendRegistry{
+		ecs:     make(map[*backend.Backend]ecsPolicy),
+		keys:    make(map[*backend.Backend]string),
+		running: make(map[string][]*backend.Backend),
+		reused:  make(map[*backend.Backend]bool),
+	}
+	for _, b := range running {
+		if key, ok := keys[b]; ok {
+			r.running[key] = append(r.running[key], b)
+		}
+	}
+	return r
+}
+
+// backend returns a running backend configured the same way, reporting
+// it was reused, or else creates one
+func (r *backendRegistry) backend(cfg *config.Config, bcfg config.BackendConfig) (*backend.Backend, bool, error) {
+	key := backendKey(cfg, bcfg)
+	if running := r.running[key]; len(running) > 0 {
+		b := running[0]
+		r.running[key] = running[1:]
+		r.reused[b] = true
+		r.add(b, key, bcfg)
+		return b, true, nil
+	}
+
+	b, err := NewBackend(cfg, bcfg)
+	if err != nil {
+		return nil, false, err
+	}
+	r.add(b, key, bcfg)
+	return b, false, nil
+}
+
+// add records a backend's fingerprint and ECS policy
+func (r *backendRegistry) add(b *backend.Backend, key string, bcfg config.BackendConfig) {
+	r.keys[b] = key
+	if bcfg.ECS != nil {
+		r.ecs[b] = newECSPolicy(bcfg.ECS)
+	}
+}
+
+// backendKey fingerprints a backend's configuration along with the global
+// settings NewBackend applies to it, so a backend is only reused on
+// reload when it would be created the same way
+func backendKey(cfg *config.Config, bcfg config.BackendConfig) string {
+	key, _ := json.Marshal(struct {
+		Backend           config.BackendConfig
+		PreferFamily      string
+		CheckType         string
+		CheckCommand      []string
+		AcceptRcodes      []string
+		SlowStart         *config.SlowStartConfig
+		DNSCookies        bool
+		CaseRandomization bool
+		SourceAddress     string
+		SourcePorts       *config.SourcePortsConfig
+	}{
+		bcfg, cfg.PreferFamily, cfg.HealthCheck.CheckType, cfg.HealthCheck.Command, cfg.HealthCheck.AcceptRcodes,
+		cfg.SlowStart, cfg.DNSCookies, cfg.CaseRandomization, cfg.SourceAddress, cfg.SourcePorts,
+	})
+	return string(key)
+}
+
+// allBackends returns every backend in use, those of routes included
+func (lb *LoadBalancer) allBackends() []*backend.Backend {
+	return lb.active.Load().backends
+}
+
+// timeout returns how long a backend has to answer a query
+func (lb *LoadBalancer) timeout() time.Duration {
+	return lb.active.Load().timeout
+}
+
+// AddBackend adds a default backend at runtime. It joins the pool of its
+// priority, or a new one, and is health checked from the next round on;
+// like at startup it is taken to be healthy until then.
+func (lb *LoadBalancer) AddBackend(bcfg config.BackendConfig) (*backend.Backend, error) {
+	// A reload may replace the configuration while the backend is built
+	lb.activeMu.Lock()
+	cfg := lb.config
+	lb.activeMu.Unlock()
+
+	if err := cfg.ValidateBackend(bcfg); err != nil {
+		return nil, err
+	}
+	b, err := NewBackend(cfg, bcfg)
+	if err != nil {
+		return nil, err
+	}
+
+	lb.activeMu.Lock()
+	defer lb.activeMu.Unlock()
+
+	active := lb.active.Load()
+	defaults, priorities := poolMembers(active.pools)
+	for _, existing := range defaults {
+		if existing.Address == b.Address {
+			b.Close()
+			return nil, fmt.Errorf("backend %q already exists", b.Address)
+		}
+	}
+
+	next := active.copyMaps()
+	next.keys[b] = backendKey(cfg, bcfg)
+	if bcfg.ECS != nil {
+		next.ecs[b] = newECSPolicy(bcfg.ECS)
+	}
+	lb.setDefaults(next, append(defaults, b), append(priorities, bcfg.Priority))
+
+	lb.logger.WithFields(logrus.Fields{
+		"backend":  b.Address,
+		"priority": bcfg.Priority,
+		"weight":   bcfg.Weight,
+	}).Info("Backend added")
+	return b, nil
+}
+
+// RemoveBackend removes the default backends with the given address at
+// runtime. They get no new queries from then on, and are closed once the
+// queries already sent to them complete. The last default backend can't
+// be removed, nor can those the quorum needs. Backends of routes are left
+// alone.
+func (lb *LoadBalancer) RemoveBackend(address string) ([]*backend.Backend, error) {
+	lb.activeMu.Lock()
+	defer lb.activeMu.Unlock()
+
+	active := lb.active.Load()
+	defaults, priorities := poolMembers(active.pools)
+	var kept, removed []*backend.Backend
+	var keptPriorities []int
+	for i, b := range defaults {
+		if b.Address == address {
+			removed = append(removed, b)
+			continue
+		}
+		kept = append(kept, b)
+		keptPriorities = append(keptPriorities, priorities[i])
+	}
+	if len(removed) == 0 {
+		return nil, fmt.Errorf("no backend with address %q", address)
+	}
+	if len(kept) == 0 {
+		return nil, errLastBackend
+	}
+	if left := len(active.backends) - len(removed); lb.quorum != nil && lb.quorum.minHealthy > left {
+		return nil, fmt.Errorf("%w: min_healthy %d exceeds the %d backends left", errQuorumBackends, lb.quorum.minHealthy, left)
+	}
+
+	next := active.copyMaps()
+	for _, b := range removed {
+		delete(next.ecs, b)
+		delete(next.keys, b)
+	}
+	lb.setDefaults(next, kept, keptPriorities)
+	lb.closeBackends(removed)
+
+	var inFlight int64
+	for _, b := range removed {
+		inFlight += b.InFlight()
+	}
+	lb.logger.WithFields(logrus.Fields{
+		"backend":   address,
+		"count":     len(removed),
+		"in_flight": inFlight,
+	}).Warn("Backend removed")
+	return removed, nil
+}
+
+// closeBackends closes backends taken out of use once the queries in
+// flight to them complete, or right away when the load balancer stops.
+// They are given one poll interval in any case, for queries that picked
+// them just before they were taken out.
+func (lb *LoadBalancer) closeBackends(backends []*backend.Backend) {
+	if len(backends) == 0 {
+		return
+	}
+
+	go func() {
+		ticker := time.NewTicker(closePollInterval)
+		defer ticker.Stop()
+
+	wait:
+		for {
+			select {
+			case <-lb.ctx.Done():
+				break wait
+			case <-ticker.C:
+				if !anyInFlight(backends) {
+					break wait
+				}
+			}
+		}
+		for _, b := range backends {
+			b.Close()
+		}
+	}()
+}
+
+// anyInFlight reports whether queries are in flight to any of the backends
+func anyInFlight(backends []*backend.Backend) bool {
+	for _, b := range backends {
+		if b.InFlight() > 0 {
+			return true
+		}
+	}
+	return false
+}
+
+// copyMaps returns a copy of the set to be changed, with maps of its own
+func (a *activeBackends) copyMaps() *activeBackends {
+	next := *a
+	next.ecs = make(map[*backend.Backend]ecsPolicy, len(a.ecs))
+	for b, policy := range a.ecs {
+		next.ecs[b] = policy
+	}
+	next.keys = make(map[*backend.Backend]string, len(a.keys))
+	for b, key := range a.keys {
+		next.keys[b] = key
+	}
+	return &next
+}
+
+// setDefaults makes next, with the given default backends regrouped into
+// pools, the set in use. The caller holds lb.activeMu.
+func (lb *LoadBalancer) setDefaults(next *activeBackends, defaults []*backend.Backend, priorities []int) {
+	previous, _ := poolMembers(next.pools)
+	wasDefault := make(map[*backend.Backend]bool, len(previous))
+	for _, b := range previous {
+		wasDefault[b] = true
+	}
+
+	backends := append([]*backend.Backend{}, defaults...)
+	for _, b := range next.backends {
+		if !wasDefault[b] {
+			backends = append(backends, b)
+		}
+	}
+	next.backends = backends
+	next.pools = newBackendPools(defaults, priorities, lb.factory)
+	lb.activate(next)
+}
+
+// activate makes a set the one in use and has the health checker, the
+// outlier detector and the quorum follow. The caller holds lb.activeMu.
+func (lb *LoadBalancer) activate(next *activeBackends) {
+	lb.active.Store(next)
+	if lb.healthChecker != nil {
+		lb.healthChecker.setBackends(next.backends)
+	}
+	if lb.outliers != nil {
+		lb.outliers.setPools(lb.allPools())
+	}
+	lb.checkQuorum()
+}
+
+// poolMembers returns the backends of the pools with their priorities
+func poolMembers(pools []*backendPool) ([]*backend.Backend, []int) {
+	var backends []*backend.Backend
+	var priorities []int
+	for _, pool := range pools {
+		for _, b := range pool.backends {
+			backends = append(backends, b)
+			priorities = append(priorities, pool.priority)
+		}
+	}
+	return backends, priorities
+}
@@ -0,0 +1,923 @@
+package lb
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/aram535/dnsbalancer/backend"
+	"github.com/aram535/dnsbalancer/config"
+	"github.com/sirupsen/logrus"
+	"gopkg.in/yaml.v3"
+)
+
+// startAdmin starts the HTTP runtime API
+func (lb *LoadBalancer) startAdmin() error {
+	listener, err := net.Listen("tcp", lb.adminConfig.Listen)
+	if err != nil {
+		return fmt.Errorf("failed to listen on %s (admin): %w", lb.adminConfig.Listen, err)
+	}
+	lb.startStream()
+
+	lb.adminServer = &http.Server{
+		Handler:           lb.adminMux(),
+		ReadHeaderTimeout: 5 * time.Second,
+		IdleTimeout:       60 * time.Second,
+	}
+
+	lb.wg.Add(1)
+	go func() {
+		defer lb.wg.Done()
+		if err := lb.adminServer.Serve(listener); err != nil && err != http.ErrServerClosed {
+			lb.logger.WithError(err).Error("Admin API server failed")
+		}
+	}()
+
+	lb.logger.WithField("address", lb.adminConfig.Listen).Info("Admin API started")
+	return nil
+}
+
+// adminMux routes the runtime API, served on the admin address and the
+// control socket alike
+func (lb *LoadBalancer) adminMux() *http.ServeMux {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/status", lb.serveStatus)
+	mux.HandleFunc("/backends", lb.serveBackends)
+	mux.HandleFunc("/backends/drain", lb.serveDrain(true))
+	mux.HandleFunc("/backends/undrain", lb.serveDrain(false))
+	mux.HandleFunc("/backends/disable", lb.serveDisable(true))
+	mux.HandleFunc("/backends/enable", lb.serveDisable(false))
+	mux.HandleFunc("/backends/add", lb.serveAddBackend)
+	mux.HandleFunc("/backends/remove", lb.serveRemoveBackend)
+	mux.HandleFunc("/reload", lb.serveReload)
+	mux.HandleFunc("/counters", lb.serveCounters)
+	mux.HandleFunc("/latency", lb.serveLatency)
+	mux.HandleFunc("/statsd", lb.serveStatsD)
+	mux.HandleFunc("/webhooks", lb.serveWebhooks)
+	mux.HandleFunc("/query-log", lb.serveQueryLog)
+	mux.HandleFunc("/top", lb.serveTopTalkers)
+	mux.HandleFunc("/stream", lb.serveStream)
+	mux.HandleFunc("/trace", lb.serveTrace)
+	mux.HandleFunc("/trace/stop", lb.serveStopTrace)
+	mux.HandleFunc("/dark-launch", lb.serveDarkLaunch)
+	mux.HandleFunc("/cache", lb.serveCache)
+	mux.HandleFunc("/cache/purge", lb.servePurge)
+	mux.HandleFunc("/malformed", lb.serveMalformed)
+	mux.HandleFunc("/acl", lb.serveACL)
+	mux.HandleFunc("/rate-limit", lb.serveRateLimit)
+	mux.HandleFunc("/overload", lb.serveOverload)
+	mux.HandleFunc("/nxdomain-guard", lb.serveNXDomainGuard)
+	mux.HandleFunc("/query-types", lb.serveQueryTypes)
+	mux.HandleFunc("/filter-aaaa", lb.serveAAAAFilter)
+	mux.HandleFunc("/opcodes", lb.serveOpcodes)
+	mux.HandleFunc("/allowlist", lb.serveAllowlist)
+	mux.HandleFunc("/blocklist", lb.serveBlocklist)
+	mux.HandleFunc("/dnssec", lb.serveDNSSEC)
+	mux.HandleFunc("/local-records", lb.serveLocalRecords)
+	mux.HandleFunc("/search-domains", lb.serveSearchDomains)
+	mux.HandleFunc("/zones", lb.serveZones)
+	mux.HandleFunc("/nxdomain-redirects", lb.serveNXRedirects)
+	mux.HandleFunc("/ttl-rules", lb.serveTTLRules)
+	mux.HandleFunc("/health", lb.serveHealth)
+	mux.HandleFunc("/ready", lb.serveHealth)
+	if lb.adminConfig != nil && lb.adminConfig.Dashboard {
+		mux.HandleFunc("/", lb.serveDashboard)
+	}
+	return mux
+}
+
+// stopAdmin gracefully shuts down the runtime API
+func (lb *LoadBalancer) stopAdmin() {
+	if lb.adminServer == nil {
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	if err := lb.adminServer.Shutdown(ctx); err != nil {
+		lb.logger.WithError(err).Error("Error closing admin API")
+	}
+}
+
+// SetDraining puts every backend with the given address into or out of
+// maintenance. Draining backends get no new queries while the ones in
+// flight complete, so an operator can wait for in_flight to reach zero
+// before taking the resolver down.
+func (lb *LoadBalancer) SetDraining(address string, draining bool) ([]*backend.Backend, error) {
+	var matched []*backend.Backend
+	for _, b := range lb.allBackends() {
+		if b.Address == address {
+			b.SetDraining(draining)
+			matched = append(matched, b)
+		}
+	}
+	if len(matched) == 0 {
+		return nil, fmt.Errorf("no backend with address %q", address)
+	}
+
+	logger := lb.logger.WithFields(logrus.Fields{
+		"backend": address,
+		"count":   len(matched),
+	})
+	if draining {
+		logger.Warn("Backend draining, no new queries")
+	} else {
+		logger.Info("Backend drain ended, back in rotation")
+	}
+	return matched, nil
+}
+
+// SetDisabled marks every backend with the given address administratively
+// down or up. Disabled backends get no queries and no health checks and
+// don't count toward the quorum, until they are enabled again.
+func (lb *LoadBalancer) SetDisabled(address string, disabled bool) ([]*backend.Backend, error) {
+	var matched []*backend.Backend
+	for _, b := range lb.allBackends() {
+		if b.Address == address {
+			b.SetDisabled(disabled)
+			matched = append(matched, b)
+		}
+	}
+	if len(matched) == 0 {
+		return nil, fmt.Errorf("no backend with address %q", address)
+	}
+
+	logger := lb.logger.WithFields(logrus.Fields{
+		"backend": address,
+		"count":   len(matched),
+	})
+	if disabled {
+		logger.Warn("Backend disabled, administratively down")
+	} else {
+		logger.Info("Backend enabled, back in rotation")
+	}
+	lb.checkQuorum()
+	return matched, nil
+}
+
+// serveBackends lists every backend with its statistics
+func (lb *LoadBalancer) serveBackends(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	writeBackendStats(w, lb.allBackends())
+}
+
+// serveCounters reports the queries received by type and the responses
+// sent by response code
+func (lb *LoadBalancer) serveCounters(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(lb.CounterStats()); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+	}
+}
+
+// serveLatency reports the latency percentiles, overall and per backend
+func (lb *LoadBalancer) serveLatency(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(lb.LatencyStats()); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+	}
+}
+
+// serveStatus reports the state of the instance at a glance
+func (lb *LoadBalancer) serveStatus(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(lb.Status()); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+	}
+}
+
+// serveStatsD reports where metrics are pushed and the datagrams sent
+func (lb *LoadBalancer) serveStatsD(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	stats := lb.StatsDStats()
+	if stats == nil {
+		http.Error(w, "statsd is not enabled", http.StatusNotFound)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(stats); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+	}
+}
+
+// serveTrace lists the query traces running on GET, and on POST starts
+// one for the client and domain parameters, for duration if given
+func (lb *LoadBalancer) serveTrace(w http.ResponseWriter, r *http.Request) {
+	var result interface{}
+	switch r.Method {
+	case http.MethodGet:
+		result = lb.TraceStats()
+	case http.MethodPost:
+		params := r.URL.Query()
+		var duration time.Duration
+		if param := params.Get("duration"); param != "" {
+			var err error
+			if duration, err = time.ParseDuration(param); err != nil {
+				http.Error(w, "invalid duration", http.StatusBadRequest)
+				return
+			}
+		}
+		id, err := lb.StartTrace(params.Get("client"), params.Get("domain"), duration)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		result = map[string]int{"id": id}
+	default:
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(result); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+	}
+}
+
+// serveStopTrace stops the query trace named by the id parameter, or every
+// trace with all=true
+func (lb *LoadBalancer) serveStopTrace(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	params := r.URL.Query()
+	id := 0
+	switch {
+	case params.Get("id") != "":
+		var err error
+		if id, err = strconv.Atoi(params.Get("id")); err != nil || id <= 0 {
+			http.Error(w, "id must be a positive number", http.StatusBadRequest)
+			return
+		}
+	case params.Get("all") != "true":
+		http.Error(w, "missing id or all=true parameter", http.StatusBadRequest)
+		return
+	}
+
+	stopped := lb.StopTrace(id)
+	if id != 0 && stopped == 0 {
+		http.Error(w, "no such trace", http.StatusNotFound)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(map[string]int{"stopped": stopped}); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+	}
+}
+
+// serveWebhooks reports the webhook targets and the events delivered
+func (lb *LoadBalancer) serveWebhooks(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	stats := lb.WebhookStats()
+	if stats == nil {
+		http.Error(w, "webhooks are not enabled", http.StatusNotFound)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(stats); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+	}
+}
+
+// serveQueryLog reports where the query log goes and the records written
+func (lb *LoadBalancer) serveQueryLog(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	stats := lb.QueryLogStats()
+	if stats == nil {
+		http.Error(w, "the query log is not enabled", http.StatusNotFound)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(stats); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+	}
+}
+
+// serveTopTalkers reports the busiest clients and most queried names, as
+// many of each as the n parameter asks for
+func (lb *LoadBalancer) serveTopTalkers(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	n := 0
+	if param := r.URL.Query().Get("n"); param != "" {
+		var err error
+		if n, err = strconv.Atoi(param); err != nil || n <= 0 {
+			http.Error(w, "n must be a positive number", http.StatusBadRequest)
+			return
+		}
+	}
+
+	stats := lb.TopTalkerStats(n)
+	if stats == nil {
+		http.Error(w, "top talkers are not enabled", http.StatusNotFound)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(stats); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+	}
+}
+
+// serveDrain returns the handler draining or undraining the backend named
+// by the address parameter
+func (lb *LoadBalancer) serveDrain(draining bool) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+
+		address := r.URL.Query().Get("address")
+		if address == "" {
+			http.Error(w, "missing address parameter", http.StatusBadRequest)
+			return
+		}
+
+		matched, err := lb.SetDraining(address, draining)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusNotFound)
+			return
+		}
+		writeBackendStats(w, matched)
+	}
+}
+
+// serveDisable returns the handler disabling or enabling the backend
+// named by the address parameter
+func (lb *LoadBalancer) serveDisable(disabled bool) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+
+		address := r.URL.Query().Get("address")
+		if address == "" {
+			http.Error(w, "missing address parameter", http.StatusBadRequest)
+			return
+		}
+
+		matched, err := lb.SetDisabled(address, disabled)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusNotFound)
+			return
+		}
+		writeBackendStats(w, matched)
+	}
+}
+
+// serveAddBackend adds the backend described by the request body, in
+// the configuration's format as YAML or JSON, or named by the address
+// parameter with default options
+func (lb *LoadBalancer) serveAddBackend(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	body, err := io.ReadAll(io.LimitReader(r.Body, 64<<10))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	var bcfg config.BackendConfig
+	if len(bytes.TrimSpace(body)) > 0 {
+		decoder := yaml.NewDecoder(bytes.NewReader(body))
+		decoder.KnownFields(true)
+		if err := decoder.Decode(&bcfg); err != nil {
+			http.Error(w, fmt.Sprintf("invalid backend: %v", err), http.StatusBadRequest)
+			return
+		}
+	} else {
+		bcfg.Address = r.URL.Query().Get("address")
+	}
+	if bcfg.Address == "" {
+		http.Error(w, "missing address parameter", http.StatusBadRequest)
+		return
+	}
+
+	b, err := lb.AddBackend(bcfg)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	writeBackendStats(w, []*backend.Backend{b})
+}
+
+// serveRemoveBackend removes the backend named by the address parameter
+func (lb *LoadBalancer) serveRemoveBackend(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	address := r.URL.Query().Get("address")
+	if address == "" {
+		http.Error(w, "missing address parameter", http.StatusBadRequest)
+		return
+	}
+
+	removed, err := lb.RemoveBackend(address)
+	if err == errLastBackend || errors.Is(err, errQuorumBackends) {
+		http.Error(w, err.Error(), http.StatusConflict)
+		return
+	} else if err != nil {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+	writeBackendStats(w, removed)
+}
+
+// serveReload reads the configuration again and applies it, answering
+// with what changed. With dry_run=true it only answers with what would
+// change.
+func (lb *LoadBalancer) serveReload(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	reload := lb.ReloadConfig
+	if r.URL.Query().Get("dry_run") == "true" {
+		reload = lb.CheckReloadConfig
+	}
+	summary, err := reload()
+	if err == errNoConfigLoader {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	} else if err != nil {
+		http.Error(w, "configuration rejected: "+err.Error(), http.StatusUnprocessableEntity)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(summary); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+	}
+}
+
+// serveDarkLaunch reports how the dark launch candidate's answers compare
+func (lb *LoadBalancer) serveDarkLaunch(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	stats := lb.DarkLaunchStats()
+	if stats == nil {
+		http.Error(w, "dark launch is not enabled", http.StatusNotFound)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(stats); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+	}
+}
+
+// serveCache reports the response cache's size, hit ratio and evictions
+func (lb *LoadBalancer) serveCache(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	stats := lb.CacheStats()
+	if stats == nil {
+		http.Error(w, "cache is not enabled", http.StatusNotFound)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(stats); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+	}
+}
+
+// servePurge drops cached responses for the name parameter, for the
+// suffix parameter and its subdomains, or with all=true for every name
+func (lb *LoadBalancer) servePurge(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	params := r.URL.Query()
+	var name string
+	var subdomains bool
+	switch {
+	case params.Get("name") != "":
+		name = params.Get("name")
+	case params.Get("suffix") != "":
+		name, subdomains = params.Get("suffix"), true
+	case params.Get("all") == "true":
+		name, subdomains = ".", true
+	default:
+		http.Error(w, "missing name, suffix or all=true parameter", http.StatusBadRequest)
+		return
+	}
+
+	purged, err := lb.PurgeCache(name, subdomains)
+	if err == errSharedPurge {
+		http.Error(w, err.Error(), http.StatusConflict)
+		return
+	} else if err != nil {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(map[string]int{"purged": purged}); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+	}
+}
+
+// serveMalformed reports the queries answered FORMERR and the junk
+// messages dropped
+func (lb *LoadBalancer) serveMalformed(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(lb.MalformedStats()); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+	}
+}
+
+// serveACL reports how many queries the client ACL denied
+func (lb *LoadBalancer) serveACL(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	stats := lb.ACLStats()
+	if stats == nil {
+		http.Error(w, "acl is not enabled", http.StatusNotFound)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(stats); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+	}
+}
+
+// serveRateLimit reports the rate limit and how many queries exceeded it
+func (lb *LoadBalancer) serveRateLimit(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	stats := lb.RateLimitStats()
+	if stats == nil {
+		http.Error(w, "rate limiting is not enabled", http.StatusNotFound)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(stats); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+	}
+}
+
+// serveOverload reports the process-wide ceilings and the queries shed
+func (lb *LoadBalancer) serveOverload(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	stats := lb.OverloadStats()
+	if stats == nil {
+		http.Error(w, "overload limits are not enabled", http.StatusNotFound)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(stats); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+	}
+}
+
+// serveNXDomainGuard reports the zones limited and clients blocked for
+// NXDOMAIN floods
+func (lb *LoadBalancer) serveNXDomainGuard(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	stats := lb.NXDomainGuardStats()
+	if stats == nil {
+		http.Error(w, "nxdomain guard is not enabled", http.StatusNotFound)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(stats); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+	}
+}
+
+// serveLocalRecords reports the local names and the queries they answered
+func (lb *LoadBalancer) serveLocalRecords(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	stats := lb.LocalRecordStats()
+	if stats == nil {
+		http.Error(w, "no local records are configured", http.StatusNotFound)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(stats); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+	}
+}
+
+// serveSearchDomains reports the search domains and the single-label
+// queries answered with them
+func (lb *LoadBalancer) serveSearchDomains(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	stats := lb.SearchDomainStats()
+	if stats == nil {
+		http.Error(w, "no search domains are configured", http.StatusNotFound)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(stats); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+	}
+}
+
+// serveZones lists the local zones and the queries each answered
+func (lb *LoadBalancer) serveZones(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	stats := lb.ZoneStats()
+	if stats == nil {
+		http.Error(w, "no local zones are loaded", http.StatusNotFound)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(stats); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+	}
+}
+
+// serveNXRedirects reports the redirect domains and the answers rewritten
+func (lb *LoadBalancer) serveNXRedirects(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	stats := lb.NXRedirectStats()
+	if stats == nil {
+		http.Error(w, "no nxdomain redirects are configured", http.StatusNotFound)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(stats); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+	}
+}
+
+// serveTTLRules reports the per-domain TTL bounds and the answers
+// rewritten
+func (lb *LoadBalancer) serveTTLRules(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	stats := lb.TTLRuleStats()
+	if stats == nil {
+		http.Error(w, "no TTL rules are configured", http.StatusNotFound)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(stats); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+	}
+}
+
+// serveQueryTypes reports how many queries were answered locally for
+// their type
+func (lb *LoadBalancer) serveQueryTypes(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	stats := lb.QueryTypeStats()
+	if stats == nil {
+		http.Error(w, "query type filtering is not enabled", http.StatusNotFound)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(stats); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+	}
+}
+
+// serveAAAAFilter reports the networks whose AAAA answers are filtered
+// and how many were
+func (lb *LoadBalancer) serveAAAAFilter(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	stats := lb.AAAAFilterStats()
+	if stats == nil {
+		http.Error(w, "AAAA filtering is not enabled", http.StatusNotFound)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(stats); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+	}
+}
+
+// serveOpcodes reports the zone transfers refused and the queries with
+// other opcodes answered NOTIMP
+func (lb *LoadBalancer) serveOpcodes(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(lb.OpcodeStats()); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+	}
+}
+
+// serveAllowlist reports the allowed domains and the queries for others
+func (lb *LoadBalancer) serveAllowlist(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	stats := lb.AllowlistStats()
+	if stats == nil {
+		http.Error(w, "allowlist is not enabled", http.StatusNotFound)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(stats); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+	}
+}
+
+// serveBlocklist reports the blocked domains and queries and the state of
+// each list
+func (lb *LoadBalancer) serveBlocklist(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	stats := lb.BlocklistStats()
+	if stats == nil {
+		http.Error(w, "blocklist is not enabled", http.StatusNotFound)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(stats); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+	}
+}
+
+// serveDNSSEC reports the validation counters and cached zone cuts
+func (lb *LoadBalancer) serveDNSSEC(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	stats := lb.DNSSECStats()
+	if stats == nil {
+		http.Error(w, "dnssec validation is not enabled", http.StatusNotFound)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(stats); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+	}
+}
+
+// serveHealth answers liveness and readiness probes, failing them while
+// fewer backends are healthy than the quorum so an orchestrator takes the
+// instance out of rotation. Readiness also fails until the instance serves.
+func (lb *LoadBalancer) serveHealth(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	status := map[string]interface{}{"status": "ok"}
+	code := http.StatusOK
+	if r.URL.Path == "/ready" && !lb.isReady() {
+		status["status"] = "starting"
+		code = http.StatusServiceUnavailable
+	} else if stats := lb.QuorumStats(); stats != nil {
+		for k, v := range stats {
+			status[k] = v
+		}
+		if stats["quorum"] == false {
+			status["status"] = "below quorum"
+			code = http.StatusServiceUnavailable
+		}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	json.NewEncoder(w).Encode(status)
+}
+
+// writeBackendStats writes the statistics of backends as a JSON array
+func writeBackendStats(w http.ResponseWriter, backends []*backend.Backend) {
+	stats := make([]map[string]interface{}, 0, len(backends))
+	for _, b := range backends {
+		stats = append(stats, b.Stats())
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(stats); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+	}
+}
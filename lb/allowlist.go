@@ -0,0 +1,92 @@
+package lb
+
+import (
+	"fmt"
+	"sync/atomic"
+
+	"github.com/aram535/dnsbalancer/config"
+	"github.com/miekg/dns"
+	"github.com/sirupsen/logrus"
+)
+
+// allowlist restricts resolution to a set of domains and their
+// subdomains; every other name is answered locally as nonexistent
+type allowlist struct {
+	domains map[string]bool // Allowed domains as routeTable keys
+	refuse  bool            // Answer REFUSED instead of NXDOMAIN
+	denied  uint64          // Queries for names not on the list
+}
+
+// newAllowlist creates the allowlist, or returns nil when none is enabled
+func newAllowlist(cfg *config.AllowlistConfig) (*allowlist, error) {
+	if cfg == nil || !cfg.Enabled {
+		return nil, nil
+	}
+
+	a := &allowlist{
+		domains: make(map[string]bool, len(cfg.Domains)),
+		refuse:  cfg.Response == "refused",
+	}
+	for _, domain := range cfg.Domains {
+		key, err := routeKey(domain)
+		if err != nil {
+			return nil, fmt.Errorf("allowlist domain %q: %w", domain, err)
+		}
+		a.domains[key] = true
+	}
+	return a, nil
+}
+
+// permits reports whether the query name is an allowed domain or one of
+// their subdomains
+func (a *allowlist) permits(query []byte) bool {
+	name := queryName(query)
+	if name == nil {
+		return false
+	}
+
+	for off := 0; ; off += 1 + int(name[off]) {
+		if a.domains[string(name[off:])] {
+			return true
+		}
+		if off >= len(name) {
+			return false
+		}
+	}
+}
+
+// filterAllowed answers a query for a name off the allowlist, returning
+// false for queries to forward
+func (lb *LoadBalancer) filterAllowed(query []byte, logger *logrus.Entry) ([]byte, bool) {
+	a := lb.allowlist
+	if a == nil || a.permits(query) {
+		return nil, false
+	}
+
+	atomic.AddUint64(&a.denied, 1)
+	logger.Debug("Query for domain not on the allowlist")
+
+	if a.refuse {
+		return rcodeResponse(query, dns.RcodeRefused), true
+	}
+	return rcodeResponse(query, dns.RcodeNameError), true
+}
+
+// AllowlistStats returns the number of allowed domains and of queries
+// for other names, or nil if no allowlist is enabled
+func (lb *LoadBalancer) AllowlistStats() map[string]interface{} {
+	a := lb.allowlist
+	if a == nil {
+		return nil
+	}
+
+	response := "nxdomain"
+	if a.refuse {
+		response = "refused"
+	}
+	return map[string]interface{}{
+		"domains":  len(a.domains),
+		"denied":   atomic.LoadUint64(&a.denied),
+		"response": response,
+	}
+}
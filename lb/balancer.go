@@ -0,0 +1,294 @@
+package lb
+
+import (
+	"context"
+	"math/rand"
+	"net"
+	"sync"
+	"sync/atomic"
+
+	"github.com/aram535/dnsbalancer/backend"
+)
+
+// Balancer chooses the backend for each query. Every priority pool has its
+// own Balancer over the pool's backends, so a Balancer never has to deal
+// with failover between pools.
+type Balancer interface {
+	// Pick returns an available backend for the query, or nil if none of
+	// the backends is available (see backend.Backend.Available)
+	Pick(ctx context.Context, query []byte, client net.Addr) *backend.Backend
+}
+
+// BalancerFactory creates a Balancer over one pool of backends
+type BalancerFactory func(backends []*backend.Backend) Balancer
+
+// SetBalancer replaces the selection logic of every pool, including those
+// of domain and client routes, with balancers built by factory. It must be called
+// before Start.
+func (lb *LoadBalancer) SetBalancer(factory BalancerFactory) {
+	lb.factory = factory
+	for _, pool := range lb.allPools() {
+		pool.balancer = factory(pool.backends)
+	}
+}
+
+// roundRobinBalancer takes turns across healthy backends
+type roundRobinBalancer struct {
+	backends     []*backend.Backend
+	currentIndex uint32
+}
+
+// NewRoundRobin returns a Balancer that takes turns across healthy backends
+func NewRoundRobin(backends []*backend.Backend) Balancer {
+	return &roundRobinBalancer{backends: backends}
+}
+
+// Pick chooses the next healthy backend in turn. A backend in slow start
+// only takes its turn with a probability matching its warmth.
+func (r *roundRobinBalancer) Pick(ctx context.Context, query []byte, client net.Addr) *backend.Backend {
+	maxAttempts := len(r.backends)
+	var warming *backend.Backend
+
+	for i := 0; i < maxAttempts; i++ {
+		idx := atomic.AddUint32(&r.currentIndex, 1) % uint32(len(r.backends))
+		backend := r.backends[idx]
+
+		if backend.Available() {
+			if admit(backend) {
+				return backend
+			}
+			warming = backend
+		}
+	}
+
+	// Only warming backends are healthy, or all backends unhealthy
+	return warming
+}
+
+// weightedBalancer spreads queries in proportion to backend weights
+type weightedBalancer struct {
+	backends []*backend.Backend
+	current  []float64
+	mu       sync.Mutex
+}
+
+// NewWeighted returns a Balancer that spreads queries across healthy
+// backends in proportion to their Weight
+func NewWeighted(backends []*backend.Backend) Balancer {
+	return &weightedBalancer{
+		backends: backends,
+		current:  make([]float64, len(backends)),
+	}
+}
+
+// Pick uses smooth weighted round-robin, which interleaves backends
+// instead of sending each one its whole share in a burst. Backends in slow
+// start have their weight scaled by their warmth.
+func (w *weightedBalancer) Pick(ctx context.Context, query []byte, client net.Addr) *backend.Backend {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	best, total := -1, 0.0
+	for i, b := range w.backends {
+		if !b.Available() {
+			continue
+		}
+		weight := float64(b.Weight)
+		if weight == 0 {
+			weight = 1
+		}
+		weight *= b.Warmth()
+		w.current[i] += weight
+		total += weight
+		if best < 0 || w.current[i] > w.current[best] {
+			best = i
+		}
+	}
+	if best < 0 {
+		return nil
+	}
+
+	w.current[best] -= total
+	return w.backends[best]
+}
+
+// leastRequestsBalancer prefers the backend with the fewest queries in
+// flight
+type leastRequestsBalancer struct {
+	backends     []*backend.Backend
+	currentIndex uint32
+}
+
+// NewLeastRequests returns a Balancer that sends each query to the healthy
+// backend with the fewest queries waiting for an answer
+func NewLeastRequests(backends []*backend.Backend) Balancer {
+	return &leastRequestsBalancer{backends: backends}
+}
+
+// Pick chooses the healthy backend with the fewest queries in flight. The
+// scan starts at a rotating offset so ties are shared out in turn. A
+// backend in slow start is only considered with a probability matching its
+// warmth.
+func (l *leastRequestsBalancer) Pick(ctx context.Context, query []byte, client net.Addr) *backend.Backend {
+	start := atomic.AddUint32(&l.currentIndex, 1)
+
+	var best, warming *backend.Backend
+	var bestInFlight int64
+	for i := range l.backends {
+		b := l.backends[(start+uint32(i))%uint32(len(l.backends))]
+		if !b.Available() {
+			continue
+		}
+		if !admit(b) {
+			warming = b
+			continue
+		}
+		if inFlight := b.InFlight(); best == nil || inFlight < bestInFlight {
+			best, bestInFlight = b, inFlight
+		}
+	}
+
+	if best == nil {
+		return warming
+	}
+	return best
+}
+
+// lowestLatencyBalancer prefers the backend with the lowest smoothed
+// response time
+type lowestLatencyBalancer struct {
+	backends []*backend.Backend
+}
+
+// NewLowestLatency returns a Balancer that prefers the healthy backend
+// with the lowest smoothed response time
+func NewLowestLatency(backends []*backend.Backend) Balancer {
+	return &lowestLatencyBalancer{backends: backends}
+}
+
+// Pick chooses the healthy backend with the lowest smoothed response time.
+// Backends that have not answered yet are tried first so they get
+// measured.
+func (l *lowestLatencyBalancer) Pick(ctx context.Context, query []byte, client net.Addr) *backend.Backend {
+	healthy := make([]*backend.Backend, 0, len(l.backends))
+	for _, b := range l.backends {
+		if b.Available() {
+			healthy = append(healthy, b)
+		}
+	}
+	if len(healthy) == 0 {
+		return nil
+	}
+
+	if len(healthy) > 1 && rand.Float64() < latencyProbeRate {
+		return healthy[rand.Intn(len(healthy))]
+	}
+
+	var best *backend.Backend
+	var bestLatency int64 = -1
+	for _, b := range healthy {
+		latency := int64(b.Latency())
+		if latency == 0 {
+			return b
+		}
+		if bestLatency < 0 || latency < bestLatency {
+			best, bestLatency = b, latency
+		}
+	}
+
+	return best
+}
+
+// hashClientBalancer hashes the client IP onto a consistent hash ring
+type hashClientBalancer struct {
+	ring     *hashRing
+	fallback Balancer
+}
+
+// NewHashClient returns a Balancer that sticks each client IP to one
+// backend while it is healthy
+func NewHashClient(backends []*backend.Backend) Balancer {
+	return &hashClientBalancer{
+		ring:     newHashRing(backends),
+		fallback: NewRoundRobin(backends),
+	}
+}
+
+// Pick hashes the client IP onto the backend ring. Clients without an IP
+// address (unix sockets) fall back to round-robin.
+func (h *hashClientBalancer) Pick(ctx context.Context, query []byte, client net.Addr) *backend.Backend {
+	ip := addrIP(client)
+	if ip == nil {
+		return h.fallback.Pick(ctx, query, client)
+	}
+
+	if ip4 := ip.To4(); ip4 != nil {
+		ip = ip4
+	}
+	return h.ring.pick(ip)
+}
+
+// hashQNameBalancer hashes the query name onto a consistent hash ring
+type hashQNameBalancer struct {
+	ring     *hashRing
+	fallback Balancer
+}
+
+// NewHashQName returns a Balancer that always sends a name to the same
+// backend while it is healthy, so each backend caches its own slice of the
+// namespace
+func NewHashQName(backends []*backend.Backend) Balancer {
+	return &hashQNameBalancer{
+		ring:     newHashRing(backends),
+		fallback: NewRoundRobin(backends),
+	}
+}
+
+// Pick hashes the query name onto the backend ring. Queries without a
+// readable question fall back to round-robin.
+func (h *hashQNameBalancer) Pick(ctx context.Context, query []byte, client net.Addr) *backend.Backend {
+	name := queryName(query)
+	if name == nil {
+		return h.fallback.Pick(ctx, query, client)
+	}
+	return h.ring.pick(name)
+}
+
+// randomBalancer picks a healthy backend at random
+type randomBalancer struct {
+	backends []*backend.Backend
+}
+
+// NewRandom returns a Balancer that picks a healthy backend uniformly at
+// random for each query
+func NewRandom(backends []*backend.Backend) Balancer {
+	return &randomBalancer{backends: backends}
+}
+
+// Pick chooses a random healthy backend, backends in slow start being
+// less likely to be chosen in proportion to their warmth
+func (r *randomBalancer) Pick(ctx context.Context, query []byte, client net.Addr) *backend.Backend {
+	healthy := make([]*backend.Backend, 0, len(r.backends))
+	warmth := make([]float64, 0, len(r.backends))
+	total := 0.0
+	for _, b := range r.backends {
+		if b.Available() {
+			w := b.Warmth()
+			healthy = append(healthy, b)
+			warmth = append(warmth, w)
+			total += w
+		}
+	}
+	if len(healthy) == 0 {
+		return nil
+	}
+
+	n := rand.Float64() * total
+	for i, w := range warmth {
+		if n < w {
+			return healthy[i]
+		}
+		n -= w
+	}
+	return healthy[len(healthy)-1]
+}
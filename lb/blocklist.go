@@ -0,0 +1,350 @@
+package lb
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/aram535/dnsbalancer/config"
+	"github.com/miekg/dns"
+	"github.com/sirupsen/logrus"
+)
+
+// Blocklist defaults
+const (
+	defaultBlocklistRefresh = 24 * time.Hour
+	defaultBlocklistTTL     = 60 * time.Second
+	blocklistFetchTimeout   = 30 * time.Second
+)
+
+// Blocklist responses
+const (
+	blockNXDomain = "nxdomain"
+	blockNull     = "null"
+	blockRefused  = "refused"
+)
+
+// blocklist answers queries for blocked domains itself. Lists are hosts
+// files, plain domain lists or adblock filter lists, read from files or
+// fetched over HTTP, and reloaded every refresh interval.
+type blocklist struct {
+	sources  []string
+	refresh  time.Duration
+	response string
+	ttl      uint32
+	client   *http.Client
+	logger   *logrus.Logger
+
+	domains atomic.Pointer[blockedDomains]
+	blocked uint64 // Queries answered for blocked domains
+
+	mu      sync.Mutex
+	lists   map[string]*blockedDomains // Last good contents of each source
+	loaded  time.Time                  // When the lists were last loaded
+	failing map[string]string          // Sources that failed to load, with the error
+}
+
+// blockedDomains is a set of blocked names as routeTable keys: exact names,
+// and domains blocked along with their subdomains
+type blockedDomains struct {
+	exact   map[string]bool
+	domains map[string]bool
+}
+
+// newBlocklist creates the blocklist, or returns nil when none is enabled.
+// Its lists are loaded by start.
+func newBlocklist(cfg *config.BlocklistConfig, logger *logrus.Logger) *blocklist {
+	if cfg == nil || !cfg.Enabled {
+		return nil
+	}
+
+	b := &blocklist{
+		sources:  cfg.Lists,
+		refresh:  cfg.Refresh,
+		response: cfg.Response,
+		ttl:      uint32(cfg.TTL / time.Second),
+		client:   &http.Client{Timeout: blocklistFetchTimeout},
+		logger:   logger,
+		lists:    make(map[string]*blockedDomains),
+		failing:  make(map[string]string),
+	}
+	if b.refresh == 0 {
+		b.refresh = defaultBlocklistRefresh
+	}
+	if b.response == "" {
+		b.response = blockNXDomain
+	}
+	if cfg.TTL == 0 {
+		b.ttl = uint32(defaultBlocklistTTL / time.Second)
+	}
+	b.domains.Store(&blockedDomains{})
+	return b
+}
+
+// start loads the lists, then reloads them every refresh interval until
+// ctx is done
+func (b *blocklist) start(ctx context.Context, wg *sync.WaitGroup) {
+	if b == nil {
+		return
+	}
+
+	b.load(ctx)
+
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		ticker := time.NewTicker(b.refresh)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+				b.load(ctx)
+			}
+		}
+	}()
+}
+
+// load reads every list and swaps in their union. A list that can't be
+// read keeps its last good contents, so a list server being down doesn't
+// unblock everything it listed.
+func (b *blocklist) load(ctx context.Context) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	for _, source := range b.sources {
+		logger := b.logger.WithField("list", source)
+		list, err := b.read(ctx, source)
+		if err != nil {
+			b.failing[source] = err.Error()
+			logger.WithError(err).Warn("Failed to load blocklist")
+			continue
+		}
+		delete(b.failing, source)
+		b.lists[source] = list
+		logger.WithField("domains", len(list.exact)+len(list.domains)).Debug("Loaded blocklist")
+	}
+
+	merged := &blockedDomains{exact: make(map[string]bool), domains: make(map[string]bool)}
+	for _, list := range b.lists {
+		for key := range list.exact {
+			merged.exact[key] = true
+		}
+		for key := range list.domains {
+			merged.domains[key] = true
+		}
+	}
+	b.domains.Store(merged)
+	b.loaded = time.Now()
+
+	b.logger.WithFields(logrus.Fields{
+		"lists":   len(b.lists),
+		"failing": len(b.failing),
+		"domains": len(merged.exact) + len(merged.domains),
+	}).Info("Blocklist loaded")
+}
+
+// read fetches and parses one list from a file or an http(s) URL
+func (b *blocklist) read(ctx context.Context, source string) (*blockedDomains, error) {
+	if !strings.HasPrefix(source, "http://") && !strings.HasPrefix(source, "https://") {
+		file, err := os.Open(source)
+		if err != nil {
+			return nil, err
+		}
+		defer file.Close()
+		return parseBlocklist(file)
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, source, nil)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := b.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("unexpected status %s", resp.Status)
+	}
+	return parseBlocklist(resp.Body)
+}
+
+// parseBlocklist reads a list in any of the usual formats, line by line:
+//
+//	0.0.0.0 ads.example.com tracker.example.com   hosts file, exact names
+//	ads.example.com                                domain list, exact name
+//	||ads.example.com^                             adblock, with subdomains
+//
+// Comments (# and !), exceptions (@@), rules with wildcards or options
+// and localhost entries are skipped.
+func parseBlocklist(r io.Reader) (*blockedDomains, error) {
+	list := &blockedDomains{exact: make(map[string]bool), domains: make(map[string]bool)}
+	add := func(set map[string]bool, name string) {
+		if name == "" || strings.ContainsAny(name, "*/$") || isLocalhostName(name) {
+			return
+		}
+		if _, ok := dns.IsDomainName(name); !ok {
+			return
+		}
+		if key, err := routeKey(name); err == nil {
+			set[key] = true
+		}
+	}
+
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		line := scanner.Text()
+		if i := strings.IndexByte(line, '#'); i >= 0 {
+			line = line[:i]
+		}
+		line = strings.TrimSpace(line)
+		if line == "" || line[0] == '!' || line[0] == '[' || strings.HasPrefix(line, "@@") {
+			continue
+		}
+
+		if strings.HasPrefix(line, "||") {
+			name, ok := strings.CutSuffix(line[2:], "^")
+			if ok {
+				add(list.domains, name)
+			}
+			continue
+		}
+
+		fields := strings.Fields(line)
+		if net.ParseIP(fields[0]) != nil {
+			for _, name := range fields[1:] {
+				add(list.exact, name)
+			}
+			continue
+		}
+		if len(fields) == 1 {
+			add(list.exact, fields[0])
+		}
+	}
+	return list, scanner.Err()
+}
+
+// isLocalhostName reports whether a hosts file name is one of the local
+// names hosts lists carry alongside the blocked ones
+func isLocalhostName(name string) bool {
+	switch strings.ToLower(strings.TrimSuffix(name, ".")) {
+	case "localhost", "localhost.localdomain", "local", "broadcasthost", "ip6-localhost", "ip6-loopback", "0.0.0.0":
+		return true
+	}
+	return false
+}
+
+// matches reports whether the query name is blocked
+func (b *blocklist) matches(query []byte) bool {
+	name := queryName(query)
+	if name == nil {
+		return false
+	}
+
+	domains := b.domains.Load()
+	if domains.exact[string(name)] {
+		return true
+	}
+	for off := 0; ; off += 1 + int(name[off]) {
+		if domains.domains[string(name[off:])] {
+			return true
+		}
+		if off >= len(name) {
+			return false
+		}
+	}
+}
+
+// filterBlocked answers a query for a blocked domain, returning false for
+// queries to forward
+func (lb *LoadBalancer) filterBlocked(query []byte, logger *logrus.Entry) ([]byte, bool) {
+	b := lb.blocklist
+	if b == nil || !b.matches(query) {
+		return nil, false
+	}
+
+	atomic.AddUint64(&b.blocked, 1)
+	logger.Debug("Query for blocked domain")
+
+	switch b.response {
+	case blockNull:
+		return b.nullResponse(query), true
+	case blockRefused:
+		return rcodeResponse(query, dns.RcodeRefused), true
+	}
+	return rcodeResponse(query, dns.RcodeNameError), true
+}
+
+// nullResponse answers A and AAAA queries with the unspecified address,
+// 0.0.0.0 or ::, and other types with no records
+func (b *blocklist) nullResponse(query []byte) []byte {
+	msg := new(dns.Msg)
+	if err := msg.Unpack(query); err != nil || len(msg.Question) != 1 {
+		return nil
+	}
+
+	reply := new(dns.Msg)
+	reply.SetReply(msg)
+	q := msg.Question[0]
+	hdr := dns.RR_Header{Name: q.Name, Rrtype: q.Qtype, Class: q.Qclass, Ttl: b.ttl}
+	switch q.Qtype {
+	case dns.TypeA:
+		reply.Answer = []dns.RR{&dns.A{Hdr: hdr, A: net.IPv4zero}}
+	case dns.TypeAAAA:
+		reply.Answer = []dns.RR{&dns.AAAA{Hdr: hdr, AAAA: net.IPv6zero}}
+	}
+	if opt := msg.IsEdns0(); opt != nil {
+		reply.SetEdns0(dns.DefaultMsgSize, opt.Do())
+	}
+
+	response, err := reply.Pack()
+	if err != nil {
+		return nil
+	}
+	return response
+}
+
+// BlocklistStats returns the number of blocked domains and queries and the
+// state of each list, or nil if no blocklist is enabled
+func (lb *LoadBalancer) BlocklistStats() map[string]interface{} {
+	b := lb.blocklist
+	if b == nil {
+		return nil
+	}
+
+	domains := b.domains.Load()
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	lists := make([]map[string]interface{}, 0, len(b.sources))
+	for _, source := range b.sources {
+		entry := map[string]interface{}{"list": source}
+		if list, ok := b.lists[source]; ok {
+			entry["domains"] = len(list.exact) + len(list.domains)
+		}
+		if err, ok := b.failing[source]; ok {
+			entry["error"] = err
+		}
+		lists = append(lists, entry)
+	}
+
+	return map[string]interface{}{
+		"domains":  len(domains.exact) + len(domains.domains),
+		"blocked":  atomic.LoadUint64(&b.blocked),
+		"response": b.response,
+		"lists":    lists,
+		"loaded":   b.loaded,
+		"refresh":  b.refresh.String(),
+	}
+}
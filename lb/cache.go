@@ -0,0 +1,607 @@
+package lb
+
+import (
+	"container/list"
+	"errors"
+	"fmt"
+	"hash/maphash"
+	"net"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/aram535/dnsbalancer/config"
+	"github.com/miekg/dns"
+	"github.com/sirupsen/logrus"
+)
+
+// Response cache defaults
+const (
+	defaultCacheSize   = 10000
+	defaultCacheShards = 16
+)
+
+// Cache eviction policies
+const (
+	cacheLRU = "lru" // Evict the least recently used response
+	cacheLFU = "lfu" // Evict the least used of a random sample
+)
+
+// cacheLFUSample is how many entries LFU eviction compares
+const cacheLFUSample = 8
+
+// cacheEntryOverhead approximates the memory an entry takes besides its
+// response and names: the entry, its list element and map slot
+const cacheEntryOverhead = 200
+
+// cacheKey identifies a cached response: the question, the header and
+// EDNS flags that change an answer, the client subnet sent upstream and
+// the pool the query was routed to, so clients of different split
+// horizon or geo routes never share answers. The pool is named by its
+// backends, so the cache stays valid across reloads rebuilding the pools.
+type cacheKey struct {
+	pool   string
+	name   string
+	qtype  uint16
+	qclass uint16
+	rd     bool
+	cd     bool
+	edns   bool
+	do     bool
+	subnet string
+}
+
+// cacheEntry is a packed response with the time it stops being served
+type cacheEntry struct {
+	key      cacheKey
+	response []byte
+	stored   time.Time
+	expires  time.Time
+	hits     uint64
+	element  *list.Element // Position in recency order
+}
+
+// cost approximates the memory an entry takes
+func (e *cacheEntry) cost() int {
+	return len(e.response) + len(e.key.name) + len(e.key.subnet) + cacheEntryOverhead
+}
+
+// errSharedPurge refuses purges with a shared tier, whose entries are
+// stored under hashed keys that can't be found by name: the server would
+// hand the purged answers back until they expire
+var errSharedPurge = errors.New("cache purge is not supported with a shared cache")
+
+// responseCache keeps backend responses for their TTL, so repeated
+// queries are answered without going upstream. Entries are spread over
+// shards by query name, each with its own lock, so concurrent queries
+// rarely wait on each other.
+type responseCache struct {
+	shards []*cacheShard
+	seed   maphash.Seed
+	policy string
+	minTTL uint32
+	maxTTL uint32           // 0 = no ceiling
+	bypass map[string]bool  // Domains never cached, as routeTable keys
+	rules  *ttlRules        // Per-domain bounds replacing minTTL and maxTTL
+	skips  uint64           // Queries for bypassed domains
+	shared *sharedCache     // Tier shared with other instances, nil if none
+	writes chan *cacheEntry // Answers queued for the shared tier
+	stop   chan struct{}    // Closed to stop the shared tier's writers
+
+	warmUpFile string // Names resolved at startup
+	warmUpTop  int    // Most requested names saved to warmUpFile at shutdown
+
+	sharedHits   uint64
+	sharedErrors uint64
+}
+
+// cacheShard holds a share of the cache: at most size responses and
+// maxBytes of memory, evicting by policy to stay within
+type cacheShard struct {
+	size      int
+	maxBytes  int // 0 = no limit
+	bytes     int
+	policy    string
+	entries   map[cacheKey]*cacheEntry
+	recency   *list.List // Most recently used first
+	hits      uint64
+	misses    uint64
+	expired   uint64 // Misses finding only an expired response
+	evictions uint64
+	mu        sync.Mutex
+}
+
+// newResponseCache creates the response cache, or returns nil when caching
+// is not enabled
+func newResponseCache(cfg *config.CacheConfig, rules *ttlRules) (*responseCache, error) {
+	if cfg == nil || !cfg.Enabled {
+		return nil, nil
+	}
+
+	c := &responseCache{
+		seed:   maphash.MakeSeed(),
+		policy: cfg.Eviction,
+		minTTL: uint32(cfg.MinTTL / time.Second),
+		maxTTL: uint32(cfg.MaxTTL / time.Second),
+		bypass: make(map[string]bool, len(cfg.Bypass)),
+		rules:  rules,
+		shared: newSharedCache(cfg.Shared),
+
+		warmUpFile: cfg.WarmUp,
+		warmUpTop:  cfg.WarmUpTop,
+	}
+	if c.policy == "" {
+		c.policy = cacheLRU
+	}
+	if c.shared != nil {
+		c.writes = make(chan *cacheEntry, sharedCacheQueue)
+		c.stop = make(chan struct{})
+		for i := 0; i < sharedCacheWriters; i++ {
+			go c.writeShared()
+		}
+	}
+	for _, domain := range cfg.Bypass {
+		key, err := routeKey(domain)
+		if err != nil {
+			return nil, fmt.Errorf("cache bypass %q: %w", domain, err)
+		}
+		c.bypass[key] = true
+	}
+
+	size := cfg.Size
+	if size == 0 {
+		size = defaultCacheSize
+	}
+	maxBytes := cfg.MaxMemoryMB << 20
+	shards := cfg.Shards
+	if shards == 0 {
+		shards = defaultCacheShards
+	}
+	if shards > size {
+		shards = size
+	}
+
+	// Split the limits evenly, the first shards taking the remainders
+	for i := 0; i < shards; i++ {
+		shard := &cacheShard{
+			size:     size / shards,
+			maxBytes: maxBytes / shards,
+			policy:   c.policy,
+			entries:  make(map[cacheKey]*cacheEntry),
+			recency:  list.New(),
+		}
+		if i < size%shards {
+			shard.size++
+		}
+		if i < maxBytes%shards {
+			shard.maxBytes++
+		}
+		c.shards = append(c.shards, shard)
+	}
+	return c, nil
+}
+
+// cached looks a query up in the cache. It returns the query's cache key,
+// nil if the query can't be cached, and the cached response with TTLs
+// counted down to now, or nil on a miss.
+func (lb *LoadBalancer) cached(query []byte, clientAddr net.Addr, pools []*backendPool) (*cacheKey, []byte) {
+	if lb.cache == nil || len(pools) == 0 || len(pools[0].backends) == 0 {
+		return nil, nil
+	}
+	if lb.cache.bypassed(query) {
+		atomic.AddUint64(&lb.cache.skips, 1)
+		return nil, nil
+	}
+
+	msg := new(dns.Msg)
+	if err := msg.Unpack(query); err != nil || msg.Response || msg.Opcode != dns.OpcodeQuery || len(msg.Question) != 1 {
+		return nil, nil
+	}
+
+	q := msg.Question[0]
+	key := &cacheKey{
+		pool:   pools[0].id,
+		name:   strings.ToLower(q.Name),
+		qtype:  q.Qtype,
+		qclass: q.Qclass,
+		rd:     msg.RecursionDesired,
+		cd:     msg.CheckingDisabled,
+	}
+	opt := msg.IsEdns0()
+	if opt != nil {
+		key.edns = true
+		key.do = opt.Do()
+	}
+
+	// The subnet the pool's backends would be sent
+	switch policy := lb.ecsPolicyFor(pools[0].backends[0]); policy.mode {
+	case ecsForward:
+		if opt != nil {
+			for _, option := range opt.Option {
+				if subnet, ok := option.(*dns.EDNS0_SUBNET); ok {
+					key.subnet = subnet.String()
+				}
+			}
+		}
+	case ecsInject:
+		if subnet := policy.clientSubnet(clientAddr); subnet != nil {
+			key.subnet = subnet.String()
+		}
+	}
+
+	return key, lb.cache.get(*key, msg)
+}
+
+// bypassed reports whether a query is for one of the domains never cached
+// or a subdomain of one
+func (c *responseCache) bypassed(query []byte) bool {
+	if len(c.bypass) == 0 {
+		return false
+	}
+
+	name := queryName(query)
+	if name == nil {
+		return false
+	}
+	for off := 0; ; off += 1 + int(name[off]) {
+		if c.bypass[string(name[off:])] {
+			return true
+		}
+		if off >= len(name) {
+			return false
+		}
+	}
+}
+
+// shard returns the shard holding a key
+func (c *responseCache) shard(key cacheKey) *cacheShard {
+	return c.shards[maphash.String(c.seed, key.name)%uint64(len(c.shards))]
+}
+
+// get returns the cached response to a query, with the query's ID and
+// question and its TTLs reduced by the time spent in the cache, or nil
+func (c *responseCache) get(key cacheKey, query *dns.Msg) []byte {
+	entry := c.shard(key).lookup(key)
+	if entry == nil {
+		entry = c.sharedGet(key)
+	}
+	if entry == nil {
+		return nil
+	}
+
+	msg := new(dns.Msg)
+	if err := msg.Unpack(entry.response); err != nil {
+		return nil
+	}
+	msg.Id = query.Id
+	msg.Question = query.Question
+
+	elapsed := uint32(time.Since(entry.stored) / time.Second)
+	for _, rr := range cacheRecords(msg) {
+		if hdr := rr.Header(); hdr.Ttl > elapsed {
+			hdr.Ttl -= elapsed
+		} else {
+			hdr.Ttl = 0
+		}
+	}
+
+	response, err := msg.Pack()
+	if err != nil {
+		return nil
+	}
+	return response
+}
+
+// set caches a response for the lowest TTL of its records, or for the
+// negative caching TTL of its SOA record (RFC 2308) if it has no answer.
+// Truncated and failed responses and those with a zero TTL are not cached.
+func (c *responseCache) set(key *cacheKey, response []byte) {
+	if c == nil || key == nil {
+		return
+	}
+
+	msg := new(dns.Msg)
+	if err := msg.Unpack(response); err != nil || msg.Truncated {
+		return
+	}
+	if msg.Rcode != dns.RcodeSuccess && msg.Rcode != dns.RcodeNameError {
+		return
+	}
+
+	clamp := c.clamp
+	if c.rules != nil {
+		if name, err := routeKey(key.name); err == nil {
+			if rule := c.rules.match([]byte(name)); rule != nil {
+				clamp = rule.clamp
+			}
+		}
+	}
+
+	records := cacheRecords(msg)
+	var ttl uint32
+	if msg.Rcode == dns.RcodeSuccess && len(msg.Answer) > 0 {
+		ttl = ^uint32(0)
+		for _, rr := range records {
+			ttl = min(ttl, clamp(rr.Header().Ttl))
+		}
+	} else {
+		soa := negativeSOA(msg)
+		if soa == nil {
+			return
+		}
+		ttl = clamp(min(soa.Hdr.Ttl, soa.Minttl))
+		soa.Hdr.Ttl = ttl
+	}
+	if ttl == 0 {
+		return
+	}
+
+	for _, rr := range records {
+		rr.Header().Ttl = clamp(rr.Header().Ttl)
+	}
+	packed, err := msg.Pack()
+	if err != nil {
+		return
+	}
+
+	now := time.Now()
+	entry := &cacheEntry{
+		key:      *key,
+		response: packed,
+		stored:   now,
+		expires:  now.Add(time.Duration(ttl) * time.Second),
+	}
+	c.shard(*key).store(entry, now)
+
+	if c.shared != nil {
+		// A server falling behind loses writes rather than piling up
+		// goroutines
+		select {
+		case c.writes <- entry:
+		default:
+			atomic.AddUint64(&c.sharedErrors, 1)
+		}
+	}
+}
+
+// writeShared writes the queued answers to the shared tier until the
+// cache is closed
+func (c *responseCache) writeShared() {
+	for {
+		select {
+		case <-c.stop:
+			return
+		case entry := <-c.writes:
+			if err := c.shared.set(entry); err != nil {
+				atomic.AddUint64(&c.sharedErrors, 1)
+			}
+		}
+	}
+}
+
+// close stops the shared tier's writers and closes its idle connections
+func (c *responseCache) close() {
+	if c == nil || c.shared == nil {
+		return
+	}
+	close(c.stop)
+	c.shared.close()
+}
+
+// sharedGet looks a key up in the shared tier after a local miss, keeping
+// a hit locally for the rest of its lifetime, or returns nil
+func (c *responseCache) sharedGet(key cacheKey) *cacheEntry {
+	if c.shared == nil {
+		return nil
+	}
+
+	entry, err := c.shared.get(key)
+	if err != nil {
+		atomic.AddUint64(&c.sharedErrors, 1)
+		return nil
+	}
+	if entry == nil {
+		return nil
+	}
+
+	atomic.AddUint64(&c.sharedHits, 1)
+	c.shard(key).store(entry, time.Now())
+	return entry
+}
+
+// lookup returns the live entry for a key, counting the hit, or nil
+func (c *cacheShard) lookup(key cacheKey) *cacheEntry {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	entry, ok := c.entries[key]
+	if !ok {
+		c.misses++
+		return nil
+	}
+	if !time.Now().Before(entry.expires) {
+		c.remove(entry)
+		c.misses++
+		c.expired++
+		return nil
+	}
+	c.hits++
+	entry.hits++
+	c.recency.MoveToFront(entry.element)
+	return entry
+}
+
+// store adds an entry, replacing any for the same key and evicting others
+// to make room
+func (c *cacheShard) store(entry *cacheEntry, now time.Time) {
+	if c.maxBytes > 0 && entry.cost() > c.maxBytes {
+		return
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if old, ok := c.entries[entry.key]; ok {
+		entry.hits = old.hits
+		c.remove(old)
+	}
+	for len(c.entries) > 0 && (len(c.entries) >= c.size || (c.maxBytes > 0 && c.bytes+entry.cost() > c.maxBytes)) {
+		c.evict(now)
+	}
+	entry.element = c.recency.PushFront(entry)
+	c.entries[entry.key] = entry
+	c.bytes += entry.cost()
+}
+
+// evict drops one entry to make room: the least recently used one, or for
+// LFU the least used of a random sample, or an expired one in it. Called
+// with mu held.
+func (c *cacheShard) evict(now time.Time) {
+	victim := c.recency.Back().Value.(*cacheEntry)
+	if c.policy == cacheLFU {
+		looked := 0
+		for _, entry := range c.entries {
+			if !now.Before(entry.expires) {
+				victim = entry
+				break
+			}
+			if looked == 0 || entry.hits < victim.hits {
+				victim = entry
+			}
+			if looked++; looked == cacheLFUSample {
+				break
+			}
+		}
+	}
+
+	if now.Before(victim.expires) {
+		c.evictions++
+	}
+	c.remove(victim)
+}
+
+// remove drops an entry. Called with mu held.
+func (c *cacheShard) remove(entry *cacheEntry) {
+	c.recency.Remove(entry.element)
+	delete(c.entries, entry.key)
+	c.bytes -= entry.cost()
+}
+
+// PurgeCache drops the cached responses for a name, or with subdomains
+// for the name and everything below it; "." with subdomains empties the
+// cache. It returns how many responses were dropped, or an error if
+// caching is not enabled or has a shared tier.
+func (lb *LoadBalancer) PurgeCache(name string, subdomains bool) (int, error) {
+	c := lb.cache
+	if c == nil {
+		return 0, fmt.Errorf("cache is not enabled")
+	}
+	if c.shared != nil {
+		return 0, errSharedPurge
+	}
+
+	name = dns.Fqdn(strings.ToLower(name))
+	purged := 0
+	for _, shard := range c.shards {
+		shard.mu.Lock()
+		for key, entry := range shard.entries {
+			if key.name == name || (subdomains && dns.IsSubDomain(name, key.name)) {
+				shard.remove(entry)
+				purged++
+			}
+		}
+		shard.mu.Unlock()
+	}
+
+	lb.logger.WithFields(logrus.Fields{
+		"name":       name,
+		"subdomains": subdomains,
+		"purged":     purged,
+	}).Info("Purged cached responses")
+	return purged, nil
+}
+
+// CacheStats returns the response cache's size, memory use, hit ratio and
+// eviction count, or nil if caching is not enabled
+func (lb *LoadBalancer) CacheStats() map[string]interface{} {
+	c := lb.cache
+	if c == nil {
+		return nil
+	}
+
+	var entries, bytes, size, maxBytes int
+	var hits, misses, expired, evictions uint64
+	for _, shard := range c.shards {
+		shard.mu.Lock()
+		entries += len(shard.entries)
+		bytes += shard.bytes
+		size += shard.size
+		maxBytes += shard.maxBytes
+		hits += shard.hits
+		misses += shard.misses
+		expired += shard.expired
+		evictions += shard.evictions
+		shard.mu.Unlock()
+	}
+
+	var hitRatio float64
+	if hits+misses > 0 {
+		hitRatio = float64(hits) / float64(hits+misses)
+	}
+
+	stats := map[string]interface{}{
+		"entries":     entries,
+		"bytes":       bytes,
+		"max_entries": size,
+		"max_bytes":   maxBytes,
+		"shards":      len(c.shards),
+		"hits":        hits,
+		"misses":      misses,
+		"hit_ratio":   hitRatio,
+		"expired":     expired,
+		"bypassed":    atomic.LoadUint64(&c.skips),
+		"eviction":    c.policy,
+		"evictions":   evictions,
+	}
+	if c.shared != nil {
+		stats["shared_hits"] = atomic.LoadUint64(&c.sharedHits)
+		stats["shared_errors"] = atomic.LoadUint64(&c.sharedErrors)
+	}
+	return stats
+}
+
+// clamp applies the configured TTL floor and ceiling
+func (c *responseCache) clamp(ttl uint32) uint32 {
+	if ttl < c.minTTL {
+		ttl = c.minTTL
+	}
+	if c.maxTTL > 0 && ttl > c.maxTTL {
+		ttl = c.maxTTL
+	}
+	return ttl
+}
+
+// cacheRecords returns the records of a response whose TTLs count down in
+// the cache, i.e. all but the OPT pseudo-record
+func cacheRecords(msg *dns.Msg) []dns.RR {
+	records := make([]dns.RR, 0, len(msg.Answer)+len(msg.Ns)+len(msg.Extra))
+	records = append(records, msg.Answer...)
+	records = append(records, msg.Ns...)
+	for _, rr := range msg.Extra {
+		if rr.Header().Rrtype != dns.TypeOPT {
+			records = append(records, rr)
+		}
+	}
+	return records
+}
+
+// negativeSOA returns the SOA record in the authority section of a
+// negative response, or nil
+func negativeSOA(msg *dns.Msg) *dns.SOA {
+	for _, rr := range msg.Ns {
+		if soa, ok := rr.(*dns.SOA); ok {
+			return soa
+		}
+	}
+	return nil
+}
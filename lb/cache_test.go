@@ -0,0 +1,115 @@
+package lb
+
+import (
+	"fmt"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/aram535/dnsbalancer/config"
+	"github.com/miekg/dns"
+)
+
+// cacheBenchNames is how many names the cache benchmarks spread queries
+// over, all of them fitting in the cache
+const cacheBenchNames = 4096
+
+// benchCache returns a cache of the given shards filled with an answer for
+// every benchmark name, along with the keys and queries to look them up
+func benchCache(b *testing.B, shards int) (*responseCache, []cacheKey, []*dns.Msg) {
+	c, err := newResponseCache(&config.CacheConfig{
+		Enabled: true,
+		Size:    2 * cacheBenchNames,
+		Shards:  shards,
+	}, nil)
+	if err != nil {
+		b.Fatal(err)
+	}
+
+	keys := make([]cacheKey, cacheBenchNames)
+	queries := make([]*dns.Msg, cacheBenchNames)
+	for i := range keys {
+		name := fmt.Sprintf("host%d.example.com.", i)
+		query := new(dns.Msg)
+		query.SetQuestion(name, dns.TypeA)
+		reply := new(dns.Msg)
+		reply.SetReply(query)
+		rr, err := dns.NewRR(name + " 300 IN A 192.0.2.1")
+		if err != nil {
+			b.Fatal(err)
+		}
+		reply.Answer = append(reply.Answer, rr)
+		response, err := reply.Pack()
+		if err != nil {
+			b.Fatal(err)
+		}
+
+		keys[i] = cacheKey{name: name, qtype: dns.TypeA, qclass: dns.ClassINET, rd: true}
+		queries[i] = query
+		c.set(&keys[i], response)
+	}
+	return c, keys, queries
+}
+
+// BenchmarkCacheGet looks cached answers up from every CPU at once, with
+// a single shard the way the cache used to be locked and with the default
+// number of shards
+func BenchmarkCacheGet(b *testing.B) {
+	for _, shards := range []int{1, defaultCacheShards} {
+		b.Run(fmt.Sprintf("shards=%d", shards), func(b *testing.B) {
+			c, keys, queries := benchCache(b, shards)
+			var next uint64
+
+			b.ResetTimer()
+			b.RunParallel(func(pb *testing.PB) {
+				// Each goroutine walks the names from its own place
+				n := atomic.AddUint64(&next, 1) * 997
+				for pb.Next() {
+					n++
+					i := n % cacheBenchNames
+					if c.get(keys[i], queries[i]) == nil {
+						b.Error("cache miss")
+						return
+					}
+				}
+			})
+		})
+	}
+}
+
+// BenchmarkCacheLookupStore hits the shards' locks alone, without the
+// unpacking and packing around them: nine lookups to a store, from every
+// CPU at once
+func BenchmarkCacheLookupStore(b *testing.B) {
+	for _, shards := range []int{1, defaultCacheShards} {
+		b.Run(fmt.Sprintf("shards=%d", shards), func(b *testing.B) {
+			c, keys, _ := benchCache(b, shards)
+			responses := make([][]byte, len(keys))
+			for i, key := range keys {
+				responses[i] = c.shard(key).lookup(key).response
+			}
+			var next uint64
+
+			b.ResetTimer()
+			b.RunParallel(func(pb *testing.PB) {
+				n := atomic.AddUint64(&next, 1) * 997
+				for pb.Next() {
+					n++
+					i := n % cacheBenchNames
+					shard := c.shard(keys[i])
+					if n%10 == 0 {
+						now := time.Now()
+						shard.store(&cacheEntry{
+							key:      keys[i],
+							response: responses[i],
+							stored:   now,
+							expires:  now.Add(5 * time.Minute),
+						}, now)
+					} else {
+						shard.lookup(keys[i])
+					}
+				}
+			})
+		})
+	}
+}
@@ -0,0 +1,75 @@
+package lb
+
+import (
+	"fmt"
+	"net"
+	"strings"
+
+	"github.com/aram535/dnsbalancer/backend"
+	"github.com/aram535/dnsbalancer/config"
+	"github.com/sirupsen/logrus"
+)
+
+// clientRoute sends queries from client networks to their own pools
+type clientRoute struct {
+	networks []*net.IPNet
+	pools    []*backendPool
+}
+
+// newClientRoutes creates the backends of every configured client route
+// and returns the routes along with all their backends
+func newClientRoutes(cfg *config.Config, registry *backendRegistry, factory BalancerFactory, logger *logrus.Logger) ([]clientRoute, []*backend.Backend, error) {
+	var routes []clientRoute
+	var all []*backend.Backend
+	for i, rcfg := range cfg.ClientRoutes {
+		networks, err := config.ParseCIDRs(rcfg.Clients)
+		if err != nil {
+			return nil, nil, fmt.Errorf("client_route %d: %w", i, err)
+		}
+
+		backends, pools, err := newBackendSet(cfg, rcfg.Backends, registry, factory, logger)
+		if err != nil {
+			return nil, nil, fmt.Errorf("client_route %d: %w", i, err)
+		}
+		routes = append(routes, clientRoute{networks: networks, pools: pools})
+		all = append(all, backends...)
+
+		logger.WithFields(logrus.Fields{
+			"clients":  strings.Join(rcfg.Clients, ","),
+			"backends": len(backends),
+		}).Info("Registered client route")
+	}
+
+	return routes, all, nil
+}
+
+// matchClient returns the pools of the client route with the most
+// specific network containing the client, or nil if none does
+func matchClient(routes []clientRoute, clientAddr net.Addr) []*backendPool {
+	if len(routes) == 0 {
+		return nil
+	}
+
+	ip := addrIP(clientAddr)
+	if ip == nil {
+		return nil
+	}
+	if ip4 := ip.To4(); ip4 != nil {
+		ip = ip4
+	}
+
+	var best []*backendPool
+	bestBits := -1
+	for _, route := range routes {
+		for _, network := range route.networks {
+			if !network.Contains(ip) {
+				continue
+			}
+			if bits, _ := network.Mask.Size(); bits > bestBits {
+				best, bestBits = route.pools, bits
+			}
+		}
+	}
+
+	return best
+}
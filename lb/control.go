@@ -0,0 +1,96 @@
+package lb
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"time"
+)
+
+// defaultControlSocketMode leaves the control socket to its owner unless
+// the config grants a group
+const defaultControlSocketMode = 0600
+
+// startControl serves the runtime API on the control socket, for the CLI
+// on the same host. Connecting to a unix socket takes write permission on
+// it, so its mode and owner decide who may control the instance, with no
+// network exposure.
+func (lb *LoadBalancer) startControl() error {
+	cfg := lb.controlConfig
+
+	mode := os.FileMode(defaultControlSocketMode)
+	if cfg.Permissions != "" {
+		perm, _ := strconv.ParseUint(cfg.Permissions, 8, 32)
+		mode = os.FileMode(perm)
+	}
+
+	if err := os.MkdirAll(filepath.Dir(cfg.Path), 0755); err != nil {
+		return fmt.Errorf("failed to create control socket directory: %w", err)
+	}
+	// Remove a socket left behind by an unclean shutdown, but never
+	// anything that isn't a socket
+	if info, err := os.Lstat(cfg.Path); err == nil {
+		if info.Mode()&os.ModeSocket == 0 {
+			return fmt.Errorf("control socket path %s exists and is not a socket", cfg.Path)
+		}
+		if err := os.Remove(cfg.Path); err != nil {
+			return fmt.Errorf("failed to remove stale control socket: %w", err)
+		}
+	}
+
+	// The socket is created under a temporary name and only moved into
+	// place once its mode is set, so there is no moment anyone else could
+	// connect
+	tmpPath := cfg.Path + ".tmp"
+	os.Remove(tmpPath)
+	listener, err := net.ListenUnix("unix", &net.UnixAddr{Name: tmpPath, Net: "unix"})
+	if err != nil {
+		return fmt.Errorf("failed to listen on %s (control): %w", cfg.Path, err)
+	}
+	listener.SetUnlinkOnClose(false)
+	if err := os.Chmod(tmpPath, mode); err == nil {
+		err = os.Rename(tmpPath, cfg.Path)
+	}
+	if err != nil {
+		listener.Close()
+		os.Remove(tmpPath)
+		return fmt.Errorf("failed to set up control socket: %w", err)
+	}
+	lb.startStream()
+
+	lb.controlServer = &http.Server{
+		Handler:           lb.adminMux(),
+		ReadHeaderTimeout: 5 * time.Second,
+		IdleTimeout:       60 * time.Second,
+	}
+
+	lb.wg.Add(1)
+	go func() {
+		defer lb.wg.Done()
+		if err := lb.controlServer.Serve(listener); err != nil && err != http.ErrServerClosed {
+			lb.logger.WithError(err).Error("Control socket server failed")
+		}
+	}()
+
+	lb.logger.WithField("path", cfg.Path).Info("Control socket started")
+	return nil
+}
+
+// stopControl shuts down the control socket and removes its file
+func (lb *LoadBalancer) stopControl() {
+	if lb.controlServer == nil {
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	if err := lb.controlServer.Shutdown(ctx); err != nil {
+		lb.logger.WithError(err).Error("Error closing control socket")
+	}
+	os.Remove(lb.controlConfig.Path)
+}
@@ -0,0 +1,91 @@
+package lb
+
+import (
+	"fmt"
+	"sync"
+	"sync/atomic"
+
+	"github.com/miekg/dns"
+)
+
+// counters counts the queries clients send by type and the responses
+// they get by response code, over every listener. Types up to 255 cover
+// nearly all traffic and are counted without locking; the rest (CAA and
+// the like) go to a map.
+type counters struct {
+	qtypes  [256]uint64
+	rcodes  [16]uint64
+	dropped uint64 // Queries given no response at all
+
+	mu    sync.Mutex
+	other map[uint16]uint64
+}
+
+// query counts a query by its type
+func (c *counters) query(query []byte) {
+	qtype, ok := questionType(query)
+	if !ok {
+		return
+	}
+	if qtype < uint16(len(c.qtypes)) {
+		atomic.AddUint64(&c.qtypes[qtype], 1)
+		return
+	}
+
+	c.mu.Lock()
+	if c.other == nil {
+		c.other = make(map[uint16]uint64)
+	}
+	c.other[qtype]++
+	c.mu.Unlock()
+}
+
+// response counts the response sent to a client by its response code, or
+// a query dropped without one
+func (c *counters) response(response []byte) {
+	if len(response) < 4 {
+		atomic.AddUint64(&c.dropped, 1)
+		return
+	}
+	atomic.AddUint64(&c.rcodes[response[3]&0x0f], 1)
+}
+
+// rcodeName returns the mnemonic of a response code, or RCODEnn for the
+// unassigned ones
+func rcodeName(rcode int) string {
+	if name, ok := dns.RcodeToString[rcode]; ok {
+		return name
+	}
+	return fmt.Sprintf("RCODE%d", rcode)
+}
+
+// CounterStats returns the queries received by type and the responses
+// sent by response code, leaving out those never seen
+func (lb *LoadBalancer) CounterStats() map[string]interface{} {
+	c := &lb.counters
+
+	qtypes := make(map[string]uint64)
+	for qtype := range c.qtypes {
+		if count := atomic.LoadUint64(&c.qtypes[qtype]); count > 0 {
+			qtypes[dns.Type(qtype).String()] = count
+		}
+	}
+	c.mu.Lock()
+	for qtype, count := range c.other {
+		qtypes[dns.Type(qtype).String()] = count
+	}
+	c.mu.Unlock()
+
+	rcodes := make(map[string]uint64)
+	for rcode := range c.rcodes {
+		if count := atomic.LoadUint64(&c.rcodes[rcode]); count > 0 {
+			rcodes[rcodeName(rcode)] = count
+		}
+	}
+
+	return map[string]interface{}{
+		"qtypes":  qtypes,
+		"rcodes":  rcodes,
+		"dropped": atomic.LoadUint64(&c.dropped),
+	}
+}
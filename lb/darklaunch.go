@@ -0,0 +1,159 @@
+package lb
+
+import (
+	"math/rand"
+	"net"
+	"sort"
+	"strings"
+	"sync/atomic"
+
+	"github.com/aram535/dnsbalancer/backend"
+	"github.com/aram535/dnsbalancer/config"
+	"github.com/miekg/dns"
+	"github.com/sirupsen/logrus"
+)
+
+// darkLaunch sends copies of client queries to a candidate backend and
+// compares its answers with the ones clients got, so a new resolver can be
+// checked against live traffic before it takes any
+type darkLaunch struct {
+	candidate  *backend.Backend
+	ecs        ecsPolicy
+	sampleRate float64
+	mirrored   uint64
+	mismatches uint64
+	failures   uint64
+}
+
+// newDarkLaunch creates the candidate backend, or returns nil when dark
+// launch is not enabled
+func newDarkLaunch(cfg *config.Config, logger *logrus.Logger) (*darkLaunch, error) {
+	if cfg.DarkLaunch == nil || !cfg.DarkLaunch.Enabled {
+		return nil, nil
+	}
+
+	candidate, err := NewBackend(cfg, cfg.DarkLaunch.Candidate)
+	if err != nil {
+		return nil, err
+	}
+
+	d := &darkLaunch{
+		candidate:  candidate,
+		ecs:        newECSPolicy(cfg.ECS),
+		sampleRate: cfg.DarkLaunch.SampleRate,
+	}
+	if cfg.DarkLaunch.Candidate.ECS != nil {
+		d.ecs = newECSPolicy(cfg.DarkLaunch.Candidate.ECS)
+	}
+	if d.sampleRate == 0 {
+		d.sampleRate = 1
+	}
+
+	logger.WithFields(logrus.Fields{
+		"candidate":   candidate.Address,
+		"sample_rate": d.sampleRate,
+	}).Info("Dark launch enabled")
+
+	return d, nil
+}
+
+// mirror sends a copy of a query to the dark launch candidate in the
+// background and logs it if the candidate's answer differs from the one
+// the client got
+func (lb *LoadBalancer) mirror(query []byte, clientAddr net.Addr, stream bool, response []byte) {
+	d := lb.darkLaunch
+	if d == nil || (d.sampleRate < 1 && rand.Float64() >= d.sampleRate) {
+		return
+	}
+
+	// The client's response may be rewritten (truncated) once this returns
+	response = append([]byte(nil), response...)
+
+	lb.wg.Add(1)
+	go func() {
+		defer lb.wg.Done()
+
+		upstream, rewrite := lb.upstreamQuery(query, clientAddr, d.ecs, stream)
+		var candidate []byte
+		var err error
+		if stream {
+			candidate, err = d.candidate.ForwardQueryTCP(upstream, lb.timeout())
+		} else {
+			candidate, err = d.candidate.ForwardQuery(upstream, lb.timeout())
+		}
+
+		atomic.AddUint64(&d.mirrored, 1)
+		logger := lb.logger.WithField("candidate", d.candidate.Address)
+		if err != nil {
+			atomic.AddUint64(&d.failures, 1)
+			logger.WithError(err).Debug("Dark launch candidate query failed")
+			return
+		}
+
+		if diff := compareAnswers(response, rewrite.restore(candidate)); diff != nil {
+			atomic.AddUint64(&d.mismatches, 1)
+			logger.WithFields(diff).Warn("Dark launch candidate answer differs")
+		}
+	}()
+}
+
+// compareAnswers compares the response code and answer section of two
+// responses, ignoring TTLs and record order, and returns the differences
+// as log fields, or nil if the answers match
+func compareAnswers(primary, candidate []byte) logrus.Fields {
+	want, got := new(dns.Msg), new(dns.Msg)
+	if err := want.Unpack(primary); err != nil {
+		return nil
+	}
+	if err := got.Unpack(candidate); err != nil {
+		return logrus.Fields{"error": err.Error()}
+	}
+
+	wantAnswers, gotAnswers := answerSet(want), answerSet(got)
+	if want.Rcode == got.Rcode && strings.Join(wantAnswers, "\n") == strings.Join(gotAnswers, "\n") {
+		return nil
+	}
+
+	fields := logrus.Fields{
+		"primary_rcode":     dns.RcodeToString[want.Rcode],
+		"candidate_rcode":   dns.RcodeToString[got.Rcode],
+		"primary_answers":   strings.Join(wantAnswers, "; "),
+		"candidate_answers": strings.Join(gotAnswers, "; "),
+	}
+	if len(want.Question) > 0 {
+		fields["name"] = want.Question[0].Name
+		fields["type"] = dns.TypeToString[want.Question[0].Qtype]
+	}
+	return fields
+}
+
+// answerSet returns the answer records of a response as sorted strings
+// with their TTLs zeroed
+func answerSet(msg *dns.Msg) []string {
+	answers := make([]string, 0, len(msg.Answer))
+	for _, rr := range msg.Answer {
+		rr = dns.Copy(rr)
+		rr.Header().Ttl = 0
+		answers = append(answers, rr.String())
+	}
+	sort.Strings(answers)
+	return answers
+}
+
+// DarkLaunchStats returns how many queries were mirrored to the dark
+// launch candidate and how many of its answers failed or differed, or nil
+// if dark launch is not enabled
+func (lb *LoadBalancer) DarkLaunchStats() map[string]interface{} {
+	d := lb.darkLaunch
+	if d == nil {
+		return nil
+	}
+
+	return map[string]interface{}{
+		"candidate":   d.candidate.Address,
+		"sample_rate": d.sampleRate,
+		"mirrored":    atomic.LoadUint64(&d.mirrored),
+		"mismatches":  atomic.LoadUint64(&d.mismatches),
+		"failures":    atomic.LoadUint64(&d.failures),
+	}
+}
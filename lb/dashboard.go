@@ -0,0 +1,32 @@
+package lb
+
+import (
+	_ "embed"
+	"net/http"
+)
+
+// dashboardPage is the web dashboard, a single page reading the runtime
+// API from the browser
+//
+//go:embed dashboard.html
+var dashboardPage []byte
+
+// serveDashboard serves the web dashboard at the root of the runtime API
+func (lb *LoadBalancer) serveDashboard(w http.ResponseWriter, r *http.Request) {
+	if r.URL.Path != "/" {
+		http.NotFound(w, r)
+		return
+	}
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	// The page has buttons changing the instance, so it may not be framed
+	// by another site
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.Header().Set("X-Frame-Options", "DENY")
+	w.Header().Set("Content-Security-Policy", "default-src 'self'; script-src 'unsafe-inline'; style-src 'unsafe-inline'; frame-ancestors 'none'")
+	w.Header().Set("Cache-Control", "no-store")
+	w.Write(dashboardPage)
+}
@@ -0,0 +1,87 @@
+package lb
+
+import (
+	"context"
+	"expvar"
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/pprof"
+	runtimepprof "runtime/pprof"
+	"time"
+)
+
+// startDebug starts the debug server: the pprof profiles, expvar
+// variables and a goroutine dump, so a production instance can be
+// profiled without a rebuild. Profiles can expose memory contents, so it
+// only listens on loopback.
+func (lb *LoadBalancer) startDebug() error {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/debug/pprof/", pprof.Index)
+	mux.HandleFunc("/debug/pprof/cmdline", pprof.Cmdline)
+	mux.HandleFunc("/debug/pprof/profile", pprof.Profile)
+	mux.HandleFunc("/debug/pprof/symbol", pprof.Symbol)
+	mux.HandleFunc("/debug/pprof/trace", pprof.Trace)
+	mux.Handle("/debug/vars", expvar.Handler())
+	mux.HandleFunc("/debug/goroutines", serveGoroutines)
+
+	// expvar variables are process wide; the first load balancer's
+	// counters are the ones published
+	if expvar.Get("dnsbalancer") == nil {
+		expvar.Publish("dnsbalancer", expvar.Func(func() interface{} {
+			return map[string]interface{}{
+				"counters": lb.CounterStats(),
+				"cache":    lb.CacheStats(),
+			}
+		}))
+	}
+
+	listener, err := net.Listen("tcp", lb.debugConfig.Listen)
+	if err != nil {
+		return fmt.Errorf("failed to listen on %s (debug): %w", lb.debugConfig.Listen, err)
+	}
+
+	// No write timeout: CPU profiles and traces take as long as asked
+	lb.debugServer = &http.Server{
+		Handler:           mux,
+		ReadHeaderTimeout: 5 * time.Second,
+		IdleTimeout:       60 * time.Second,
+	}
+
+	lb.wg.Add(1)
+	go func() {
+		defer lb.wg.Done()
+		if err := lb.debugServer.Serve(listener); err != nil && err != http.ErrServerClosed {
+			lb.logger.WithError(err).Error("Debug server failed")
+		}
+	}()
+
+	lb.logger.WithField("address", lb.debugConfig.Listen).Info("Debug server started")
+	return nil
+}
+
+// stopDebug shuts down the debug server, cutting short any profile being
+// taken
+func (lb *LoadBalancer) stopDebug() {
+	if lb.debugServer == nil {
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+
+	if err := lb.debugServer.Shutdown(ctx); err != nil {
+		lb.debugServer.Close()
+	}
+}
+
+// serveGoroutines writes the stack of every goroutine, as a panic would
+func serveGoroutines(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	runtimepprof.Lookup("goroutine").WriteTo(w, 2)
+}
@@ -0,0 +1,185 @@
+package lb
+
+import (
+	"encoding/hex"
+	"fmt"
+	"net"
+	"time"
+
+	"github.com/aram535/dnsbalancer/dnscrypt"
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	// dnscryptDefaultCertLifetime is used when no lifetime is configured
+	dnscryptDefaultCertLifetime = 24 * time.Hour
+
+	// dnscryptRotationCheck is how often certificate expiry is checked
+	dnscryptRotationCheck = time.Minute
+)
+
+// startDNSCrypt loads the provider key and starts the DNSCrypt UDP and
+// TCP listeners along with certificate rotation
+func (lb *LoadBalancer) startDNSCrypt() error {
+	cfg := lb.dnscryptConfig
+
+	key, generated, err := dnscrypt.LoadProviderKey(cfg.ProviderKeyFile)
+	if err != nil {
+		return err
+	}
+
+	lifetime := cfg.CertLifetime
+	if lifetime == 0 {
+		lifetime = dnscryptDefaultCertLifetime
+	}
+
+	lb.dnscrypt, err = dnscrypt.NewServer(cfg.ProviderName, key, lifetime)
+	if err != nil {
+		return fmt.Errorf("failed to create dnscrypt certificates: %w", err)
+	}
+
+	addr, err := net.ResolveUDPAddr("udp", cfg.Listen)
+	if err != nil {
+		return fmt.Errorf("failed to resolve dnscrypt listen address: %w", err)
+	}
+	lb.dnscryptUDP, err = net.ListenUDP("udp", addr)
+	if err != nil {
+		return fmt.Errorf("failed to listen on %s (dnscrypt): %w", cfg.Listen, err)
+	}
+	tcpListener, err := net.Listen("tcp", cfg.Listen)
+	if err != nil {
+		lb.dnscryptUDP.Close()
+		return fmt.Errorf("failed to listen on %s (dnscrypt tcp): %w", cfg.Listen, err)
+	}
+	lb.dnscryptTCP = lb.wrapStreamListener(tcpListener)
+
+	lb.wg.Add(3)
+	go lb.acceptDNSCryptQueries()
+	go lb.acceptTCP(lb.dnscryptTCP, func(packet []byte, clientAddr net.Addr) []byte {
+		return lb.handleDNSCrypt(packet, clientAddr, 0)
+	})
+	go lb.rotateDNSCryptCerts(lifetime)
+
+	logger := lb.logger.WithFields(logrus.Fields{
+		"address":       cfg.Listen,
+		"provider_name": cfg.ProviderName,
+		"public_key":    hex.EncodeToString(lb.dnscrypt.PublicKey()),
+	})
+	if generated {
+		logger.WithField("key_file", cfg.ProviderKeyFile).Warn("Generated new DNSCrypt provider key")
+	}
+	if dnscrypt.IsSpecifiedHost(cfg.Listen) {
+		logger = logger.WithField("stamp", lb.dnscrypt.Stamp(cfg.Listen))
+	}
+	logger.Info("DNSCrypt listener started")
+
+	return nil
+}
+
+// stopDNSCrypt closes the DNSCrypt listeners
+func (lb *LoadBalancer) stopDNSCrypt() {
+	if lb.dnscryptUDP != nil {
+		if err := lb.dnscryptUDP.Close(); err != nil {
+			lb.logger.WithError(err).Error("Error closing DNSCrypt listener")
+		}
+	}
+	if lb.dnscryptTCP != nil {
+		if err := lb.dnscryptTCP.Close(); err != nil {
+			lb.logger.WithError(err).Error("Error closing DNSCrypt TCP listener")
+		}
+	}
+}
+
+// acceptDNSCryptQueries reads DNSCrypt datagrams from the UDP listener
+func (lb *LoadBalancer) acceptDNSCryptQueries() {
+	defer lb.wg.Done()
+
+	buffer := make([]byte, 65535)
+
+	for {
+		n, clientAddr, err := lb.dnscryptUDP.ReadFromUDP(buffer)
+		if err != nil {
+			select {
+			case <-lb.ctx.Done():
+				return
+			default:
+				lb.logger.WithError(err).Error("Error reading from DNSCrypt socket")
+				continue
+			}
+		}
+
+		packet := make([]byte, n)
+		copy(packet, buffer[:n])
+
+		lb.wg.Add(1)
+		go func() {
+			defer lb.wg.Done()
+
+			response := lb.handleDNSCrypt(packet, clientAddr, len(packet))
+			if response == nil {
+				return
+			}
+			if _, err := lb.dnscryptUDP.WriteToUDP(response, clientAddr); err != nil {
+				lb.logger.WithError(err).WithField("client", lb.privacy.client(clientAddr)).Error("Failed to send response to client")
+			}
+		}()
+	}
+}
+
+// handleDNSCrypt serves a single DNSCrypt packet: certificate requests are
+// answered in plain DNS, everything else must be an encrypted query.
+// maxSize limits the encrypted response size (0 for TCP).
+func (lb *LoadBalancer) handleDNSCrypt(packet []byte, clientAddr net.Addr, maxSize int) []byte {
+	if response, ok := lb.dnscrypt.CertResponse(packet); ok {
+		return response
+	}
+
+	logger := lb.logger.WithFields(logrus.Fields{
+		"client":    lb.privacy.client(clientAddr),
+		"transport": "dnscrypt",
+	})
+
+	query, session, err := lb.dnscrypt.Decrypt(packet)
+	if err != nil {
+		logger.WithError(err).Debug("Dropping invalid DNSCrypt query")
+		return nil
+	}
+
+	response := lb.resolve(query, clientAddr)
+	if response == nil {
+		return nil
+	}
+
+	encrypted, err := session.Encrypt(response, maxSize)
+	if err != nil {
+		logger.WithError(err).Error("Failed to encrypt DNSCrypt response")
+		return nil
+	}
+
+	return encrypted
+}
+
+// rotateDNSCryptCerts issues new resolver certificates before the current
+// ones expire
+func (lb *LoadBalancer) rotateDNSCryptCerts(lifetime time.Duration) {
+	defer lb.wg.Done()
+
+	ticker := time.NewTicker(dnscryptRotationCheck)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-lb.ctx.Done():
+			return
+		case now := <-ticker.C:
+			if !lb.dnscrypt.NeedsRotation(now) {
+				continue
+			}
+			if err := lb.dnscrypt.Rotate(now); err != nil {
+				lb.logger.WithError(err).Error("Failed to rotate DNSCrypt certificates")
+				continue
+			}
+			lb.logger.WithField("valid_for", lifetime).Info("Rotated DNSCrypt certificates")
+		}
+	}
+}
@@ -0,0 +1,1064 @@
+package lb
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/aram535/dnsbalancer/config"
+	"github.com/miekg/dns"
+	"github.com/sirupsen/logrus"
+)
+
+// DNSSEC validation limits
+const (
+	dnssecUDPSize      = 1232      // Payload size advertised on queries the validator adds an OPT record to
+	dnssecMaxCacheTTL  = time.Hour // Longest a validated key set or zone cut is trusted
+	dnssecMinCacheTTL  = 5 * time.Second
+	dnssecMaxZones     = 10000 // Zone cuts cached before the cache is cleared
+	nsec3MaxIterations = 150   // NSEC3 with more iterations is treated as insecure (RFC 9276)
+)
+
+// rootTrustAnchors are the DS records of the root zone's key signing keys,
+// as published by IANA
+var rootTrustAnchors = []string{
+	". IN DS 20326 8 2 E06D44B80B8F1D39A95C0B0D7C65D08458E880409BBC683457104237C7F8EC8D",
+	". IN DS 38696 8 2 683D2D0ACB8C9B712A1948B27F741219298D0A450D612C483AF444A4C0FB2B16",
+}
+
+// Validation results
+type dnssecStatus int
+
+const (
+	dnssecInsecure dnssecStatus = iota
+	dnssecSecure
+	dnssecBogus
+)
+
+// validator checks the DNSSEC signatures of backend answers, building the
+// chain of trust from the trust anchors down with DS and DNSKEY queries of
+// its own. Secure answers get the AD flag, bogus ones are answered
+// SERVFAIL, so clients get validated answers even from backends that don't
+// validate.
+type validator struct {
+	anchors  map[string][]dns.RR // DS or DNSKEY records trusted for each zone
+	exchange func(name string, qtype uint16) (*dns.Msg, error)
+	logger   *logrus.Logger
+
+	mu    sync.Mutex
+	zones map[string]*zoneCut // What the chain walk learned about each name
+
+	secure   uint64
+	insecure uint64
+	bogus    uint64
+}
+
+// zoneCut is what a chain walk learned about a name: the validated keys
+// when it is a signed zone, that it is an unsigned delegation, that it
+// doesn't exist, or, with none of those, that it is no zone cut
+type zoneCut struct {
+	keys     []*dns.DNSKEY
+	insecure bool
+	missing  bool
+	expires  time.Time
+}
+
+// secureZone is a zone whose keys validated from a trust anchor down
+type secureZone struct {
+	name string
+	keys []*dns.DNSKEY
+}
+
+// dnssecCheck records what a client asked for, to shape the validated
+// response it gets back
+type dnssecCheck struct {
+	edns     bool // The client used EDNS
+	do       bool // The client wants DNSSEC records
+	ad       bool // The client wants the AD flag even without DO (RFC 6840)
+	addedOPT bool // The validator added the OPT record to the upstream query
+}
+
+// newValidator creates the validator, or returns nil when validation is
+// disabled. Sub-queries go through exchange.
+func newValidator(cfg *config.DNSSECConfig, exchange func(string, uint16) (*dns.Msg, error), logger *logrus.Logger) (*validator, error) {
+	if cfg == nil || !cfg.Enabled {
+		return nil, nil
+	}
+
+	anchors, err := loadTrustAnchors(cfg.TrustAnchors)
+	if err != nil {
+		return nil, fmt.Errorf("dnssec trust_anchors: %w", err)
+	}
+
+	return &validator{
+		anchors:  anchors,
+		exchange: exchange,
+		logger:   logger,
+		zones:    make(map[string]*zoneCut),
+	}, nil
+}
+
+// loadTrustAnchors reads DS and DNSKEY records in zone file format from a
+// file, or returns the root anchors when no file is given
+func loadTrustAnchors(path string) (map[string][]dns.RR, error) {
+	var records []dns.RR
+	if path == "" {
+		for _, s := range rootTrustAnchors {
+			rr, err := dns.NewRR(s)
+			if err != nil {
+				return nil, err
+			}
+			records = append(records, rr)
+		}
+	} else {
+		file, err := os.Open(path)
+		if err != nil {
+			return nil, err
+		}
+		defer file.Close()
+
+		parser := dns.NewZoneParser(file, ".", path)
+		for rr, ok := parser.Next(); ok; rr, ok = parser.Next() {
+			records = append(records, rr)
+		}
+		if err := parser.Err(); err != nil {
+			return nil, err
+		}
+	}
+
+	anchors := make(map[string][]dns.RR)
+	for _, rr := range records {
+		switch rr.Header().Rrtype {
+		case dns.TypeDS, dns.TypeDNSKEY:
+			zone := strings.ToLower(rr.Header().Name)
+			anchors[zone] = append(anchors[zone], rr)
+		default:
+			return nil, fmt.Errorf("%s is not a DS or DNSKEY record", rr.Header().Name)
+		}
+	}
+	if len(anchors) == 0 {
+		return nil, errors.New("no trust anchors")
+	}
+	return anchors, nil
+}
+
+// prepare asks the backend for DNSSEC records with checking disabled, so
+// the validator sees bogus answers too, and records what the client asked
+// for. It returns nil when the client disabled checking itself, and for
+// updates and notifies.
+func (v *validator) prepare(query, upstream []byte) ([]byte, *dnssecCheck) {
+	if v == nil {
+		return upstream, nil
+	}
+
+	client := new(dns.Msg)
+	if err := client.Unpack(query); err != nil || client.CheckingDisabled || client.Opcode != dns.OpcodeQuery {
+		return upstream, nil
+	}
+	msg := new(dns.Msg)
+	if err := msg.Unpack(upstream); err != nil {
+		return upstream, nil
+	}
+
+	check := &dnssecCheck{ad: client.AuthenticatedData}
+	if opt := client.IsEdns0(); opt != nil {
+		check.edns = true
+		check.do = opt.Do()
+	}
+
+	opt := msg.IsEdns0()
+	if opt == nil {
+		msg.SetEdns0(dnssecUDPSize, true)
+		check.addedOPT = true
+	} else {
+		opt.SetDo()
+	}
+	msg.CheckingDisabled = true
+
+	packed, err := msg.Pack()
+	if err != nil {
+		return upstream, nil
+	}
+	return packed, check
+}
+
+// finish validates a backend response and shapes it for the client:
+// bogus answers become SERVFAIL, secure ones get the AD flag, and DNSSEC
+// records the client didn't ask for are removed
+func (v *validator) finish(response []byte, check *dnssecCheck) []byte {
+	if v == nil || check == nil {
+		return response
+	}
+
+	msg := new(dns.Msg)
+	if err := msg.Unpack(response); err != nil {
+		return response
+	}
+	msg.CheckingDisabled = false
+	// A truncated answer can't be validated; the client retries over TCP
+	if msg.Truncated {
+		return check.strip(msg, packOr(msg, response))
+	}
+
+	status, err := v.validate(msg)
+	switch status {
+	case dnssecSecure:
+		atomic.AddUint64(&v.secure, 1)
+		msg.AuthenticatedData = check.do || check.ad
+	case dnssecInsecure:
+		atomic.AddUint64(&v.insecure, 1)
+		msg.AuthenticatedData = false
+	case dnssecBogus:
+		atomic.AddUint64(&v.bogus, 1)
+		fields := logrus.Fields{}
+		if len(msg.Question) == 1 {
+			fields["name"] = msg.Question[0].Name
+			fields["type"] = dns.TypeToString[msg.Question[0].Qtype]
+		}
+		v.logger.WithFields(fields).WithError(err).Warn("DNSSEC validation failed")
+		return check.servfail(msg, err)
+	}
+
+	packed, err := msg.Pack()
+	if err != nil {
+		return response
+	}
+	return check.strip(msg, packed)
+}
+
+// strip removes the DNSSEC records and OPT record the client didn't ask
+// for from a response
+func (c *dnssecCheck) strip(msg *dns.Msg, response []byte) []byte {
+	if c.do {
+		return response
+	}
+
+	qtype := uint16(0)
+	if len(msg.Question) == 1 {
+		qtype = msg.Question[0].Qtype
+	}
+	keep := func(rrs []dns.RR) []dns.RR {
+		kept := rrs[:0]
+		for _, rr := range rrs {
+			switch t := rr.Header().Rrtype; t {
+			case dns.TypeRRSIG, dns.TypeNSEC, dns.TypeNSEC3:
+				if t != qtype {
+					continue
+				}
+			}
+			kept = append(kept, rr)
+		}
+		return kept
+	}
+	msg.Answer = keep(msg.Answer)
+	msg.Ns = keep(msg.Ns)
+	msg.Extra = keep(msg.Extra)
+
+	if opt := msg.IsEdns0(); opt != nil {
+		if c.addedOPT {
+			return stripOPT(packOr(msg, response))
+		}
+		opt.SetDo(false)
+	}
+	return packOr(msg, response)
+}
+
+// servfail answers a query whose response was bogus, explaining why in an
+// extended DNS error (RFC 8914) to clients using EDNS
+func (c *dnssecCheck) servfail(msg *dns.Msg, reason error) []byte {
+	reply := new(dns.Msg)
+	reply.Id = msg.Id
+	reply.Response = true
+	reply.Opcode = msg.Opcode
+	reply.RecursionDesired = msg.RecursionDesired
+	reply.RecursionAvailable = msg.RecursionAvailable
+	reply.Rcode = dns.RcodeServerFailure
+	reply.Question = msg.Question
+	if c.edns {
+		reply.SetEdns0(dns.DefaultMsgSize, c.do)
+		ede := &dns.EDNS0_EDE{InfoCode: dns.ExtendedErrorCodeDNSBogus}
+		if reason != nil {
+			ede.ExtraText = reason.Error()
+		}
+		opt := reply.IsEdns0()
+		opt.Option = append(opt.Option, ede)
+	}
+
+	packed, err := reply.Pack()
+	if err != nil {
+		return nil
+	}
+	return packed
+}
+
+// packOr packs a message, falling back to the original response
+func packOr(msg *dns.Msg, response []byte) []byte {
+	packed, err := msg.Pack()
+	if err != nil {
+		return response
+	}
+	return packed
+}
+
+// validate returns the security status of a response. Every RRset in the
+// answer must verify, one expanded from a wildcard along with the proof
+// that the name asked for doesn't exist, and a missing answer must come
+// with a signed proof of nonexistence from the zone it would be in.
+func (v *validator) validate(msg *dns.Msg) (dnssecStatus, error) {
+	if len(msg.Question) != 1 {
+		return dnssecInsecure, nil
+	}
+	if msg.Rcode != dns.RcodeSuccess && msg.Rcode != dns.RcodeNameError {
+		// Errors carry nothing to validate
+		return dnssecInsecure, nil
+	}
+	q := msg.Question[0]
+
+	status := dnssecSecure
+	for _, set := range rrsets(msg.Answer) {
+		hdr := set[0].Header()
+		if hdr.Rrtype == dns.TypeRRSIG || synthesizedCNAME(msg.Answer, set[0]) {
+			continue
+		}
+		sigs := signatures(msg.Answer, hdr)
+		setStatus, err := v.validateRRset(set, sigs)
+		if err != nil {
+			return dnssecBogus, err
+		}
+		if setStatus == dnssecSecure && expanded(hdr.Name, sigs[0]) {
+			insecure, err := v.wildcardProof(msg, hdr.Name, sigs[0])
+			if err != nil {
+				return dnssecBogus, err
+			}
+			if insecure {
+				setStatus = dnssecInsecure
+			}
+		}
+		if setStatus == dnssecInsecure {
+			status = dnssecInsecure
+		}
+	}
+
+	// Follow CNAMEs to the name the answer is really about
+	target := q.Name
+	for i := 0; i < len(msg.Answer); i++ {
+		next := ""
+		for _, rr := range msg.Answer {
+			if cname, ok := rr.(*dns.CNAME); ok && strings.EqualFold(cname.Hdr.Name, target) {
+				next = cname.Target
+				break
+			}
+		}
+		if next == "" {
+			break
+		}
+		target = next
+	}
+
+	if q.Qtype == dns.TypeANY || q.Qtype == dns.TypeCNAME || hasRRset(msg.Answer, target, q.Qtype) {
+		return status, nil
+	}
+
+	zone, err := v.zoneOf(target)
+	if err != nil {
+		return dnssecBogus, err
+	}
+	if zone == nil {
+		return dnssecInsecure, nil
+	}
+	insecure, err := v.deny(zone, msg, target, q.Qtype)
+	if err != nil {
+		return dnssecBogus, err
+	}
+	if insecure {
+		return dnssecInsecure, nil
+	}
+	return status, nil
+}
+
+// validateRRset verifies one RRset against the keys of the zone that
+// signed it. Unsigned RRsets are only acceptable in insecure zones.
+func (v *validator) validateRRset(set []dns.RR, sigs []*dns.RRSIG) (dnssecStatus, error) {
+	hdr := set[0].Header()
+	if len(sigs) == 0 {
+		zone, err := v.zoneOf(hdr.Name)
+		if err != nil {
+			return dnssecBogus, err
+		}
+		if zone != nil {
+			return dnssecBogus, fmt.Errorf("%s %s is not signed", hdr.Name, dns.TypeToString[hdr.Rrtype])
+		}
+		return dnssecInsecure, nil
+	}
+
+	signer := strings.ToLower(sigs[0].SignerName)
+	if !dns.IsSubDomain(signer, hdr.Name) {
+		return dnssecBogus, fmt.Errorf("%s %s is signed by %s", hdr.Name, dns.TypeToString[hdr.Rrtype], signer)
+	}
+	zone, err := v.zoneOf(signer)
+	if err != nil {
+		return dnssecBogus, err
+	}
+	if zone == nil {
+		return dnssecInsecure, nil
+	}
+	if zone.name != signer {
+		return dnssecBogus, fmt.Errorf("%s %s is signed by %s, which is not a zone", hdr.Name, dns.TypeToString[hdr.Rrtype], signer)
+	}
+	if err := verifyRRset(zone, set, sigs); err != nil {
+		return dnssecBogus, fmt.Errorf("%s %s: %w", hdr.Name, dns.TypeToString[hdr.Rrtype], err)
+	}
+	return dnssecSecure, nil
+}
+
+// zoneOf walks from the closest trust anchor above name down to it and
+// returns the deepest secure zone containing it. It returns nil if name is
+// under an unsigned delegation or no trust anchor, and an error if the
+// chain of trust is broken.
+func (v *validator) zoneOf(name string) (*secureZone, error) {
+	name = strings.ToLower(dns.Fqdn(name))
+	anchor := v.closestAnchor(name)
+	if anchor == "" {
+		return nil, nil
+	}
+
+	cut, err := v.anchorCut(anchor)
+	if err != nil {
+		return nil, err
+	}
+	if cut.insecure {
+		return nil, nil
+	}
+	zone := &secureZone{name: anchor, keys: cut.keys}
+
+	labels := dns.SplitDomainName(name)
+	for i := len(labels) - dns.CountLabel(anchor) - 1; i >= 0; i-- {
+		child := dns.Fqdn(strings.Join(labels[i:], "."))
+		cut, err := v.cut(zone, child)
+		if err != nil {
+			return nil, err
+		}
+		switch {
+		case cut.insecure:
+			return nil, nil
+		case cut.missing:
+			return zone, nil
+		case cut.keys != nil:
+			zone = &secureZone{name: child, keys: cut.keys}
+		}
+	}
+	return zone, nil
+}
+
+// closestAnchor returns the deepest zone with a trust anchor that contains
+// name, or "" if there is none
+func (v *validator) closestAnchor(name string) string {
+	for off, end := 0, false; !end; off, end = dns.NextLabel(name, off) {
+		if _, ok := v.anchors[name[off:]]; ok {
+			return name[off:]
+		}
+	}
+	if _, ok := v.anchors["."]; ok {
+		return "."
+	}
+	return ""
+}
+
+// anchorCut returns the validated keys of a trust anchor's zone
+func (v *validator) anchorCut(anchor string) (*zoneCut, error) {
+	if cut := v.cached(anchor); cut != nil {
+		return cut, nil
+	}
+	keys, ttl, err := v.fetchKeys(anchor, v.anchors[anchor])
+	if err != nil {
+		return nil, err
+	}
+	return v.store(anchor, &zoneCut{keys: keys}, ttl), nil
+}
+
+// cut finds out whether child, a name in the secure zone parent, is the
+// apex of a signed zone, an unsigned delegation or neither, from its DS
+// records or the signed proof that it has none
+func (v *validator) cut(parent *secureZone, child string) (*zoneCut, error) {
+	if cut := v.cached(child); cut != nil {
+		return cut, nil
+	}
+
+	resp, err := v.exchange(child, dns.TypeDS)
+	if err != nil {
+		return nil, err
+	}
+	ttl := minTTL(resp)
+
+	var ds []dns.RR
+	for _, rr := range resp.Answer {
+		hdr := rr.Header()
+		if hdr.Rrtype == dns.TypeDS && strings.EqualFold(hdr.Name, child) {
+			ds = append(ds, rr)
+		}
+	}
+	if len(ds) > 0 {
+		if err := verifyRRset(parent, ds, signatures(resp.Answer, ds[0].Header())); err != nil {
+			return nil, fmt.Errorf("%s DS: %w", child, err)
+		}
+		if !supportedDS(ds) {
+			// Keys we can't check make the zone insecure (RFC 4035 5.2)
+			return v.store(child, &zoneCut{insecure: true}, ttl), nil
+		}
+		keys, keyTTL, err := v.fetchKeys(child, ds)
+		if err != nil {
+			return nil, err
+		}
+		return v.store(child, &zoneCut{keys: keys}, min(ttl, keyTTL)), nil
+	}
+
+	// A name owning a CNAME can't be a delegation
+	for _, rr := range resp.Answer {
+		if rr.Header().Rrtype == dns.TypeCNAME && strings.EqualFold(rr.Header().Name, child) {
+			return v.store(child, &zoneCut{}, ttl), nil
+		}
+	}
+
+	insecure, err := v.deny(parent, resp, child, dns.TypeDS)
+	if err != nil {
+		return nil, fmt.Errorf("%s DS: %w", child, err)
+	}
+	cut := &zoneCut{insecure: insecure, missing: resp.Rcode == dns.RcodeNameError}
+	return v.store(child, cut, ttl), nil
+}
+
+// fetchKeys queries a zone's DNSKEY records and returns them once the key
+// set verifies with a key matching one of the trusted DS or DNSKEY records
+func (v *validator) fetchKeys(zone string, trusted []dns.RR) ([]*dns.DNSKEY, time.Duration, error) {
+	resp, err := v.exchange(zone, dns.TypeDNSKEY)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	var set []dns.RR
+	var keys, signing []*dns.DNSKEY
+	for _, rr := range resp.Answer {
+		key, ok := rr.(*dns.DNSKEY)
+		if !ok || !strings.EqualFold(key.Hdr.Name, zone) {
+			continue
+		}
+		set = append(set, key)
+		if key.Flags&dns.ZONE == 0 {
+			continue
+		}
+		keys = append(keys, key)
+		if trustedKey(key, trusted) {
+			signing = append(signing, key)
+		}
+	}
+	if len(signing) == 0 {
+		return nil, 0, fmt.Errorf("no %s DNSKEY matches its trust anchor or DS records", zone)
+	}
+
+	if err := verifyRRset(&secureZone{name: strings.ToLower(zone), keys: signing}, set, signatures(resp.Answer, set[0].Header())); err != nil {
+		return nil, 0, fmt.Errorf("%s DNSKEY: %w", zone, err)
+	}
+	return keys, minTTL(resp), nil
+}
+
+// trustedKey reports whether a key matches a DS record or is a trusted
+// DNSKEY itself
+func trustedKey(key *dns.DNSKEY, trusted []dns.RR) bool {
+	for _, rr := range trusted {
+		switch t := rr.(type) {
+		case *dns.DS:
+			if t.KeyTag != key.KeyTag() || t.Algorithm != key.Algorithm {
+				continue
+			}
+			if ds := key.ToDS(t.DigestType); ds != nil && strings.EqualFold(ds.Digest, t.Digest) {
+				return true
+			}
+		case *dns.DNSKEY:
+			if t.Algorithm == key.Algorithm && t.PublicKey == key.PublicKey {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// supportedDS reports whether any DS record uses an algorithm and digest
+// the validator can check
+func supportedDS(ds []dns.RR) bool {
+	for _, rr := range ds {
+		d, ok := rr.(*dns.DS)
+		if !ok {
+			continue
+		}
+		switch d.DigestType {
+		case dns.SHA1, dns.SHA256, dns.SHA384:
+		default:
+			continue
+		}
+		switch d.Algorithm {
+		case dns.RSASHA1, dns.RSASHA1NSEC3SHA1, dns.RSASHA256, dns.RSASHA512,
+			dns.ECDSAP256SHA256, dns.ECDSAP384SHA384, dns.ED25519:
+			return true
+		}
+	}
+	return false
+}
+
+// verifyRRset checks that one of the signatures over an RRset is current
+// and made by one of the zone's keys
+func verifyRRset(zone *secureZone, set []dns.RR, sigs []*dns.RRSIG) error {
+	if len(sigs) == 0 {
+		return errors.New("missing signature")
+	}
+
+	now := time.Now()
+	var lastErr error
+	for _, sig := range sigs {
+		if !strings.EqualFold(sig.SignerName, zone.name) {
+			lastErr = fmt.Errorf("signed by %s instead of %s", sig.SignerName, zone.name)
+			continue
+		}
+		if !sig.ValidityPeriod(now) {
+			lastErr = errors.New("signature expired or not yet valid")
+			continue
+		}
+		for _, key := range zone.keys {
+			if key.KeyTag() != sig.KeyTag || key.Algorithm != sig.Algorithm {
+				continue
+			}
+			err := sig.Verify(key, set)
+			if err == nil {
+				return nil
+			}
+			lastErr = err
+		}
+	}
+	if lastErr == nil {
+		lastErr = errors.New("no key matches the signature")
+	}
+	return lastErr
+}
+
+// deny checks that a response proves name has no qtype records, or doesn't
+// exist at all, with NSEC or NSEC3 records signed by zone. It reports
+// whether the proof leaves the answer insecure: a delegation without DS,
+// an opt-out span or NSEC3 parameters too costly to check.
+func (v *validator) deny(zone *secureZone, msg *dns.Msg, name string, qtype uint16) (bool, error) {
+	nsecs, nsec3s, err := denials(zone, msg)
+	if err != nil {
+		return false, err
+	}
+
+	nxdomain := msg.Rcode == dns.RcodeNameError
+	switch {
+	case len(nsecs) > 0:
+		return denyNSEC(nsecs, name, qtype, nxdomain)
+	case len(nsec3s) > 0:
+		return denyNSEC3(nsec3s, zone.name, name, qtype, nxdomain)
+	}
+	return false, fmt.Errorf("no proof that %s %s does not exist", name, dns.TypeToString[qtype])
+}
+
+// denials returns the NSEC and NSEC3 records of a response's authority
+// section, checking they are signed by zone
+func denials(zone *secureZone, msg *dns.Msg) ([]*dns.NSEC, []*dns.NSEC3, error) {
+	var nsecs []*dns.NSEC
+	var nsec3s []*dns.NSEC3
+	for _, set := range rrsets(msg.Ns) {
+		hdr := set[0].Header()
+		if hdr.Rrtype != dns.TypeNSEC && hdr.Rrtype != dns.TypeNSEC3 {
+			continue
+		}
+		if err := verifyRRset(zone, set, signatures(msg.Ns, hdr)); err != nil {
+			return nil, nil, fmt.Errorf("%s %s: %w", hdr.Name, dns.TypeToString[hdr.Rrtype], err)
+		}
+		for _, rr := range set {
+			switch r := rr.(type) {
+			case *dns.NSEC:
+				nsecs = append(nsecs, r)
+			case *dns.NSEC3:
+				nsec3s = append(nsec3s, r)
+			}
+		}
+	}
+	return nsecs, nsec3s, nil
+}
+
+// expanded reports whether an RRset was synthesized from a wildcard: its
+// signature counts fewer labels than its owner name has, the wildcard's
+// asterisk aside (RFC 4035 section 5.3.2)
+func expanded(name string, sig *dns.RRSIG) bool {
+	labels := dns.CountLabel(name)
+	if strings.HasPrefix(name, "*.") {
+		labels--
+	}
+	return int(sig.Labels) < labels
+}
+
+// wildcardProof checks that an answer expanded from a wildcard comes with
+// the proof that no closer match exists (RFC 4035 section 5.3.4, RFC 5155
+// section 8.8): an NSEC covering the name, or an NSEC3 covering the next
+// closer name below the wildcard's parent, signed by the answer's zone.
+// It reports whether the proof leaves the answer insecure.
+func (v *validator) wildcardProof(msg *dns.Msg, name string, sig *dns.RRSIG) (bool, error) {
+	zone, err := v.zoneOf(sig.SignerName)
+	if err != nil || zone == nil {
+		return zone == nil, err
+	}
+	nsecs, nsec3s, err := denials(zone, msg)
+	if err != nil {
+		return false, err
+	}
+
+	for _, nsec := range nsecs {
+		if nsecCovers(nsec, name) {
+			return false, nil
+		}
+	}
+
+	labels := dns.SplitDomainName(name)
+	nextCloser := dns.Fqdn(strings.Join(labels[len(labels)-int(sig.Labels)-1:], "."))
+	for _, nsec3 := range nsec3s {
+		if nsec3.Hash != dns.SHA1 || nsec3.Iterations > nsec3MaxIterations {
+			return true, nil
+		}
+	}
+	for _, nsec3 := range nsec3s {
+		if nsec3.Cover(nextCloser) {
+			// Opt-out: an unsigned delegation may exist at the name
+			return nsec3.Flags&1 != 0, nil
+		}
+	}
+	return false, fmt.Errorf("no proof that %s was expanded from a wildcard with no closer match", name)
+}
+
+// denyNSEC checks an NSEC proof: for NXDOMAIN an NSEC covering the name
+// and one covering the wildcard at its closest encloser, for no data an
+// NSEC at the name, at a wildcard matching it or covering it as an empty
+// non-terminal, without the type in its bitmap
+func denyNSEC(nsecs []*dns.NSEC, name string, qtype uint16, nxdomain bool) (bool, error) {
+	lacks := func(nsec *dns.NSEC) bool {
+		return !hasType(nsec.TypeBitMap, qtype) && !hasType(nsec.TypeBitMap, dns.TypeCNAME)
+	}
+
+	if nxdomain {
+		for _, nsec := range nsecs {
+			if !nsecCovers(nsec, name) {
+				continue
+			}
+			// The closest encloser is the deepest ancestor of the name the
+			// covering NSEC's owner or next name share
+			labels := dns.SplitDomainName(name)
+			common := dns.CompareDomainName(name, nsec.Hdr.Name)
+			if next := dns.CompareDomainName(name, nsec.NextDomain); next > common {
+				common = next
+			}
+			wildcard := "*."
+			if common > 0 {
+				wildcard = dns.Fqdn("*." + strings.Join(labels[len(labels)-common:], "."))
+			}
+			for _, other := range nsecs {
+				if nsecCovers(other, wildcard) {
+					return false, nil
+				}
+			}
+			return false, fmt.Errorf("no NSEC proves %s does not match %s", name, wildcard)
+		}
+		return false, fmt.Errorf("no NSEC proves %s does not exist", name)
+	}
+
+	covered := false
+	for _, nsec := range nsecs {
+		if strings.EqualFold(nsec.Hdr.Name, name) {
+			if !lacks(nsec) {
+				return false, fmt.Errorf("NSEC for %s lists %s", name, dns.TypeToString[qtype])
+			}
+			return qtype == dns.TypeDS && hasType(nsec.TypeBitMap, dns.TypeNS) && !hasType(nsec.TypeBitMap, dns.TypeSOA), nil
+		}
+		if nsecCovers(nsec, name) {
+			if dns.IsSubDomain(name, nsec.NextDomain) {
+				return false, nil // Empty non-terminal
+			}
+			covered = true
+		}
+	}
+
+	if covered {
+		for _, nsec := range nsecs {
+			if strings.HasPrefix(nsec.Hdr.Name, "*.") && dns.IsSubDomain(nsec.Hdr.Name[2:], name) && lacks(nsec) {
+				return false, nil
+			}
+		}
+	}
+	return false, fmt.Errorf("no NSEC proves %s %s does not exist", name, dns.TypeToString[qtype])
+}
+
+// denyNSEC3 checks an NSEC3 proof (RFC 5155 section 8): for no data an
+// NSEC3 matching the name without the type, otherwise a closest encloser
+// with the next closer name covered, and then for no data a matching
+// wildcard without the type or for NXDOMAIN the wildcard covered
+func denyNSEC3(nsec3s []*dns.NSEC3, zone, name string, qtype uint16, nxdomain bool) (bool, error) {
+	for _, nsec3 := range nsec3s {
+		if nsec3.Hash != dns.SHA1 || nsec3.Iterations > nsec3MaxIterations {
+			return true, nil
+		}
+	}
+	lacks := func(nsec3 *dns.NSEC3) bool {
+		return !hasType(nsec3.TypeBitMap, qtype) && !hasType(nsec3.TypeBitMap, dns.TypeCNAME)
+	}
+
+	if !nxdomain {
+		for _, nsec3 := range nsec3s {
+			if nsec3.Match(name) {
+				if !lacks(nsec3) {
+					return false, fmt.Errorf("NSEC3 for %s lists %s", name, dns.TypeToString[qtype])
+				}
+				return qtype == dns.TypeDS && hasType(nsec3.TypeBitMap, dns.TypeNS) && !hasType(nsec3.TypeBitMap, dns.TypeSOA), nil
+			}
+		}
+	}
+
+	encloser, covering := closestEncloser(nsec3s, zone, name)
+	if covering == nil {
+		return false, fmt.Errorf("no NSEC3 closest encloser proof for %s", name)
+	}
+	if covering.Flags&1 != 0 {
+		// Opt-out: unsigned delegations may exist in the span
+		return true, nil
+	}
+	wildcard := "*." + encloser
+	if encloser == "." {
+		wildcard = "*."
+	}
+	if nxdomain {
+		for _, nsec3 := range nsec3s {
+			if nsec3.Cover(wildcard) {
+				return false, nil
+			}
+		}
+		return false, fmt.Errorf("no NSEC3 proves %s does not exist", wildcard)
+	}
+	for _, nsec3 := range nsec3s {
+		if nsec3.Match(wildcard) && lacks(nsec3) {
+			return false, nil
+		}
+	}
+	return false, fmt.Errorf("no NSEC3 proves %s %s does not exist", name, dns.TypeToString[qtype])
+}
+
+// closestEncloser finds the deepest existing ancestor of name in zone
+// with an NSEC3 matching it, and the NSEC3 covering the next closer name
+func closestEncloser(nsec3s []*dns.NSEC3, zone, name string) (string, *dns.NSEC3) {
+	labels := dns.SplitDomainName(name)
+	for i := 1; i <= len(labels)-dns.CountLabel(zone); i++ {
+		encloser := dns.Fqdn(strings.Join(labels[i:], "."))
+		nextCloser := dns.Fqdn(strings.Join(labels[i-1:], "."))
+
+		var matched bool
+		var covering *dns.NSEC3
+		for _, nsec3 := range nsec3s {
+			if nsec3.Match(encloser) {
+				matched = true
+			}
+			if nsec3.Cover(nextCloser) {
+				covering = nsec3
+			}
+		}
+		if matched {
+			return encloser, covering
+		}
+	}
+	return "", nil
+}
+
+// nsecCovers reports whether name falls strictly between an NSEC record's
+// owner and next name in canonical order
+func nsecCovers(nsec *dns.NSEC, name string) bool {
+	owner, next := nsec.Hdr.Name, nsec.NextDomain
+	if canonicalCompare(owner, next) < 0 {
+		return canonicalCompare(owner, name) < 0 && canonicalCompare(name, next) < 0
+	}
+	// The zone's last NSEC points back to the apex
+	return canonicalCompare(owner, name) < 0
+}
+
+// canonicalCompare orders names canonically (RFC 4034 section 6.1): label
+// by label from the root, case-insensitively
+func canonicalCompare(a, b string) int {
+	labelsA := dns.SplitDomainName(strings.ToLower(a))
+	labelsB := dns.SplitDomainName(strings.ToLower(b))
+	for i, j := len(labelsA)-1, len(labelsB)-1; i >= 0 && j >= 0; i, j = i-1, j-1 {
+		if c := strings.Compare(labelsA[i], labelsB[j]); c != 0 {
+			return c
+		}
+	}
+	return len(labelsA) - len(labelsB)
+}
+
+// hasType reports whether an NSEC or NSEC3 type bitmap lists qtype
+func hasType(bitmap []uint16, qtype uint16) bool {
+	for _, t := range bitmap {
+		if t == qtype {
+			return true
+		}
+	}
+	return false
+}
+
+// hasRRset reports whether a section holds records of qtype owned by name
+func hasRRset(rrs []dns.RR, name string, qtype uint16) bool {
+	for _, rr := range rrs {
+		if rr.Header().Rrtype == qtype && strings.EqualFold(rr.Header().Name, name) {
+			return true
+		}
+	}
+	return false
+}
+
+// synthesizedCNAME reports whether a CNAME was synthesized from a DNAME in
+// the same answer; those are unsigned and follow from the signed DNAME
+func synthesizedCNAME(answer []dns.RR, rr dns.RR) bool {
+	if rr.Header().Rrtype != dns.TypeCNAME {
+		return false
+	}
+	for _, other := range answer {
+		if dname, ok := other.(*dns.DNAME); ok && dns.IsSubDomain(dname.Hdr.Name, rr.Header().Name) {
+			return true
+		}
+	}
+	return false
+}
+
+// rrsets groups a section's records by owner, type and class, in order of
+// first appearance
+func rrsets(rrs []dns.RR) [][]dns.RR {
+	type setKey struct {
+		name   string
+		rrtype uint16
+		class  uint16
+	}
+	index := make(map[setKey]int)
+	var sets [][]dns.RR
+	for _, rr := range rrs {
+		hdr := rr.Header()
+		key := setKey{strings.ToLower(hdr.Name), hdr.Rrtype, hdr.Class}
+		if i, ok := index[key]; ok {
+			sets[i] = append(sets[i], rr)
+			continue
+		}
+		index[key] = len(sets)
+		sets = append(sets, []dns.RR{rr})
+	}
+	return sets
+}
+
+// signatures returns the RRSIGs in a section covering an RRset
+func signatures(rrs []dns.RR, hdr *dns.RR_Header) []*dns.RRSIG {
+	var sigs []*dns.RRSIG
+	for _, rr := range rrs {
+		if sig, ok := rr.(*dns.RRSIG); ok && sig.TypeCovered == hdr.Rrtype && strings.EqualFold(sig.Hdr.Name, hdr.Name) {
+			sigs = append(sigs, sig)
+		}
+	}
+	return sigs
+}
+
+// minTTL returns how long a sub-query's answer may be cached: its lowest
+// record TTL, within the validator's bounds
+func minTTL(msg *dns.Msg) time.Duration {
+	ttl := dnssecMaxCacheTTL
+	for _, section := range [][]dns.RR{msg.Answer, msg.Ns} {
+		for _, rr := range section {
+			ttl = min(ttl, time.Duration(rr.Header().Ttl)*time.Second)
+		}
+	}
+	return max(ttl, dnssecMinCacheTTL)
+}
+
+// cached returns what is known about a name, if it hasn't expired
+func (v *validator) cached(name string) *zoneCut {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+
+	cut, ok := v.zones[name]
+	if !ok || time.Now().After(cut.expires) {
+		return nil
+	}
+	return cut
+}
+
+// store caches what was learned about a name for ttl
+func (v *validator) store(name string, cut *zoneCut, ttl time.Duration) *zoneCut {
+	cut.expires = time.Now().Add(ttl)
+
+	v.mu.Lock()
+	defer v.mu.Unlock()
+
+	if len(v.zones) >= dnssecMaxZones {
+		v.zones = make(map[string]*zoneCut)
+	}
+	v.zones[name] = cut
+	return cut
+}
+
+// dnssecExchange sends one of the validator's DS or DNSKEY queries over
+// TCP to a backend the name routes to, with checking disabled so the
+// validator gets to judge the answer
+func (lb *LoadBalancer) dnssecExchange(name string, qtype uint16) (*dns.Msg, error) {
+	msg := new(dns.Msg)
+	msg.SetQuestion(name, qtype)
+	msg.SetEdns0(dnssecUDPSize, true)
+	msg.CheckingDisabled = true
+	query, err := msg.Pack()
+	if err != nil {
+		return nil, err
+	}
+
+	b, _ := selectBackend(lb.ctx, lb.poolsFor(query, localClient), query, localClient)
+	if b == nil {
+		return nil, errors.New("no healthy backends available")
+	}
+	raw, err := b.ForwardQueryTCP(query, lb.timeout())
+	if err != nil {
+		return nil, fmt.Errorf("%s %s query: %w", name, dns.TypeToString[qtype], err)
+	}
+
+	resp := new(dns.Msg)
+	if err := resp.Unpack(raw); err != nil {
+		return nil, fmt.Errorf("%s %s query: %w", name, dns.TypeToString[qtype], err)
+	}
+	if resp.Rcode != dns.RcodeSuccess && resp.Rcode != dns.RcodeNameError {
+		return nil, fmt.Errorf("%s %s query answered %s", name, dns.TypeToString[qtype], dns.RcodeToString[resp.Rcode])
+	}
+	return resp, nil
+}
+
+// DNSSECStats returns the validation counters and the number of zone cuts
+// cached, or nil if validation is disabled
+func (lb *LoadBalancer) DNSSECStats() map[string]interface{} {
+	v := lb.validator
+	if v == nil {
+		return nil
+	}
+
+	v.mu.Lock()
+	zones := len(v.zones)
+	v.mu.Unlock()
+
+	anchors := make([]string, 0, len(v.anchors))
+	for zone := range v.anchors {
+		anchors = append(anchors, zone)
+	}
+
+	return map[string]interface{}{
+		"secure":        atomic.LoadUint64(&v.secure),
+		"insecure":      atomic.LoadUint64(&v.insecure),
+		"bogus":         atomic.LoadUint64(&v.bogus),
+		"cached_zones":  zones,
+		"trust_anchors": anchors,
+	}
+}
@@ -0,0 +1,94 @@
+package lb
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+
+	"github.com/miekg/dns"
+)
+
+// nsec3Base32 is the base32hex alphabet NSEC3 hashes are written in
+const nsec3Base32 = "0123456789ABCDEFGHIJKLMNOPQRSTUV"
+
+// nsec3Proof builds NSEC3 records for example.com. with a salt that keeps
+// every hash clear of the ends of the alphabet, so a record covering one
+// name is a narrow span around its hash that covers nothing else
+type nsec3Proof struct {
+	salt string
+}
+
+func newNSEC3Proof(t *testing.T, names ...string) *nsec3Proof {
+	for i := 0; i < 256; i++ {
+		p := &nsec3Proof{salt: fmt.Sprintf("%02X", i)}
+		ok := true
+		for _, name := range names {
+			last := p.hash(name)[31]
+			if last == nsec3Base32[0] || last == nsec3Base32[len(nsec3Base32)-1] {
+				ok = false
+			}
+		}
+		if ok {
+			return p
+		}
+	}
+	t.Fatal("no salt keeps the hashes clear of the alphabet's ends")
+	return nil
+}
+
+func (p *nsec3Proof) hash(name string) string {
+	return dns.HashName(name, dns.SHA1, 0, p.salt)
+}
+
+func (p *nsec3Proof) record(owner, next string, types ...uint16) *dns.NSEC3 {
+	return &dns.NSEC3{
+		Hdr:        dns.RR_Header{Name: owner + ".example.com.", Rrtype: dns.TypeNSEC3, Class: dns.ClassINET, Ttl: 300},
+		Hash:       dns.SHA1,
+		Iterations: 0,
+		SaltLength: uint8(len(p.salt) / 2),
+		Salt:       p.salt,
+		HashLength: 20,
+		NextDomain: next,
+		TypeBitMap: types,
+	}
+}
+
+// match returns an NSEC3 matching name with the given types
+func (p *nsec3Proof) match(name string, types ...uint16) *dns.NSEC3 {
+	h := p.hash(name)
+	return p.record(h, shiftHash(h, 1), types...)
+}
+
+// cover returns an NSEC3 covering name
+func (p *nsec3Proof) cover(name string) *dns.NSEC3 {
+	h := p.hash(name)
+	return p.record(shiftHash(h, -1), shiftHash(h, 1))
+}
+
+// shiftHash moves the last character of a hash by delta in the alphabet
+func shiftHash(h string, delta int) string {
+	i := strings.IndexByte(nsec3Base32, h[len(h)-1])
+	return h[:len(h)-1] + string(nsec3Base32[i+delta])
+}
+
+// TestDenyNSEC3NXDomain checks an NSEC3 NXDOMAIN proof needs the wildcard
+// at the closest encloser covered as well as the next closer name
+func TestDenyNSEC3NXDomain(t *testing.T) {
+	const (
+		zone     = "example.com."
+		name     = "b.example.com."
+		wildcard = "*.example.com."
+	)
+	p := newNSEC3Proof(t, zone, name, wildcard)
+	encloser := p.match(zone, dns.TypeNS, dns.TypeSOA, dns.TypeRRSIG, dns.TypeDNSKEY, dns.TypeNSEC3PARAM)
+
+	insecure, err := denyNSEC3([]*dns.NSEC3{encloser, p.cover(name), p.cover(wildcard)}, zone, name, dns.TypeA, true)
+	if err != nil || insecure {
+		t.Fatalf("wildcard covered: got insecure %v, error %v", insecure, err)
+	}
+
+	_, err = denyNSEC3([]*dns.NSEC3{encloser, p.cover(name)}, zone, name, dns.TypeA, true)
+	if err == nil {
+		t.Fatal("wildcard not covered: proof accepted")
+	}
+}
@@ -0,0 +1,273 @@
+package lb
+
+import (
+	"context"
+	"crypto/sha256"
+	"crypto/subtle"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/base64"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/netip"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/miekg/dns"
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	// dohContentType is the media type for DNS wire-format messages (RFC 8484)
+	dohContentType = "application/dns-message"
+
+	// dohDefaultPath is used when no path is configured
+	dohDefaultPath = "/dns-query"
+
+	// dohMaxMessageSize caps POST bodies at the largest possible DNS message
+	dohMaxMessageSize = 65535
+)
+
+// startDoH starts the DNS-over-HTTPS listener
+func (lb *LoadBalancer) startDoH() error {
+	path := lb.dohConfig.Path
+	if path == "" {
+		path = dohDefaultPath
+	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc(path, lb.serveDoH)
+
+	listener, err := net.Listen("tcp", lb.dohConfig.Listen)
+	if err != nil {
+		return fmt.Errorf("failed to listen on %s (doh): %w", lb.dohConfig.Listen, err)
+	}
+
+	lb.dohServer = &http.Server{
+		Handler:           mux,
+		ReadHeaderTimeout: 5 * time.Second,
+		IdleTimeout:       60 * time.Second,
+	}
+	useTLS := lb.dohConfig.CertFile != ""
+	if lb.dohConfig.ClientCAFile != "" {
+		tlsConfig, err := dohClientAuth(lb.dohConfig.ClientCAFile, len(lb.dohConfig.Tokens) > 0)
+		if err != nil {
+			listener.Close()
+			return err
+		}
+		lb.dohServer.TLSConfig = tlsConfig
+	}
+	// The certificate is loaded here rather than by ServeTLS, so a bad one
+	// fails the start instead of only being logged
+	if useTLS {
+		cert, err := tls.LoadX509KeyPair(lb.dohConfig.CertFile, lb.dohConfig.KeyFile)
+		if err != nil {
+			listener.Close()
+			return fmt.Errorf("failed to load doh certificate: %w", err)
+		}
+		if lb.dohServer.TLSConfig == nil {
+			lb.dohServer.TLSConfig = &tls.Config{}
+		}
+		lb.dohServer.TLSConfig.Certificates = []tls.Certificate{cert}
+	}
+	lb.dohTokens = nil
+	for _, token := range lb.dohConfig.Tokens {
+		lb.dohTokens = append(lb.dohTokens, sha256.Sum256([]byte(token)))
+	}
+
+	listener = lb.wrapStreamListener(listener)
+
+	lb.wg.Add(1)
+	go func() {
+		defer lb.wg.Done()
+
+		var err error
+		if useTLS {
+			err = lb.dohServer.ServeTLS(listener, "", "")
+		} else {
+			err = lb.dohServer.Serve(listener)
+		}
+		if err != nil && err != http.ErrServerClosed {
+			lb.logger.WithError(err).Error("DoH server failed")
+		}
+	}()
+
+	logger := lb.logger.WithFields(logrus.Fields{
+		"address":     lb.dohConfig.Listen,
+		"path":        path,
+		"tls":         useTLS,
+		"client_auth": lb.dohConfig.ClientCAFile != "" || len(lb.dohTokens) > 0,
+	})
+	if !useTLS {
+		logger.Warn("DoH listener started without TLS, expecting a TLS-terminating proxy in front")
+	} else {
+		logger.Info("DoH listener started")
+	}
+
+	return nil
+}
+
+// dohClientAuth returns the TLS settings that verify DoH clients against
+// the CA in caFile. When tokens are accepted as well, a client without a
+// certificate is let through to present one instead.
+func dohClientAuth(caFile string, tokens bool) (*tls.Config, error) {
+	pem, err := os.ReadFile(caFile)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read doh client CA file: %w", err)
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(pem) {
+		return nil, fmt.Errorf("no certificates found in doh client CA file %s", caFile)
+	}
+
+	cfg := &tls.Config{
+		ClientCAs:  pool,
+		ClientAuth: tls.RequireAndVerifyClientCert,
+	}
+	if tokens {
+		cfg.ClientAuth = tls.VerifyClientCertIfGiven
+	}
+	return cfg, nil
+}
+
+// dohAuthorized reports whether a DoH request may be served: client
+// authentication is off, the client presented a certificate the CA
+// verified, or the request carries one of the bearer tokens
+func (lb *LoadBalancer) dohAuthorized(r *http.Request) bool {
+	if lb.dohConfig.ClientCAFile == "" && len(lb.dohTokens) == 0 {
+		return true
+	}
+	if lb.dohConfig.ClientCAFile != "" && r.TLS != nil && len(r.TLS.VerifiedChains) > 0 {
+		return true
+	}
+
+	scheme, token, ok := strings.Cut(r.Header.Get("Authorization"), " ")
+	if !ok || !strings.EqualFold(scheme, "Bearer") {
+		return false
+	}
+	// Compare hashes in constant time so the tokens can't be guessed from
+	// response times
+	sum := sha256.Sum256([]byte(strings.TrimSpace(token)))
+	authorized := 0
+	for _, accepted := range lb.dohTokens {
+		authorized |= subtle.ConstantTimeCompare(sum[:], accepted[:])
+	}
+	return authorized == 1
+}
+
+// stopDoH gracefully shuts down the DoH listener
+func (lb *LoadBalancer) stopDoH() {
+	if lb.dohServer == nil {
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	if err := lb.dohServer.Shutdown(ctx); err != nil {
+		lb.logger.WithError(err).Error("Error closing DoH listener")
+	}
+}
+
+// serveDoH handles a single DNS-over-HTTPS request (GET or POST)
+func (lb *LoadBalancer) serveDoH(w http.ResponseWriter, r *http.Request) {
+	if !lb.dohAuthorized(r) {
+		lb.logger.WithField("client", lb.privacy.client(dohClientAddr(r))).Debug("Unauthorized DoH request")
+		if len(lb.dohTokens) > 0 {
+			w.Header().Set("WWW-Authenticate", `Bearer realm="dns"`)
+		}
+		http.Error(w, "unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	var query []byte
+
+	switch r.Method {
+	case http.MethodGet:
+		param := r.URL.Query().Get("dns")
+		if param == "" {
+			http.Error(w, "missing dns parameter", http.StatusBadRequest)
+			return
+		}
+
+		var err error
+		query, err = base64.RawURLEncoding.DecodeString(param)
+		if err != nil {
+			http.Error(w, "invalid dns parameter", http.StatusBadRequest)
+			return
+		}
+
+	case http.MethodPost:
+		if r.Header.Get("Content-Type") != dohContentType {
+			http.Error(w, "unsupported content type", http.StatusUnsupportedMediaType)
+			return
+		}
+
+		var err error
+		query, err = io.ReadAll(io.LimitReader(r.Body, dohMaxMessageSize+1))
+		if err != nil {
+			http.Error(w, "failed to read request body", http.StatusBadRequest)
+			return
+		}
+		if len(query) > dohMaxMessageSize {
+			http.Error(w, "request body too large", http.StatusRequestEntityTooLarge)
+			return
+		}
+
+	default:
+		w.Header().Set("Allow", "GET, POST")
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	if len(query) < 12 {
+		http.Error(w, "malformed DNS message", http.StatusBadRequest)
+		return
+	}
+
+	response := lb.resolve(query, dohClientAddr(r))
+	if response == nil {
+		http.Error(w, "upstream query failed", http.StatusBadGateway)
+		return
+	}
+
+	w.Header().Set("Content-Type", dohContentType)
+	if ttl, ok := minResponseTTL(response); ok {
+		w.Header().Set("Cache-Control", fmt.Sprintf("max-age=%d", ttl))
+	}
+	w.Write(response)
+}
+
+// dohClientAddr converts the HTTP remote address into a net.Addr
+func dohClientAddr(r *http.Request) net.Addr {
+	addrPort, err := netip.ParseAddrPort(r.RemoteAddr)
+	if err != nil {
+		return &net.TCPAddr{}
+	}
+	return net.TCPAddrFromAddrPort(addrPort)
+}
+
+// minResponseTTL returns the smallest TTL in the answer and authority
+// sections, used as the HTTP cache lifetime of a DoH response
+func minResponseTTL(response []byte) (uint32, bool) {
+	msg := new(dns.Msg)
+	if err := msg.Unpack(response); err != nil {
+		return 0, false
+	}
+
+	found := false
+	var ttl uint32
+	for _, section := range [][]dns.RR{msg.Answer, msg.Ns} {
+		for _, rr := range section {
+			if !found || rr.Header().Ttl < ttl {
+				ttl = rr.Header().Ttl
+				found = true
+			}
+		}
+	}
+
+	return ttl, found
+}
@@ -0,0 +1,73 @@
+package lb
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+)
+
+// DumpStats writes a readable snapshot of the backends, counters, cache
+// and queries in flight to the log, one line per subject, so the state of
+// a running instance can be had with nothing but a signal
+func (lb *LoadBalancer) DumpStats() {
+	logger := lb.logger.WithField("dump", "stats")
+	backends := lb.allBackends()
+	logger.Infof("Statistics dump: %d backends", len(backends))
+
+	var inFlight int64
+	for _, b := range backends {
+		stats := b.Stats()
+		state := backendState(stats)
+		inFlight += stats["in_flight"].(int64)
+		logger.Infof("Backend %s: %s, %d in flight, %d queries, %d failures, latency %s (%s), responses %s",
+			b.Address, state, stats["in_flight"].(int64), stats["total_queries"].(uint64), stats["total_failures"].(uint64),
+			stats["latency_ewma"].(time.Duration).Round(time.Microsecond), dumpPercentiles(stats["latency_percentiles"].(map[string]interface{})),
+			dumpCounts(stats["rcodes"].(map[string]uint64)))
+	}
+	logger.Infof("Latency: %s", dumpPercentiles(lb.latency.Snapshot()))
+
+	counters := lb.CounterStats()
+	logger.Infof("Queries by type: %s", dumpCounts(counters["qtypes"].(map[string]uint64)))
+	logger.Infof("Responses by rcode: %s, dropped %d", dumpCounts(counters["rcodes"].(map[string]uint64)), counters["dropped"].(uint64))
+
+	if o := lb.OverloadStats(); o != nil {
+		logger.Infof("In flight: %d queries (ceiling %d), %d forwarded to backends", o["in_flight"], o["max_in_flight"], inFlight)
+	} else {
+		logger.Infof("In flight: %d queries forwarded to backends", inFlight)
+	}
+
+	if c := lb.CacheStats(); c != nil {
+		logger.Infof("Cache: %d entries (%d bytes), %d hits, %d misses, hit ratio %.1f%%, %d evictions",
+			c["entries"], c["bytes"], c["hits"], c["misses"], c["hit_ratio"].(float64)*100, c["evictions"])
+	} else {
+		logger.Info("Cache: not enabled")
+	}
+}
+
+// dumpPercentiles formats latency percentiles as "p50=1.2ms p95=..."
+func dumpPercentiles(stats map[string]interface{}) string {
+	if stats["count"].(uint64) == 0 {
+		return "no recent answers"
+	}
+	return fmt.Sprintf("p50=%gms p95=%gms p99=%gms", stats["p50_ms"], stats["p95_ms"], stats["p99_ms"])
+}
+
+// dumpCounts formats a count map as "NAME=count" pairs in name order
+func dumpCounts(counts map[string]uint64) string {
+	if len(counts) == 0 {
+		return "none"
+	}
+
+	names := make([]string, 0, len(counts))
+	for name := range counts {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	pairs := make([]string, len(names))
+	for i, name := range names {
+		pairs[i] = fmt.Sprintf("%s=%d", name, counts[name])
+	}
+	return strings.Join(pairs, " ")
+}
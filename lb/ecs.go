@@ -0,0 +1,99 @@
+package lb
+
+import (
+	"net"
+
+	"github.com/aram535/dnsbalancer/backend"
+	"github.com/aram535/dnsbalancer/config"
+	"github.com/miekg/dns"
+)
+
+// EDNS Client Subnet modes
+const (
+	ecsForward = "forward" // Relay whatever the client sent
+	ecsStrip   = "strip"   // Remove client subnet options
+	ecsInject  = "inject"  // Replace them with the real client's subnet
+)
+
+const (
+	// Prefix lengths injected when none is configured, as recommended by
+	// RFC 7871 section 11.1
+	ecsDefaultIPv4Prefix = 24
+	ecsDefaultIPv6Prefix = 56
+)
+
+// ecsPolicy decides what client subnet information reaches a backend
+type ecsPolicy struct {
+	mode       string
+	ipv4Prefix uint8
+	ipv6Prefix uint8
+}
+
+// newECSPolicy builds a policy from its configuration; nil means forward
+func newECSPolicy(cfg *config.ECSConfig) ecsPolicy {
+	policy := ecsPolicy{
+		mode:       ecsForward,
+		ipv4Prefix: ecsDefaultIPv4Prefix,
+		ipv6Prefix: ecsDefaultIPv6Prefix,
+	}
+	if cfg == nil {
+		return policy
+	}
+
+	if cfg.Mode != "" {
+		policy.mode = cfg.Mode
+	}
+	if cfg.IPv4Prefix != 0 {
+		policy.ipv4Prefix = uint8(cfg.IPv4Prefix)
+	}
+	if cfg.IPv6Prefix != 0 {
+		policy.ipv6Prefix = uint8(cfg.IPv6Prefix)
+	}
+
+	return policy
+}
+
+// ecsPolicyFor returns the policy for a backend, falling back to the
+// global one
+func (lb *LoadBalancer) ecsPolicyFor(b *backend.Backend) ecsPolicy {
+	if policy, ok := lb.active.Load().ecs[b]; ok {
+		return policy
+	}
+	return lb.ecs
+}
+
+// clientSubnet builds the ECS option describing a client's network, or
+// nil if the client has no IP address (e.g. unix socket clients)
+func (p ecsPolicy) clientSubnet(clientAddr net.Addr) *dns.EDNS0_SUBNET {
+	ip := addrIP(clientAddr)
+	if ip == nil {
+		return nil
+	}
+
+	subnet := &dns.EDNS0_SUBNET{Code: dns.EDNS0SUBNET}
+	if ip4 := ip.To4(); ip4 != nil {
+		subnet.Family = 1
+		subnet.SourceNetmask = p.ipv4Prefix
+		subnet.Address = ip4.Mask(net.CIDRMask(int(p.ipv4Prefix), 32))
+	} else {
+		subnet.Family = 2
+		subnet.SourceNetmask = p.ipv6Prefix
+		subnet.Address = ip.Mask(net.CIDRMask(int(p.ipv6Prefix), 128))
+	}
+
+	return subnet
+}
+
+// removeECS drops client subnet options from an OPT record, reporting
+// whether there were any
+func removeECS(opt *dns.OPT) bool {
+	options := opt.Option[:0]
+	for _, option := range opt.Option {
+		if option.Option() != dns.EDNS0SUBNET {
+			options = append(options, option)
+		}
+	}
+	removed := len(options) != len(opt.Option)
+	opt.Option = options
+	return removed
+}
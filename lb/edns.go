@@ -0,0 +1,144 @@
+package lb
+
+import (
+	"net"
+
+	"github.com/miekg/dns"
+)
+
+// queryRewrite records the EDNS0 changes made to a query on its way
+// upstream that have to be undone in the response
+type queryRewrite struct {
+	addedOPT bool // The client sent no OPT record
+	addedECS bool // The client subnet option was ours, not the client's
+}
+
+// upstreamQuery rewrites a client query for a backend. UDP queries
+// advertise the configured EDNS0 payload size, adding an OPT record if the
+// client sent none, and every query has the backend's client subnet policy
+// applied.
+func (lb *LoadBalancer) upstreamQuery(query []byte, clientAddr net.Addr, ecs ecsPolicy, stream bool) ([]byte, queryRewrite) {
+	var rewrite queryRewrite
+
+	setSize := !stream && lb.ednsUDPSize != 0
+	if !setSize && ecs.mode == ecsForward {
+		return query, rewrite
+	}
+
+	msg := new(dns.Msg)
+	if err := msg.Unpack(query); err != nil {
+		return query, rewrite
+	}
+
+	changed := false
+	opt := msg.IsEdns0()
+
+	if setSize {
+		if opt == nil {
+			msg.SetEdns0(lb.ednsUDPSize, false)
+			opt = msg.IsEdns0()
+			rewrite.addedOPT = true
+			changed = true
+		} else if opt.UDPSize() != lb.ednsUDPSize {
+			opt.SetUDPSize(lb.ednsUDPSize)
+			changed = true
+		}
+	}
+
+	switch ecs.mode {
+	case ecsStrip:
+		if opt != nil && removeECS(opt) {
+			changed = true
+		}
+	case ecsInject:
+		subnet := ecs.clientSubnet(clientAddr)
+		if subnet == nil {
+			break
+		}
+		if opt == nil {
+			// Keep the client's classic 512 byte limit
+			size := lb.ednsUDPSize
+			if size == 0 || stream {
+				size = dns.MinMsgSize
+			}
+			msg.SetEdns0(size, false)
+			opt = msg.IsEdns0()
+			rewrite.addedOPT = true
+		}
+		removeECS(opt)
+		opt.Option = append(opt.Option, subnet)
+		rewrite.addedECS = true
+		changed = true
+	}
+
+	if !changed {
+		return query, queryRewrite{}
+	}
+
+	packed, err := msg.Pack()
+	if err != nil {
+		return query, queryRewrite{}
+	}
+
+	return packed, rewrite
+}
+
+// restore undoes a query rewrite in the backend's response, so clients
+// never see EDNS0 data they did not ask for
+func (r queryRewrite) restore(response []byte) []byte {
+	switch {
+	case r.addedOPT:
+		return stripOPT(response)
+	case r.addedECS:
+		return stripResponseECS(response)
+	}
+	return response
+}
+
+// stripOPT removes the OPT record from a response to a client that did
+// not use EDNS0
+func stripOPT(response []byte) []byte {
+	msg := new(dns.Msg)
+	if err := msg.Unpack(response); err != nil {
+		return response
+	}
+
+	extra := msg.Extra[:0]
+	for _, rr := range msg.Extra {
+		if rr.Header().Rrtype != dns.TypeOPT {
+			extra = append(extra, rr)
+		}
+	}
+	msg.Extra = extra
+
+	// Extended RCODE bits lived in the OPT record
+	msg.Rcode &= 0x0f
+
+	packed, err := msg.Pack()
+	if err != nil {
+		return response
+	}
+
+	return packed
+}
+
+// stripResponseECS removes the client subnet option a backend echoed for a
+// subnet we injected
+func stripResponseECS(response []byte) []byte {
+	msg := new(dns.Msg)
+	if err := msg.Unpack(response); err != nil {
+		return response
+	}
+
+	opt := msg.IsEdns0()
+	if opt == nil || !removeECS(opt) {
+		return response
+	}
+
+	packed, err := msg.Pack()
+	if err != nil {
+		return response
+	}
+
+	return packed
+}
@@ -0,0 +1,188 @@
+package lb
+
+import (
+	"fmt"
+	"net"
+	"strings"
+
+	"github.com/aram535/dnsbalancer/backend"
+	"github.com/aram535/dnsbalancer/config"
+	"github.com/oschwald/maxminddb-golang"
+	"github.com/sirupsen/logrus"
+)
+
+// geoRecord is the part of a Country or City database record used for
+// routing. registered_country stands in for networks without a country,
+// e.g. anycast ranges.
+type geoRecord struct {
+	Country struct {
+		ISOCode string `maxminddb:"iso_code"`
+	} `maxminddb:"country"`
+	RegisteredCountry struct {
+		ISOCode string `maxminddb:"iso_code"`
+	} `maxminddb:"registered_country"`
+	Continent struct {
+		Code string `maxminddb:"code"`
+	} `maxminddb:"continent"`
+}
+
+// asnRecord is the part of an ASN database record used for routing
+type asnRecord struct {
+	ASN uint `maxminddb:"autonomous_system_number"`
+}
+
+// geoRoute sends queries from clients in its regions to its own pools
+type geoRoute struct {
+	countries  map[string]bool
+	continents map[string]bool
+	asns       map[uint]bool
+	pools      []*backendPool
+}
+
+// geoRouter looks client addresses up in GeoIP databases and picks the geo
+// route serving them
+type geoRouter struct {
+	countryDB *maxminddb.Reader
+	asnDB     *maxminddb.Reader
+	routes    []geoRoute
+}
+
+// newGeoRouter opens the GeoIP databases and creates the backends of every
+// geo route, returning the router along with all their backends. It
+// returns nil when GeoIP is not enabled.
+func newGeoRouter(cfg *config.Config, registry *backendRegistry, factory BalancerFactory, logger *logrus.Logger) (*geoRouter, []*backend.Backend, error) {
+	if cfg.GeoIP == nil || !cfg.GeoIP.Enabled {
+		return nil, nil, nil
+	}
+
+	g := &geoRouter{}
+	if cfg.GeoIP.Database != "" {
+		db, err := maxminddb.Open(cfg.GeoIP.Database)
+		if err != nil {
+			return nil, nil, fmt.Errorf("failed to open geoip database: %w", err)
+		}
+		g.countryDB = db
+	}
+	if cfg.GeoIP.ASNDatabase != "" {
+		db, err := maxminddb.Open(cfg.GeoIP.ASNDatabase)
+		if err != nil {
+			g.close()
+			return nil, nil, fmt.Errorf("failed to open geoip asn_database: %w", err)
+		}
+		g.asnDB = db
+	}
+
+	var all []*backend.Backend
+	for i, rcfg := range cfg.GeoRoutes {
+		backends, pools, err := newBackendSet(cfg, rcfg.Backends, registry, factory, logger)
+		if err != nil {
+			g.close()
+			return nil, nil, fmt.Errorf("geo_route %d: %w", i, err)
+		}
+
+		route := geoRoute{
+			countries:  make(map[string]bool),
+			continents: make(map[string]bool),
+			asns:       make(map[uint]bool),
+			pools:      pools,
+		}
+		for _, country := range rcfg.Countries {
+			route.countries[country] = true
+		}
+		for _, continent := range rcfg.Continents {
+			route.continents[continent] = true
+		}
+		for _, asn := range rcfg.ASNs {
+			route.asns[asn] = true
+		}
+		g.routes = append(g.routes, route)
+		all = append(all, backends...)
+
+		logger.WithFields(logrus.Fields{
+			"countries":  strings.Join(rcfg.Countries, ","),
+			"continents": strings.Join(rcfg.Continents, ","),
+			"asns":       len(rcfg.ASNs),
+			"backends":   len(backends),
+		}).Info("Registered geo route")
+	}
+
+	return g, all, nil
+}
+
+// match returns the pools of the geo route serving the client, or nil if
+// none does. A route listing the client's ASN wins over one listing its
+// country, which wins over one listing its continent.
+func (g *geoRouter) match(clientAddr net.Addr) []*backendPool {
+	if g == nil || len(g.routes) == 0 {
+		return nil
+	}
+
+	ip := addrIP(clientAddr)
+	if ip == nil {
+		return nil
+	}
+
+	if g.asnDB != nil {
+		var record asnRecord
+		if err := g.asnDB.Lookup(ip, &record); err == nil && record.ASN != 0 {
+			for _, route := range g.routes {
+				if route.asns[record.ASN] {
+					return route.pools
+				}
+			}
+		}
+	}
+
+	if g.countryDB != nil {
+		var record geoRecord
+		if err := g.countryDB.Lookup(ip, &record); err != nil {
+			return nil
+		}
+		country := record.Country.ISOCode
+		if country == "" {
+			country = record.RegisteredCountry.ISOCode
+		}
+		if country != "" {
+			for _, route := range g.routes {
+				if route.countries[country] {
+					return route.pools
+				}
+			}
+		}
+		if continent := record.Continent.Code; continent != "" {
+			for _, route := range g.routes {
+				if route.continents[continent] {
+					return route.pools
+				}
+			}
+		}
+	}
+
+	return nil
+}
+
+// allPools returns the pools of every geo route
+func (g *geoRouter) allPools() []*backendPool {
+	if g == nil {
+		return nil
+	}
+
+	var pools []*backendPool
+	for _, route := range g.routes {
+		pools = append(pools, route.pools...)
+	}
+	return pools
+}
+
+// close releases the GeoIP databases
+func (g *geoRouter) close() {
+	if g == nil {
+		return
+	}
+	if g.countryDB != nil {
+		g.countryDB.Close()
+	}
+	if g.asnDB != nil {
+		g.asnDB.Close()
+	}
+}
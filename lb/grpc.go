@@ -0,0 +1,316 @@
+package lb
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"time"
+
+	"github.com/aram535/dnsbalancer/backend"
+	"github.com/aram535/dnsbalancer/config"
+	"github.com/aram535/dnsbalancer/controlpb"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/types/known/timestamppb"
+)
+
+// startGRPC serves the control API over gRPC, the runtime API's status,
+// backend operations, reload, cache operations and live events for
+// external controllers
+func (lb *LoadBalancer) startGRPC() error {
+	listener, err := net.Listen("tcp", lb.grpcConfig.Listen)
+	if err != nil {
+		return fmt.Errorf("failed to listen on %s (grpc): %w", lb.grpcConfig.Listen, err)
+	}
+	lb.startStream()
+
+	lb.grpcServer = grpc.NewServer()
+	controlpb.RegisterControlServer(lb.grpcServer, &grpcControl{lb: lb})
+
+	lb.wg.Add(1)
+	go func() {
+		defer lb.wg.Done()
+		if err := lb.grpcServer.Serve(listener); err != nil {
+			lb.logger.WithError(err).Error("gRPC control API server failed")
+		}
+	}()
+
+	lb.logger.WithField("address", lb.grpcConfig.Listen).Info("gRPC control API started")
+	return nil
+}
+
+// stopGRPC gracefully shuts down the gRPC control API, cutting off the
+// calls still running after 5 seconds
+func (lb *LoadBalancer) stopGRPC() {
+	if lb.grpcServer == nil {
+		return
+	}
+
+	stopped := make(chan struct{})
+	go func() {
+		lb.grpcServer.GracefulStop()
+		close(stopped)
+	}()
+	select {
+	case <-stopped:
+	case <-time.After(5 * time.Second):
+		lb.grpcServer.Stop()
+	}
+}
+
+// grpcControl implements the gRPC control API over the load balancer
+type grpcControl struct {
+	controlpb.UnimplementedControlServer
+	lb *LoadBalancer
+}
+
+func (s *grpcControl) GetStatus(ctx context.Context, req *controlpb.GetStatusRequest) (*controlpb.Status, error) {
+	stats := s.lb.Status()
+	reply := &controlpb.Status{
+		Started:         timestamppb.New(s.lb.started),
+		UptimeSeconds:   stats["uptime_seconds"].(int64),
+		Ready:           stats["ready"].(bool),
+		Queries:         stats["queries"].(uint64),
+		HealthyBackends: int32(stats["healthy_backends"].(int)),
+		Latency:         latencyProto(stats["latency"].(map[string]interface{})),
+		Cache:           cacheProto(s.lb.CacheStats()),
+	}
+	if qps, ok := stats["qps"].(float64); ok {
+		reply.Qps = qps
+	}
+	if quorum, ok := stats["quorum"].(bool); ok {
+		reply.Quorum = &quorum
+	}
+	for _, b := range stats["backends"].([]map[string]interface{}) {
+		reply.Backends = append(reply.Backends, backendProto(b))
+	}
+	return reply, nil
+}
+
+func (s *grpcControl) ListBackends(ctx context.Context, req *controlpb.ListBackendsRequest) (*controlpb.BackendsResponse, error) {
+	return backendsResponse(s.lb.allBackends()), nil
+}
+
+func (s *grpcControl) DrainBackend(ctx context.Context, req *controlpb.BackendRequest) (*controlpb.BackendsResponse, error) {
+	return s.change(req, func(address string) ([]*backend.Backend, error) {
+		return s.lb.SetDraining(address, true)
+	})
+}
+
+func (s *grpcControl) UndrainBackend(ctx context.Context, req *controlpb.BackendRequest) (*controlpb.BackendsResponse, error) {
+	return s.change(req, func(address string) ([]*backend.Backend, error) {
+		return s.lb.SetDraining(address, false)
+	})
+}
+
+func (s *grpcControl) DisableBackend(ctx context.Context, req *controlpb.BackendRequest) (*controlpb.BackendsResponse, error) {
+	return s.change(req, func(address string) ([]*backend.Backend, error) {
+		return s.lb.SetDisabled(address, true)
+	})
+}
+
+func (s *grpcControl) EnableBackend(ctx context.Context, req *controlpb.BackendRequest) (*controlpb.BackendsResponse, error) {
+	return s.change(req, func(address string) ([]*backend.Backend, error) {
+		return s.lb.SetDisabled(address, false)
+	})
+}
+
+func (s *grpcControl) RemoveBackend(ctx context.Context, req *controlpb.BackendRequest) (*controlpb.BackendsResponse, error) {
+	return s.change(req, s.lb.RemoveBackend)
+}
+
+// change applies a change to the backends with the requested address,
+// answering with the backends changed
+func (s *grpcControl) change(req *controlpb.BackendRequest, apply func(address string) ([]*backend.Backend, error)) (*controlpb.BackendsResponse, error) {
+	if req.Address == "" {
+		return nil, status.Error(codes.InvalidArgument, "missing address")
+	}
+	changed, err := apply(req.Address)
+	if err == errLastBackend || errors.Is(err, errQuorumBackends) {
+		return nil, status.Error(codes.FailedPrecondition, err.Error())
+	} else if err != nil {
+		return nil, status.Error(codes.NotFound, err.Error())
+	}
+	return backendsResponse(changed), nil
+}
+
+func (s *grpcControl) AddBackend(ctx context.Context, req *controlpb.AddBackendRequest) (*controlpb.BackendsResponse, error) {
+	if req.Address == "" {
+		return nil, status.Error(codes.InvalidArgument, "missing address")
+	}
+	b, err := s.lb.AddBackend(config.BackendConfig{
+		Address:     req.Address,
+		Weight:      int(req.Weight),
+		Priority:    int(req.Priority),
+		MaxInflight: int(req.MaxInflight),
+	})
+	if err != nil {
+		return nil, status.Error(codes.InvalidArgument, err.Error())
+	}
+	return backendsResponse([]*backend.Backend{b}), nil
+}
+
+func (s *grpcControl) Reload(ctx context.Context, req *controlpb.ReloadRequest) (*controlpb.ReloadResponse, error) {
+	reload := s.lb.ReloadConfig
+	if req.DryRun {
+		reload = s.lb.CheckReloadConfig
+	}
+	summary, err := reload()
+	if err == errNoConfigLoader {
+		return nil, status.Error(codes.Unimplemented, err.Error())
+	} else if err != nil {
+		return nil, status.Error(codes.FailedPrecondition, "configuration rejected: "+err.Error())
+	}
+
+	reply := &controlpb.ReloadResponse{Restart: summary.Restart}
+	for _, change := range summary.Changes {
+		reply.Changes = append(reply.Changes, &controlpb.ReloadChange{
+			Setting: change.Setting,
+			Backend: change.Backend,
+			Action:  change.Action,
+			From:    change.From,
+			To:      change.To,
+		})
+	}
+	return reply, nil
+}
+
+func (s *grpcControl) GetCacheStats(ctx context.Context, req *controlpb.GetCacheStatsRequest) (*controlpb.CacheStats, error) {
+	stats := cacheProto(s.lb.CacheStats())
+	if stats == nil {
+		return nil, status.Error(codes.FailedPrecondition, "cache is not enabled")
+	}
+	return stats, nil
+}
+
+func (s *grpcControl) PurgeCache(ctx context.Context, req *controlpb.PurgeCacheRequest) (*controlpb.PurgeCacheResponse, error) {
+	var name string
+	var subdomains bool
+	switch {
+	case req.Name != "":
+		name = req.Name
+	case req.Suffix != "":
+		name, subdomains = req.Suffix, true
+	case req.All:
+		name, subdomains = ".", true
+	default:
+		return nil, status.Error(codes.InvalidArgument, "missing name, suffix or all")
+	}
+
+	purged, err := s.lb.PurgeCache(name, subdomains)
+	if err != nil {
+		return nil, status.Error(codes.FailedPrecondition, err.Error())
+	}
+	return &controlpb.PurgeCacheResponse{Purged: int64(purged)}, nil
+}
+
+// StreamEvents sends the live statistics stream's events until the client
+// cancels or the load balancer stops. A client that falls behind misses
+// events, as on the runtime API's /stream.
+func (s *grpcControl) StreamEvents(req *controlpb.StreamEventsRequest, stream controlpb.Control_StreamEventsServer) error {
+	events := s.lb.stream.subscribe()
+	defer s.lb.stream.unsubscribe(events)
+
+	for {
+		select {
+		case <-stream.Context().Done():
+			return nil
+		case <-s.lb.ctx.Done():
+			return nil
+		case event := <-events:
+			if err := stream.Send(eventProto(event)); err != nil {
+				return err
+			}
+		}
+	}
+}
+
+// eventProto converts a live statistics stream event
+func eventProto(event streamEvent) *controlpb.Event {
+	switch data := event.data.(type) {
+	case statsEvent:
+		stats := &controlpb.StatsEvent{
+			Time:        timestamppb.New(data.Time),
+			Queries:     data.Queries,
+			Rcodes:      data.Rcodes,
+			Dropped:     data.Dropped,
+			CacheHits:   data.CacheHits,
+			CacheMisses: data.CacheMisses,
+		}
+		for _, b := range data.Backends {
+			stats.Backends = append(stats.Backends, &controlpb.BackendCounts{
+				Address:  b.Address,
+				State:    b.State,
+				Queries:  b.Queries,
+				Failures: b.Failures,
+				InFlight: b.InFlight,
+			})
+		}
+		return &controlpb.Event{Event: &controlpb.Event_Stats{Stats: stats}}
+	case stateEvent:
+		return &controlpb.Event{Event: &controlpb.Event_BackendState{BackendState: &controlpb.BackendStateEvent{
+			Time:    timestamppb.New(data.Time),
+			Backend: data.Backend,
+			From:    data.From,
+			To:      data.To,
+		}}}
+	}
+	return &controlpb.Event{}
+}
+
+// backendsResponse lists backends with their state and statistics
+func backendsResponse(backends []*backend.Backend) *controlpb.BackendsResponse {
+	reply := &controlpb.BackendsResponse{}
+	for _, b := range backends {
+		reply.Backends = append(reply.Backends, backendProto(b.Stats()))
+	}
+	return reply
+}
+
+// backendProto converts a backend's statistics
+func backendProto(stats map[string]interface{}) *controlpb.Backend {
+	return &controlpb.Backend{
+		Address:       stats["address"].(string),
+		State:         backendState(stats),
+		Healthy:       stats["healthy"].(bool),
+		Ejected:       stats["ejected"].(bool),
+		Draining:      stats["draining"].(bool),
+		Disabled:      stats["disabled"].(bool),
+		InFlight:      stats["in_flight"].(int64),
+		TotalQueries:  stats["total_queries"].(uint64),
+		TotalFailures: stats["total_failures"].(uint64),
+		LatencyEwmaMs: float64(stats["latency_ewma"].(time.Duration)) / float64(time.Millisecond),
+		Latency:       latencyProto(stats["latency_percentiles"].(map[string]interface{})),
+		Rcodes:        stats["rcodes"].(map[string]uint64),
+		Qtypes:        stats["qtypes"].(map[string]uint64),
+	}
+}
+
+// latencyProto converts a latency percentiles snapshot
+func latencyProto(snapshot map[string]interface{}) *controlpb.Latency {
+	return &controlpb.Latency{
+		P50Ms: snapshot["p50_ms"].(float64),
+		P95Ms: snapshot["p95_ms"].(float64),
+		P99Ms: snapshot["p99_ms"].(float64),
+		Count: snapshot["count"].(uint64),
+	}
+}
+
+// cacheProto converts the cache statistics, nil when the cache is not
+// enabled
+func cacheProto(stats map[string]interface{}) *controlpb.CacheStats {
+	if stats == nil {
+		return nil
+	}
+	return &controlpb.CacheStats{
+		Entries:   int64(stats["entries"].(int)),
+		Bytes:     int64(stats["bytes"].(int)),
+		Hits:      stats["hits"].(uint64),
+		Misses:    stats["misses"].(uint64),
+		HitRatio:  stats["hit_ratio"].(float64),
+		Expired:   stats["expired"].(uint64),
+		Evictions: stats["evictions"].(uint64),
+	}
+}
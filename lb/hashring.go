@@ -0,0 +1,83 @@
+package lb
+
+import (
+	"hash/fnv"
+	"sort"
+	"strconv"
+
+	"github.com/aram535/dnsbalancer/backend"
+)
+
+// hashRingReplicas is the number of points each backend gets on the ring,
+// enough to spread keys evenly across a handful of backends
+const hashRingReplicas = 128
+
+// hashRing maps keys onto backends with consistent hashing, so a backend
+// going down or coming back only moves the keys it owns
+type hashRing struct {
+	points []uint64
+	owners []*backend.Backend
+}
+
+// newHashRing places every backend on the ring
+func newHashRing(backends []*backend.Backend) *hashRing {
+	type point struct {
+		hash  uint64
+		owner *backend.Backend
+	}
+
+	points := make([]point, 0, len(backends)*hashRingReplicas)
+	for _, b := range backends {
+		for i := 0; i < hashRingReplicas; i++ {
+			points = append(points, point{hashKey([]byte(b.Address + "#" + strconv.Itoa(i))), b})
+		}
+	}
+	sort.Slice(points, func(i, j int) bool { return points[i].hash < points[j].hash })
+
+	ring := &hashRing{
+		points: make([]uint64, len(points)),
+		owners: make([]*backend.Backend, len(points)),
+	}
+	for i, p := range points {
+		ring.points[i] = p.hash
+		ring.owners[i] = p.owner
+	}
+
+	return ring
+}
+
+// pick returns the first healthy backend at or after the key's position
+// on the ring, or nil if none is healthy
+func (r *hashRing) pick(key []byte) *backend.Backend {
+	if len(r.points) == 0 {
+		return nil
+	}
+
+	hash := hashKey(key)
+	start := sort.Search(len(r.points), func(i int) bool { return r.points[i] >= hash })
+
+	for i := 0; i < len(r.points); i++ {
+		owner := r.owners[(start+i)%len(r.points)]
+		if owner.Available() {
+			return owner
+		}
+	}
+
+	return nil
+}
+
+// hashKey hashes a ring key with 64-bit FNV-1a. FNV alone clusters keys
+// that differ only in their last bytes, as replica keys do, so the result
+// is run through the MurmurHash3 finalizer to spread them over the ring.
+func hashKey(key []byte) uint64 {
+	h := fnv.New64a()
+	h.Write(key)
+
+	x := h.Sum64()
+	x ^= x >> 33
+	x *= 0xff51afd7ed558ccd
+	x ^= x >> 33
+	x *= 0xc4ceb9fe1a85ec53
+	x ^= x >> 33
+	return x
+}
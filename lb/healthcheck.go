@@ -2,26 +2,65 @@ package lb
 
 import (
 	"context"
+	"math/rand"
+	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/sirupsen/logrus"
 	"github.com/aram535/dnsbalancer/backend"
 	"github.com/aram535/dnsbalancer/config"
+	"github.com/miekg/dns"
 )
 
+// defaultHealthCheckConcurrency is how many health checks may run at once
+// unless configured
+const defaultHealthCheckConcurrency = 10
+
 // HealthChecker performs periodic health checks on backends
 type HealthChecker struct {
 	backends         []*backend.Backend
 	config           *config.HealthCheckConfig
 	logger           *logrus.Logger
+	jitter           time.Duration
+	slots            chan struct{}                // Limits the checks running at once
+	running          map[*backend.Backend]bool    // Backends whose check has not finished yet
+	queries          []config.HealthCheckQuery
+	nextQuery        map[*backend.Backend]int     // Index of each backend's next query
+	onChange         func(*backend.Backend, bool) // Called after a backend's health changed
+	maxBackoff       int                          // Most rounds between probes of an unhealthy backend
+	backoff          map[*backend.Backend]int     // Rounds between probes of each backing off backend
+	skip             map[*backend.Backend]int     // Rounds each backing off backend still sits out
+	mu               sync.Mutex
 }
 
 // NewHealthChecker creates a new health checker instance
 func NewHealthChecker(backends []*backend.Backend, cfg *config.HealthCheckConfig, logger *logrus.Logger) *HealthChecker {
+	concurrency := cfg.Concurrency
+	if concurrency == 0 {
+		concurrency = defaultHealthCheckConcurrency
+	}
+	jitter := cfg.Jitter
+	if jitter == 0 {
+		jitter = cfg.Interval / 10
+	}
+	queries := cfg.Queries
+	if len(queries) == 0 {
+		queries = []config.HealthCheckQuery{{Name: cfg.QueryName, Type: cfg.QueryType}}
+	}
+
 	return &HealthChecker{
-		backends: backends,
-		config:   cfg,
-		logger:   logger,
+		backends:   backends,
+		config:     cfg,
+		logger:     logger,
+		jitter:     jitter,
+		slots:      make(chan struct{}, concurrency),
+		running:    make(map[*backend.Backend]bool),
+		queries:    queries,
+		nextQuery:  make(map[*backend.Backend]int),
+		maxBackoff: int(cfg.MaxBackoff / cfg.Interval),
+		backoff:    make(map[*backend.Backend]int),
+		skip:       make(map[*backend.Backend]int),
 	}
 }
 
@@ -31,12 +70,12 @@ func (hc *HealthChecker) Start(ctx context.Context) {
 
 	go func() {
 		// Perform initial health check immediately
-		hc.checkAllBackends()
+		hc.checkAllBackends(ctx, 0)
 
 		for {
 			select {
 			case <-ticker.C:
-				hc.checkAllBackends()
+				hc.checkAllBackends(ctx, hc.jitter)
 			case <-ctx.Done():
 				ticker.Stop()
 				hc.logger.Info("Health checker stopped")
@@ -50,24 +89,193 @@ func (hc *HealthChecker) Start(ctx context.Context) {
 		"timeout":            hc.config.Timeout,
 		"failure_threshold":  hc.config.FailureThreshold,
 		"success_threshold":  hc.config.SuccessThreshold,
-		"query":              hc.config.QueryName,
+		"queries":            len(hc.queries),
+		"check_type":         hc.config.CheckType,
+		"concurrency":        cap(hc.slots),
+		"jitter":             hc.jitter,
+		"max_backoff":        hc.config.MaxBackoff,
 	}).Info("Health checker started")
 }
 
-// checkAllBackends performs health checks on all backends
-func (hc *HealthChecker) checkAllBackends() {
-	for _, backend := range hc.backends {
-		go hc.checkBackend(backend)
+// checkAllBackends performs health checks on all backends, each after a
+// random delay of up to jitter so probes don't go out in bursts, with at
+// most cap(slots) running at once. A backend whose previous check is still
+// running is skipped.
+func (hc *HealthChecker) checkAllBackends(ctx context.Context, jitter time.Duration) {
+	for _, b := range hc.checked() {
+		if b.IsDisabled() || hc.backingOff(b) {
+			continue
+		}
+		if !hc.claim(b) {
+			hc.logger.WithField("backend", b.Address).Debug("Previous health check still running, skipping")
+			continue
+		}
+
+		var delay time.Duration
+		if jitter > 0 {
+			delay = time.Duration(rand.Int63n(int64(jitter)))
+		}
+
+		go func(b *backend.Backend) {
+			defer hc.release(b)
+
+			timer := time.NewTimer(delay)
+			defer timer.Stop()
+			select {
+			case <-timer.C:
+			case <-ctx.Done():
+				return
+			}
+
+			select {
+			case hc.slots <- struct{}{}:
+			case <-ctx.Done():
+				return
+			}
+			defer func() { <-hc.slots }()
+
+			hc.checkBackend(b)
+		}(b)
+	}
+}
+
+// checked returns the backends being checked
+func (hc *HealthChecker) checked() []*backend.Backend {
+	hc.mu.Lock()
+	defer hc.mu.Unlock()
+	return hc.backends
+}
+
+// setBackends replaces the backends being checked, after backends are
+// added or removed, forgetting the state kept for those removed
+func (hc *HealthChecker) setBackends(backends []*backend.Backend) {
+	kept := make(map[*backend.Backend]bool, len(backends))
+	for _, b := range backends {
+		kept[b] = true
+	}
+
+	hc.mu.Lock()
+	defer hc.mu.Unlock()
+	hc.backends = backends
+	for b := range hc.nextQuery {
+		if !kept[b] {
+			delete(hc.nextQuery, b)
+		}
+	}
+	for b := range hc.backoff {
+		if !kept[b] {
+			delete(hc.backoff, b)
+			delete(hc.skip, b)
+		}
+	}
+}
+
+// claim marks a backend's check as running, reporting false if one
+// already is
+func (hc *HealthChecker) claim(b *backend.Backend) bool {
+	hc.mu.Lock()
+	defer hc.mu.Unlock()
+	if hc.running[b] {
+		return false
+	}
+	hc.running[b] = true
+	return true
+}
+
+// query returns the query for a backend's next check, taking the
+// configured queries in turn so a name a broken resolver still has cached
+// can't keep it passing
+func (hc *HealthChecker) query(b *backend.Backend) config.HealthCheckQuery {
+	hc.mu.Lock()
+	defer hc.mu.Unlock()
+	i := hc.nextQuery[b]
+	hc.nextQuery[b] = (i + 1) % len(hc.queries)
+	return hc.queries[i]
+}
+
+// backingOff reports whether an unhealthy backend sits out this round,
+// counting the round off if so
+func (hc *HealthChecker) backingOff(b *backend.Backend) bool {
+	hc.mu.Lock()
+	defer hc.mu.Unlock()
+	if hc.skip[b] == 0 {
+		return false
+	}
+	hc.skip[b]--
+	return true
+}
+
+// updateBackoff doubles the rounds between probes of a backend that is
+// still unhealthy after a failed check, up to maxBackoff, and returns to
+// probing every round once a check succeeds. It returns the new spacing.
+func (hc *HealthChecker) updateBackoff(b *backend.Backend, success, healthy bool) int {
+	hc.mu.Lock()
+	defer hc.mu.Unlock()
+	if success || healthy || hc.maxBackoff <= 1 {
+		delete(hc.backoff, b)
+		delete(hc.skip, b)
+		return 1
+	}
+
+	rounds := hc.backoff[b] * 2
+	if rounds == 0 {
+		rounds = 2
+	}
+	if rounds > hc.maxBackoff {
+		rounds = hc.maxBackoff
+	}
+	hc.backoff[b] = rounds
+	hc.skip[b] = rounds - 1
+	return rounds
+}
+
+// release marks a backend's check as finished
+func (hc *HealthChecker) release(b *backend.Backend) {
+	hc.mu.Lock()
+	defer hc.mu.Unlock()
+	delete(hc.running, b)
+}
+
+// checkOnce checks every backend once, waiting for the results, and
+// returns how many checks passed
+func (hc *HealthChecker) checkOnce() int {
+	var wg sync.WaitGroup
+	var passed int64
+	for _, b := range hc.checked() {
+		wg.Add(1)
+		go func(b *backend.Backend) {
+			defer wg.Done()
+			hc.slots <- struct{}{}
+			defer func() { <-hc.slots }()
+
+			if hc.checkBackend(b) {
+				atomic.AddInt64(&passed, 1)
+			}
+		}(b)
 	}
+	wg.Wait()
+	return int(passed)
 }
 
-// checkBackend performs a health check on a single backend
-func (hc *HealthChecker) checkBackend(b *backend.Backend) {
+// checkBackend performs a health check on a single backend and reports
+// whether it passed
+func (hc *HealthChecker) checkBackend(b *backend.Backend) bool {
 	logger := hc.logger.WithField("backend", b.Address)
 
-	err := b.HealthCheck(hc.config.QueryName, hc.config.QueryType, hc.config.Timeout)
+	query := hc.query(b)
+	logger = logger.WithField("query", query.Name+" "+query.Type)
+
+	start := time.Now()
+	err := b.HealthCheck(query.Name, query.Type, hc.config.Timeout)
 	success := err == nil
 
+	// Probe RTTs feed the latency average so the latency strategy has data
+	// on backends that get little live traffic. Only queries over the
+	// backend's own transport are comparable with live queries.
+	if success && (hc.config.CheckType == "" || hc.config.CheckType == backend.CheckDNS) {
+		b.RecordLatency(time.Since(start))
+	}
+
 	if !success {
 		logger.WithError(err).Debug("Health check failed")
 	}
@@ -85,8 +293,31 @@ func (hc *HealthChecker) checkBackend(b *backend.Backend) {
 		} else {
 			logger.Warn("Backend marked unhealthy")
 		}
+		if hc.onChange != nil {
+			hc.onChange(b, newHealth)
+		}
 	} else if !success {
 		// Log failures even if health hasn't changed yet
 		logger.Debug("Health check failed but threshold not reached")
 	}
+
+	if rounds := hc.updateBackoff(b, success, newHealth); rounds > 1 {
+		logger.WithField("next_check", time.Duration(rounds)*hc.config.Interval).Debug("Backing off unhealthy backend")
+	}
+
+	return success
+}
+
+// acceptRcodes returns the response codes passing health checks, or nil
+// for the backend default of NOERROR and NXDOMAIN
+func acceptRcodes(cfg *config.HealthCheckConfig) map[int]bool {
+	if len(cfg.AcceptRcodes) == 0 {
+		return nil
+	}
+
+	rcodes := make(map[int]bool, len(cfg.AcceptRcodes))
+	for _, name := range cfg.AcceptRcodes {
+		rcodes[dns.StringToRcode[name]] = true
+	}
+	return rcodes
 }
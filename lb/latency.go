@@ -0,0 +1,24 @@
+package lb
+
+import (
+	"github.com/aram535/dnsbalancer/backend"
+)
+
+// LatencyStats returns the p50, p95 and p99 time to answer over the last
+// minute or two: overall, from receiving a query to having its response,
+// cache hits and local answers included, and for each backend, of the
+// queries it answered
+func (lb *LoadBalancer) LatencyStats() map[string]interface{} {
+	all := lb.allBackends()
+	backends := make([]map[string]interface{}, len(all))
+	for i, b := range all {
+		stats := b.Stats()["latency_percentiles"].(map[string]interface{})
+		stats["address"] = b.Address
+		backends[i] = stats
+	}
+	return map[string]interface{}{
+		"window":   backend.QuantileWindow.String(),
+		"overall":  lb.latency.Snapshot(),
+		"backends": backends,
+	}
+}
@@ -2,86 +2,447 @@ package lb
 
 import (
 	"context"
+	"crypto/sha256"
 	"fmt"
 	"net"
 	"sync"
 	"sync/atomic"
+	"net/http"
+	"runtime"
 	"time"
 
 	"github.com/sirupsen/logrus"
 	"github.com/aram535/dnsbalancer/backend"
 	"github.com/aram535/dnsbalancer/config"
+	"github.com/aram535/dnsbalancer/dnscrypt"
+	"github.com/miekg/dns"
+	"google.golang.org/grpc"
+)
+
+// Source port randomization defaults
+const (
+	defaultSourcePortSockets = 8
+	defaultSourcePortMin     = 1024
+	defaultSourcePortMax     = 65535
+	defaultSourcePortQueries = 100
 )
 
 // LoadBalancer manages DNS query distribution across backends
 type LoadBalancer struct {
-	backends      []*backend.Backend
-	currentIndex  uint32
-	timeout       time.Duration
-	failBehavior  string // "closed" or "open"
-	logger        *logrus.Logger
-	healthChecker *HealthChecker
-	listener      *net.UDPConn
-	ctx           context.Context
-	cancel        context.CancelFunc
-	wg            sync.WaitGroup
+	active         atomic.Pointer[activeBackends] // Replaced as a whole when backends are added or removed
+	activeMu       sync.Mutex                     // Serializes the changes to active
+	config         *config.Config                 // Running configuration, guarded by activeMu once started
+	factory        BalancerFactory
+	loadConfig     ConfigLoader // Reads the configuration a reload applies
+	racePolicy     racePolicy
+	retryRcodes    map[int]bool // Response codes that send a query on to another backend
+	errorStreak    int          // Consecutive error responses marking a backend unhealthy, 0 = off
+	geo            *geoRouter
+	logger         *logrus.Logger
+	healthChecker  *HealthChecker
+	outliers       *OutlierDetector
+	quorum         *quorum
+	startupGate    *config.StartupGateConfig
+	cache          *responseCache
+	acl            *acl
+	rateLimiter    *rateLimiter
+	overload       *overload
+	privacy        *clientPrivacy
+	nxGuard        *nxdomainGuard
+	malformed      malformed
+	counters       counters
+	latency        backend.LatencyQuantiles // Time to answer queries, for percentiles
+	statsd         *statsdExporter
+	queryLog       *queryLog
+	topTalkers     *topTalkers
+	tracer         *tracer
+	webhooks       *webhooks
+	opcodeFilter   *opcodeFilter
+	qtypeFilter    *qtypeFilter
+	aaaaFilter     *aaaaFilter
+	allowlist      *allowlist
+	blocklist      *blocklist
+	localRecords   *localRecords
+	searchDomains  *searchDomains
+	zones          localZones
+	nxRedirect     *nxRedirect
+	ttlRules       *ttlRules
+	validator      *validator
+	ready          int32 // Set once serving, after the startup gate
+	started        time.Time
+	darkLaunch     *darkLaunch
+	listeners      []*net.UDPConn
+	udpSockets     int
+	ednsUDPSize    uint16
+	tcpListener    net.Listener
+	dohConfig      *config.DoHConfig
+	dohServer      *http.Server
+	dohTokens      [][sha256.Size]byte // Hashes of the bearer tokens accepted
+	dnscryptConfig *config.DNSCryptConfig
+	dnscrypt       *dnscrypt.Server
+	dnscryptUDP    *net.UDPConn
+	dnscryptTCP    net.Listener
+	proxyTrusted   []*net.IPNet
+	unixConfig     *config.UnixSocketConfig
+	unixListener   net.Listener
+	unixConn       *net.UnixConn
+	adminConfig    *config.AdminConfig
+	adminServer    *http.Server
+	stream         *statsStream
+	controlConfig  *config.ControlSocketConfig
+	controlServer  *http.Server
+	grpcConfig     *config.GRPCConfig
+	grpcServer     *grpc.Server
+	debugConfig    *config.DebugServerConfig
+	debugServer    *http.Server
+	ecs            ecsPolicy
+	ctx            context.Context
+	cancel         context.CancelFunc
+	wg             sync.WaitGroup
 }
 
 // New creates a new LoadBalancer instance
 func New(cfg *config.Config, logger *logrus.Logger) (*LoadBalancer, error) {
 	// Create backends
-	backends := make([]*backend.Backend, len(cfg.Backends))
-	for i, bcfg := range cfg.Backends {
-		backends[i] = backend.NewBackend(bcfg.Address)
-		logger.WithField("backend", bcfg.Address).Info("Registered backend")
+	registry := newBackendRegistry(nil, nil)
+	factory := strategyBalancer(cfg.Strategy)
+	active, err := newActiveBackends(cfg, registry, factory, logger)
+	if err != nil {
+		return nil, err
+	}
+
+	geo, geoBackends, err := newGeoRouter(cfg, registry, factory, logger)
+	if err != nil {
+		return nil, err
+	}
+	active.backends = append(active.backends, geoBackends...)
+	backends := active.backends
+
+	var proxyTrusted []*net.IPNet
+	if cfg.ProxyProto != nil && cfg.ProxyProto.Enabled {
+		var err error
+		proxyTrusted, err = config.ParseCIDRs(cfg.ProxyProto.TrustedProxies)
+		if err != nil {
+			return nil, fmt.Errorf("invalid proxy_protocol trusted_proxies: %w", err)
+		}
+	}
+
+	// One SO_REUSEPORT socket per CPU unless a count is configured
+	udpSockets := cfg.UDPSockets
+	if udpSockets == 0 {
+		udpSockets = runtime.NumCPU()
+	}
+
+	darkLaunch, err := newDarkLaunch(cfg, logger)
+	if err != nil {
+		return nil, fmt.Errorf("dark_launch candidate %s: %w", cfg.DarkLaunch.Candidate.Address, err)
+	}
+
+	quorum, err := newQuorum(cfg.Quorum, backends)
+	if err != nil {
+		return nil, err
+	}
+
+	ttlRules, err := newTTLRules(cfg.TTLRules)
+	if err != nil {
+		return nil, err
+	}
+
+	statsd, err := newStatsDExporter(cfg.StatsD, logger)
+	if err != nil {
+		return nil, err
+	}
+
+	cache, err := newResponseCache(cfg.Cache, ttlRules)
+	if err != nil {
+		return nil, err
+	}
+
+	acl, err := newACL(cfg.ACL)
+	if err != nil {
+		return nil, err
+	}
+
+	opcodeFilter, err := newOpcodeFilter(cfg.ZoneOperations)
+	if err != nil {
+		return nil, err
+	}
+
+	allowlist, err := newAllowlist(cfg.Allowlist)
+	if err != nil {
+		return nil, err
+	}
+
+	aaaaFilter, err := newAAAAFilter(cfg.FilterAAAA)
+	if err != nil {
+		return nil, err
+	}
+
+	localRecords, err := newLocalRecords(cfg.LocalRecords)
+	if err != nil {
+		return nil, err
+	}
+
+	zones, err := newLocalZones(cfg.Zones)
+	if err != nil {
+		return nil, err
+	}
+
+	nxRedirect, err := newNXRedirect(cfg.NXDomainRedirects)
+	if err != nil {
+		return nil, err
+	}
+
+	privacy, err := newClientPrivacy(cfg.Privacy)
+	if err != nil {
+		return nil, err
+	}
+
+	queryLog, err := newQueryLog(cfg.QueryLog, cfg.LogDir, privacy, logger)
+	if err != nil {
+		return nil, err
 	}
 
 	ctx, cancel := context.WithCancel(context.Background())
 
 	lb := &LoadBalancer{
-		backends:     backends,
-		timeout:      cfg.Timeout,
-		failBehavior: cfg.FailBehavior,
-		logger:       logger,
-		ctx:          ctx,
-		cancel:       cancel,
+		config:         cfg,
+		factory:        factory,
+		racePolicy:     newRacePolicy(cfg),
+		retryRcodes:    retryRcodes(cfg.Retry),
+		darkLaunch:     darkLaunch,
+		quorum:         quorum,
+		startupGate:    cfg.StartupGate,
+		cache:          cache,
+		acl:            acl,
+		rateLimiter:    newRateLimiter(cfg.RateLimit),
+		overload:       newOverload(cfg.Overload),
+		privacy:        privacy,
+		nxGuard:        newNXDomainGuard(cfg.NXDomainGuard, privacy, logger),
+		opcodeFilter:   opcodeFilter,
+		qtypeFilter:    newQtypeFilter(cfg.QueryTypes),
+		aaaaFilter:     aaaaFilter,
+		allowlist:      allowlist,
+		blocklist:      newBlocklist(cfg.Blocklist, logger),
+		localRecords:   localRecords,
+		searchDomains:  newSearchDomains(cfg.SearchDomains),
+		zones:          zones,
+		nxRedirect:     nxRedirect,
+		ttlRules:       ttlRules,
+		statsd:         statsd,
+		queryLog:       queryLog,
+		topTalkers:     newTopTalkers(cfg.TopTalkers, privacy),
+		tracer:         newTracer(logger),
+		webhooks:       newWebhooks(cfg.Webhooks, logger),
+		geo:            geo,
+		udpSockets:     udpSockets,
+		ednsUDPSize:    uint16(cfg.EDNSUDPSize),
+		dohConfig:      cfg.DoH,
+		dnscryptConfig: cfg.DNSCrypt,
+		proxyTrusted:   proxyTrusted,
+		unixConfig:     cfg.UnixSocket,
+		adminConfig:    cfg.Admin,
+		controlConfig:  cfg.ControlSocket,
+		grpcConfig:     cfg.GRPC,
+		debugConfig:    cfg.DebugServer,
+		ecs:            newECSPolicy(cfg.ECS),
+		logger:         logger,
+		ctx:            ctx,
+		cancel:         cancel,
+	}
+
+	lb.active.Store(active)
+
+	lb.validator, err = newValidator(cfg.DNSSEC, lb.dnssecExchange, logger)
+	if err != nil {
+		return nil, err
 	}
 
 	// Initialize health checker if enabled
 	if cfg.HealthCheck.Enabled {
 		lb.healthChecker = NewHealthChecker(backends, &cfg.HealthCheck, logger)
+		lb.errorStreak = cfg.HealthCheck.ErrorStreak
+		lb.healthChecker.onChange = lb.backendHealthChanged
 		logger.Info("Health checking enabled")
 	}
 
+	if cfg.OutlierDetection != nil && cfg.OutlierDetection.Enabled {
+		lb.outliers = NewOutlierDetector(lb.allPools(), cfg.OutlierDetection, logger)
+	}
+
 	return lb, nil
 }
 
 // Start begins listening for DNS queries
 func (lb *LoadBalancer) Start(listenAddr string) error {
-	addr, err := net.ResolveUDPAddr("udp", listenAddr)
-	if err != nil {
-		return fmt.Errorf("failed to resolve listen address: %w", err)
+	lb.started = time.Now()
+
+	// The admin API comes up first so readiness probes can see the
+	// instance is still waiting on the startup gate
+	if lb.adminConfig != nil && lb.adminConfig.Enabled {
+		if err := lb.startAdmin(); err != nil {
+			return err
+		}
+	}
+	if lb.controlConfig != nil && lb.controlConfig.Enabled {
+		if err := lb.startControl(); err != nil {
+			lb.stopAdmin()
+			return err
+		}
+	}
+	if lb.grpcConfig != nil && lb.grpcConfig.Enabled {
+		if err := lb.startGRPC(); err != nil {
+			lb.stopAdmin()
+			lb.stopControl()
+			return err
+		}
+	}
+	if lb.debugConfig != nil && lb.debugConfig.Enabled {
+		if err := lb.startDebug(); err != nil {
+			lb.stopAdmin()
+			lb.stopControl()
+			lb.stopGRPC()
+			return err
+		}
+	}
+
+	if lb.startupGate != nil && lb.startupGate.Enabled && lb.healthChecker != nil {
+		if err := lb.waitForHealthy(); err != nil {
+			lb.stopAdmin()
+			lb.stopControl()
+			lb.stopGRPC()
+			lb.stopDebug()
+			return err
+		}
+	}
+
+	// Blocked names must be known before the first query, warm-up included
+	lb.blocklist.start(lb.ctx, &lb.wg)
+	lb.warmUp()
+	lb.statsd.start(lb.ctx, &lb.wg, lb.metrics)
+	lb.topTalkers.start(lb.ctx, &lb.wg)
+	lb.webhooks.start(lb.ctx, &lb.wg)
+
+	if err := lb.listenUDP(listenAddr); err != nil {
+		lb.abortStart()
+		return err
 	}
 
-	lb.listener, err = net.ListenUDP("udp", addr)
+	tcpListener, err := net.Listen("tcp", listenAddr)
 	if err != nil {
-		return fmt.Errorf("failed to listen on %s: %w", listenAddr, err)
+		lb.abortStart()
+		return fmt.Errorf("failed to listen on %s (tcp): %w", listenAddr, err)
 	}
+	lb.tcpListener = lb.wrapStreamListener(tcpListener)
 
-	lb.logger.WithField("address", listenAddr).Info("DNS load balancer started")
+	if lb.dohConfig != nil && lb.dohConfig.Enabled {
+		if err := lb.startDoH(); err != nil {
+			lb.abortStart()
+			return err
+		}
+	}
+
+	if lb.dnscryptConfig != nil && lb.dnscryptConfig.Enabled {
+		if err := lb.startDNSCrypt(); err != nil {
+			lb.abortStart()
+			return err
+		}
+	}
+
+	if lb.unixConfig != nil && lb.unixConfig.Enabled {
+		if err := lb.startUnix(); err != nil {
+			lb.abortStart()
+			return err
+		}
+	}
+
+	lb.logger.WithFields(logrus.Fields{
+		"address":     listenAddr,
+		"udp_sockets": len(lb.listeners),
+	}).Info("DNS load balancer started")
 
 	// Start health checker if configured
+	if lb.outliers != nil {
+		lb.outliers.Start(lb.ctx)
+	}
+
 	if lb.healthChecker != nil {
 		lb.healthChecker.Start(lb.ctx)
 	}
 
 	// Start accepting queries
+	for _, conn := range lb.listeners {
+		lb.wg.Add(1)
+		go lb.acceptQueries(conn)
+	}
 	lb.wg.Add(1)
-	go lb.acceptQueries()
+	go lb.acceptTCP(lb.tcpListener, lb.resolve)
+
+	atomic.StoreInt32(&lb.ready, 1)
+	return nil
+}
+
+// listenUDP opens the UDP listening socket, or one socket per configured
+// accept loop bound with SO_REUSEPORT so the kernel spreads datagrams
+// across them
+func (lb *LoadBalancer) listenUDP(listenAddr string) error {
+	if lb.udpSockets <= 1 {
+		addr, err := net.ResolveUDPAddr("udp", listenAddr)
+		if err != nil {
+			return fmt.Errorf("failed to resolve listen address: %w", err)
+		}
+
+		conn, err := net.ListenUDP("udp", addr)
+		if err != nil {
+			return fmt.Errorf("failed to listen on %s: %w", listenAddr, err)
+		}
+
+		lb.listeners = []*net.UDPConn{conn}
+		return nil
+	}
+
+	for i := 0; i < lb.udpSockets; i++ {
+		conn, err := listenUDPReusePort(listenAddr)
+		if err != nil {
+			lb.closeListeners()
+			return fmt.Errorf("failed to listen on %s (socket %d): %w", listenAddr, i+1, err)
+		}
+		lb.listeners = append(lb.listeners, conn)
+	}
 
 	return nil
 }
 
+// abortStart undoes a Start that failed after the background workers
+// were launched: they are stopped and waited for, and the listeners
+// opened so far are closed
+func (lb *LoadBalancer) abortStart() {
+	lb.cancel()
+	lb.closeListeners()
+	lb.wg.Wait()
+}
+
+// closeListeners closes every open listening socket
+func (lb *LoadBalancer) closeListeners() {
+	for _, conn := range lb.listeners {
+		if err := conn.Close(); err != nil {
+			lb.logger.WithError(err).Error("Error closing listener")
+		}
+	}
+	if lb.tcpListener != nil {
+		if err := lb.tcpListener.Close(); err != nil {
+			lb.logger.WithError(err).Error("Error closing TCP listener")
+		}
+	}
+	lb.stopDoH()
+	lb.stopDNSCrypt()
+	lb.stopUnix()
+	lb.stopAdmin()
+	lb.stopControl()
+	lb.stopGRPC()
+	lb.stopDebug()
+}
+
 // Stop gracefully shuts down the load balancer
 func (lb *LoadBalancer) Stop() error {
 	lb.logger.Info("Shutting down DNS load balancer")
@@ -89,12 +450,8 @@ func (lb *LoadBalancer) Stop() error {
 	// Cancel context to stop health checker and query handlers
 	lb.cancel()
 
-	// Close listener
-	if lb.listener != nil {
-		if err := lb.listener.Close(); err != nil {
-			lb.logger.WithError(err).Error("Error closing listener")
-		}
-	}
+	// Close listeners
+	lb.closeListeners()
 
 	// Wait for all goroutines to finish with timeout
 	done := make(chan struct{})
@@ -105,6 +462,13 @@ func (lb *LoadBalancer) Stop() error {
 
 	select {
 	case <-done:
+		// Queries have finished with the GeoIP databases
+		lb.geo.close()
+		lb.queryLog.close()
+		lb.cache.close()
+		if err := lb.saveWarmUp(); err != nil {
+			lb.logger.WithError(err).Error("Failed to save cache warm-up list")
+		}
 		lb.logger.Info("Graceful shutdown complete")
 	case <-time.After(5 * time.Second):
 		lb.logger.Warn("Shutdown timeout reached, forcing exit")
@@ -113,8 +477,8 @@ func (lb *LoadBalancer) Stop() error {
 	return nil
 }
 
-// acceptQueries listens for incoming DNS queries
-func (lb *LoadBalancer) acceptQueries() {
+// acceptQueries listens for incoming DNS queries on a UDP socket
+func (lb *LoadBalancer) acceptQueries(conn *net.UDPConn) {
 	defer lb.wg.Done()
 
 	buffer := make([]byte, 4096)
@@ -127,9 +491,9 @@ func (lb *LoadBalancer) acceptQueries() {
 		}
 
 		// Set read deadline to allow periodic context checking
-		lb.listener.SetReadDeadline(time.Now().Add(1 * time.Second))
+		conn.SetReadDeadline(time.Now().Add(1 * time.Second))
 
-		n, clientAddr, err := lb.listener.ReadFromUDP(buffer)
+		n, clientAddr, err := conn.ReadFromUDP(buffer)
 		if err != nil {
 			if netErr, ok := err.(net.Error); ok && netErr.Timeout() {
 				continue // Read timeout, check context and try again
@@ -151,78 +515,390 @@ func (lb *LoadBalancer) acceptQueries() {
 
 		// Handle query in separate goroutine
 		lb.wg.Add(1)
-		go lb.handleQuery(query, clientAddr)
+		go lb.handleQuery(conn, query, clientAddr)
 	}
 }
 
-// handleQuery processes a single DNS query
-func (lb *LoadBalancer) handleQuery(query []byte, clientAddr *net.UDPAddr) {
+// handleQuery processes a single DNS query received over UDP
+func (lb *LoadBalancer) handleQuery(conn *net.UDPConn, query []byte, clientAddr *net.UDPAddr) {
 	defer lb.wg.Done()
 
+	response := lb.resolve(query, clientAddr)
+	if response == nil {
+		return
+	}
+
+	// Never send more than the client can receive over UDP
+	response = truncateResponse(response, udpResponseLimit(query))
+	if response == nil {
+		return
+	}
+
+	// Send response back to client
+	if _, err := conn.WriteToUDP(response, clientAddr); err != nil {
+		lb.logger.WithError(err).WithField("client", lb.privacy.client(clientAddr)).Error("Failed to send response to client")
+		return
+	}
+}
+
+// resolve forwards a query to a backend and returns the response to send
+// back to the client, or nil if the query should be dropped
+func (lb *LoadBalancer) resolve(query []byte, clientAddr net.Addr) (response []byte) {
 	logger := lb.logger.WithFields(logrus.Fields{
-		"client": clientAddr.String(),
+		"client": lb.privacy.client(clientAddr),
 	})
+	lb.counters.query(query)
+	lb.topTalkers.observe(query, clientAddr)
+	start := time.Now()
+	defer func() {
+		lb.counters.response(response)
+		if response != nil {
+			lb.latency.Observe(time.Since(start))
+		}
+	}()
+	if record, sampled := lb.queryLog.sample(query, clientAddr, logger); record != nil {
+		logger = sampled
+		defer func() { lb.queryLog.write(record, response) }()
+	}
+	logger, traced := lb.trace(query, clientAddr, logger)
+	if traced != nil {
+		defer func() { traced(response) }()
+	}
+
+	if response, ok := lb.checkQuery(query, logger); !ok {
+		return response
+	}
+	if !lb.overload.admit() {
+		return lb.shed(query, clientAddr, logger)
+	}
+	defer lb.overload.done()
+
+	if !lb.acl.permits(clientAddr) {
+		return lb.denied(query, logger)
+	}
+	if !lb.rateLimiter.allow(clientAddr) {
+		return lb.rateLimited(query, clientAddr, logger)
+	}
+	if response, answered := lb.filterOpcode(query, clientAddr, logger); answered {
+		return response
+	}
+	if response, answered := lb.filterQtype(query, logger); answered {
+		return response
+	}
+
+	response, forwarded := lb.resolveName(query, clientAddr, logger)
+	response, forwarded = lb.expandSearch(query, response, forwarded, clientAddr, logger)
+	if !forwarded {
+		return response
+	}
+	response = lb.redirectNXDomain(query, response, clientAddr, logger)
+	return lb.filterAAAA(query, response, clientAddr, logger)
+}
+
+// resolveName answers a query for its name: from the allowlist and
+// blocklist, the local records and zones, or the backends, reporting
+// whether the answer came from the backends
+func (lb *LoadBalancer) resolveName(query []byte, clientAddr net.Addr, logger *logrus.Entry) ([]byte, bool) {
+	if response, answered := lb.filterAllowed(query, logger); answered {
+		return response, false
+	}
+	if response, answered := lb.filterBlocked(query, logger); answered {
+		return response, false
+	}
+	if response, answered := lb.answerLocal(query, logger); answered {
+		return response, false
+	}
+	if response, answered := lb.answerFromZone(query, clientAddr, logger); answered {
+		return response, false
+	}
+
+	return lb.resolveUpstream(query, clientAddr, logger), true
+}
+
+// firstEnabled returns the first backend of the pools that isn't
+// administratively down, or nil
+func firstEnabled(pools []*backendPool) *backend.Backend {
+	for _, pool := range pools {
+		for _, b := range pool.backends {
+			if !b.IsDisabled() {
+				return b
+			}
+		}
+	}
+	return nil
+}
+
+// resolveUpstream answers an admitted query from the cache or the
+// backends, or returns nil if it should be dropped
+func (lb *LoadBalancer) resolveUpstream(query []byte, clientAddr net.Addr, logger *logrus.Entry) []byte {
+	pools := lb.poolsFor(query, clientAddr)
+	cacheKey, response := lb.cached(query, clientAddr, pools)
+	if response != nil {
+		logger.Debug("Answered from cache")
+		queryRecordOf(logger).noteCached()
+		return response
+	}
+	if response, answered := lb.guardNXDomain(query, clientAddr, logger); answered {
+		return response
+	}
 
 	// Select backend
-	backend := lb.selectBackend()
+	backend, pool := selectBackend(lb.ctx, pools, query, clientAddr)
+	// Below quorum, the quorum's fail behavior applies instead
+	failBehavior := lb.active.Load().failBehavior
+	if override := lb.quorum.failOverride(); override != "" {
+		failBehavior = override
+		if failBehavior == "closed" {
+			logger.Debug("Below quorum, fail-closed: dropping query")
+			return nil
+		}
+	}
 	if backend == nil {
 		logger.Error("No healthy backends available")
 		
-		if lb.failBehavior == "closed" {
+		if failBehavior == "closed" {
 			// TODO: Send SERVFAIL response
 			logger.Debug("Fail-closed: dropping query")
-			return
+			return nil
 		}
-		// Fail-open: try anyway with first backend
-		if len(lb.backends) > 0 {
-			backend = lb.backends[0]
-			logger.Debug("Fail-open: attempting query with unhealthy backend")
-		} else {
-			return
+		// Fail-open: try anyway with the first backend not disabled
+		backend = firstEnabled(pools)
+		if backend == nil {
+			return nil
+		}
+		logger.Debug("Fail-open: attempting query with unhealthy backend")
+	}
+
+	// Forward query to backend. Queries from stream clients (TCP, DoH,
+	// DNSCrypt over TCP, unix stream sockets) go upstream over TCP as well
+	// so answers too large for UDP come back whole.
+	stream := isStreamClient(clientAddr)
+
+	if lb.racePolicy.max > 1 {
+		candidates := pool.raceCandidates(backend, lb.racePolicy.max)
+		// With retries configured, a query with no other backend to go to
+		// still gets the per-try timeout, the deadline and the budget
+		if len(candidates) > 1 || lb.racePolicy.budget != nil {
+			if len(candidates) > 1 {
+				logger.WithField("backends", len(candidates)).Debug("Racing query across backends")
+			}
+			result := lb.race(candidates, query, clientAddr, stream, logger)
+			logger = logger.WithField("backend", result.backend.Address)
+			queryRecordOf(logger).noteBackend(result.backend.Address)
+			if result.err != nil {
+				logger.WithError(result.err).Error("Backend query failed")
+				return nil
+			}
+			logger.WithField("rcode", responseRcode(result.response)).Debug("Query handled successfully")
+			lb.nxGuard.observe(query, clientAddr, result.response)
+			response := lb.rewriteTTLs(query, result.response)
+			lb.cache.set(cacheKey, response)
+			lb.mirror(query, clientAddr, stream, result.response)
+			return response
 		}
 	}
 
 	logger = logger.WithField("backend", backend.Address)
 	logger.Debug("Forwarding query to backend")
+	queryRecordOf(logger).noteBackend(backend.Address)
 
-	// Forward query to backend
-	response, err := backend.ForwardQuery(query, lb.timeout)
+	start := time.Now()
+	response, err := lb.forward(backend, query, clientAddr, stream, lb.timeout())
+	logger = logger.WithField("duration", time.Since(start))
 	if err != nil {
 		logger.WithError(err).Error("Backend query failed")
-		return
+		return nil
 	}
 
-	// Send response back to client
-	if _, err := lb.listener.WriteToUDP(response, clientAddr); err != nil {
-		logger.WithError(err).Error("Failed to send response to client")
+	logger.WithField("rcode", responseRcode(response)).Debug("Query handled successfully")
+	lb.nxGuard.observe(query, clientAddr, response)
+	lb.mirror(query, clientAddr, stream, response)
+	response = lb.rewriteTTLs(query, response)
+	lb.cache.set(cacheKey, response)
+	return response
+}
+
+// forward sends a client query to one backend, rewriting it for the
+// backend on the way up and undoing the rewrite in the response
+func (lb *LoadBalancer) forward(b *backend.Backend, query []byte, clientAddr net.Addr, stream bool, timeout time.Duration) ([]byte, error) {
+	upstream, rewrite := lb.upstreamQuery(query, clientAddr, lb.ecsPolicyFor(b), stream)
+	upstream, check := lb.validator.prepare(query, upstream)
+
+	var response []byte
+	var err error
+	start := time.Now()
+	if stream {
+		response, err = b.ForwardQueryTCP(upstream, timeout)
+	} else {
+		response, err = b.ForwardQuery(upstream, timeout)
+	}
+	if lb.outliers != nil {
+		// SERVFAIL and the like count against a backend that answers
+		failed := err != nil || len(response) < 4 || lb.retryRcodes[int(response[3]&0x0f)]
+		lb.outliers.record(b, time.Since(start), failed)
+	}
+	if err != nil {
+		return nil, err
+	}
+	lb.recordRcode(b, response)
+
+	return rewrite.restore(lb.validator.finish(response, check)), nil
+}
+
+// recordRcode counts the response code of a backend's answer, taking the
+// backend out of rotation once its error streak reaches the threshold
+func (lb *LoadBalancer) recordRcode(b *backend.Backend, response []byte) {
+	if len(response) < 4 {
 		return
 	}
 
-	logger.Debug("Query handled successfully")
+	rcode := int(response[3] & 0x0f)
+	if b.RecordRcode(rcode, lb.retryRcodes[rcode], lb.errorStreak) {
+		lb.logger.WithFields(logrus.Fields{
+			"backend": b.Address,
+			"rcode":   dns.RcodeToString[rcode],
+			"streak":  lb.errorStreak,
+		}).Warn("Backend marked unhealthy after consecutive error responses")
+		lb.backendHealthChanged(b, false)
+	}
 }
 
-// selectBackend chooses the next healthy backend using round-robin
-func (lb *LoadBalancer) selectBackend() *backend.Backend {
-	if len(lb.backends) == 0 {
-		return nil
+// backendHealthChanged notifies the webhooks of a backend marked healthy
+// or unhealthy and checks whether the quorum is still met
+func (lb *LoadBalancer) backendHealthChanged(b *backend.Backend, healthy bool) {
+	lb.webhooks.backendChanged(b.Address, healthy, lb.healthyCount(), len(lb.allBackends()))
+	lb.checkQuorum()
+}
+
+// isStreamClient reports whether a client is connected over a stream
+// transport, where responses are not limited by datagram size
+func isStreamClient(clientAddr net.Addr) bool {
+	switch addr := clientAddr.(type) {
+	case *net.TCPAddr:
+		return true
+	case *net.UnixAddr:
+		return addr.Net == "unix"
 	}
+	return false
+}
 
-	maxAttempts := len(lb.backends)
+// addrIP returns a client's IP address, or nil for clients without one
+// (unix sockets)
+func addrIP(clientAddr net.Addr) net.IP {
+	switch addr := clientAddr.(type) {
+	case *net.UDPAddr:
+		return addr.IP
+	case *net.TCPAddr:
+		return addr.IP
+	}
+	return nil
+}
 
-	for i := 0; i < maxAttempts; i++ {
-		idx := atomic.AddUint32(&lb.currentIndex, 1) % uint32(len(lb.backends))
-		backend := lb.backends[idx]
+// selectBackend chooses a healthy backend for a query from the active
+// pool using the pool's balancer. It returns the backend and its pool, or
+// nil if every backend is unhealthy.
+func selectBackend(ctx context.Context, pools []*backendPool, query []byte, clientAddr net.Addr) (*backend.Backend, *backendPool) {
+	pool := activePool(pools)
+	if pool == nil {
+		// All backends unhealthy
+		return nil, nil
+	}
 
-		if backend.IsHealthy() {
-			return backend
+	b := pool.balancer.Pick(ctx, query, clientAddr)
+	if b == nil {
+		return nil, nil
+	}
+	return b, pool
+}
+
+// newBackendSet creates the backends of one backend list, or takes them
+// from the registry, and groups them into priority pools with balancers
+// made by factory
+func newBackendSet(cfg *config.Config, bcfgs []config.BackendConfig, registry *backendRegistry, factory BalancerFactory, logger *logrus.Logger) ([]*backend.Backend, []*backendPool, error) {
+	backends := make([]*backend.Backend, len(bcfgs))
+	priorities := make([]int, len(bcfgs))
+	for i, bcfg := range bcfgs {
+		b, reused, err := registry.backend(cfg, bcfg)
+		if err != nil {
+			return nil, nil, fmt.Errorf("backend %s: %w", bcfg.Address, err)
+		}
+		backends[i] = b
+		priorities[i] = bcfg.Priority
+		if !reused {
+			logger.WithField("backend", bcfg.Address).Info("Registered backend")
 		}
 	}
 
-	// All backends unhealthy
-	return nil
+	return backends, newBackendPools(backends, priorities, factory), nil
+}
+
+// NewBackend creates a backend from its configuration, applying the
+// global defaults it does not override
+func NewBackend(cfg *config.Config, bcfg config.BackendConfig) (*backend.Backend, error) {
+	var tlsOpts *backend.TLSOptions
+	if bcfg.TLS != nil {
+		tlsOpts = &backend.TLSOptions{
+			ServerName:         bcfg.TLS.ServerName,
+			CAFile:             bcfg.TLS.CAFile,
+			InsecureSkipVerify: bcfg.TLS.InsecureSkipVerify,
+			CertFile:           bcfg.TLS.CertFile,
+			KeyFile:            bcfg.TLS.KeyFile,
+			SPKIPins:           bcfg.TLS.SPKIPins,
+		}
+	}
+
+	b, err := backend.NewBackend(bcfg.Address, tlsOpts)
+	if err != nil {
+		return nil, err
+	}
+	b.PreferFamily = cfg.PreferFamily
+	b.Weight = bcfg.Weight
+	b.MaxInFlight = int64(bcfg.MaxInflight)
+	b.Draining = bcfg.Drain
+	b.CheckType = cfg.HealthCheck.CheckType
+	b.CheckCommand = cfg.HealthCheck.Command
+	b.AcceptRcodes = acceptRcodes(&cfg.HealthCheck)
+	b.SlowStart = slowStart(cfg.SlowStart)
+	b.DNSCookies = cfg.DNSCookies
+	b.CaseRandomization = cfg.CaseRandomization
+	if bcfg.CaseRandomization != nil {
+		b.CaseRandomization = *bcfg.CaseRandomization
+	}
+	b.SourceAddress = cfg.SourceAddress
+	if bcfg.SourceAddress != "" {
+		b.SourceAddress = bcfg.SourceAddress
+	}
+	if cfg.SourcePorts != nil && cfg.SourcePorts.Enabled {
+		b.SourcePorts = sourcePorts(cfg.SourcePorts)
+	}
+
+	return b, nil
+}
+
+// sourcePorts applies defaults to the source port randomization settings
+func sourcePorts(cfg *config.SourcePortsConfig) *backend.PortRandomization {
+	ports := &backend.PortRandomization{
+		Sockets:    cfg.Sockets,
+		PortMin:    cfg.PortMin,
+		PortMax:    cfg.PortMax,
+		MaxQueries: cfg.MaxQueries,
+	}
+	if ports.Sockets == 0 {
+		ports.Sockets = defaultSourcePortSockets
+	}
+	if ports.PortMin == 0 {
+		ports.PortMin = defaultSourcePortMin
+	}
+	if ports.PortMax == 0 {
+		ports.PortMax = defaultSourcePortMax
+	}
+	if ports.MaxQueries == 0 {
+		ports.MaxQueries = defaultSourcePortQueries
+	}
+	return ports
 }
 
 // GetBackends returns the list of backends (for status reporting)
 func (lb *LoadBalancer) GetBackends() []*backend.Backend {
-	return lb.backends
+	return lb.allBackends()
 }
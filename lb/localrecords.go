@@ -0,0 +1,138 @@
+package lb
+
+import (
+	"fmt"
+	"net"
+	"strings"
+	"sync/atomic"
+
+	"github.com/aram535/dnsbalancer/config"
+	"github.com/miekg/dns"
+	"github.com/sirupsen/logrus"
+)
+
+// defaultLocalRecordTTL is the TTL of local records unless configured
+const defaultLocalRecordTTL = 300
+
+// localRecords answers addresses for names configured locally, ahead of
+// local zones, routes and the backends. An exact name wins over wildcard
+// patterns, and a pattern for a longer domain over a shorter one.
+type localRecords struct {
+	exact     map[string]*localRecord // By routeTable key of the name
+	wildcards map[string]*localRecord // By routeTable key of the domain below the "*"
+	answered  uint64
+}
+
+// localRecord is the addresses answered for a name or pattern
+type localRecord struct {
+	addresses []net.IP
+	ttl       uint32
+}
+
+// newLocalRecords creates the local records, or returns nil when none are
+// configured
+func newLocalRecords(cfg []config.LocalRecordConfig) (*localRecords, error) {
+	if len(cfg) == 0 {
+		return nil, nil
+	}
+
+	l := &localRecords{
+		exact:     make(map[string]*localRecord),
+		wildcards: make(map[string]*localRecord),
+	}
+	for _, rc := range cfg {
+		record := &localRecord{ttl: rc.TTL}
+		if record.ttl == 0 {
+			record.ttl = defaultLocalRecordTTL
+		}
+		for _, address := range rc.Addresses {
+			record.addresses = append(record.addresses, net.ParseIP(address))
+		}
+
+		table, name := l.exact, rc.Name
+		if domain, ok := strings.CutPrefix(rc.Name, "*."); ok {
+			table, name = l.wildcards, domain
+		}
+		key, err := routeKey(name)
+		if err != nil {
+			return nil, fmt.Errorf("local record %q: %w", rc.Name, err)
+		}
+		table[key] = record
+	}
+	return l, nil
+}
+
+// match returns the record for the query name: its own, or that of the
+// closest wildcard above it, which covers names at any depth below its
+// domain but not the domain itself
+func (l *localRecords) match(query []byte) *localRecord {
+	name := queryName(query)
+	if len(name) == 0 {
+		return nil
+	}
+	if record, ok := l.exact[string(name)]; ok {
+		return record
+	}
+
+	for off := 1 + int(name[0]); ; off += 1 + int(name[off]) {
+		if record, ok := l.wildcards[string(name[off:])]; ok {
+			return record
+		}
+		if off >= len(name) {
+			return nil
+		}
+	}
+}
+
+// answerLocal answers a query for a name with local records, returning
+// false for queries to resolve otherwise. Other types than those of the
+// record's addresses get an empty answer: the name is local and not
+// looked up anywhere else.
+func (lb *LoadBalancer) answerLocal(query []byte, logger *logrus.Entry) ([]byte, bool) {
+	l := lb.localRecords
+	if l == nil {
+		return nil, false
+	}
+	record := l.match(query)
+	if record == nil {
+		return nil, false
+	}
+
+	msg := new(dns.Msg)
+	if err := msg.Unpack(query); err != nil || len(msg.Question) != 1 || msg.Question[0].Qclass != dns.ClassINET {
+		return nil, false
+	}
+	q := msg.Question[0]
+
+	reply := new(dns.Msg)
+	reply.SetReply(msg)
+	reply.Authoritative = true
+	reply.RecursionAvailable = true
+	reply.Answer = addressRecords(record.addresses, q.Name, q.Qtype, record.ttl)
+	if opt := msg.IsEdns0(); opt != nil {
+		reply.SetEdns0(dns.DefaultMsgSize, opt.Do())
+	}
+
+	response, err := reply.Pack()
+	if err != nil {
+		return nil, false
+	}
+	atomic.AddUint64(&l.answered, 1)
+	logger.Debug("Answered from local records")
+	return response, true
+}
+
+// LocalRecordStats returns the number of local names and patterns and of
+// queries they answered, or nil if there are no local records
+func (lb *LoadBalancer) LocalRecordStats() map[string]interface{} {
+	l := lb.localRecords
+	if l == nil {
+		return nil
+	}
+
+	return map[string]interface{}{
+		"names":     len(l.exact),
+		"wildcards": len(l.wildcards),
+		"answered":  atomic.LoadUint64(&l.answered),
+	}
+}
@@ -0,0 +1,71 @@
+package lb
+
+import (
+	"encoding/binary"
+	"sync/atomic"
+
+	"github.com/miekg/dns"
+	"github.com/sirupsen/logrus"
+)
+
+// Smallest encodings of a question (root name, type, class) and of a
+// resource record (root name, type, class, TTL, data length)
+const (
+	minQuestionSize = 5
+	minRRSize       = 11
+)
+
+// malformed counts the messages turned away before resolution
+type malformed struct {
+	formErr uint64 // DNS queries that don't parse, answered FORMERR
+	junk    uint64 // Messages that aren't DNS queries at all, dropped
+}
+
+// checkQuery sorts out messages not worth resolving, returning false for
+// them along with the answer to send, if any. Messages that aren't DNS
+// queries at all (shorter than a header, responses, or claiming more
+// records than they have bytes) are dropped silently so junk and
+// reflected traffic get nothing back. Queries with a plausible header that
+// don't parse or don't ask exactly one question are answered FORMERR.
+func (lb *LoadBalancer) checkQuery(query []byte, logger *logrus.Entry) ([]byte, bool) {
+	if len(query) < 12 || query[2]&0x80 != 0 {
+		atomic.AddUint64(&lb.malformed.junk, 1)
+		logger.Debug("Dropping message that is not a DNS query")
+		return nil, false
+	}
+
+	qdcount := int(binary.BigEndian.Uint16(query[4:6]))
+	rrcount := int(binary.BigEndian.Uint16(query[6:8])) + int(binary.BigEndian.Uint16(query[8:10])) + int(binary.BigEndian.Uint16(query[10:12]))
+	if qdcount*minQuestionSize+rrcount*minRRSize > len(query)-12 {
+		atomic.AddUint64(&lb.malformed.junk, 1)
+		logger.Debug("Dropping message that is not a DNS query")
+		return nil, false
+	}
+
+	msg := new(dns.Msg)
+	if err := msg.Unpack(query); err != nil || len(msg.Question) != 1 {
+		atomic.AddUint64(&lb.malformed.formErr, 1)
+		logger.WithError(err).Debug("Malformed query, answering FORMERR")
+		return formErrResponse(query), false
+	}
+	return nil, true
+}
+
+// formErrResponse answers a query that can't be parsed with a bare header:
+// its ID, opcode and RD flag, and rcode FORMERR
+func formErrResponse(query []byte) []byte {
+	response := make([]byte, 12)
+	copy(response, query[:2])
+	response[2] = 0x80 | query[2]&0x79
+	response[3] = dns.RcodeFormatError
+	return response
+}
+
+// MalformedStats returns the number of queries answered FORMERR and of
+// junk messages dropped
+func (lb *LoadBalancer) MalformedStats() map[string]interface{} {
+	return map[string]interface{}{
+		"formerr": atomic.LoadUint64(&lb.malformed.formErr),
+		"dropped": atomic.LoadUint64(&lb.malformed.junk),
+	}
+}
@@ -0,0 +1,82 @@
+package lb
+
+import (
+	"sort"
+	"time"
+)
+
+// metric is one value of the snapshot the metrics exporters send: a
+// counter, which only grows from startup, or a gauge. Tags are "key:value"
+// pairs telling apart the values of one name, e.g. per backend.
+type metric struct {
+	name    string
+	counter bool
+	value   float64
+	tags    []string
+}
+
+// metrics takes a snapshot of the counters and backend state exporters
+// report, from the same statistics the admin API serves
+func (lb *LoadBalancer) metrics() []metric {
+	var metrics []metric
+	counter := func(name string, value uint64, tags ...string) {
+		metrics = append(metrics, metric{name: name, counter: true, value: float64(value), tags: tags})
+	}
+	gauge := func(name string, value float64, tags ...string) {
+		metrics = append(metrics, metric{name: name, value: value, tags: tags})
+	}
+
+	counters := lb.CounterStats()
+	qtypes := counters["qtypes"].(map[string]uint64)
+	for _, qtype := range sortedKeys(qtypes) {
+		counter("queries", qtypes[qtype], "qtype:"+qtype)
+	}
+	rcodes := counters["rcodes"].(map[string]uint64)
+	for _, rcode := range sortedKeys(rcodes) {
+		counter("responses", rcodes[rcode], "rcode:"+rcode)
+	}
+	counter("dropped", counters["dropped"].(uint64))
+	percentiles := func(name string, stats map[string]interface{}, tags ...string) {
+		for _, p := range []string{"p50", "p95", "p99"} {
+			gauge(name+"."+p+"_ms", stats[p+"_ms"].(float64), tags...)
+		}
+	}
+	percentiles("latency", lb.latency.Snapshot())
+
+	for _, b := range lb.allBackends() {
+		stats := b.Stats()
+		tag := "backend:" + b.Address
+		counter("backend.queries", stats["total_queries"].(uint64), tag)
+		counter("backend.failures", stats["total_failures"].(uint64), tag)
+		rcodes := stats["rcodes"].(map[string]uint64)
+		for _, rcode := range sortedKeys(rcodes) {
+			counter("backend.responses", rcodes[rcode], tag, "rcode:"+rcode)
+		}
+		healthy := 0.0
+		if stats["healthy"].(bool) {
+			healthy = 1
+		}
+		gauge("backend.healthy", healthy, tag)
+		gauge("backend.in_flight", float64(stats["in_flight"].(int64)), tag)
+		gauge("backend.latency_ms", float64(stats["latency_ewma"].(time.Duration))/float64(time.Millisecond), tag)
+		percentiles("backend.latency", stats["latency_percentiles"].(map[string]interface{}), tag)
+	}
+
+	if cache := lb.CacheStats(); cache != nil {
+		counter("cache.hits", cache["hits"].(uint64))
+		counter("cache.misses", cache["misses"].(uint64))
+		gauge("cache.entries", float64(cache["entries"].(int)))
+	}
+	return metrics
+}
+
+// sortedKeys returns the keys of a count map in order, so snapshots list
+// their values the same way every time
+func sortedKeys(counts map[string]uint64) []string {
+	keys := make([]string, 0, len(counts))
+	for key := range counts {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
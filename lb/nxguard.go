@@ -0,0 +1,290 @@
+package lb
+
+import (
+	"net"
+	"net/netip"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/aram535/dnsbalancer/config"
+	"github.com/miekg/dns"
+	"github.com/sirupsen/logrus"
+)
+
+// NXDOMAIN guard defaults and actions
+const (
+	defaultNXGuardWindow   = 10 * time.Second
+	defaultNXGuardDuration = time.Minute
+
+	nxGuardRefuse   = "refuse"
+	nxGuardServfail = "servfail"
+	nxGuardDrop     = "drop"
+
+	// nxGuardTracked bounds the zones and clients counted in one window,
+	// so a flood from spoofed sources can't grow the maps without limit
+	nxGuardTracked = 100000
+)
+
+// nxdomainGuard counts the NXDOMAIN answers backends give per zone and per
+// client over fixed windows. A zone crossing its threshold, the target of
+// a random subdomain ("water torture") attack, has its uncached queries
+// limited or blocked for a while; a client crossing its threshold is
+// blocked. Zones are the query name with its first label removed, where
+// these attacks put their random part.
+type nxdomainGuard struct {
+	window          time.Duration
+	zoneThreshold   int // 0 = zones not watched
+	clientThreshold int // 0 = clients not watched
+	duration        time.Duration
+	zoneQPS         float64 // Queries still forwarded to a limited zone, 0 = none
+	action          string
+	privacy         *clientPrivacy
+	logger          *logrus.Logger
+
+	mu      sync.Mutex
+	start   time.Time // Of the current window
+	zones   map[string]int
+	clients map[netip.Addr]int
+	limited map[string]*limitedZone
+	blocked map[netip.Addr]time.Time // Until when
+
+	zonesLimited   uint64 // Times a zone crossed the threshold
+	clientsBlocked uint64 // Times a client crossed the threshold
+	zoneQueries    uint64 // Queries answered for a limited zone
+	clientQueries  uint64 // Queries answered for a blocked client
+}
+
+// limitedZone is a zone whose uncached queries are limited until a time
+type limitedZone struct {
+	until  time.Time
+	tokens float64
+	last   time.Time
+}
+
+// newNXDomainGuard creates the NXDOMAIN guard, or returns nil when it is
+// not enabled
+func newNXDomainGuard(cfg *config.NXDomainGuardConfig, privacy *clientPrivacy, logger *logrus.Logger) *nxdomainGuard {
+	if cfg == nil || !cfg.Enabled {
+		return nil
+	}
+
+	g := &nxdomainGuard{
+		window:          cfg.Window,
+		zoneThreshold:   cfg.ZoneThreshold,
+		clientThreshold: cfg.ClientThreshold,
+		duration:        cfg.Duration,
+		zoneQPS:         cfg.ZoneQPS,
+		action:          cfg.Action,
+		privacy:         privacy,
+		logger:          logger,
+		start:           time.Now(),
+		zones:           make(map[string]int),
+		clients:         make(map[netip.Addr]int),
+		limited:         make(map[string]*limitedZone),
+		blocked:         make(map[netip.Addr]time.Time),
+	}
+	if g.window == 0 {
+		g.window = defaultNXGuardWindow
+	}
+	if g.duration == 0 {
+		g.duration = defaultNXGuardDuration
+	}
+	if g.action == "" {
+		g.action = nxGuardRefuse
+	}
+	return g
+}
+
+// parentZone returns the routeTable key of the zone a query name is
+// counted under, or false for the root, which has no parent
+func parentZone(query []byte) (string, bool) {
+	name := queryName(query)
+	if len(name) == 0 {
+		return "", false
+	}
+	return string(name[1+int(name[0]):]), true
+}
+
+// roll starts a new window once the current one is over, forgetting its
+// counts and the limits and blocks that have run out. Called with mu held.
+func (g *nxdomainGuard) roll(now time.Time) {
+	if now.Sub(g.start) < g.window {
+		return
+	}
+
+	g.start = now
+	g.zones = make(map[string]int)
+	g.clients = make(map[netip.Addr]int)
+	for zone, limit := range g.limited {
+		if now.After(limit.until) {
+			delete(g.limited, zone)
+		}
+	}
+	for client, until := range g.blocked {
+		if now.After(until) {
+			delete(g.blocked, client)
+		}
+	}
+}
+
+// observe counts a backend's answer if it is NXDOMAIN, limiting the zone
+// or blocking the client that crossed a threshold with it
+func (g *nxdomainGuard) observe(query []byte, clientAddr net.Addr, response []byte) {
+	if g == nil || len(response) < 4 || response[3]&0x0f != dns.RcodeNameError {
+		return
+	}
+	zone, hasZone := parentZone(query)
+	client, hasClient := netip.AddrFromSlice(addrIP(clientAddr))
+
+	now := time.Now()
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	g.roll(now)
+
+	if _, known := g.zones[zone]; g.zoneThreshold > 0 && hasZone && (known || len(g.zones) < nxGuardTracked) {
+		g.zones[zone]++
+		if g.zones[zone] == g.zoneThreshold {
+			g.limited[zone] = &limitedZone{until: now.Add(g.duration), tokens: g.zoneQPS, last: now}
+			g.zonesLimited++
+			g.logger.WithFields(logrus.Fields{
+				"zone":      zoneName(zone),
+				"nxdomains": g.zoneThreshold,
+				"window":    g.window,
+				"for":       g.duration,
+			}).Warn("NXDOMAIN flood toward zone, limiting its queries")
+		}
+	}
+
+	client = client.Unmap()
+	if _, known := g.clients[client]; g.clientThreshold > 0 && hasClient && (known || len(g.clients) < nxGuardTracked) {
+		g.clients[client]++
+		if g.clients[client] == g.clientThreshold {
+			g.blocked[client] = now.Add(g.duration)
+			g.clientsBlocked++
+			g.logger.WithFields(logrus.Fields{
+				"client":    g.privacy.ip(client),
+				"nxdomains": g.clientThreshold,
+				"window":    g.window,
+				"for":       g.duration,
+			}).Warn("NXDOMAIN flood from client, blocking it")
+		}
+	}
+}
+
+// holds returns why a query may not be forwarded, "client" when its
+// client is blocked or "zone" when its zone is limited and out of tokens,
+// or "" when it may
+func (g *nxdomainGuard) holds(query []byte, clientAddr net.Addr) string {
+	now := time.Now()
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	g.roll(now)
+
+	if client, ok := netip.AddrFromSlice(addrIP(clientAddr)); ok {
+		if until, blocked := g.blocked[client.Unmap()]; blocked && now.Before(until) {
+			return "client"
+		}
+	}
+
+	zone, ok := parentZone(query)
+	if !ok {
+		return ""
+	}
+	limit, limited := g.limited[zone]
+	if !limited || now.After(limit.until) {
+		return ""
+	}
+	if g.zoneQPS > 0 {
+		limit.tokens = min(max(1, g.zoneQPS), limit.tokens+now.Sub(limit.last).Seconds()*g.zoneQPS)
+		limit.last = now
+		if limit.tokens >= 1 {
+			limit.tokens--
+			return ""
+		}
+	}
+	return "zone"
+}
+
+// guardNXDomain answers a query from a blocked client or for a limited
+// zone, returning false for queries to forward
+func (lb *LoadBalancer) guardNXDomain(query []byte, clientAddr net.Addr, logger *logrus.Entry) ([]byte, bool) {
+	g := lb.nxGuard
+	if g == nil {
+		return nil, false
+	}
+
+	switch g.holds(query, clientAddr) {
+	case "":
+		return nil, false
+	case "zone":
+		atomic.AddUint64(&g.zoneQueries, 1)
+		logger.Debug("Query for zone under NXDOMAIN flood limited")
+	default:
+		atomic.AddUint64(&g.clientQueries, 1)
+		logger.Debug("Query from client blocked for NXDOMAIN flood")
+	}
+
+	switch g.action {
+	case nxGuardServfail:
+		return rcodeResponse(query, dns.RcodeServerFailure), true
+	case nxGuardDrop:
+		return nil, true
+	}
+	return rcodeResponse(query, dns.RcodeRefused), true
+}
+
+// zoneName turns a routeTable key back into a domain name
+func zoneName(key string) string {
+	var labels []string
+	for off := 0; off < len(key); off += 1 + int(key[off]) {
+		labels = append(labels, key[off+1:off+1+int(key[off])])
+	}
+	return dns.Fqdn(strings.Join(labels, "."))
+}
+
+// NXDomainGuardStats returns the thresholds, the zones limited and clients
+// blocked now, and the queries answered for them, or nil if the NXDOMAIN
+// guard is not enabled
+func (lb *LoadBalancer) NXDomainGuardStats() map[string]interface{} {
+	g := lb.nxGuard
+	if g == nil {
+		return nil
+	}
+
+	now := time.Now()
+	g.mu.Lock()
+	zones := make([]string, 0, len(g.limited))
+	for zone, limit := range g.limited {
+		if now.Before(limit.until) {
+			zones = append(zones, zoneName(zone))
+		}
+	}
+	clients := make([]string, 0, len(g.blocked))
+	for client, until := range g.blocked {
+		if now.Before(until) {
+			clients = append(clients, g.privacy.ip(client))
+		}
+	}
+	stats := map[string]interface{}{
+		"window":           g.window.String(),
+		"zone_threshold":   g.zoneThreshold,
+		"client_threshold": g.clientThreshold,
+		"duration":         g.duration.String(),
+		"zone_qps":         g.zoneQPS,
+		"action":           g.action,
+		"zones_limited":    g.zonesLimited,
+		"clients_blocked":  g.clientsBlocked,
+	}
+	g.mu.Unlock()
+
+	sort.Strings(zones)
+	sort.Strings(clients)
+	stats["limited_zones"] = zones
+	stats["blocked_clients"] = clients
+	stats["zone_queries"] = atomic.LoadUint64(&g.zoneQueries)
+	stats["client_queries"] = atomic.LoadUint64(&g.clientQueries)
+	return stats
+}
@@ -0,0 +1,147 @@
+package lb
+
+import (
+	"fmt"
+	"net"
+	"sort"
+	"sync/atomic"
+
+	"github.com/aram535/dnsbalancer/config"
+	"github.com/miekg/dns"
+	"github.com/sirupsen/logrus"
+)
+
+// defaultRedirectTTL is the TTL of redirect records unless configured
+const defaultRedirectTTL = 60
+
+// nxRedirect rewrites NXDOMAIN answers from the backends for names under
+// its domains, captive portal style: into fixed addresses, or into a CNAME
+// to another name
+type nxRedirect struct {
+	rules      map[string]*redirectRule // By routeTable key of the domain
+	redirected uint64                   // Answers rewritten
+}
+
+// redirectRule is what NXDOMAIN answers under one domain become
+type redirectRule struct {
+	domain    string
+	addresses []net.IP
+	name      string
+	ttl       uint32
+}
+
+// newNXRedirect creates the NXDOMAIN rewriter, or returns nil when no
+// redirects are configured
+func newNXRedirect(cfg []config.NXRedirectConfig) (*nxRedirect, error) {
+	if len(cfg) == 0 {
+		return nil, nil
+	}
+
+	r := &nxRedirect{rules: make(map[string]*redirectRule, len(cfg))}
+	for _, rc := range cfg {
+		key, err := routeKey(rc.Domain)
+		if err != nil {
+			return nil, fmt.Errorf("nxdomain_redirect domain %q: %w", rc.Domain, err)
+		}
+		rule := &redirectRule{
+			domain: dns.Fqdn(rc.Domain),
+			name:   rc.Name,
+			ttl:    rc.TTL,
+		}
+		if rule.name != "" {
+			rule.name = dns.Fqdn(rule.name)
+		}
+		if rule.ttl == 0 {
+			rule.ttl = defaultRedirectTTL
+		}
+		for _, address := range rc.Addresses {
+			rule.addresses = append(rule.addresses, net.ParseIP(address))
+		}
+		r.rules[key] = rule
+	}
+	return r, nil
+}
+
+// match returns the rule of the longest domain the query name is in, or
+// nil if there is none
+func (r *nxRedirect) match(query []byte) *redirectRule {
+	name := queryName(query)
+	if name == nil {
+		return nil
+	}
+
+	for off := 0; ; off += 1 + int(name[off]) {
+		if rule, ok := r.rules[string(name[off:])]; ok {
+			return rule
+		}
+		if off >= len(name) {
+			return nil
+		}
+	}
+}
+
+// redirectNXDomain rewrites a backend's NXDOMAIN answer when the query
+// name is under a redirect domain. Answers the backend validated (AD set)
+// are left alone, as rewriting them would forge signed data. Address
+// rules only rewrite queries for the address types they have.
+func (lb *LoadBalancer) redirectNXDomain(query, response []byte, clientAddr net.Addr, logger *logrus.Entry) []byte {
+	r := lb.nxRedirect
+	if r == nil || len(response) < 4 || response[3]&0x0f != dns.RcodeNameError || response[3]&0x20 != 0 {
+		return response
+	}
+	rule := r.match(query)
+	if rule == nil {
+		return response
+	}
+
+	msg := new(dns.Msg)
+	reply := new(dns.Msg)
+	if msg.Unpack(query) != nil || reply.Unpack(response) != nil || len(msg.Question) != 1 {
+		return response
+	}
+	q := msg.Question[0]
+
+	reply.Rcode = dns.RcodeSuccess
+	reply.Ns = nil
+	if rule.name != "" {
+		reply.Answer = []dns.RR{&dns.CNAME{
+			Hdr:    dns.RR_Header{Name: q.Name, Rrtype: dns.TypeCNAME, Class: dns.ClassINET, Ttl: rule.ttl},
+			Target: rule.name,
+		}}
+		if q.Qtype != dns.TypeCNAME {
+			lb.chaseUpstream(reply, msg, rule.name, clientAddr, logger)
+		}
+	} else {
+		reply.Answer = addressRecords(rule.addresses, q.Name, q.Qtype, rule.ttl)
+		if len(reply.Answer) == 0 {
+			return response
+		}
+	}
+
+	redirected, err := reply.Pack()
+	if err != nil {
+		return response
+	}
+	atomic.AddUint64(&r.redirected, 1)
+	logger.WithField("domain", rule.domain).Debug("Redirected NXDOMAIN answer")
+	return redirected
+}
+
+// NXRedirectStats returns the redirect domains and the number of answers
+// rewritten, or nil if no redirects are configured
+func (lb *LoadBalancer) NXRedirectStats() map[string]interface{} {
+	r := lb.nxRedirect
+	if r == nil {
+		return nil
+	}
+
+	domains := make([]string, 0, len(r.rules))
+	for _, rule := range r.rules {
+		domains = append(domains, rule.domain)
+	}
+	sort.Strings(domains)
+	return map[string]interface{}{
+		"domains":    domains,
+		"redirected": atomic.LoadUint64(&r.redirected),
+	}
+}
@@ -0,0 +1,88 @@
+package lb
+
+import (
+	"fmt"
+	"net"
+	"sync/atomic"
+
+	"github.com/aram535/dnsbalancer/config"
+	"github.com/miekg/dns"
+	"github.com/sirupsen/logrus"
+)
+
+// opcodeFilter keeps zone transfers, dynamic updates and notifies away
+// from the backends, which are often internal servers that would act on
+// them, unless the client is in one of the allowed networks. Opcodes other
+// than QUERY, UPDATE and NOTIFY are never forwarded.
+type opcodeFilter struct {
+	allow   []*net.IPNet
+	refused uint64 // Zone transfers answered REFUSED
+	notImp  uint64 // Updates, notifies and other opcodes answered NOTIMP
+}
+
+// newOpcodeFilter creates the filter, which is always on; the config only
+// lists the clients exempt from it
+func newOpcodeFilter(cfg *config.ZoneOperationsConfig) (*opcodeFilter, error) {
+	f := &opcodeFilter{}
+	if cfg == nil {
+		return f, nil
+	}
+
+	allow, err := config.ParseCIDRs(cfg.Allow)
+	if err != nil {
+		return nil, fmt.Errorf("zone_operations allow: %w", err)
+	}
+	f.allow = allow
+	return f, nil
+}
+
+// allows reports whether a client may send zone operations through.
+// Clients without an IP address (unix sockets) are local and may.
+func (f *opcodeFilter) allows(clientAddr net.Addr) bool {
+	ip := addrIP(clientAddr)
+	if ip == nil {
+		return true
+	}
+	if ip4 := ip.To4(); ip4 != nil {
+		ip = ip4
+	}
+	return longestMatch(f.allow, ip) >= 0
+}
+
+// filterOpcode answers zone transfers REFUSED and other opcodes than QUERY
+// NOTIMP, returning false for queries to forward
+func (lb *LoadBalancer) filterOpcode(query []byte, clientAddr net.Addr, logger *logrus.Entry) ([]byte, bool) {
+	f := lb.opcodeFilter
+	if len(query) < 12 {
+		return nil, false
+	}
+
+	opcode := int(query[2]>>3) & 0x0f
+	if opcode == dns.OpcodeQuery {
+		qtype, ok := questionType(query)
+		if !ok || qtype != dns.TypeAXFR && qtype != dns.TypeIXFR || f.allows(clientAddr) {
+			return nil, false
+		}
+		atomic.AddUint64(&f.refused, 1)
+		logger.WithField("type", dns.TypeToString[qtype]).Debug("Zone transfer refused")
+		return rcodeResponse(query, dns.RcodeRefused), true
+	}
+
+	if (opcode == dns.OpcodeUpdate || opcode == dns.OpcodeNotify) && f.allows(clientAddr) {
+		return nil, false
+	}
+	atomic.AddUint64(&f.notImp, 1)
+	logger.WithField("opcode", dns.OpcodeToString[opcode]).Debug("Opcode not implemented")
+	return rcodeResponse(query, dns.RcodeNotImplemented), true
+}
+
+// OpcodeStats returns the number of zone transfers refused and of other
+// opcodes answered NOTIMP
+func (lb *LoadBalancer) OpcodeStats() map[string]interface{} {
+	f := lb.opcodeFilter
+	return map[string]interface{}{
+		"refused":         atomic.LoadUint64(&f.refused),
+		"not_implemented": atomic.LoadUint64(&f.notImp),
+		"allowed_clients": len(f.allow),
+	}
+}
@@ -0,0 +1,269 @@
+package lb
+
+import (
+	"context"
+	"math/rand"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/aram535/dnsbalancer/backend"
+	"github.com/aram535/dnsbalancer/config"
+	"github.com/sirupsen/logrus"
+)
+
+// Outlier detection defaults
+const (
+	defaultOutlierInterval     = 10 * time.Second
+	defaultOutlierMinRequests  = 20
+	defaultOutlierErrorRate    = 0.2
+	defaultOutlierLatency      = 3.0
+	defaultOutlierEjectionTime = 30 * time.Second
+	defaultOutlierMaxEjection  = 50
+)
+
+// outlierMaxSamples caps the latencies kept per backend and interval
+const outlierMaxSamples = 512
+
+// outlierMinLatency is the p95 latency below which a backend is never
+// ejected as slow, however it compares to its peers
+const outlierMinLatency = 20 * time.Millisecond
+
+// outlierStats is one backend's live traffic during an interval
+type outlierStats struct {
+	requests  int
+	failures  int
+	latencies []time.Duration
+}
+
+// outlierSample is one backend's result for an interval
+type outlierSample struct {
+	backend   *backend.Backend
+	errorRate float64
+	p95       time.Duration
+}
+
+// OutlierDetector ejects backends whose live traffic is much worse than
+// that of their pool peers, even while their health checks pass
+type OutlierDetector struct {
+	pools        [][]*backend.Backend
+	interval     time.Duration
+	minRequests  int
+	errorRate    float64
+	latency      float64
+	ejectionTime time.Duration
+	maxEjection  int
+	stats        map[*backend.Backend]*outlierStats
+	ejected      map[*backend.Backend]bool
+	mu           sync.Mutex
+	logger       *logrus.Logger
+}
+
+// NewOutlierDetector creates an outlier detector comparing the backends of
+// each pool with each other
+func NewOutlierDetector(pools []*backendPool, cfg *config.OutlierDetectionConfig, logger *logrus.Logger) *OutlierDetector {
+	d := &OutlierDetector{
+		interval:     cfg.Interval,
+		minRequests:  cfg.MinRequests,
+		errorRate:    cfg.ErrorRateThreshold,
+		latency:      cfg.LatencyFactor,
+		ejectionTime: cfg.EjectionTime,
+		maxEjection:  cfg.MaxEjectionPercent,
+		stats:        make(map[*backend.Backend]*outlierStats),
+		ejected:      make(map[*backend.Backend]bool),
+		logger:       logger,
+	}
+	d.setPools(pools)
+
+	if d.interval == 0 {
+		d.interval = defaultOutlierInterval
+	}
+	if d.minRequests == 0 {
+		d.minRequests = defaultOutlierMinRequests
+	}
+	if d.errorRate == 0 {
+		d.errorRate = defaultOutlierErrorRate
+	}
+	if d.latency == 0 {
+		d.latency = defaultOutlierLatency
+	}
+	if d.ejectionTime == 0 {
+		d.ejectionTime = defaultOutlierEjectionTime
+	}
+	if d.maxEjection == 0 {
+		d.maxEjection = defaultOutlierMaxEjection
+	}
+
+	return d
+}
+
+// setPools replaces the pools whose backends are compared, after backends
+// are added or removed
+func (d *OutlierDetector) setPools(pools []*backendPool) {
+	backends := make([][]*backend.Backend, len(pools))
+	for i, pool := range pools {
+		backends[i] = pool.backends
+	}
+	d.mu.Lock()
+	d.pools = backends
+	d.mu.Unlock()
+}
+
+// Start begins comparing backends every interval
+func (d *OutlierDetector) Start(ctx context.Context) {
+	ticker := time.NewTicker(d.interval)
+
+	go func() {
+		for {
+			select {
+			case <-ticker.C:
+				d.evaluate()
+			case <-ctx.Done():
+				ticker.Stop()
+				return
+			}
+		}
+	}()
+
+	d.logger.WithFields(logrus.Fields{
+		"interval":             d.interval,
+		"min_requests":         d.minRequests,
+		"error_rate_threshold": d.errorRate,
+		"latency_factor":       d.latency,
+		"ejection_time":        d.ejectionTime,
+	}).Info("Outlier detection started")
+}
+
+// record adds the outcome of a query to a backend's stats for the current
+// interval
+func (d *OutlierDetector) record(b *backend.Backend, rtt time.Duration, failed bool) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	stats, ok := d.stats[b]
+	if !ok {
+		stats = &outlierStats{}
+		d.stats[b] = stats
+	}
+
+	stats.requests++
+	if failed {
+		stats.failures++
+		return
+	}
+
+	// Reservoir sampling keeps the latencies representative of the whole
+	// interval once the cap is reached
+	if len(stats.latencies) < outlierMaxSamples {
+		stats.latencies = append(stats.latencies, rtt)
+	} else if i := rand.Intn(stats.requests); i < outlierMaxSamples {
+		stats.latencies[i] = rtt
+	}
+}
+
+// evaluate compares the backends of every pool over the past interval and
+// ejects the outliers
+func (d *OutlierDetector) evaluate() {
+	d.mu.Lock()
+	stats := d.stats
+	pools := d.pools
+	d.stats = make(map[*backend.Backend]*outlierStats)
+	d.mu.Unlock()
+
+	for b := range d.ejected {
+		if !b.Ejected() {
+			delete(d.ejected, b)
+			d.logger.WithField("backend", b.Address).Info("Outlier ejection ended, backend back in rotation")
+		}
+	}
+
+	for _, pool := range pools {
+		d.evaluatePool(pool, stats)
+	}
+}
+
+// evaluatePool ejects the backends of a pool that do much worse than the
+// median of their peers, leaving at most maxEjection percent of the pool
+// ejected
+func (d *OutlierDetector) evaluatePool(pool []*backend.Backend, stats map[*backend.Backend]*outlierStats) {
+	ejected := 0
+	var samples []outlierSample
+	for _, b := range pool {
+		if b.Ejected() {
+			ejected++
+			continue
+		}
+		s := stats[b]
+		if s == nil || s.requests < d.minRequests {
+			continue
+		}
+		samples = append(samples, outlierSample{
+			backend:   b,
+			errorRate: float64(s.failures) / float64(s.requests),
+			p95:       percentile(s.latencies, 0.95),
+		})
+	}
+
+	maxEjected := len(pool) * d.maxEjection / 100
+	for i, s := range samples {
+		var peerErrors []float64
+		var peerLatencies []time.Duration
+		for j, peer := range samples {
+			if j == i {
+				continue
+			}
+			peerErrors = append(peerErrors, peer.errorRate)
+			// Peers that only failed have no latency to compare with
+			if peer.p95 > 0 {
+				peerLatencies = append(peerLatencies, peer.p95)
+			}
+		}
+		if len(peerErrors) == 0 {
+			return
+		}
+
+		sort.Float64s(peerErrors)
+		peerErrorRate := peerErrors[len(peerErrors)/2]
+		peerP95 := percentile(peerLatencies, 0.5)
+
+		var reason string
+		switch {
+		case s.errorRate-peerErrorRate >= d.errorRate:
+			reason = "error rate"
+		case s.p95 > outlierMinLatency && peerP95 > 0 && float64(s.p95) > d.latency*float64(peerP95):
+			reason = "latency"
+		default:
+			continue
+		}
+
+		logger := d.logger.WithFields(logrus.Fields{
+			"backend":         s.backend.Address,
+			"reason":          reason,
+			"error_rate":      s.errorRate,
+			"peer_error_rate": peerErrorRate,
+			"p95":             s.p95,
+			"peer_p95":        peerP95,
+		})
+		if ejected >= maxEjected {
+			logger.Warn("Backend is an outlier but too many backends are already ejected")
+			continue
+		}
+
+		s.backend.Eject(d.ejectionTime)
+		d.ejected[s.backend] = true
+		ejected++
+		logger.WithField("ejection_time", d.ejectionTime).Warn("Ejected outlier backend")
+	}
+}
+
+// percentile returns the p-th percentile of a set of latencies, or 0 if
+// there are none
+func percentile(latencies []time.Duration, p float64) time.Duration {
+	if len(latencies) == 0 {
+		return 0
+	}
+
+	sorted := append([]time.Duration{}, latencies...)
+	sort.Slice(sorted, func(i, j int) bool { return sorted[i] < sorted[j] })
+	return sorted[int(p*float64(len(sorted)-1))]
+}
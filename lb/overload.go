@@ -0,0 +1,149 @@
+package lb
+
+import (
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/aram535/dnsbalancer/config"
+	"github.com/miekg/dns"
+	"github.com/sirupsen/logrus"
+)
+
+// Overload actions
+const (
+	overloadServfail = "servfail"
+	overloadTruncate = "truncate"
+	overloadDrop     = "drop"
+)
+
+// overloadWarnInterval is how often shedding is logged above debug level
+const overloadWarnInterval = 10 * time.Second
+
+// overload caps the queries the whole process takes on, by rate and by the
+// number being resolved at once. Queries beyond either are answered
+// straight away instead of piling up goroutines waiting on slow backends.
+type overload struct {
+	qps         float64 // 0 = no rate ceiling
+	maxInFlight int64   // 0 = no in-flight ceiling
+	action      string
+
+	mu     sync.Mutex
+	tokens float64
+	last   time.Time
+
+	inFlight     int64  // Queries being resolved
+	shedRate     uint64 // Queries shed over the QPS ceiling
+	shedInFlight uint64 // Queries shed over the in-flight ceiling
+	lastWarn     int64  // Unix nanoseconds of the last shedding warning
+}
+
+// newOverload creates the process-wide limiter, or returns nil when it is
+// not enabled
+func newOverload(cfg *config.OverloadConfig) *overload {
+	if cfg == nil || !cfg.Enabled {
+		return nil
+	}
+
+	o := &overload{
+		qps:         cfg.QPS,
+		maxInFlight: int64(cfg.InFlight),
+		action:      cfg.Action,
+		tokens:      cfg.QPS,
+		last:        time.Now(),
+	}
+	if o.action == "" {
+		o.action = overloadServfail
+	}
+	return o
+}
+
+// admit takes a query on if it fits under both ceilings. Every admitted
+// query must be released with done.
+func (o *overload) admit() bool {
+	if o == nil {
+		return true
+	}
+
+	if o.maxInFlight > 0 && atomic.AddInt64(&o.inFlight, 1) > o.maxInFlight {
+		atomic.AddInt64(&o.inFlight, -1)
+		atomic.AddUint64(&o.shedInFlight, 1)
+		return false
+	}
+	if o.qps > 0 && !o.take() {
+		if o.maxInFlight > 0 {
+			atomic.AddInt64(&o.inFlight, -1)
+		}
+		atomic.AddUint64(&o.shedRate, 1)
+		return false
+	}
+	return true
+}
+
+// take takes a token from the process-wide bucket, which holds up to one
+// second's worth of queries
+func (o *overload) take() bool {
+	now := time.Now()
+	o.mu.Lock()
+	defer o.mu.Unlock()
+
+	o.tokens = min(o.qps, o.tokens+now.Sub(o.last).Seconds()*o.qps)
+	o.last = now
+	if o.tokens < 1 {
+		return false
+	}
+	o.tokens--
+	return true
+}
+
+// done releases an admitted query
+func (o *overload) done() {
+	if o != nil && o.maxInFlight > 0 {
+		atomic.AddInt64(&o.inFlight, -1)
+	}
+}
+
+// shed answers a query the process has no room for: SERVFAIL, an empty
+// truncated response that sends a UDP client over to TCP and so slows it
+// down, or nothing at all. Stream clients are answered SERVFAIL instead of
+// truncated.
+func (lb *LoadBalancer) shed(query []byte, clientAddr net.Addr, logger *logrus.Entry) []byte {
+	o := lb.overload
+	now := time.Now().UnixNano()
+	if last := atomic.LoadInt64(&o.lastWarn); now-last >= int64(overloadWarnInterval) && atomic.CompareAndSwapInt64(&o.lastWarn, last, now) {
+		lb.logger.WithFields(logrus.Fields{
+			"in_flight": atomic.LoadInt64(&o.inFlight),
+			"action":    o.action,
+		}).Warn("Overloaded, shedding queries")
+	}
+	logger.Debug("Overloaded, shedding query")
+
+	switch o.action {
+	case overloadTruncate:
+		if !isStreamClient(clientAddr) {
+			return truncatedResponse(query)
+		}
+	case overloadDrop:
+		return nil
+	}
+	return rcodeResponse(query, dns.RcodeServerFailure)
+}
+
+// OverloadStats returns the ceilings, the queries in flight and the number
+// shed, or nil if the overload limits are not enabled
+func (lb *LoadBalancer) OverloadStats() map[string]interface{} {
+	o := lb.overload
+	if o == nil {
+		return nil
+	}
+
+	return map[string]interface{}{
+		"qps":            o.qps,
+		"max_in_flight":  o.maxInFlight,
+		"in_flight":      atomic.LoadInt64(&o.inFlight),
+		"action":         o.action,
+		"shed_qps":       atomic.LoadUint64(&o.shedRate),
+		"shed_in_flight": atomic.LoadUint64(&o.shedInFlight),
+	}
+}
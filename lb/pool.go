@@ -0,0 +1,82 @@
+package lb
+
+import (
+	"sort"
+	"strings"
+
+	"github.com/aram535/dnsbalancer/backend"
+)
+
+// defaultPriority is the pool backends belong to unless configured
+const defaultPriority = 1
+
+// backendPool is a group of backends sharing a priority. Queries only go to
+// the pool with the lowest priority number that has a healthy member, so
+// backup pools take over only once every primary backend is down.
+type backendPool struct {
+	priority int
+	backends []*backend.Backend
+	balancer Balancer
+	id       string // Backend addresses, naming the pool the same on every instance
+}
+
+// newBackendPools groups backends by priority, most preferred pool first,
+// giving each pool a balancer made by factory
+func newBackendPools(backends []*backend.Backend, priorities []int, factory BalancerFactory) []*backendPool {
+	byPriority := make(map[int]*backendPool)
+	var pools []*backendPool
+
+	for i, b := range backends {
+		priority := priorities[i]
+		if priority == 0 {
+			priority = defaultPriority
+		}
+
+		pool, ok := byPriority[priority]
+		if !ok {
+			pool = &backendPool{priority: priority}
+			byPriority[priority] = pool
+			pools = append(pools, pool)
+		}
+		pool.backends = append(pool.backends, b)
+	}
+
+	sort.Slice(pools, func(i, j int) bool { return pools[i].priority < pools[j].priority })
+	for _, pool := range pools {
+		pool.balancer = factory(pool.backends)
+		addresses := make([]string, len(pool.backends))
+		for i, b := range pool.backends {
+			addresses[i] = b.Address
+		}
+		pool.id = strings.Join(addresses, ",")
+	}
+
+	return pools
+}
+
+// activePool returns the most preferred pool with an available backend,
+// i.e. one that is healthy and below its in-flight cap
+func activePool(pools []*backendPool) *backendPool {
+	for _, pool := range pools {
+		for _, b := range pool.backends {
+			if b.Available() {
+				return pool
+			}
+		}
+	}
+	return nil
+}
+
+// allPools returns the pools of the default backends and of every domain,
+// client and geo route
+func (lb *LoadBalancer) allPools() []*backendPool {
+	active := lb.active.Load()
+	pools := append([]*backendPool{}, active.pools...)
+	for _, routePools := range active.routes {
+		pools = append(pools, routePools...)
+	}
+	for _, route := range active.clientRoutes {
+		pools = append(pools, route.pools...)
+	}
+	return append(pools, lb.geo.allPools()...)
+}
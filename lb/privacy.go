@@ -0,0 +1,101 @@
+package lb
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"net"
+	"net/netip"
+
+	"github.com/aram535/dnsbalancer/config"
+)
+
+// Client address privacy modes and default truncation prefixes
+const (
+	privacyFull     = "full"
+	privacyTruncate = "truncate"
+	privacyHash     = "hash"
+
+	defaultPrivacyIPv4Prefix = 24
+	defaultPrivacyIPv6Prefix = 48
+)
+
+// clientPrivacy turns client addresses into what logs and statistics
+// record: the network with the host bits zeroed, or a keyed hash that
+// still tells clients apart without revealing them. A nil clientPrivacy
+// records addresses in full.
+type clientPrivacy struct {
+	mode       string
+	ipv4Prefix int
+	ipv6Prefix int
+	key        []byte // HMAC key for the hash mode
+}
+
+// newClientPrivacy creates the client address anonymizer, or returns nil
+// when addresses are recorded in full
+func newClientPrivacy(cfg *config.PrivacyConfig) (*clientPrivacy, error) {
+	if cfg == nil || cfg.ClientIP == "" || cfg.ClientIP == privacyFull {
+		return nil, nil
+	}
+
+	p := &clientPrivacy{
+		mode:       cfg.ClientIP,
+		ipv4Prefix: cfg.IPv4Prefix,
+		ipv6Prefix: cfg.IPv6Prefix,
+		key:        []byte(cfg.HashKey),
+	}
+	if p.ipv4Prefix == 0 {
+		p.ipv4Prefix = defaultPrivacyIPv4Prefix
+	}
+	if p.ipv6Prefix == 0 {
+		p.ipv6Prefix = defaultPrivacyIPv6Prefix
+	}
+	if p.mode == privacyHash && len(p.key) == 0 {
+		// Without a configured key, pseudonyms last until the next restart
+		p.key = make([]byte, 32)
+		if _, err := rand.Read(p.key); err != nil {
+			return nil, fmt.Errorf("failed to generate privacy hash key: %w", err)
+		}
+	}
+	return p, nil
+}
+
+// client returns how a client address is recorded. Addresses without an
+// IP, such as unix socket peers, are recorded as they are; anonymized
+// ones lose their port.
+func (p *clientPrivacy) client(clientAddr net.Addr) string {
+	if p == nil {
+		return clientAddr.String()
+	}
+	ip, ok := netip.AddrFromSlice(addrIP(clientAddr))
+	if !ok {
+		return clientAddr.String()
+	}
+	return p.ip(ip)
+}
+
+// ip returns how a client IP address is recorded
+func (p *clientPrivacy) ip(ip netip.Addr) string {
+	ip = ip.Unmap()
+	if p == nil {
+		return ip.String()
+	}
+
+	if p.mode == privacyHash {
+		mac := hmac.New(sha256.New, p.key)
+		mac.Write(ip.AsSlice())
+		return hex.EncodeToString(mac.Sum(nil)[:8])
+	}
+
+	bits := p.ipv6Prefix
+	if ip.Is4() {
+		bits = p.ipv4Prefix
+	}
+	prefix, err := ip.Prefix(bits)
+	if err != nil {
+		return ip.String()
+	}
+	return prefix.Addr().String()
+}
@@ -0,0 +1,245 @@
+package lb
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+// proxyHeaderTimeout bounds how long a proxy may take to send the header
+const proxyHeaderTimeout = 5 * time.Second
+
+// proxyV2Signature starts every PROXY protocol v2 header
+var proxyV2Signature = []byte("\r\n\r\n\x00\r\nQUIT\n")
+
+// proxyListener wraps a stream listener and strips PROXY protocol v1/v2
+// headers sent by trusted proxies, exposing the original client address
+// as the connection's RemoteAddr. Headers are read off the accept path so
+// a slow proxy can't stall other connections.
+type proxyListener struct {
+	net.Listener
+	trusted []*net.IPNet
+	logger  *logrus.Logger
+
+	conns     chan net.Conn
+	errs      chan error
+	done      chan struct{}
+	closeOnce sync.Once
+}
+
+// proxyConn is a connection whose header has been consumed
+type proxyConn struct {
+	net.Conn
+	reader *bufio.Reader
+	remote net.Addr
+}
+
+func (c *proxyConn) Read(b []byte) (int, error) { return c.reader.Read(b) }
+func (c *proxyConn) RemoteAddr() net.Addr       { return c.remote }
+
+// newProxyListener starts accepting on inner and parsing PROXY headers
+func newProxyListener(inner net.Listener, trusted []*net.IPNet, logger *logrus.Logger) *proxyListener {
+	l := &proxyListener{
+		Listener: inner,
+		trusted:  trusted,
+		logger:   logger,
+		conns:    make(chan net.Conn),
+		errs:     make(chan error, 1),
+		done:     make(chan struct{}),
+	}
+	go l.acceptLoop()
+	return l
+}
+
+// Accept returns the next connection with its PROXY header consumed
+func (l *proxyListener) Accept() (net.Conn, error) {
+	select {
+	case conn := <-l.conns:
+		return conn, nil
+	case err := <-l.errs:
+		return nil, err
+	case <-l.done:
+		return nil, net.ErrClosed
+	}
+}
+
+// Close stops accepting connections
+func (l *proxyListener) Close() error {
+	l.closeOnce.Do(func() { close(l.done) })
+	return l.Listener.Close()
+}
+
+// acceptLoop accepts raw connections and hands each to a header parser
+func (l *proxyListener) acceptLoop() {
+	for {
+		conn, err := l.Listener.Accept()
+		if err != nil {
+			select {
+			case l.errs <- err:
+			case <-l.done:
+				return
+			}
+			if errors.Is(err, net.ErrClosed) {
+				return
+			}
+			continue
+		}
+
+		go l.handshake(conn)
+	}
+}
+
+// handshake reads the PROXY header from trusted peers and delivers the
+// connection to Accept. Untrusted peers are passed through unchanged.
+func (l *proxyListener) handshake(conn net.Conn) {
+	if l.isTrusted(conn.RemoteAddr()) {
+		conn.SetReadDeadline(time.Now().Add(proxyHeaderTimeout))
+
+		reader := bufio.NewReader(conn)
+		remote, err := readProxyHeader(reader)
+		if err != nil {
+			l.logger.WithError(err).WithField("proxy", conn.RemoteAddr().String()).Debug("Rejecting connection with invalid PROXY header")
+			conn.Close()
+			return
+		}
+		conn.SetReadDeadline(time.Time{})
+
+		if remote == nil {
+			remote = conn.RemoteAddr()
+		}
+		conn = &proxyConn{Conn: conn, reader: reader, remote: remote}
+	}
+
+	select {
+	case l.conns <- conn:
+	case <-l.done:
+		conn.Close()
+	}
+}
+
+// isTrusted reports whether addr belongs to a trusted proxy
+func (l *proxyListener) isTrusted(addr net.Addr) bool {
+	tcpAddr, ok := addr.(*net.TCPAddr)
+	if !ok {
+		return false
+	}
+	for _, network := range l.trusted {
+		if network.Contains(tcpAddr.IP) {
+			return true
+		}
+	}
+	return false
+}
+
+// readProxyHeader parses a v1 or v2 PROXY header. It returns a nil address
+// for LOCAL/UNKNOWN headers, meaning the proxy's own address applies.
+func readProxyHeader(r *bufio.Reader) (net.Addr, error) {
+	peek, err := r.Peek(len(proxyV2Signature))
+	if err != nil {
+		return nil, fmt.Errorf("failed to read PROXY header: %w", err)
+	}
+
+	if bytes.Equal(peek, proxyV2Signature) {
+		return readProxyHeaderV2(r)
+	}
+	if bytes.HasPrefix(peek, []byte("PROXY ")) {
+		return readProxyHeaderV1(r)
+	}
+
+	return nil, errors.New("missing PROXY header")
+}
+
+// readProxyHeaderV1 parses the text form, e.g.
+// "PROXY TCP4 192.0.2.1 198.51.100.1 56324 53\r\n"
+func readProxyHeaderV1(r *bufio.Reader) (net.Addr, error) {
+	// The longest valid v1 header is 107 bytes
+	var line []byte
+	for len(line) < 107 {
+		b, err := r.ReadByte()
+		if err != nil {
+			return nil, fmt.Errorf("failed to read PROXY v1 header: %w", err)
+		}
+		line = append(line, b)
+		if b == '\n' {
+			break
+		}
+	}
+	if !bytes.HasSuffix(line, []byte("\r\n")) {
+		return nil, errors.New("PROXY v1 header too long or not terminated")
+	}
+
+	fields := strings.Fields(string(line[:len(line)-2]))
+	if len(fields) >= 2 && fields[1] == "UNKNOWN" {
+		return nil, nil
+	}
+	if len(fields) != 6 || (fields[1] != "TCP4" && fields[1] != "TCP6") {
+		return nil, fmt.Errorf("malformed PROXY v1 header %q", line)
+	}
+
+	ip := net.ParseIP(fields[2])
+	port, err := strconv.ParseUint(fields[4], 10, 16)
+	if ip == nil || err != nil {
+		return nil, fmt.Errorf("malformed PROXY v1 source %q %q", fields[2], fields[4])
+	}
+
+	return &net.TCPAddr{IP: ip, Port: int(port)}, nil
+}
+
+// readProxyHeaderV2 parses the binary form
+func readProxyHeaderV2(r *bufio.Reader) (net.Addr, error) {
+	header := make([]byte, 16)
+	if _, err := io.ReadFull(r, header); err != nil {
+		return nil, fmt.Errorf("failed to read PROXY v2 header: %w", err)
+	}
+
+	verCmd, family := header[12], header[13]
+	length := int(binary.BigEndian.Uint16(header[14:16]))
+
+	if verCmd>>4 != 2 {
+		return nil, fmt.Errorf("unsupported PROXY protocol version %d", verCmd>>4)
+	}
+
+	payload := make([]byte, length)
+	if _, err := io.ReadFull(r, payload); err != nil {
+		return nil, fmt.Errorf("failed to read PROXY v2 addresses: %w", err)
+	}
+
+	switch verCmd & 0x0f {
+	case 0x0: // LOCAL: health checks from the proxy itself
+		return nil, nil
+	case 0x1: // PROXY
+	default:
+		return nil, fmt.Errorf("unsupported PROXY v2 command %d", verCmd&0x0f)
+	}
+
+	switch family >> 4 {
+	case 0x1: // AF_INET
+		if length < 12 {
+			return nil, errors.New("short PROXY v2 IPv4 address block")
+		}
+		return &net.TCPAddr{
+			IP:   net.IP(append([]byte(nil), payload[0:4]...)),
+			Port: int(binary.BigEndian.Uint16(payload[8:10])),
+		}, nil
+	case 0x2: // AF_INET6
+		if length < 36 {
+			return nil, errors.New("short PROXY v2 IPv6 address block")
+		}
+		return &net.TCPAddr{
+			IP:   net.IP(append([]byte(nil), payload[0:16]...)),
+			Port: int(binary.BigEndian.Uint16(payload[32:34])),
+		}, nil
+	default: // AF_UNSPEC or AF_UNIX carry no usable client IP
+		return nil, nil
+	}
+}
@@ -0,0 +1,134 @@
+package lb
+
+import (
+	"sync/atomic"
+
+	"github.com/aram535/dnsbalancer/config"
+	"github.com/miekg/dns"
+	"github.com/sirupsen/logrus"
+)
+
+// minimalAnyTTL is the TTL of the HINFO record answering ANY queries
+const minimalAnyTTL = 3600
+
+// qtypeFilter answers queries of some types itself instead of forwarding
+// them: refused types get REFUSED, and ANY gets the minimal answer of
+// RFC 8482, a lone synthesized HINFO record, rather than the large
+// response that makes it popular for amplification attacks
+type qtypeFilter struct {
+	refuse     map[uint16]bool
+	forwardAny bool
+	refused    uint64 // Queries answered REFUSED
+	minimalAny uint64 // ANY queries answered with HINFO
+}
+
+// newQtypeFilter creates the query type filter, or returns nil when none
+// is enabled
+func newQtypeFilter(cfg *config.QueryTypesConfig) *qtypeFilter {
+	if cfg == nil || !cfg.Enabled {
+		return nil
+	}
+
+	f := &qtypeFilter{
+		refuse:     make(map[uint16]bool, len(cfg.Refuse)),
+		forwardAny: cfg.ForwardAny,
+	}
+	for _, name := range cfg.Refuse {
+		f.refuse[dns.StringToType[name]] = true
+	}
+	return f
+}
+
+// filterQtype answers a query the filter doesn't let through, returning
+// false for queries to forward
+func (lb *LoadBalancer) filterQtype(query []byte, logger *logrus.Entry) ([]byte, bool) {
+	f := lb.qtypeFilter
+	if f == nil {
+		return nil, false
+	}
+	qtype, ok := questionType(query)
+	if !ok {
+		return nil, false
+	}
+
+	if f.refuse[qtype] {
+		atomic.AddUint64(&f.refused, 1)
+		logger.WithField("qtype", dns.Type(qtype).String()).Debug("Refusing query type")
+		return rcodeResponse(query, dns.RcodeRefused), true
+	}
+	if qtype == dns.TypeANY && !f.forwardAny {
+		atomic.AddUint64(&f.minimalAny, 1)
+		logger.Debug("Answering ANY query with HINFO")
+		return minimalAnyResponse(query), true
+	}
+	return nil, false
+}
+
+// minimalAnyResponse answers an ANY query with a single HINFO record
+// (RFC 8482 section 4.2)
+func minimalAnyResponse(query []byte) []byte {
+	msg := new(dns.Msg)
+	if err := msg.Unpack(query); err != nil || len(msg.Question) != 1 {
+		return nil
+	}
+
+	reply := new(dns.Msg)
+	reply.SetReply(msg)
+	reply.Answer = []dns.RR{&dns.HINFO{
+		Hdr: dns.RR_Header{
+			Name:   msg.Question[0].Name,
+			Rrtype: dns.TypeHINFO,
+			Class:  msg.Question[0].Qclass,
+			Ttl:    minimalAnyTTL,
+		},
+		Cpu: "RFC8482",
+	}}
+	if opt := msg.IsEdns0(); opt != nil {
+		reply.SetEdns0(dns.DefaultMsgSize, opt.Do())
+	}
+
+	response, err := reply.Pack()
+	if err != nil {
+		return nil
+	}
+	return response
+}
+
+// questionType reads the type of a query's first question, without
+// unpacking the whole message unless its name is compressed
+func questionType(query []byte) (uint16, bool) {
+	if len(query) < 12 || query[4] == 0 && query[5] == 0 {
+		return 0, false
+	}
+
+	off := 12
+	for off < len(query) && query[off] != 0 {
+		if query[off]&0xC0 != 0 {
+			msg := new(dns.Msg)
+			if err := msg.Unpack(query); err != nil || len(msg.Question) == 0 {
+				return 0, false
+			}
+			return msg.Question[0].Qtype, true
+		}
+		off += int(query[off]) + 1
+	}
+	off++
+	if off+2 > len(query) {
+		return 0, false
+	}
+	return uint16(query[off])<<8 | uint16(query[off+1]), true
+}
+
+// QueryTypeStats returns the number of queries refused for their type and
+// of ANY queries answered with HINFO, or nil if no filter is enabled
+func (lb *LoadBalancer) QueryTypeStats() map[string]interface{} {
+	f := lb.qtypeFilter
+	if f == nil {
+		return nil
+	}
+
+	return map[string]interface{}{
+		"refused":     atomic.LoadUint64(&f.refused),
+		"minimal_any": atomic.LoadUint64(&f.minimalAny),
+	}
+}
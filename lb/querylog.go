@@ -0,0 +1,310 @@
+package lb
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"math/rand"
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/aram535/dnsbalancer/config"
+	"github.com/miekg/dns"
+	"github.com/sirupsen/logrus"
+)
+
+// Query log defaults
+const (
+	defaultQueryLogFile    = "queries.log" // Name in the log directory
+	defaultQueryLogMode    = 0644
+	defaultQueryLogBackups = 5
+	queryLogReopenDelay    = time.Second // Between attempts to open the file again after a failure
+)
+
+// queryLog writes a JSON line for a sample of the queries answered, apart
+// from the application log, so busy sites can keep a record of a share of
+// their traffic without logging every query at debug level. It rotates
+// its own file, by size or age, keeping the last few: file.1 is the
+// newest, and the oldest is removed.
+type queryLog struct {
+	file        string
+	sampleRate  float64
+	errorsOnly  bool // Only dropped queries and error answers are written
+	mode        os.FileMode
+	maxSize     int64 // Bytes, 0 = no size limit
+	rotateEvery time.Duration
+	maxBackups  int
+	privacy     *clientPrivacy
+	logger      *logrus.Logger
+
+	mu        sync.Mutex
+	out       *os.File
+	size      int64     // Bytes in the current file
+	rotateAt  time.Time // When the current file is rotated, zero = not by age
+	reopenAt  time.Time // When to try opening the file again, after it failed to
+	written   uint64    // Records written
+	errors    uint64    // Records that failed to write
+	rotations uint64
+}
+
+// queryRecord is one line of the query log. It rides along with the
+// query on its logger's context, so the steps resolving it can note the
+// backend and whether it came from the cache.
+type queryRecord struct {
+	Time    string  `json:"time"`
+	Client  string  `json:"client"`
+	Name    string  `json:"qname"`
+	Type    string  `json:"qtype"`
+	Rcode   string  `json:"rcode,omitempty"`
+	Dropped bool    `json:"dropped,omitempty"` // No response was sent
+	Backend string  `json:"backend,omitempty"`
+	Cached  bool    `json:"cached"`
+	Latency float64 `json:"latency_ms"`
+
+	start time.Time
+}
+
+// queryRecordKey is the context key of a query's record
+type queryRecordKey struct{}
+
+// newQueryLog opens the query log, or returns nil when it is not enabled.
+// Without a file it is written next to the application log.
+func newQueryLog(cfg *config.QueryLogConfig, logDir string, privacy *clientPrivacy, logger *logrus.Logger) (*queryLog, error) {
+	if cfg == nil || !cfg.Enabled {
+		return nil, nil
+	}
+
+	q := &queryLog{
+		file:        cfg.File,
+		sampleRate:  cfg.SampleRate,
+		errorsOnly:  cfg.Level == "errors",
+		mode:        defaultQueryLogMode,
+		maxSize:     int64(cfg.MaxSizeMB) << 20,
+		rotateEvery: cfg.RotateEvery,
+		maxBackups:  cfg.MaxBackups,
+		privacy:     privacy,
+		logger:      logger,
+	}
+	if q.file == "" {
+		q.file = filepath.Join(logDir, defaultQueryLogFile)
+	}
+	if q.sampleRate == 0 {
+		q.sampleRate = 1
+	}
+	if cfg.Permissions != "" {
+		mode, _ := strconv.ParseUint(cfg.Permissions, 8, 32)
+		q.mode = os.FileMode(mode)
+	}
+	if q.maxBackups == 0 {
+		q.maxBackups = defaultQueryLogBackups
+	}
+
+	if err := q.open(); err != nil {
+		return nil, fmt.Errorf("failed to open query log: %w", err)
+	}
+	return q, nil
+}
+
+// open opens the query log file for appending, giving it the configured
+// mode even if it already existed. The caller holds q.mu or is the only
+// user.
+func (q *queryLog) open() error {
+	out, err := os.OpenFile(q.file, os.O_CREATE|os.O_WRONLY|os.O_APPEND, q.mode)
+	if err != nil {
+		return err
+	}
+	info, err := out.Stat()
+	if err == nil {
+		err = out.Chmod(q.mode)
+	}
+	if err != nil {
+		out.Close()
+		return err
+	}
+
+	q.out = out
+	q.size = info.Size()
+	q.rotateAt = time.Time{}
+	if q.rotateEvery > 0 {
+		q.rotateAt = time.Now().Add(q.rotateEvery)
+	}
+	return nil
+}
+
+// rotate moves the current file to file.1, shifting the older ones up and
+// removing the oldest, and opens a new file. If the file can't be moved,
+// writing goes on to the same file until the next rotation is due; if the
+// new one can't be opened, records are dropped until it can. The caller
+// holds q.mu.
+func (q *queryLog) rotate() {
+	q.out.Close()
+
+	os.Remove(fmt.Sprintf("%s.%d", q.file, q.maxBackups))
+	for i := q.maxBackups - 1; i >= 1; i-- {
+		os.Rename(fmt.Sprintf("%s.%d", q.file, i), fmt.Sprintf("%s.%d", q.file, i+1))
+	}
+	renameErr := os.Rename(q.file, q.file+".1")
+	if renameErr != nil {
+		q.logger.WithError(renameErr).WithField("file", q.file).Warn("Failed to rotate query log")
+	} else {
+		q.rotations++
+	}
+
+	if err := q.open(); err != nil {
+		q.logger.WithError(err).WithField("file", q.file).Error("Failed to reopen query log")
+		q.out = nil
+		q.reopenAt = time.Now().Add(queryLogReopenDelay)
+		return
+	}
+	if renameErr != nil {
+		// Count the size afresh so the next attempt waits for another
+		// max_size_mb rather than coming with the next record
+		q.size = 0
+	}
+}
+
+// sample starts the record of a query picked for the log, returning the
+// logger carrying it, or the logger as it is for queries not logged
+func (q *queryLog) sample(query []byte, clientAddr net.Addr, logger *logrus.Entry) (*queryRecord, *logrus.Entry) {
+	if q == nil || (q.sampleRate < 1 && rand.Float64() >= q.sampleRate) {
+		return nil, logger
+	}
+
+	msg := new(dns.Msg)
+	if err := msg.Unpack(query); err != nil || len(msg.Question) == 0 {
+		return nil, logger
+	}
+
+	now := time.Now()
+	record := &queryRecord{
+		Time:   now.UTC().Format(time.RFC3339Nano),
+		Client: q.privacy.client(clientAddr),
+		Name:   msg.Question[0].Name,
+		Type:   dns.Type(msg.Question[0].Qtype).String(),
+		start:  now,
+	}
+	ctx := context.WithValue(context.Background(), queryRecordKey{}, record)
+	return record, logger.WithContext(ctx)
+}
+
+// queryRecordOf returns the record of the query a logger is for, or nil
+// if the query isn't logged
+func queryRecordOf(logger *logrus.Entry) *queryRecord {
+	if logger.Context == nil {
+		return nil
+	}
+	record, _ := logger.Context.Value(queryRecordKey{}).(*queryRecord)
+	return record
+}
+
+// noteBackend records the backend that answered a logged query
+func (r *queryRecord) noteBackend(address string) {
+	if r != nil {
+		r.Backend = address
+	}
+}
+
+// noteCached records that a logged query was answered from the cache
+func (r *queryRecord) noteCached() {
+	if r != nil {
+		r.Cached = true
+	}
+}
+
+// reopen tries again to open the file a rotation failed to reopen. The
+// caller holds q.mu.
+func (q *queryLog) reopen() {
+	if err := q.open(); err != nil {
+		q.reopenAt = time.Now().Add(queryLogReopenDelay)
+		return
+	}
+	q.logger.WithField("file", q.file).Info("Query log reopened")
+}
+
+// write completes a record with the response and writes it out
+func (q *queryLog) write(record *queryRecord, response []byte) {
+	if record == nil {
+		return
+	}
+
+	record.Latency = float64(time.Since(record.start).Microseconds()) / 1000
+	if len(response) < 4 {
+		record.Dropped = true
+	} else {
+		rcode := int(response[3] & 0x0f)
+		if q.errorsOnly && (rcode == dns.RcodeSuccess || rcode == dns.RcodeNameError) {
+			return
+		}
+		record.Rcode = rcodeName(rcode)
+	}
+
+	line, err := json.Marshal(record)
+	if err != nil {
+		return
+	}
+	line = append(line, '\n')
+
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if q.out != nil && ((q.maxSize > 0 && q.size+int64(len(line)) > q.maxSize && q.size > 0) ||
+		(!q.rotateAt.IsZero() && time.Now().After(q.rotateAt))) {
+		q.rotate()
+	}
+	if q.out == nil && !time.Now().Before(q.reopenAt) {
+		q.reopen()
+	}
+	if q.out == nil {
+		q.errors++
+		return
+	}
+	n, err := q.out.Write(line)
+	q.size += int64(n)
+	if err != nil {
+		q.errors++
+		return
+	}
+	q.written++
+}
+
+// close closes the query log file
+func (q *queryLog) close() {
+	if q == nil {
+		return
+	}
+
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if q.out != nil {
+		q.out.Close()
+	}
+}
+
+// QueryLogStats returns where the query log goes, its sample rate and the
+// records written, or nil if the query log is not enabled
+func (lb *LoadBalancer) QueryLogStats() map[string]interface{} {
+	q := lb.queryLog
+	if q == nil {
+		return nil
+	}
+
+	level := "all"
+	if q.errorsOnly {
+		level = "errors"
+	}
+
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	return map[string]interface{}{
+		"file":        q.file,
+		"sample_rate": q.sampleRate,
+		"level":       level,
+		"size":        q.size,
+		"written":     q.written,
+		"errors":      q.errors,
+		"rotations":   q.rotations,
+	}
+}
@@ -0,0 +1,119 @@
+package lb
+
+import (
+	"fmt"
+	"sync"
+
+	"github.com/aram535/dnsbalancer/backend"
+	"github.com/aram535/dnsbalancer/config"
+	"github.com/sirupsen/logrus"
+)
+
+// quorum tracks whether enough backends are healthy for this instance to
+// keep serving as usual. Below quorum the health endpoints fail, so an
+// orchestrator can take the instance out of its virtual IP, and queries
+// may follow a fail behavior of their own.
+type quorum struct {
+	minHealthy   int
+	failBehavior string // Replaces the fail behavior while below quorum, empty to keep it
+	healthy      int
+	lost         bool
+	mu           sync.Mutex
+}
+
+// newQuorum returns the quorum of the backends, or nil when no quorum is
+// configured
+func newQuorum(cfg *config.QuorumConfig, backends []*backend.Backend) (*quorum, error) {
+	if cfg == nil || !cfg.Enabled {
+		return nil, nil
+	}
+	if cfg.MinHealthy > len(backends) {
+		return nil, fmt.Errorf("quorum min_healthy %d exceeds the %d backends", cfg.MinHealthy, len(backends))
+	}
+
+	return &quorum{
+		minHealthy:   cfg.MinHealthy,
+		failBehavior: cfg.FailBehavior,
+		healthy:      len(backends), // Backends start out healthy
+	}, nil
+}
+
+// checkQuorum counts the healthy backends, logging and notifying the
+// webhooks when their number falls below or climbs back to the quorum
+func (lb *LoadBalancer) checkQuorum() {
+	q := lb.quorum
+	if q == nil {
+		return
+	}
+
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	healthy := lb.healthyCount()
+	q.healthy = healthy
+
+	lost := healthy < q.minHealthy
+	if lost == q.lost {
+		return
+	}
+	q.lost = lost
+
+	logger := lb.logger.WithFields(logrus.Fields{
+		"healthy":     healthy,
+		"min_healthy": q.minHealthy,
+	})
+	if lost {
+		logger.Error("Healthy backends below quorum")
+	} else {
+		logger.Info("Healthy backends back at quorum")
+	}
+	lb.webhooks.quorumChanged(lost, healthy, len(lb.allBackends()), q.minHealthy)
+}
+
+// healthyCount returns the number of backends marked healthy
+func (lb *LoadBalancer) healthyCount() int {
+	healthy := 0
+	for _, b := range lb.allBackends() {
+		if b.IsHealthy() {
+			healthy++
+		}
+	}
+	return healthy
+}
+
+// status returns the number of healthy backends and whether it is below
+// the quorum. A nil quorum is always met.
+func (q *quorum) status() (healthy int, lost bool) {
+	if q == nil {
+		return 0, false
+	}
+
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	return q.healthy, q.lost
+}
+
+// failOverride returns the fail behavior replacing the configured one, or
+// "" while the quorum is met or none is set
+func (q *quorum) failOverride() string {
+	if _, lost := q.status(); lost {
+		return q.failBehavior
+	}
+	return ""
+}
+
+// QuorumStats returns the healthy backend count and quorum state, or nil
+// if no quorum is configured
+func (lb *LoadBalancer) QuorumStats() map[string]interface{} {
+	q := lb.quorum
+	if q == nil {
+		return nil
+	}
+
+	healthy, lost := q.status()
+	return map[string]interface{}{
+		"healthy":     healthy,
+		"min_healthy": q.minHealthy,
+		"quorum":      !lost,
+	}
+}
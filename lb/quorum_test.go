@@ -0,0 +1,83 @@
+package lb
+
+import (
+	"io"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/aram535/dnsbalancer/config"
+	"github.com/miekg/dns"
+	"github.com/sirupsen/logrus"
+)
+
+// TestQuorumFailClosed checks a quorum failing closed drops queries while
+// below quorum even though a healthy backend could answer them
+func TestQuorumFailClosed(t *testing.T) {
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	server := &dns.Server{
+		PacketConn: conn,
+		Handler: dns.HandlerFunc(func(w dns.ResponseWriter, r *dns.Msg) {
+			reply := new(dns.Msg)
+			reply.SetReply(r)
+			w.WriteMsg(reply)
+		}),
+	}
+	go server.ActivateAndServe()
+	defer server.Shutdown()
+
+	path := filepath.Join(t.TempDir(), "config.yaml")
+	err = os.WriteFile(path, []byte(`listen: "127.0.0.1:0"
+backends:
+  - address: "`+conn.LocalAddr().String()+`"
+  - address: "127.0.0.1:9"
+health_check:
+  enabled: true
+quorum:
+  enabled: true
+  min_healthy: 2
+  fail_behavior: closed
+`), 0o600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cfg, err := config.LoadConfig(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	logger := logrus.New()
+	logger.SetOutput(io.Discard)
+	lb, err := New(cfg, logger)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer lb.cancel()
+
+	query := new(dns.Msg)
+	query.SetQuestion("example.com.", dns.TypeA)
+	packed, err := query.Pack()
+	if err != nil {
+		t.Fatal(err)
+	}
+	client := &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 5300}
+	resolve := func() []byte {
+		return lb.resolveUpstream(packed, client, logrus.NewEntry(logger))
+	}
+
+	// One healthy backend of the two the quorum needs
+	lb.active.Load().backends[1].SetDisabled(true)
+	lb.checkQuorum()
+	if response := resolve(); response != nil {
+		t.Fatal("below quorum: query answered")
+	}
+
+	// Without a fail behavior of its own the healthy backend answers
+	lb.quorum.failBehavior = ""
+	if response := resolve(); response == nil {
+		t.Fatal("below quorum without fail_behavior: query dropped")
+	}
+}
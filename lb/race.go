@@ -0,0 +1,302 @@
+package lb
+
+import (
+	"errors"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/aram535/dnsbalancer/backend"
+	"github.com/aram535/dnsbalancer/config"
+	"github.com/miekg/dns"
+	"github.com/sirupsen/logrus"
+)
+
+// defaultFanOut is how many backends race for each query when fan-out is
+// enabled without a count
+const defaultFanOut = 2
+
+// Hedging defaults: one extra backend, queried once the first has taken
+// longer than most answers do
+const (
+	defaultMaxHedges  = 1
+	defaultHedgeDelay = 100 * time.Millisecond
+)
+
+// Retry defaults: one retry, with retries and hedges together limited to a
+// fifth of the queries plus a small burst
+const (
+	defaultRetryAttempts = 2
+	defaultRetryBudget   = 0.2
+	retryBudgetBurst     = 10
+)
+
+// errRaceDeadline is returned when no backend answered within the overall
+// retry deadline
+var errRaceDeadline = errors.New("retry deadline exceeded")
+
+// defaultRetryRcodes are the response codes that say more about the
+// backend than about the name, so another backend may still answer
+var defaultRetryRcodes = []int{dns.RcodeServerFailure, dns.RcodeRefused}
+
+// racePolicy decides how many backends a query is sent to and when. Fan-out
+// queries several at once, hedging adds one after a delay, and retries add
+// one after a failure; all three share the same loop.
+type racePolicy struct {
+	initial    int           // Backends queried straight away
+	max        int           // Backends tried in total
+	delay      time.Duration // Wait before querying one more backend, 0 = only after failures
+	tryTimeout time.Duration // Timeout of each backend query
+	deadline   time.Duration // Time allowed for the whole race, 0 = none
+	budget     *retryBudget  // Limits queries beyond the initial ones, nil = unlimited
+}
+
+// retryBudget is a token bucket limiting retries and hedges to a fraction
+// of the queries, so a failing upstream is not hit with a storm of extra
+// queries. Every query adds ratio tokens and every extra query takes one.
+type retryBudget struct {
+	ratio  float64
+	tokens float64
+	mu     sync.Mutex
+}
+
+// newRetryBudget creates a budget that starts full
+func newRetryBudget(ratio float64) *retryBudget {
+	return &retryBudget{ratio: ratio, tokens: retryBudgetBurst}
+}
+
+// deposit credits the budget for a query
+func (b *retryBudget) deposit() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.tokens += b.ratio
+	if b.tokens > retryBudgetBurst {
+		b.tokens = retryBudgetBurst
+	}
+}
+
+// withdraw takes a token for an extra query, reporting whether one was
+// left
+func (b *retryBudget) withdraw() bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.tokens < 1 {
+		return false
+	}
+	b.tokens--
+	return true
+}
+
+// raceResult is one backend's answer in a race
+type raceResult struct {
+	backend  *backend.Backend
+	response []byte
+	err      error
+	took     time.Duration
+}
+
+// newRacePolicy builds the race policy from the fan-out, hedging and retry
+// settings. A policy with max below 2 sends each query to one backend.
+func newRacePolicy(cfg *config.Config) racePolicy {
+	policy := racePolicy{initial: 1, max: 1, tryTimeout: cfg.Timeout}
+
+	switch {
+	case cfg.FanOut != nil && cfg.FanOut.Enabled:
+		policy.initial = cfg.FanOut.Backends
+		if policy.initial == 0 {
+			policy.initial = defaultFanOut
+		}
+		policy.max = policy.initial
+	case cfg.Hedge != nil && cfg.Hedge.Enabled:
+		hedges := cfg.Hedge.MaxHedges
+		if hedges == 0 {
+			hedges = defaultMaxHedges
+		}
+		policy.max = 1 + hedges
+		policy.delay = cfg.Hedge.Delay
+		if policy.delay == 0 {
+			policy.delay = defaultHedgeDelay
+		}
+	}
+
+	if cfg.Retry != nil && cfg.Retry.Enabled {
+		attempts := cfg.Retry.Attempts
+		if attempts == 0 {
+			attempts = defaultRetryAttempts
+		}
+		if attempts > policy.max {
+			policy.max = attempts
+		}
+		if cfg.Retry.PerTryTimeout != 0 {
+			policy.tryTimeout = cfg.Retry.PerTryTimeout
+		}
+		policy.deadline = cfg.Retry.Deadline
+		ratio := cfg.Retry.Budget
+		if ratio == 0 {
+			ratio = defaultRetryBudget
+		}
+		policy.budget = newRetryBudget(ratio)
+	}
+
+	return policy
+}
+
+// retryRcodes returns the response codes that send a query on to another
+// backend
+func retryRcodes(cfg *config.RetryConfig) map[int]bool {
+	codes := defaultRetryRcodes
+	if cfg != nil && cfg.Enabled && len(cfg.Rcodes) > 0 {
+		codes = nil
+		for _, name := range cfg.Rcodes {
+			codes = append(codes, dns.StringToRcode[name])
+		}
+	}
+
+	rcodes := make(map[int]bool, len(codes))
+	for _, code := range codes {
+		rcodes[code] = true
+	}
+	return rcodes
+}
+
+// raceCandidates returns the selected backend followed by up to n-1 other
+// healthy backends from the same pool, taken in pool order after it so the
+// extra load is spread evenly. Without a pool it is the backend alone.
+func (p *backendPool) raceCandidates(first *backend.Backend, n int) []*backend.Backend {
+	candidates := []*backend.Backend{first}
+	if p == nil {
+		return candidates
+	}
+
+	start := 0
+	for i, b := range p.backends {
+		if b == first {
+			start = i
+			break
+		}
+	}
+
+	for i := 1; i < len(p.backends) && len(candidates) < n; i++ {
+		b := p.backends[(start+i)%len(p.backends)]
+		if b != first && b.Available() {
+			candidates = append(candidates, b)
+		}
+	}
+
+	return candidates
+}
+
+// race sends a query to the candidates and returns the first usable
+// answer. The first policy.initial candidates are queried at once; the next
+// one is queried when policy.delay passes without a usable answer, or
+// straight away when a backend fails, as long as the retry budget allows.
+// Queries still in flight are left to finish in the background and their
+// answers are discarded. When no backend gives a usable answer, the first
+// answer received is returned so the client still gets the upstream's
+// error, or the last error if none answered at all.
+func (lb *LoadBalancer) race(candidates []*backend.Backend, query []byte, clientAddr net.Addr, stream bool, logger *logrus.Entry) raceResult {
+	policy := lb.racePolicy
+	if policy.budget != nil {
+		policy.budget.deposit()
+	}
+
+	results := make(chan raceResult, len(candidates))
+	next, pending := 0, 0
+	launch := func() {
+		b := candidates[next]
+		next++
+		pending++
+		logger.WithField("backend", b.Address).Debug("Querying backend")
+		go func() {
+			start := time.Now()
+			response, err := lb.forward(b, query, clientAddr, stream, policy.tryTimeout)
+			results <- raceResult{backend: b, response: response, err: err, took: time.Since(start)}
+		}()
+	}
+	// launchExtra queries one more candidate if any is left and the budget
+	// allows it
+	launchExtra := func() bool {
+		if next >= len(candidates) {
+			return false
+		}
+		if policy.budget != nil && !policy.budget.withdraw() {
+			logger.Debug("Retry budget exhausted")
+			return false
+		}
+		launch()
+		return true
+	}
+
+	for next < len(candidates) && next < policy.initial {
+		launch()
+	}
+
+	var timer *time.Timer
+	var timeout <-chan time.Time
+	if policy.delay > 0 {
+		timer = time.NewTimer(policy.delay)
+		defer timer.Stop()
+		timeout = timer.C
+	}
+
+	var expired <-chan time.Time
+	if policy.deadline > 0 {
+		deadline := time.NewTimer(policy.deadline)
+		defer deadline.Stop()
+		expired = deadline.C
+	}
+
+	var fallback *raceResult
+	var last raceResult
+	for pending > 0 {
+		select {
+		case <-timeout:
+			if launchExtra() {
+				timer.Reset(policy.delay)
+			}
+		case <-expired:
+			if fallback != nil {
+				return *fallback
+			}
+			return raceResult{backend: candidates[0], err: errRaceDeadline}
+		case result := <-results:
+			pending--
+			resultLogger := logger.WithFields(logrus.Fields{
+				"backend":  result.backend.Address,
+				"duration": result.took,
+			})
+			if result.err != nil {
+				resultLogger.WithError(result.err).Debug("Backend query failed")
+			} else {
+				resultLogger.WithField("rcode", responseRcode(result.response)).Debug("Backend answered")
+			}
+			if result.err == nil && lb.usableAnswer(result.response) {
+				return result
+			}
+			if result.err == nil && fallback == nil {
+				r := result
+				fallback = &r
+			}
+			last = result
+			if launchExtra() {
+				logger.WithField("backend", result.backend.Address).Debug("Retried query on another backend")
+			}
+		}
+	}
+
+	if fallback != nil {
+		return *fallback
+	}
+	return last
+}
+
+// usableAnswer reports whether a response settles a query, i.e. it can be
+// read and its response code is not one that sends the query on to another
+// backend
+func (lb *LoadBalancer) usableAnswer(response []byte) bool {
+	msg := new(dns.Msg)
+	if err := msg.Unpack(response); err != nil {
+		return false
+	}
+	return !lb.retryRcodes[msg.Rcode]
+}
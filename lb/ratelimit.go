@@ -0,0 +1,153 @@
+package lb
+
+import (
+	"container/list"
+	"net"
+	"net/netip"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/aram535/dnsbalancer/config"
+	"github.com/miekg/dns"
+	"github.com/sirupsen/logrus"
+)
+
+// defaultRateLimitClients is how many clients' buckets are kept by default
+const defaultRateLimitClients = 100000
+
+// Rate limit actions
+const (
+	rateLimitDrop     = "drop"
+	rateLimitTruncate = "truncate"
+	rateLimitRefuse   = "refuse"
+)
+
+// rateLimiter gives each client IP address a token bucket, refilled at qps
+// tokens a second up to burst, so one client flooding queries can't take
+// the capacity the others need. Buckets are kept for the most recently
+// seen clients only; a client whose bucket was evicted starts full again.
+type rateLimiter struct {
+	qps     float64
+	burst   float64
+	size    int
+	action  string
+	buckets map[netip.Addr]*list.Element
+	recency *list.List // Most recently seen client first
+	limited uint64     // Queries over the limit
+	mu      sync.Mutex
+}
+
+// clientBucket is the token bucket of one client
+type clientBucket struct {
+	client netip.Addr
+	tokens float64
+	last   time.Time // When tokens was last refilled
+}
+
+// newRateLimiter creates the per-client rate limiter, or returns nil when
+// rate limiting is not enabled
+func newRateLimiter(cfg *config.RateLimitConfig) *rateLimiter {
+	if cfg == nil || !cfg.Enabled {
+		return nil
+	}
+
+	r := &rateLimiter{
+		qps:     cfg.QPS,
+		burst:   float64(cfg.Burst),
+		size:    cfg.Clients,
+		action:  cfg.Action,
+		buckets: make(map[netip.Addr]*list.Element),
+		recency: list.New(),
+	}
+	if r.burst == 0 {
+		r.burst = max(1, r.qps)
+	}
+	if r.size == 0 {
+		r.size = defaultRateLimitClients
+	}
+	if r.action == "" {
+		r.action = rateLimitDrop
+	}
+	return r
+}
+
+// allow takes a token from the client's bucket, reporting whether it had
+// one. Clients without an IP address (unix sockets) are never limited.
+func (r *rateLimiter) allow(clientAddr net.Addr) bool {
+	if r == nil {
+		return true
+	}
+	ip, ok := netip.AddrFromSlice(addrIP(clientAddr))
+	if !ok {
+		return true
+	}
+	ip = ip.Unmap()
+
+	now := time.Now()
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	var bucket *clientBucket
+	if element, ok := r.buckets[ip]; ok {
+		bucket = element.Value.(*clientBucket)
+		r.recency.MoveToFront(element)
+		bucket.tokens = min(r.burst, bucket.tokens+now.Sub(bucket.last).Seconds()*r.qps)
+		bucket.last = now
+	} else {
+		if r.recency.Len() >= r.size {
+			oldest := r.recency.Back()
+			delete(r.buckets, oldest.Value.(*clientBucket).client)
+			r.recency.Remove(oldest)
+		}
+		bucket = &clientBucket{client: ip, tokens: r.burst, last: now}
+		r.buckets[ip] = r.recency.PushFront(bucket)
+	}
+
+	if bucket.tokens < 1 {
+		return false
+	}
+	bucket.tokens--
+	return true
+}
+
+// rateLimited answers a query over its client's rate limit: nothing, an
+// empty truncated response sending a UDP client over to TCP, or REFUSED.
+// Stream clients can't be sent to TCP, so truncation refuses them instead.
+func (lb *LoadBalancer) rateLimited(query []byte, clientAddr net.Addr, logger *logrus.Entry) []byte {
+	atomic.AddUint64(&lb.rateLimiter.limited, 1)
+	logger.WithField("action", lb.rateLimiter.action).Debug("Client over rate limit")
+
+	switch lb.rateLimiter.action {
+	case rateLimitTruncate:
+		if !isStreamClient(clientAddr) {
+			return truncatedResponse(query)
+		}
+		return rcodeResponse(query, dns.RcodeRefused)
+	case rateLimitRefuse:
+		return rcodeResponse(query, dns.RcodeRefused)
+	}
+	return nil
+}
+
+// RateLimitStats returns the rate limit and the number of queries over
+// it, or nil if rate limiting is not enabled
+func (lb *LoadBalancer) RateLimitStats() map[string]interface{} {
+	r := lb.rateLimiter
+	if r == nil {
+		return nil
+	}
+
+	r.mu.Lock()
+	clients := r.recency.Len()
+	r.mu.Unlock()
+
+	return map[string]interface{}{
+		"qps":         r.qps,
+		"burst":       r.burst,
+		"action":      r.action,
+		"clients":     clients,
+		"max_clients": r.size,
+		"limited":     atomic.LoadUint64(&r.limited),
+	}
+}
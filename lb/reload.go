@@ -0,0 +1,302 @@
+package lb
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"reflect"
+	"strings"
+
+	"github.com/aram535/dnsbalancer/backend"
+	"github.com/aram535/dnsbalancer/config"
+	"github.com/sirupsen/logrus"
+)
+
+// reloadable are the settings a reload applies, by their key in the
+// configuration file. Changes to the others only take effect on restart.
+var reloadable = map[string]bool{
+	"backends":      true,
+	"routes":        true,
+	"client_routes": true,
+	"timeout":       true,
+	"fail_behavior": true,
+	"strategy":      true,
+	"log_level":     true,
+}
+
+// errNoConfigLoader refuses a reload when there is nowhere to read the
+// configuration from
+var errNoConfigLoader = errors.New("configuration reload is not enabled")
+
+// ConfigLoader reads the configuration to apply on a reload
+type ConfigLoader func() (*config.Config, error)
+
+// SetConfigLoader sets where ReloadConfig and CheckReloadConfig read the
+// configuration from. It must be called before Start.
+func (lb *LoadBalancer) SetConfigLoader(loader ConfigLoader) {
+	lb.loadConfig = loader
+}
+
+// reloadedConfig returns the running configuration with the settings a
+// reload applies taken from cfg. The rest keep their running values until
+// a restart, and are still reported as changed on the next reload.
+func (lb *LoadBalancer) reloadedConfig(cfg *config.Config) *config.Config {
+	applied := *lb.config
+	applied.Backends = cfg.Backends
+	applied.Routes = cfg.Routes
+	applied.ClientRoutes = cfg.ClientRoutes
+	applied.Timeout = cfg.Timeout
+	applied.FailBehavior = cfg.FailBehavior
+	applied.Strategy = cfg.Strategy
+	applied.LogLevel = cfg.LogLevel
+	return &applied
+}
+
+// ReloadSummary describes what a configuration reload changed, or would
+// change
+type ReloadSummary struct {
+	Changes []ReloadChange `json:"changes"`           // Changes applied
+	Restart []string       `json:"restart,omitempty"` // Settings that changed but only take effect on restart
+}
+
+// ReloadChange is one change a reload applies
+type ReloadChange struct {
+	Setting string `json:"setting"`           // Key in the configuration file, or "backend"
+	Backend string `json:"backend,omitempty"` // Address of the backend added, removed or changed
+	Action  string `json:"action"`            // "added", "removed" or "changed"
+	From    string `json:"from,omitempty"`
+	To      string `json:"to,omitempty"`
+}
+
+// String describes the change the way it is logged
+func (c ReloadChange) String() string {
+	switch {
+	case c.Backend != "":
+		return fmt.Sprintf("backend %s %s", c.Backend, c.Action)
+	case c.From != "" || c.To != "":
+		return fmt.Sprintf("%s %s -> %s", c.Setting, c.From, c.To)
+	}
+	return fmt.Sprintf("%s %s", c.Setting, c.Action)
+}
+
+// Reload applies a new configuration to the running instance: the default
+// backends and those of domain and client routes, the timeout, the fail
+// behavior, the selection strategy and the log level. Backends configured
+// as before keep running with their health and statistics; removed ones
+// get no new queries and are closed once those already sent to them
+// complete. The listeners are left alone. A configuration that can't be applied is
+// rejected as a whole and the running one kept. Backends added at runtime
+// and not in the new configuration are removed.
+func (lb *LoadBalancer) Reload(cfg *config.Config) (*ReloadSummary, error) {
+	return lb.reload(cfg, false)
+}
+
+// CheckReload reports what Reload would change, or why it would reject the
+// configuration, without applying it
+func (lb *LoadBalancer) CheckReload(cfg *config.Config) (*ReloadSummary, error) {
+	return lb.reload(cfg, true)
+}
+
+// reload prepares the backends and settings of cfg and applies them,
+// unless dryRun
+func (lb *LoadBalancer) reload(cfg *config.Config, dryRun bool) (*ReloadSummary, error) {
+	level, err := logrus.ParseLevel(cfg.LogLevel)
+	if err != nil {
+		return nil, fmt.Errorf("invalid log level: %w", err)
+	}
+
+	lb.activeMu.Lock()
+	defer lb.activeMu.Unlock()
+
+	// Geo routes are left as they are, their backends with them
+	active := lb.active.Load()
+	geoBackends, _ := poolMembers(lb.geo.allPools())
+	isGeo := make(map[*backend.Backend]bool, len(geoBackends))
+	for _, b := range geoBackends {
+		isGeo[b] = true
+	}
+	var running []*backend.Backend
+	for _, b := range active.backends {
+		if !isGeo[b] {
+			running = append(running, b)
+		}
+	}
+
+	factory := lb.factory
+	if cfg.Strategy != lb.config.Strategy {
+		factory = strategyBalancer(cfg.Strategy)
+	}
+	// A dry run leaves the backends it creates unused, so they are not
+	// logged as registered
+	logger := lb.logger
+	if dryRun {
+		logger = logrus.New()
+		logger.SetOutput(io.Discard)
+	}
+	applied := lb.reloadedConfig(cfg)
+	registry := newBackendRegistry(active.keys, running)
+	next, err := newActiveBackends(applied, registry, factory, logger)
+	if err != nil {
+		return nil, err
+	}
+	for _, b := range geoBackends {
+		next.backends = append(next.backends, b)
+		next.keys[b] = active.keys[b]
+		if policy, ok := active.ecs[b]; ok {
+			next.ecs[b] = policy
+		}
+	}
+	configured := next.backends[:len(next.backends)-len(geoBackends)]
+	// Backends created for a configuration that isn't applied are never
+	// used
+	discard := func() {
+		for _, b := range configured {
+			if !registry.reused[b] {
+				b.Close()
+			}
+		}
+	}
+	if lb.quorum != nil && lb.quorum.minHealthy > len(next.backends) {
+		discard()
+		return nil, fmt.Errorf("quorum min_healthy %d exceeds the %d backends", lb.quorum.minHealthy, len(next.backends))
+	}
+
+	summary := lb.reloadSummary(cfg, running, configured, registry)
+	if dryRun {
+		discard()
+		return summary, nil
+	}
+	lb.factory = factory
+	lb.config = applied
+	lb.activate(next)
+	lb.logger.SetLevel(level)
+
+	var dropped []*backend.Backend
+	for _, b := range running {
+		if !registry.reused[b] {
+			dropped = append(dropped, b)
+		}
+	}
+	lb.closeBackends(dropped)
+
+	for _, change := range summary.Changes {
+		lb.logger.WithField("change", change.String()).Info("Configuration change applied")
+	}
+	for _, setting := range summary.Restart {
+		lb.logger.WithField("setting", setting).Warn("Configuration change takes a restart")
+	}
+	lb.logger.WithFields(logrus.Fields{
+		"changes":  len(summary.Changes),
+		"restart":  len(summary.Restart),
+		"backends": len(next.backends),
+	}).Info("Configuration reloaded")
+	return summary, nil
+}
+
+// ReloadConfig reads the configuration again and applies it, keeping the
+// running one if it can't be read or applied
+func (lb *LoadBalancer) ReloadConfig() (*ReloadSummary, error) {
+	if lb.loadConfig == nil {
+		return nil, errNoConfigLoader
+	}
+	lb.logger.Info("Reloading configuration")
+
+	cfg, err := lb.loadConfig()
+	if err != nil {
+		err = fmt.Errorf("failed to load config: %w", err)
+	} else {
+		var summary *ReloadSummary
+		if summary, err = lb.Reload(cfg); err == nil {
+			return summary, nil
+		}
+	}
+	lb.logger.WithError(err).Error("Configuration reload failed, keeping the running configuration")
+	return nil, err
+}
+
+// CheckReloadConfig reads the configuration again and reports what
+// ReloadConfig would change, or why it would fail, without applying it
+func (lb *LoadBalancer) CheckReloadConfig() (*ReloadSummary, error) {
+	if lb.loadConfig == nil {
+		return nil, errNoConfigLoader
+	}
+
+	cfg, err := lb.loadConfig()
+	if err != nil {
+		return nil, fmt.Errorf("failed to load config: %w", err)
+	}
+	return lb.CheckReload(cfg)
+}
+
+// reloadSummary lists the changes from the running configuration to cfg:
+// the backends added, removed or changed, comparing those running before
+// with those after, the other settings applied and those that take a
+// restart
+func (lb *LoadBalancer) reloadSummary(cfg *config.Config, before, after []*backend.Backend, registry *backendRegistry) *ReloadSummary {
+	summary := &ReloadSummary{Changes: []ReloadChange{}}
+	noted := make(map[ReloadChange]bool)
+	note := func(change ReloadChange) {
+		if !noted[change] {
+			noted[change] = true
+			summary.Changes = append(summary.Changes, change)
+		}
+	}
+
+	// Backends not reused were added or changed; those with the address of
+	// one no longer running changed options. An address in several lists
+	// is reported once.
+	gone := make(map[string]bool)
+	for _, b := range before {
+		if !registry.reused[b] {
+			gone[b.Address] = true
+		}
+	}
+	created := make(map[string]bool)
+	for _, b := range after {
+		if registry.reused[b] {
+			continue
+		}
+		created[b.Address] = true
+		action := "added"
+		if gone[b.Address] {
+			action = "changed"
+		}
+		note(ReloadChange{Setting: "backend", Backend: b.Address, Action: action})
+	}
+	for _, b := range before {
+		if !registry.reused[b] && !created[b.Address] {
+			note(ReloadChange{Setting: "backend", Backend: b.Address, Action: "removed"})
+		}
+	}
+
+	old := lb.config
+	if !reflect.DeepEqual(old.Routes, cfg.Routes) {
+		note(ReloadChange{Setting: "routes", Action: "changed"})
+	}
+	if !reflect.DeepEqual(old.ClientRoutes, cfg.ClientRoutes) {
+		note(ReloadChange{Setting: "client_routes", Action: "changed"})
+	}
+	for _, setting := range []struct{ name, from, to string }{
+		{"timeout", old.Timeout.String(), cfg.Timeout.String()},
+		{"fail_behavior", old.FailBehavior, cfg.FailBehavior},
+		{"strategy", old.Strategy, cfg.Strategy},
+		{"log_level", old.LogLevel, cfg.LogLevel},
+	} {
+		if setting.from != setting.to {
+			note(ReloadChange{Setting: setting.name, Action: "changed", From: setting.from, To: setting.to})
+		}
+	}
+
+	// Every other setting that differs takes a restart
+	oldValue, newValue := reflect.ValueOf(old).Elem(), reflect.ValueOf(cfg).Elem()
+	for i := 0; i < oldValue.NumField(); i++ {
+		name, _, _ := strings.Cut(oldValue.Type().Field(i).Tag.Get("yaml"), ",")
+		if name == "" || reloadable[name] {
+			continue
+		}
+		if !reflect.DeepEqual(oldValue.Field(i).Interface(), newValue.Field(i).Interface()) {
+			summary.Restart = append(summary.Restart, name)
+		}
+	}
+	return summary
+}
@@ -0,0 +1,56 @@
+package lb
+
+import (
+	"net"
+
+	"github.com/miekg/dns"
+)
+
+// rcodeResponse answers a query with nothing but a response code, echoing
+// its ID, flags, question and EDNS, or returns nil if it can't be parsed
+func rcodeResponse(query []byte, rcode int) []byte {
+	return emptyResponse(query, rcode, false)
+}
+
+// truncatedResponse answers a query with an empty response with the TC
+// flag set, so the client retries over TCP
+func truncatedResponse(query []byte) []byte {
+	return emptyResponse(query, dns.RcodeSuccess, true)
+}
+
+// addressRecords returns the A or AAAA records, as qtype asks, of the
+// addresses of that family, owned by name
+func addressRecords(addresses []net.IP, name string, qtype uint16, ttl uint32) []dns.RR {
+	var records []dns.RR
+	for _, ip := range addresses {
+		hdr := dns.RR_Header{Name: name, Rrtype: qtype, Class: dns.ClassINET, Ttl: ttl}
+		switch {
+		case qtype == dns.TypeA && ip.To4() != nil:
+			records = append(records, &dns.A{Hdr: hdr, A: ip.To4()})
+		case qtype == dns.TypeAAAA && ip.To4() == nil:
+			records = append(records, &dns.AAAA{Hdr: hdr, AAAA: ip})
+		}
+	}
+	return records
+}
+
+// emptyResponse builds a response to query without records
+func emptyResponse(query []byte, rcode int, truncated bool) []byte {
+	msg := new(dns.Msg)
+	if err := msg.Unpack(query); err != nil {
+		return nil
+	}
+
+	reply := new(dns.Msg)
+	reply.SetRcode(msg, rcode)
+	reply.Truncated = truncated
+	if opt := msg.IsEdns0(); opt != nil {
+		reply.SetEdns0(dns.DefaultMsgSize, opt.Do())
+	}
+
+	response, err := reply.Pack()
+	if err != nil {
+		return nil
+	}
+	return response
+}
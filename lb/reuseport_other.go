@@ -0,0 +1,13 @@
+//go:build !(linux || darwin || dragonfly || freebsd || netbsd || openbsd)
+
+package lb
+
+import (
+	"fmt"
+	"net"
+)
+
+// listenUDPReusePort is not available on this platform
+func listenUDPReusePort(address string) (*net.UDPConn, error) {
+	return nil, fmt.Errorf("SO_REUSEPORT is not supported on this platform, set udp_sockets to 1")
+}
@@ -0,0 +1,35 @@
+//go:build linux || darwin || dragonfly || freebsd || netbsd || openbsd
+
+package lb
+
+import (
+	"context"
+	"net"
+	"syscall"
+
+	"golang.org/x/sys/unix"
+)
+
+// listenUDPReusePort opens a UDP socket with SO_REUSEPORT set so several
+// sockets can share the same address
+func listenUDPReusePort(address string) (*net.UDPConn, error) {
+	lc := net.ListenConfig{
+		Control: func(network, address string, c syscall.RawConn) error {
+			var sockErr error
+			err := c.Control(func(fd uintptr) {
+				sockErr = unix.SetsockoptInt(int(fd), unix.SOL_SOCKET, unix.SO_REUSEPORT, 1)
+			})
+			if err != nil {
+				return err
+			}
+			return sockErr
+		},
+	}
+
+	conn, err := lc.ListenPacket(context.Background(), "udp", address)
+	if err != nil {
+		return nil, err
+	}
+
+	return conn.(*net.UDPConn), nil
+}
@@ -0,0 +1,98 @@
+package lb
+
+import (
+	"fmt"
+	"net"
+	"strings"
+
+	"github.com/aram535/dnsbalancer/backend"
+	"github.com/aram535/dnsbalancer/config"
+	"github.com/miekg/dns"
+	"github.com/sirupsen/logrus"
+)
+
+// routeTable maps a domain, in lowercased wire format without the root
+// label, to the pools serving it and its subdomains
+type routeTable map[string][]*backendPool
+
+// newRouteTable creates the backends of every configured route and returns
+// the table along with all route backends
+func newRouteTable(cfg *config.Config, registry *backendRegistry, factory BalancerFactory, logger *logrus.Logger) (routeTable, []*backend.Backend, error) {
+	if len(cfg.Routes) == 0 {
+		return nil, nil, nil
+	}
+
+	routes := make(routeTable, len(cfg.Routes))
+	var all []*backend.Backend
+	for _, rcfg := range cfg.Routes {
+		key, err := routeKey(rcfg.Domain)
+		if err != nil {
+			return nil, nil, fmt.Errorf("route %q: %w", rcfg.Domain, err)
+		}
+
+		backends, pools, err := newBackendSet(cfg, rcfg.Backends, registry, factory, logger)
+		if err != nil {
+			return nil, nil, fmt.Errorf("route %q: %w", rcfg.Domain, err)
+		}
+		routes[key] = pools
+		all = append(all, backends...)
+
+		logger.WithFields(logrus.Fields{
+			"domain":   dns.Fqdn(rcfg.Domain),
+			"backends": len(backends),
+		}).Info("Registered route")
+	}
+
+	return routes, all, nil
+}
+
+// routeKey converts a domain to its routeTable key
+func routeKey(domain string) (string, error) {
+	buf := make([]byte, 256)
+	n, err := dns.PackDomainName(dns.Fqdn(strings.ToLower(domain)), buf, 0, nil, false)
+	if err != nil {
+		return "", err
+	}
+	// Drop the root label
+	return string(buf[:n-1]), nil
+}
+
+// match returns the pools of the longest route matching the query name, or
+// nil if no route matches
+func (t routeTable) match(query []byte) []*backendPool {
+	if len(t) == 0 {
+		return nil
+	}
+
+	name := queryName(query)
+	if name == nil {
+		return nil
+	}
+
+	// Try the whole name first, then each parent domain down to the root
+	for off := 0; ; off += 1 + int(name[off]) {
+		if pools, ok := t[string(name[off:])]; ok {
+			return pools
+		}
+		if off >= len(name) {
+			return nil
+		}
+	}
+}
+
+// poolsFor returns the pools a query is sent to: those of the longest
+// matching domain route, then those of the client's network, then those of
+// the client's region, then the default backends
+func (lb *LoadBalancer) poolsFor(query []byte, clientAddr net.Addr) []*backendPool {
+	active := lb.active.Load()
+	if pools := active.routes.match(query); pools != nil {
+		return pools
+	}
+	if pools := matchClient(active.clientRoutes, clientAddr); pools != nil {
+		return pools
+	}
+	if pools := lb.geo.match(clientAddr); pools != nil {
+		return pools
+	}
+	return active.pools
+}
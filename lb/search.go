@@ -0,0 +1,113 @@
+package lb
+
+import (
+	"net"
+	"strings"
+	"sync/atomic"
+
+	"github.com/miekg/dns"
+	"github.com/sirupsen/logrus"
+)
+
+// searchTTL is the TTL of the CNAME from a single-label name to the name
+// with the search domain that answered it
+const searchTTL = 60
+
+// searchDomains retries single-label queries answered NXDOMAIN with each
+// search domain appended, for clients that expect the resolver to know
+// their flat names the way a resolv.conf search list would
+type searchDomains struct {
+	suffixes []string // Fully qualified, in the order tried
+	expanded uint64   // Queries answered for a name with a search domain
+	notFound uint64   // Queries none of the search domains answered
+}
+
+// newSearchDomains creates the search list, or returns nil when no search
+// domains are configured
+func newSearchDomains(domains []string) *searchDomains {
+	if len(domains) == 0 {
+		return nil
+	}
+
+	s := &searchDomains{}
+	for _, domain := range domains {
+		s.suffixes = append(s.suffixes, strings.ToLower(dns.Fqdn(domain)))
+	}
+	return s
+}
+
+// expandSearch answers a single-label query that came back NXDOMAIN with
+// the first search domain the name exists under, as a CNAME to the longer
+// name followed by its answer. It returns the response and whether it came
+// from the backends, unchanged when no search domain answered.
+func (lb *LoadBalancer) expandSearch(query, response []byte, forwarded bool, clientAddr net.Addr, logger *logrus.Entry) ([]byte, bool) {
+	s := lb.searchDomains
+	if s == nil || len(response) < 4 || response[3]&0x0f != dns.RcodeNameError {
+		return response, forwarded
+	}
+	if name := queryName(query); len(name) == 0 || 1+int(name[0]) != len(name) {
+		return response, forwarded
+	}
+
+	msg := new(dns.Msg)
+	if err := msg.Unpack(query); err != nil || len(msg.Question) != 1 {
+		return response, forwarded
+	}
+	q := msg.Question[0]
+
+	for _, suffix := range s.suffixes {
+		target := q.Name + suffix
+		candidate := msg.Copy()
+		candidate.Id = dns.Id()
+		candidate.Question[0].Name = target
+		packed, err := candidate.Pack()
+		if err != nil {
+			continue
+		}
+
+		answer, upstream := lb.resolveName(packed, clientAddr, logger)
+		found := new(dns.Msg)
+		if answer == nil || found.Unpack(answer) != nil || found.Rcode != dns.RcodeSuccess {
+			continue
+		}
+
+		reply := new(dns.Msg)
+		reply.SetReply(msg)
+		reply.RecursionAvailable = true
+		reply.Answer = append([]dns.RR{&dns.CNAME{
+			Hdr:    dns.RR_Header{Name: q.Name, Rrtype: dns.TypeCNAME, Class: dns.ClassINET, Ttl: searchTTL},
+			Target: target,
+		}}, found.Answer...)
+		reply.Ns = found.Ns
+		if opt := msg.IsEdns0(); opt != nil {
+			reply.SetEdns0(dns.DefaultMsgSize, opt.Do())
+		}
+
+		expanded, err := reply.Pack()
+		if err != nil {
+			continue
+		}
+		atomic.AddUint64(&s.expanded, 1)
+		logger.WithField("name", target).Debug("Answered single-label query with search domain")
+		return expanded, upstream
+	}
+
+	atomic.AddUint64(&s.notFound, 1)
+	return response, forwarded
+}
+
+// SearchDomainStats returns the search domains and the number of queries
+// answered with one or not found under any, or nil if no search domains
+// are configured
+func (lb *LoadBalancer) SearchDomainStats() map[string]interface{} {
+	s := lb.searchDomains
+	if s == nil {
+		return nil
+	}
+
+	return map[string]interface{}{
+		"domains":   s.suffixes,
+		"expanded":  atomic.LoadUint64(&s.expanded),
+		"not_found": atomic.LoadUint64(&s.notFound),
+	}
+}
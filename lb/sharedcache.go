@@ -0,0 +1,322 @@
+package lb
+
+import (
+	"bufio"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/aram535/dnsbalancer/config"
+)
+
+// Shared cache defaults
+const (
+	defaultSharedCachePrefix  = "dnsbalancer:"
+	defaultSharedCacheTimeout = 100 * time.Millisecond
+	sharedCacheIdleConns      = 16
+	sharedCacheWriters        = 4    // Goroutines writing answers to the server
+	sharedCacheQueue          = 1024 // Answers waiting to be written before new ones are dropped
+)
+
+// Shared cache types
+const (
+	sharedRedis     = "redis"
+	sharedMemcached = "memcached"
+)
+
+// errCacheMiss is returned by a shared cache store without the key
+var errCacheMiss = errors.New("cache miss")
+
+// sharedStore is a key-value server that instances share cached
+// responses through
+type sharedStore interface {
+	get(conn *bufio.ReadWriter, key string) ([]byte, error)
+	set(conn *bufio.ReadWriter, key string, value []byte, ttl time.Duration) error
+}
+
+// sharedCache is a cache tier behind the local one, shared with the other
+// instances of a fleet, so a response one of them fetched answers the
+// same query on the others
+type sharedCache struct {
+	store   sharedStore
+	address string
+	prefix  string
+	timeout time.Duration
+	auth    string // Redis password, sent on every new connection
+	idle    chan net.Conn
+}
+
+// newSharedCache creates the shared cache tier, or returns nil when none is
+// configured
+func newSharedCache(cfg *config.SharedCacheConfig) *sharedCache {
+	if cfg == nil || cfg.Address == "" {
+		return nil
+	}
+
+	s := &sharedCache{
+		address: cfg.Address,
+		prefix:  cfg.Prefix,
+		timeout: cfg.Timeout,
+		auth:    cfg.Password,
+		idle:    make(chan net.Conn, sharedCacheIdleConns),
+	}
+	if s.prefix == "" {
+		s.prefix = defaultSharedCachePrefix
+	}
+	if s.timeout == 0 {
+		s.timeout = defaultSharedCacheTimeout
+	}
+	if cfg.Type == sharedMemcached {
+		s.store = memcachedStore{}
+	} else {
+		s.store = redisStore{}
+	}
+	return s
+}
+
+// storageKey turns a cache key into a key valid for any store: the hash
+// of its fields, the pool being named by its backends so every instance
+// with the same configuration uses the same key
+func (s *sharedCache) storageKey(key cacheKey) string {
+	fields := fmt.Sprintf("%s|%s|%d|%d|%t|%t|%t|%t|%s",
+		key.pool, key.name, key.qtype, key.qclass, key.rd, key.cd, key.edns, key.do, key.subnet)
+	sum := sha256.Sum256([]byte(fields))
+	return s.prefix + hex.EncodeToString(sum[:])
+}
+
+// get fetches an entry, returning nil if the store doesn't have a live
+// one, or an error if it can't be reached in time
+func (s *sharedCache) get(key cacheKey) (*cacheEntry, error) {
+	var value []byte
+	err := s.do(func(conn *bufio.ReadWriter) error {
+		var err error
+		value, err = s.store.get(conn, s.storageKey(key))
+		return err
+	})
+	if err == errCacheMiss {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if len(value) < 16 {
+		return nil, fmt.Errorf("shared cache value of %d bytes is too short", len(value))
+	}
+
+	entry := &cacheEntry{
+		key:      key,
+		stored:   time.Unix(0, int64(binary.BigEndian.Uint64(value[0:8]))),
+		expires:  time.Unix(0, int64(binary.BigEndian.Uint64(value[8:16]))),
+		response: value[16:],
+	}
+	if !time.Now().Before(entry.expires) {
+		return nil, nil
+	}
+	return entry, nil
+}
+
+// set stores an entry for the rest of its lifetime
+func (s *sharedCache) set(entry *cacheEntry) error {
+	ttl := time.Until(entry.expires)
+	if ttl <= 0 {
+		return nil
+	}
+
+	value := make([]byte, 16+len(entry.response))
+	binary.BigEndian.PutUint64(value[0:8], uint64(entry.stored.UnixNano()))
+	binary.BigEndian.PutUint64(value[8:16], uint64(entry.expires.UnixNano()))
+	copy(value[16:], entry.response)
+
+	return s.do(func(conn *bufio.ReadWriter) error {
+		return s.store.set(conn, s.storageKey(entry.key), value, ttl)
+	})
+}
+
+// do runs a request on an idle or new connection, giving up after the
+// timeout. Connections are only reused after a clean request.
+func (s *sharedCache) do(request func(*bufio.ReadWriter) error) error {
+	var conn net.Conn
+	select {
+	case conn = <-s.idle:
+	default:
+		var err error
+		conn, err = net.DialTimeout("tcp", s.address, s.timeout)
+		if err != nil {
+			return err
+		}
+		if s.auth != "" {
+			rw := bufio.NewReadWriter(bufio.NewReader(conn), bufio.NewWriter(conn))
+			conn.SetDeadline(time.Now().Add(s.timeout))
+			if err := redisCommand(rw, "AUTH", []byte(s.auth)); err != nil {
+				conn.Close()
+				return err
+			}
+			if _, err := redisReply(rw); err != nil {
+				conn.Close()
+				return err
+			}
+		}
+	}
+
+	conn.SetDeadline(time.Now().Add(s.timeout))
+	rw := bufio.NewReadWriter(bufio.NewReader(conn), bufio.NewWriter(conn))
+	err := request(rw)
+	if err != nil && err != errCacheMiss {
+		conn.Close()
+		return err
+	}
+
+	select {
+	case s.idle <- conn:
+	default:
+		conn.Close()
+	}
+	return err
+}
+
+// close closes the idle connections
+func (s *sharedCache) close() {
+	if s == nil {
+		return
+	}
+	for {
+		select {
+		case conn := <-s.idle:
+			conn.Close()
+		default:
+			return
+		}
+	}
+}
+
+// redisStore speaks the Redis serialization protocol (RESP)
+type redisStore struct{}
+
+func (redisStore) get(conn *bufio.ReadWriter, key string) ([]byte, error) {
+	if err := redisCommand(conn, "GET", []byte(key)); err != nil {
+		return nil, err
+	}
+	value, err := redisReply(conn)
+	if err == nil && value == nil {
+		return nil, errCacheMiss
+	}
+	return value, err
+}
+
+func (redisStore) set(conn *bufio.ReadWriter, key string, value []byte, ttl time.Duration) error {
+	ms := strconv.FormatInt(ttl.Milliseconds()+1, 10)
+	if err := redisCommand(conn, "SET", []byte(key), value, []byte("PX"), []byte(ms)); err != nil {
+		return err
+	}
+	_, err := redisReply(conn)
+	return err
+}
+
+// redisCommand sends a command as an array of bulk strings
+func redisCommand(conn *bufio.ReadWriter, name string, args ...[]byte) error {
+	fmt.Fprintf(conn, "*%d\r\n$%d\r\n%s\r\n", len(args)+1, len(name), name)
+	for _, arg := range args {
+		fmt.Fprintf(conn, "$%d\r\n", len(arg))
+		conn.Write(arg)
+		conn.WriteString("\r\n")
+	}
+	return conn.Flush()
+}
+
+// redisReply reads a simple string, error or bulk string reply, returning
+// nil for a null bulk string
+func redisReply(conn *bufio.ReadWriter) ([]byte, error) {
+	line, err := conn.ReadString('\n')
+	if err != nil {
+		return nil, err
+	}
+	line = strings.TrimRight(line, "\r\n")
+	if line == "" {
+		return nil, fmt.Errorf("empty redis reply")
+	}
+
+	switch line[0] {
+	case '+':
+		return []byte(line[1:]), nil
+	case '-':
+		return nil, fmt.Errorf("redis: %s", line[1:])
+	case '$':
+		n, err := strconv.Atoi(line[1:])
+		if err != nil {
+			return nil, fmt.Errorf("invalid redis reply %q", line)
+		}
+		if n < 0 {
+			return nil, nil
+		}
+		value := make([]byte, n+2)
+		if _, err := io.ReadFull(conn, value); err != nil {
+			return nil, err
+		}
+		return value[:n], nil
+	}
+	return nil, fmt.Errorf("unexpected redis reply %q", line)
+}
+
+// memcachedStore speaks the memcached text protocol
+type memcachedStore struct{}
+
+func (memcachedStore) get(conn *bufio.ReadWriter, key string) ([]byte, error) {
+	fmt.Fprintf(conn, "get %s\r\n", key)
+	if err := conn.Flush(); err != nil {
+		return nil, err
+	}
+
+	line, err := conn.ReadString('\n')
+	if err != nil {
+		return nil, err
+	}
+	fields := strings.Fields(line)
+	if len(fields) == 1 && fields[0] == "END" {
+		return nil, errCacheMiss
+	}
+	if len(fields) < 4 || fields[0] != "VALUE" {
+		return nil, fmt.Errorf("unexpected memcached reply %q", strings.TrimSpace(line))
+	}
+	n, err := strconv.Atoi(fields[3])
+	if err != nil {
+		return nil, fmt.Errorf("invalid memcached reply %q", strings.TrimSpace(line))
+	}
+
+	// The value, its CRLF and the closing END line
+	value := make([]byte, n+2)
+	if _, err := io.ReadFull(conn, value); err != nil {
+		return nil, err
+	}
+	if end, err := conn.ReadString('\n'); err != nil || strings.TrimSpace(end) != "END" {
+		return nil, fmt.Errorf("unterminated memcached reply")
+	}
+	return value[:n], nil
+}
+
+func (memcachedStore) set(conn *bufio.ReadWriter, key string, value []byte, ttl time.Duration) error {
+	// Expiry times are in whole seconds; round up so entries outlive their
+	// TTL rather than vanish early, expiry is checked on read anyway
+	seconds := int64((ttl + time.Second - 1) / time.Second)
+	fmt.Fprintf(conn, "set %s 0 %d %d\r\n", key, seconds, len(value))
+	conn.Write(value)
+	conn.WriteString("\r\n")
+	if err := conn.Flush(); err != nil {
+		return err
+	}
+
+	line, err := conn.ReadString('\n')
+	if err != nil {
+		return err
+	}
+	if strings.TrimSpace(line) != "STORED" {
+		return fmt.Errorf("unexpected memcached reply %q", strings.TrimSpace(line))
+	}
+	return nil
+}
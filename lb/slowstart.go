@@ -0,0 +1,44 @@
+package lb
+
+import (
+	"math/rand"
+	"time"
+
+	"github.com/aram535/dnsbalancer/backend"
+	"github.com/aram535/dnsbalancer/config"
+)
+
+// Slow start defaults: recovered backends start at a tenth of their share
+// and reach all of it after 30 seconds
+const (
+	defaultSlowStartWindow    = 30 * time.Second
+	defaultSlowStartMinWeight = 0.1
+)
+
+// admit reports whether a backend takes a query it was picked for. Backends
+// in slow start take queries with a probability matching their warmth, so
+// their share of traffic ramps up instead of jumping straight to full.
+func admit(b *backend.Backend) bool {
+	warmth := b.Warmth()
+	return warmth >= 1 || rand.Float64() < warmth
+}
+
+// slowStart converts the slow start configuration to the backend's ramp,
+// or nil if slow start is disabled
+func slowStart(cfg *config.SlowStartConfig) *backend.SlowStartRamp {
+	if cfg == nil || !cfg.Enabled {
+		return nil
+	}
+
+	ramp := &backend.SlowStartRamp{
+		Window:    cfg.Window,
+		MinWeight: cfg.MinWeight,
+	}
+	if ramp.Window == 0 {
+		ramp.Window = defaultSlowStartWindow
+	}
+	if ramp.MinWeight == 0 {
+		ramp.MinWeight = defaultSlowStartMinWeight
+	}
+	return ramp
+}
@@ -0,0 +1,49 @@
+package lb
+
+import (
+	"fmt"
+	"sync/atomic"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+// waitForHealthy runs health check rounds until a backend passes, so an
+// instance starting during an upstream outage doesn't take traffic it can
+// only drop. It gives up after the startup gate timeout, if any.
+func (lb *LoadBalancer) waitForHealthy() error {
+	start := time.Now()
+	interval := lb.healthChecker.config.Interval
+	timeout := lb.startupGate.Timeout
+
+	lb.logger.WithField("timeout", timeout).Info("Waiting for a healthy backend before serving")
+	for {
+		if passed := lb.healthChecker.checkOnce(); passed > 0 {
+			lb.logger.WithFields(logrus.Fields{
+				"healthy": passed,
+				"waited":  time.Since(start).Round(time.Millisecond),
+			}).Info("Backend passed health check, serving")
+			return nil
+		}
+
+		wait := interval
+		if timeout > 0 {
+			remaining := timeout - time.Since(start)
+			if remaining <= 0 {
+				return fmt.Errorf("no backend passed a health check within %s", timeout)
+			}
+			if wait > remaining {
+				wait = remaining
+			}
+		}
+
+		lb.logger.WithField("retry_in", wait.Round(time.Millisecond)).Warn("No backend passed a health check yet")
+		time.Sleep(wait)
+	}
+}
+
+// isReady reports whether the instance is serving, i.e. the startup gate,
+// if any, has passed
+func (lb *LoadBalancer) isReady() bool {
+	return atomic.LoadInt32(&lb.ready) == 1
+}
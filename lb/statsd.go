@@ -0,0 +1,201 @@
+package lb
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/aram535/dnsbalancer/config"
+	"github.com/sirupsen/logrus"
+)
+
+// StatsD exporter defaults and formats
+const (
+	defaultStatsDPrefix   = "dnsbalancer"
+	defaultStatsDInterval = 10 * time.Second
+
+	statsdPlain = "statsd"
+	statsdDog   = "dogstatsd"
+
+	// statsdMaxPacket keeps datagrams within a typical path MTU
+	statsdMaxPacket = 1432
+)
+
+// statsdExporter sends the metrics snapshot to a StatsD server over UDP
+// every interval. Counters go out as the increase since the last push,
+// gauges as they are. DogStatsD gets the tags as tags; plain StatsD has
+// none, so their values are appended to the metric name instead.
+type statsdExporter struct {
+	conn     net.Conn
+	prefix   string
+	tags     []string // Added to every metric, DogStatsD only
+	dog      bool
+	interval time.Duration
+	logger   *logrus.Logger
+	last     map[string]float64 // Counter values already sent, by metric line prefix
+
+	packets uint64 // Datagrams sent
+	errors  uint64 // Datagrams that failed to send
+}
+
+// newStatsDExporter creates the StatsD exporter, or returns nil when it
+// is not enabled
+func newStatsDExporter(cfg *config.StatsDConfig, logger *logrus.Logger) (*statsdExporter, error) {
+	if cfg == nil || !cfg.Enabled {
+		return nil, nil
+	}
+
+	conn, err := net.Dial("udp", cfg.Address)
+	if err != nil {
+		return nil, fmt.Errorf("statsd: %w", err)
+	}
+
+	e := &statsdExporter{
+		conn:     conn,
+		prefix:   cfg.Prefix,
+		tags:     cfg.Tags,
+		dog:      cfg.Format == statsdDog,
+		interval: cfg.Interval,
+		logger:   logger,
+		last:     make(map[string]float64),
+	}
+	if e.prefix == "" {
+		e.prefix = defaultStatsDPrefix
+	}
+	if e.interval == 0 {
+		e.interval = defaultStatsDInterval
+	}
+	return e, nil
+}
+
+// start pushes a snapshot of collect every interval until ctx is done,
+// and a last one then
+func (e *statsdExporter) start(ctx context.Context, wg *sync.WaitGroup, collect func() []metric) {
+	if e == nil {
+		return
+	}
+
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		defer e.conn.Close()
+		ticker := time.NewTicker(e.interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ctx.Done():
+				e.push(collect())
+				return
+			case <-ticker.C:
+				e.push(collect())
+			}
+		}
+	}()
+}
+
+// push sends the metrics, packing as many lines into each datagram as fit
+func (e *statsdExporter) push(metrics []metric) {
+	var packet []byte
+	for _, m := range metrics {
+		line, ok := e.line(m)
+		if !ok {
+			continue
+		}
+		if len(packet) > 0 && len(packet)+1+len(line) > statsdMaxPacket {
+			e.send(packet)
+			packet = packet[:0]
+		}
+		if len(packet) > 0 {
+			packet = append(packet, '\n')
+		}
+		packet = append(packet, line...)
+	}
+	if len(packet) > 0 {
+		e.send(packet)
+	}
+}
+
+// line formats a metric, or returns false for a counter that hasn't
+// changed since the last push
+func (e *statsdExporter) line(m metric) (string, bool) {
+	name := e.prefix + "." + m.name
+	var tags []string
+	if e.dog {
+		tags = append(append(tags, e.tags...), m.tags...)
+	} else {
+		for _, tag := range m.tags {
+			_, value, _ := strings.Cut(tag, ":")
+			name += "." + statsdSanitize(value)
+		}
+	}
+
+	value, kind := m.value, "g"
+	if m.counter {
+		key := name + "|" + strings.Join(tags, ",")
+		value, kind = m.value-e.last[key], "c"
+		if value < 0 {
+			// The count started over
+			value = m.value
+		}
+		e.last[key] = m.value
+		if value == 0 {
+			return "", false
+		}
+	}
+
+	line := name + ":" + strconv.FormatFloat(value, 'f', -1, 64) + "|" + kind
+	if len(tags) > 0 {
+		line += "|#" + strings.Join(tags, ",")
+	}
+	return line, true
+}
+
+// send writes one datagram, counting failures; StatsD is best effort, so
+// they are only logged at debug level
+func (e *statsdExporter) send(packet []byte) {
+	if _, err := e.conn.Write(packet); err != nil {
+		atomic.AddUint64(&e.errors, 1)
+		e.logger.WithError(err).Debug("Failed to send StatsD metrics")
+		return
+	}
+	atomic.AddUint64(&e.packets, 1)
+}
+
+// statsdSanitize makes a tag value usable as part of a plain StatsD
+// metric name, where '.' separates the name's parts and ':', '|' and '@'
+// have meaning of their own
+func statsdSanitize(value string) string {
+	return strings.Map(func(r rune) rune {
+		switch r {
+		case '.', ':', '|', '@', '/', ' ', '#', ',':
+			return '_'
+		}
+		return r
+	}, value)
+}
+
+// StatsDStats returns where metrics go and the datagrams sent and failed,
+// or nil if the StatsD exporter is not enabled
+func (lb *LoadBalancer) StatsDStats() map[string]interface{} {
+	e := lb.statsd
+	if e == nil {
+		return nil
+	}
+
+	format := statsdPlain
+	if e.dog {
+		format = statsdDog
+	}
+	return map[string]interface{}{
+		"address":  e.conn.RemoteAddr().String(),
+		"format":   format,
+		"interval": e.interval.String(),
+		"packets":  atomic.LoadUint64(&e.packets),
+		"errors":   atomic.LoadUint64(&e.errors),
+	}
+}
@@ -0,0 +1,55 @@
+package lb
+
+import (
+	"math"
+	"time"
+)
+
+// Status returns the state of the instance at a glance: uptime, query
+// rate, latency, cache hit ratio and every backend's state and statistics.
+// The query rate is over the last 10 seconds and only kept while the
+// runtime API is served.
+func (lb *LoadBalancer) Status() map[string]interface{} {
+	var queries uint64
+	for _, count := range lb.CounterStats()["qtypes"].(map[string]uint64) {
+		queries += count
+	}
+
+	healthy := 0
+	all := lb.allBackends()
+	backends := make([]map[string]interface{}, len(all))
+	for i, b := range all {
+		stats := b.Stats()
+		if backendState(stats) == "healthy" {
+			healthy++
+		}
+		backends[i] = stats
+	}
+
+	uptime := time.Since(lb.started)
+	status := map[string]interface{}{
+		"started":          lb.started.UTC().Format(time.RFC3339),
+		"uptime":           uptime.Round(time.Second).String(),
+		"uptime_seconds":   int64(uptime.Seconds()),
+		"ready":            lb.isReady(),
+		"queries":          queries,
+		"healthy_backends": healthy,
+		"latency":          lb.latency.Snapshot(),
+		"backends":         backends,
+	}
+	if lb.stream != nil {
+		status["qps"] = math.Round(lb.stream.rate()*10) / 10
+	}
+	if q := lb.QuorumStats(); q != nil {
+		status["quorum"] = q["quorum"]
+	}
+	if c := lb.CacheStats(); c != nil {
+		status["cache"] = map[string]interface{}{
+			"entries":   c["entries"],
+			"hits":      c["hits"],
+			"misses":    c["misses"],
+			"hit_ratio": c["hit_ratio"],
+		}
+	}
+	return status
+}
@@ -0,0 +1,66 @@
+package lb
+
+import (
+	"bytes"
+)
+
+// Backend selection strategies
+const (
+	StrategyRoundRobin    = "round_robin"
+	StrategyWeighted      = "weighted"
+	StrategyLeastRequests = "least_requests"
+	StrategyLatency       = "latency"
+	StrategyHashClient    = "hash_client"
+	StrategyHashQName     = "hash_qname"
+	StrategyRandom        = "random"
+)
+
+// latencyProbeRate is the share of queries the latency strategy sends to another
+// healthy backend, so the latency of slower backends stays current and a
+// recovered backend can win traffic back
+const latencyProbeRate = 0.05
+
+// strategyBalancer returns the factory for a configured strategy name
+func strategyBalancer(strategy string) BalancerFactory {
+	switch strategy {
+	case StrategyWeighted:
+		return NewWeighted
+	case StrategyLeastRequests:
+		return NewLeastRequests
+	case StrategyLatency:
+		return NewLowestLatency
+	case StrategyHashClient:
+		return NewHashClient
+	case StrategyHashQName:
+		return NewHashQName
+	case StrategyRandom:
+		return NewRandom
+	}
+	return NewRoundRobin
+}
+
+// queryName returns the lowercased wire-format name of a query's first
+// question, or nil if it can't be read
+func queryName(query []byte) []byte {
+	if len(query) < 12 || query[4] == 0 && query[5] == 0 {
+		return nil
+	}
+
+	off := 12
+	for {
+		if off >= len(query) {
+			return nil
+		}
+		length := int(query[off])
+		if length == 0 {
+			break
+		}
+		if length&0xc0 != 0 {
+			// Compression pointers have no place in a question
+			return nil
+		}
+		off += 1 + length
+	}
+
+	return bytes.ToLower(query[12:off])
+}
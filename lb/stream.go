@@ -0,0 +1,339 @@
+package lb
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/aram535/dnsbalancer/backend"
+)
+
+// Live statistics stream settings
+const (
+	streamInterval = time.Second
+	streamBuffer   = 16 // Events a subscriber may fall behind by before missing some
+	rateSamples    = 11 // Samples the query rate is over, spanning 10 seconds
+)
+
+// statsStream publishes the admin API's live events: every second the
+// counts of the last second, and backend state changes as they are seen.
+// Each subscriber has a buffered channel; one that doesn't keep up misses
+// events rather than holding up the others.
+type statsStream struct {
+	mu          sync.Mutex
+	subscribers map[chan streamEvent]struct{}
+
+	// Used by the sampling goroutine only
+	last   streamSample
+	states map[*backend.Backend]string // State of each backend at the last sample
+
+	rateMu sync.Mutex
+	recent []rateSample // Query totals of the last samples, for the query rate
+}
+
+// rateSample is the query total at a sample
+type rateSample struct {
+	at      time.Time
+	queries uint64
+}
+
+// streamSample is a snapshot of the running totals a stats event is the
+// difference of
+type streamSample struct {
+	queries  uint64
+	dropped  uint64
+	rcodes   map[string]uint64
+	hits     uint64
+	misses   uint64
+	backends map[*backend.Backend]backendSample
+}
+
+// backendSample is a backend's running totals in a streamSample
+type backendSample struct {
+	queries  uint64
+	failures uint64
+}
+
+// streamEvent is an event of the stream, named "stats" or "backend", with
+// a statsEvent or a stateEvent
+type streamEvent struct {
+	name string
+	data interface{}
+}
+
+// statsEvent has the counts of one interval
+type statsEvent struct {
+	Time        time.Time         `json:"time"`
+	Queries     uint64            `json:"queries"`
+	Rcodes      map[string]uint64 `json:"rcodes"`
+	Dropped     uint64            `json:"dropped"`
+	CacheHits   uint64            `json:"cache_hits"`
+	CacheMisses uint64            `json:"cache_misses"`
+	Backends    []backendCounts   `json:"backends"`
+}
+
+// backendCounts is a backend's counts in a statsEvent
+type backendCounts struct {
+	Address  string `json:"address"`
+	State    string `json:"state"`
+	Queries  uint64 `json:"queries"`
+	Failures uint64 `json:"failures"`
+	InFlight int64  `json:"in_flight"`
+}
+
+// stateEvent marks a change of a backend's state
+type stateEvent struct {
+	Time    time.Time `json:"time"`
+	Backend string    `json:"backend"`
+	From    string    `json:"from"`
+	To      string    `json:"to"`
+}
+
+// newStatsStream creates the live statistics stream
+func newStatsStream() *statsStream {
+	return &statsStream{subscribers: make(map[chan streamEvent]struct{})}
+}
+
+// startStream starts the live statistics stream for the runtime API, once
+// whether it is served on the admin address, the control socket or both
+func (lb *LoadBalancer) startStream() {
+	if lb.stream != nil {
+		return
+	}
+	lb.stream = newStatsStream()
+	lb.stream.start(lb.ctx, &lb.wg, lb)
+}
+
+// start samples the statistics every second until ctx is done
+func (s *statsStream) start(ctx context.Context, wg *sync.WaitGroup, lb *LoadBalancer) {
+	all := lb.allBackends()
+	s.last = lb.streamSample(all)
+	s.states = backendStates(all)
+	s.record(time.Now(), s.last.queries)
+
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		ticker := time.NewTicker(streamInterval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case now := <-ticker.C:
+				s.tick(now, lb)
+			}
+		}
+	}()
+}
+
+// tick publishes the state changes since the last sample and the counts
+// of the last interval. Backends added since are counted from zero.
+func (s *statsStream) tick(now time.Time, lb *LoadBalancer) {
+	all := lb.allBackends()
+	states := backendStates(all)
+	for _, b := range all {
+		if last, ok := s.states[b]; ok && states[b] != last {
+			s.publish("backend", stateEvent{
+				Time:    now.UTC(),
+				Backend: b.Address,
+				From:    last,
+				To:      states[b],
+			})
+		}
+	}
+	s.states = states
+
+	sample := lb.streamSample(all)
+	last := s.last
+	s.last = sample
+	s.record(now, sample.queries)
+	if s.idle() {
+		return
+	}
+
+	rcodes := make(map[string]uint64)
+	for rcode, count := range sample.rcodes {
+		if delta := count - last.rcodes[rcode]; delta > 0 {
+			rcodes[rcode] = delta
+		}
+	}
+	backends := make([]backendCounts, len(all))
+	for i, b := range all {
+		backends[i] = backendCounts{
+			Address:  b.Address,
+			State:    states[b],
+			Queries:  sample.backends[b].queries - last.backends[b].queries,
+			Failures: sample.backends[b].failures - last.backends[b].failures,
+			InFlight: b.InFlight(),
+		}
+	}
+	s.publish("stats", statsEvent{
+		Time:        now.UTC(),
+		Queries:     sample.queries - last.queries,
+		Rcodes:      rcodes,
+		Dropped:     sample.dropped - last.dropped,
+		CacheHits:   sample.hits - last.hits,
+		CacheMisses: sample.misses - last.misses,
+		Backends:    backends,
+	})
+}
+
+// record keeps a sample's query total, dropping those older than the
+// query rate's window
+func (s *statsStream) record(now time.Time, queries uint64) {
+	s.rateMu.Lock()
+	defer s.rateMu.Unlock()
+	s.recent = append(s.recent, rateSample{at: now, queries: queries})
+	if len(s.recent) > rateSamples {
+		s.recent = append(s.recent[:0], s.recent[len(s.recent)-rateSamples:]...)
+	}
+}
+
+// rate returns the queries per second over the last samples, 0 until
+// there are two
+func (s *statsStream) rate() float64 {
+	s.rateMu.Lock()
+	defer s.rateMu.Unlock()
+	if len(s.recent) < 2 {
+		return 0
+	}
+	first, last := s.recent[0], s.recent[len(s.recent)-1]
+	elapsed := last.at.Sub(first.at).Seconds()
+	if elapsed <= 0 {
+		return 0
+	}
+	return float64(last.queries-first.queries) / elapsed
+}
+
+// streamSample takes the running totals stats events are computed from
+func (lb *LoadBalancer) streamSample(all []*backend.Backend) streamSample {
+	counters := lb.CounterStats()
+	sample := streamSample{
+		dropped:  counters["dropped"].(uint64),
+		rcodes:   counters["rcodes"].(map[string]uint64),
+		backends: make(map[*backend.Backend]backendSample, len(all)),
+	}
+	for _, count := range counters["qtypes"].(map[string]uint64) {
+		sample.queries += count
+	}
+	if cache := lb.CacheStats(); cache != nil {
+		sample.hits = cache["hits"].(uint64)
+		sample.misses = cache["misses"].(uint64)
+	}
+	for _, b := range all {
+		stats := b.Stats()
+		sample.backends[b] = backendSample{
+			queries:  stats["total_queries"].(uint64),
+			failures: stats["total_failures"].(uint64),
+		}
+	}
+	return sample
+}
+
+// backendStates returns the state of every backend
+func backendStates(all []*backend.Backend) map[*backend.Backend]string {
+	states := make(map[*backend.Backend]string, len(all))
+	for _, b := range all {
+		states[b] = backendState(b.Stats())
+	}
+	return states
+}
+
+// backendState names a backend's state from its statistics: disabled,
+// draining, ejected, unhealthy or healthy
+func backendState(stats map[string]interface{}) string {
+	switch {
+	case stats["disabled"].(bool):
+		return "disabled"
+	case stats["draining"].(bool):
+		return "draining"
+	case stats["ejected"].(bool):
+		return "ejected"
+	case !stats["healthy"].(bool):
+		return "unhealthy"
+	}
+	return "healthy"
+}
+
+// subscribe adds a subscriber to the stream
+func (s *statsStream) subscribe() chan streamEvent {
+	events := make(chan streamEvent, streamBuffer)
+	s.mu.Lock()
+	s.subscribers[events] = struct{}{}
+	s.mu.Unlock()
+	return events
+}
+
+// unsubscribe removes a subscriber from the stream
+func (s *statsStream) unsubscribe(events chan streamEvent) {
+	s.mu.Lock()
+	delete(s.subscribers, events)
+	s.mu.Unlock()
+}
+
+// idle reports whether no one is subscribed
+func (s *statsStream) idle() bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return len(s.subscribers) == 0
+}
+
+// publish sends an event to every subscriber with room for it
+func (s *statsStream) publish(name string, data interface{}) {
+	event := streamEvent{name: name, data: data}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for events := range s.subscribers {
+		select {
+		case events <- event:
+		default:
+		}
+	}
+}
+
+// serveStream streams the live statistics as server-sent events until the
+// client goes away or the load balancer stops
+func (lb *LoadBalancer) serveStream(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		http.Error(w, "streaming not supported", http.StatusInternalServerError)
+		return
+	}
+
+	events := lb.stream.subscribe()
+	defer lb.stream.unsubscribe(events)
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("X-Accel-Buffering", "no")
+	w.WriteHeader(http.StatusOK)
+	fmt.Fprint(w, ": dnsbalancer live statistics\n\n")
+	flusher.Flush()
+
+	for {
+		select {
+		case <-r.Context().Done():
+			return
+		case <-lb.ctx.Done():
+			return
+		case event := <-events:
+			payload, err := json.Marshal(event.data)
+			if err != nil {
+				continue
+			}
+			if _, err := fmt.Fprintf(w, "event: %s\ndata: %s\n\n", event.name, payload); err != nil {
+				return
+			}
+			flusher.Flush()
+		}
+	}
+}
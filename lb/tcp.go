@@ -0,0 +1,148 @@
+package lb
+
+import (
+	"encoding/binary"
+	"io"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+// tcpIdleTimeout is how long an idle client TCP connection is kept open
+// waiting for the next query (RFC 7766 recommends a few seconds)
+const tcpIdleTimeout = 10 * time.Second
+
+// queryHandler turns a raw query from a client into the raw response to
+// send back, or nil if the query should be dropped
+type queryHandler func(query []byte, clientAddr net.Addr) []byte
+
+// acceptTCP accepts incoming TCP connections from DNS clients and serves
+// each one with the given handler
+func (lb *LoadBalancer) acceptTCP(listener net.Listener, handler queryHandler) {
+	defer lb.wg.Done()
+
+	for {
+		conn, err := listener.Accept()
+		if err != nil {
+			select {
+			case <-lb.ctx.Done():
+				return
+			default:
+			}
+
+			if netErr, ok := err.(net.Error); ok && netErr.Timeout() {
+				continue
+			}
+
+			lb.logger.WithError(err).Error("Error accepting TCP connection")
+			time.Sleep(100 * time.Millisecond)
+			continue
+		}
+
+		lb.wg.Add(1)
+		go lb.handleTCPConn(conn, handler)
+	}
+}
+
+// wrapStreamListener adds PROXY protocol handling to a stream listener
+// when it is enabled
+func (lb *LoadBalancer) wrapStreamListener(listener net.Listener) net.Listener {
+	if len(lb.proxyTrusted) == 0 {
+		return listener
+	}
+	return newProxyListener(listener, lb.proxyTrusted, lb.logger)
+}
+
+// handleTCPConn reads length-prefixed DNS queries from a client connection
+// until the client disconnects, goes idle, or the load balancer shuts down.
+// Queries are processed concurrently so pipelined requests don't block
+// each other; responses are written back as they become available.
+func (lb *LoadBalancer) handleTCPConn(conn net.Conn, handler queryHandler) {
+	defer lb.wg.Done()
+
+	logger := lb.logger.WithFields(logrus.Fields{
+		"client":    lb.privacy.client(conn.RemoteAddr()),
+		"transport": "tcp",
+	})
+
+	// Close the connection when shutting down so blocked reads return
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		select {
+		case <-lb.ctx.Done():
+			conn.Close()
+		case <-done:
+		}
+	}()
+
+	var (
+		writeMu  sync.Mutex
+		inflight sync.WaitGroup
+	)
+	defer func() {
+		inflight.Wait()
+		conn.Close()
+	}()
+
+	for {
+		conn.SetReadDeadline(time.Now().Add(tcpIdleTimeout))
+
+		query, err := readTCPMessage(conn)
+		if err != nil {
+			if err != io.EOF {
+				if netErr, ok := err.(net.Error); !ok || !netErr.Timeout() {
+					logger.WithError(err).Debug("Closing TCP connection")
+				}
+			}
+			return
+		}
+
+		inflight.Add(1)
+		lb.wg.Add(1)
+		go func() {
+			defer lb.wg.Done()
+			defer inflight.Done()
+
+			response := handler(query, conn.RemoteAddr())
+			if response == nil {
+				return
+			}
+
+			writeMu.Lock()
+			defer writeMu.Unlock()
+
+			conn.SetWriteDeadline(time.Now().Add(lb.timeout()))
+			if err := writeTCPMessage(conn, response); err != nil {
+				logger.WithError(err).Error("Failed to send response to client")
+			}
+		}()
+	}
+}
+
+// readTCPMessage reads a single two-byte length-prefixed DNS message
+func readTCPMessage(r io.Reader) ([]byte, error) {
+	var length [2]byte
+	if _, err := io.ReadFull(r, length[:]); err != nil {
+		return nil, err
+	}
+
+	msg := make([]byte, binary.BigEndian.Uint16(length[:]))
+	if _, err := io.ReadFull(r, msg); err != nil {
+		return nil, err
+	}
+
+	return msg, nil
+}
+
+// writeTCPMessage writes a DNS message with its two-byte length prefix
+func writeTCPMessage(w io.Writer, msg []byte) error {
+	buf := make([]byte, 2+len(msg))
+	binary.BigEndian.PutUint16(buf, uint16(len(msg)))
+	copy(buf[2:], msg)
+
+	_, err := w.Write(buf)
+	return err
+}
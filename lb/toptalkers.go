@@ -0,0 +1,268 @@
+package lb
+
+import (
+	"container/heap"
+	"context"
+	"net"
+	"net/netip"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/aram535/dnsbalancer/config"
+	"github.com/miekg/dns"
+)
+
+// Top talker defaults
+const (
+	defaultTopCapacity = 1000
+	defaultTopWindow   = time.Minute
+	defaultTopCount    = 10
+)
+
+// topTalkers keeps rolling counts of the clients sending the most queries
+// and the names queried most. Each list tracks at most capacity keys, so
+// memory stays bounded however many clients and names pass through, and
+// the counts halve every window so the lists follow current traffic.
+type topTalkers struct {
+	clients  *spaceSaving
+	names    *spaceSaving
+	capacity int
+	window   time.Duration
+	privacy  *clientPrivacy
+}
+
+// newTopTalkers creates the top talker counts, or returns nil when they
+// are not enabled
+func newTopTalkers(cfg *config.TopTalkersConfig, privacy *clientPrivacy) *topTalkers {
+	if cfg == nil || !cfg.Enabled {
+		return nil
+	}
+
+	t := &topTalkers{
+		capacity: cfg.Capacity,
+		window:   cfg.Window,
+		privacy:  privacy,
+	}
+	if t.capacity == 0 {
+		t.capacity = defaultTopCapacity
+	}
+	if t.window == 0 {
+		t.window = defaultTopWindow
+	}
+	t.clients = newSpaceSaving(t.capacity)
+	t.names = newSpaceSaving(t.capacity)
+	return t
+}
+
+// observe counts a query for its client and name. Clients are counted by
+// IP address, as the privacy settings record it.
+func (t *topTalkers) observe(query []byte, clientAddr net.Addr) {
+	if t == nil {
+		return
+	}
+
+	client := clientAddr.String()
+	if ip, ok := netip.AddrFromSlice(addrIP(clientAddr)); ok {
+		client = t.privacy.ip(ip)
+	}
+	t.clients.add(client)
+	if name := queryName(query); name != nil {
+		t.names.add(string(name))
+	}
+}
+
+// start halves the counts every window until ctx is done
+func (t *topTalkers) start(ctx context.Context, wg *sync.WaitGroup) {
+	if t == nil {
+		return
+	}
+
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		ticker := time.NewTicker(t.window)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+				t.clients.decay()
+				t.names.decay()
+			}
+		}
+	}()
+}
+
+// spaceSaving is the Space-Saving top-k counter: once full, a new key
+// takes the place of the least counted one and inherits its count, which
+// is kept as the new key's possible overcount. Keys queried more often
+// than one in capacity times are never lost.
+type spaceSaving struct {
+	capacity int
+
+	mu      sync.Mutex
+	entries map[string]*talker
+	heap    talkerHeap // Least counted first
+}
+
+// talker is a key tracked by a spaceSaving counter
+type talker struct {
+	key   string
+	count uint64
+	error uint64 // Most the count may be over the key's true count
+	index int    // Position in the heap
+}
+
+// newSpaceSaving creates a counter tracking up to capacity keys
+func newSpaceSaving(capacity int) *spaceSaving {
+	return &spaceSaving{
+		capacity: capacity,
+		entries:  make(map[string]*talker, capacity),
+	}
+}
+
+// add counts a key
+func (s *spaceSaving) add(key string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if t, ok := s.entries[key]; ok {
+		t.count++
+		heap.Fix(&s.heap, t.index)
+		return
+	}
+	if len(s.heap) < s.capacity {
+		t := &talker{key: key, count: 1}
+		s.entries[key] = t
+		heap.Push(&s.heap, t)
+		return
+	}
+
+	// Replace the least counted key
+	t := s.heap[0]
+	delete(s.entries, t.key)
+	t.key, t.error = key, t.count
+	t.count++
+	s.entries[key] = t
+	heap.Fix(&s.heap, 0)
+}
+
+// decay halves every count, dropping the keys that reach zero. Halving
+// keeps the order of the counts, but the heap is rebuilt without the
+// dropped keys, so the kept ones are given their new positions.
+func (s *spaceSaving) decay() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	kept := s.heap[:0]
+	for _, t := range s.heap {
+		t.count /= 2
+		t.error /= 2
+		if t.count == 0 {
+			delete(s.entries, t.key)
+			continue
+		}
+		t.index = len(kept)
+		kept = append(kept, t)
+	}
+	for i := len(kept); i < len(s.heap); i++ {
+		s.heap[i] = nil
+	}
+	s.heap = kept
+	heap.Init(&s.heap)
+}
+
+// top returns up to n of the most counted keys, most counted first
+func (s *spaceSaving) top(n int) []talker {
+	s.mu.Lock()
+	talkers := make([]talker, len(s.heap))
+	for i, t := range s.heap {
+		talkers[i] = *t
+	}
+	s.mu.Unlock()
+
+	sort.Slice(talkers, func(i, j int) bool {
+		if talkers[i].count != talkers[j].count {
+			return talkers[i].count > talkers[j].count
+		}
+		return talkers[i].key < talkers[j].key
+	})
+	if len(talkers) > n {
+		talkers = talkers[:n]
+	}
+	return talkers
+}
+
+// talkerHeap orders talkers by count, least first
+type talkerHeap []*talker
+
+func (h talkerHeap) Len() int           { return len(h) }
+func (h talkerHeap) Less(i, j int) bool { return h[i].count < h[j].count }
+
+func (h talkerHeap) Swap(i, j int) {
+	h[i], h[j] = h[j], h[i]
+	h[i].index = i
+	h[j].index = j
+}
+
+func (h *talkerHeap) Push(x interface{}) {
+	t := x.(*talker)
+	t.index = len(*h)
+	*h = append(*h, t)
+}
+
+func (h *talkerHeap) Pop() interface{} {
+	old := *h
+	t := old[len(old)-1]
+	old[len(old)-1] = nil
+	*h = old[:len(old)-1]
+	return t
+}
+
+// topNameText converts a name tracked in wire format to text
+func topNameText(key string) string {
+	name, _, err := dns.UnpackDomainName(append([]byte(key), 0), 0)
+	if err != nil {
+		return key
+	}
+	return name
+}
+
+// TopTalkerStats returns up to n of the busiest clients and most queried
+// names with their rolling counts, or nil if top talkers are not enabled.
+// A count may be over the true one by as much as its error.
+func (lb *LoadBalancer) TopTalkerStats(n int) map[string]interface{} {
+	t := lb.topTalkers
+	if t == nil {
+		return nil
+	}
+	if n <= 0 {
+		n = defaultTopCount
+	}
+
+	clients := make([]map[string]interface{}, 0, n)
+	for _, c := range t.clients.top(n) {
+		clients = append(clients, map[string]interface{}{
+			"client": c.key,
+			"count":  c.count,
+			"error":  c.error,
+		})
+	}
+	names := make([]map[string]interface{}, 0, n)
+	for _, c := range t.names.top(n) {
+		names = append(names, map[string]interface{}{
+			"name":  topNameText(c.key),
+			"count": c.count,
+			"error": c.error,
+		})
+	}
+
+	return map[string]interface{}{
+		"capacity": t.capacity,
+		"window":   t.window.String(),
+		"clients":  clients,
+		"names":    names,
+	}
+}
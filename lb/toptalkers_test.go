@@ -0,0 +1,44 @@
+package lb
+
+import (
+	"fmt"
+	"testing"
+)
+
+// TestSpaceSavingDecayThenAdd checks the keys kept by a decay can still be
+// counted, with the heap positions they were moved to
+func TestSpaceSavingDecayThenAdd(t *testing.T) {
+	s := newSpaceSaving(10)
+	for i := 0; i < 6; i++ {
+		// Even keys are seen 3 times and kept with a count of 1, odd
+		// keys once and dropped by the decay
+		times := 3
+		if i%2 == 1 {
+			times = 1
+		}
+		for n := 0; n < times; n++ {
+			s.add(fmt.Sprintf("key%d", i))
+		}
+	}
+	s.decay()
+
+	for i, talker := range s.heap {
+		if talker.index != i {
+			t.Fatalf("talker %s has index %d at heap position %d", talker.key, talker.index, i)
+		}
+	}
+	for _, talker := range append([]*talker(nil), s.heap...) {
+		s.add(talker.key)
+	}
+	s.add("new")
+
+	top := s.top(10)
+	if len(top) != 4 {
+		t.Fatalf("got %d keys after decay, want 4: %v", len(top), top)
+	}
+	for _, talker := range top[:3] {
+		if talker.count != 2 {
+			t.Errorf("key %s counted %d, want 2", talker.key, talker.count)
+		}
+	}
+}
@@ -0,0 +1,262 @@
+package lb
+
+import (
+	"fmt"
+	"net"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/aram535/dnsbalancer/config"
+	"github.com/miekg/dns"
+	"github.com/sirupsen/logrus"
+)
+
+// Query tracing limits: a trace left running is stopped for the operator
+const (
+	defaultTraceDuration = 10 * time.Minute
+	maxTraceDuration     = time.Hour
+)
+
+// tracer holds the query traces started at runtime. A query matching one
+// is logged at debug level, every step from the filters to the backend's
+// answer, whatever the log level, so a single client or domain can be
+// looked into on a busy instance without debug logging the rest.
+type tracer struct {
+	mu     sync.Mutex
+	traces []*queryTrace
+	nextID int
+	active int32 // Number of traces, read without the lock on every query
+
+	logger *logrus.Logger // Shares the application log's output, at debug level
+}
+
+// queryTrace is one trace: the queries of a client network, for a domain
+// and its subdomains, or both
+type queryTrace struct {
+	id       int
+	client   *net.IPNet // nil = any client
+	domain   string     // Fully qualified, for reporting
+	key      string     // routeKey of the domain, matched as a suffix; "" with no domain
+	expires  time.Time
+	matched  uint64 // Queries traced
+	anyName  bool   // No domain given
+	describe string
+}
+
+// newTracer creates the tracer, logging traced queries through a copy of
+// the application logger that lets debug messages through
+func newTracer(logger *logrus.Logger) *tracer {
+	return &tracer{
+		nextID: 1,
+		logger: &logrus.Logger{
+			Out:          logger.Out,
+			Hooks:        logger.Hooks,
+			Formatter:    logger.Formatter,
+			ReportCaller: logger.ReportCaller,
+			Level:        logrus.DebugLevel,
+			ExitFunc:     logger.ExitFunc,
+		},
+	}
+}
+
+// StartTrace traces the queries from a client IP or network, for a domain
+// and its subdomains, or both, for the duration given (0 for the default)
+// and returns the trace's ID
+func (lb *LoadBalancer) StartTrace(client, domain string, duration time.Duration) (int, error) {
+	if client == "" && domain == "" {
+		return 0, fmt.Errorf("a client or a domain is required")
+	}
+	if duration < 0 || duration > maxTraceDuration {
+		return 0, fmt.Errorf("duration must be between 0 and %s", maxTraceDuration)
+	}
+	if duration == 0 {
+		duration = defaultTraceDuration
+	}
+
+	trace := &queryTrace{anyName: domain == ""}
+	var parts []string
+	if client != "" {
+		networks, err := config.ParseCIDRs([]string{client})
+		if err != nil {
+			return 0, err
+		}
+		trace.client = networks[0]
+		parts = append(parts, "client "+trace.client.String())
+	}
+	if domain != "" {
+		key, err := routeKey(domain)
+		if err != nil {
+			return 0, fmt.Errorf("invalid domain %q: %w", domain, err)
+		}
+		trace.key = key
+		trace.domain = dns.Fqdn(strings.ToLower(domain))
+		parts = append(parts, "domain "+trace.domain)
+	}
+	trace.describe = strings.Join(parts, ", ")
+
+	t := lb.tracer
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.expire(time.Now())
+	trace.id = t.nextID
+	t.nextID++
+	trace.expires = time.Now().Add(duration)
+	t.traces = append(t.traces, trace)
+	atomic.StoreInt32(&t.active, int32(len(t.traces)))
+
+	lb.logger.WithFields(logrus.Fields{
+		"trace":    trace.id,
+		"duration": duration,
+	}).Infof("Tracing queries of %s", trace.describe)
+	return trace.id, nil
+}
+
+// StopTrace stops a trace, or every trace with an ID of 0, and returns how
+// many were stopped
+func (lb *LoadBalancer) StopTrace(id int) int {
+	t := lb.tracer
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	kept := t.traces[:0]
+	stopped := 0
+	for _, trace := range t.traces {
+		if id != 0 && trace.id != id {
+			kept = append(kept, trace)
+			continue
+		}
+		stopped++
+		lb.logger.WithFields(logrus.Fields{
+			"trace":   trace.id,
+			"matched": atomic.LoadUint64(&trace.matched),
+		}).Infof("Stopped tracing queries of %s", trace.describe)
+	}
+	t.traces = kept
+	atomic.StoreInt32(&t.active, int32(len(t.traces)))
+	return stopped
+}
+
+// expire drops the traces whose time is up. The caller holds t.mu.
+func (t *tracer) expire(now time.Time) {
+	kept := t.traces[:0]
+	for _, trace := range t.traces {
+		if now.Before(trace.expires) {
+			kept = append(kept, trace)
+		}
+	}
+	t.traces = kept
+	atomic.StoreInt32(&t.active, int32(len(t.traces)))
+}
+
+// match returns the first trace a query matches, or nil
+func (t *tracer) match(query []byte, clientAddr net.Addr) *queryTrace {
+	if atomic.LoadInt32(&t.active) == 0 {
+		return nil
+	}
+
+	ip := addrIP(clientAddr)
+	name := queryName(query)
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.expire(time.Now())
+	for _, trace := range t.traces {
+		if trace.client != nil && (ip == nil || !trace.client.Contains(ip)) {
+			continue
+		}
+		if !trace.anyName && !nameWithin(name, trace.key) {
+			continue
+		}
+		atomic.AddUint64(&trace.matched, 1)
+		return trace
+	}
+	return nil
+}
+
+// nameWithin reports whether a wire-format query name is a routeKey's
+// domain or one of its subdomains
+func nameWithin(name []byte, key string) bool {
+	if name == nil {
+		return false
+	}
+	for off := 0; ; off += 1 + int(name[off]) {
+		if string(name[off:]) == key {
+			return true
+		}
+		if off >= len(name) {
+			return false
+		}
+	}
+}
+
+// trace returns the logger for a query: for a traced one, a logger that
+// logs its steps at debug level, along with a function logging how it was
+// answered
+func (lb *LoadBalancer) trace(query []byte, clientAddr net.Addr, logger *logrus.Entry) (*logrus.Entry, func([]byte)) {
+	trace := lb.tracer.match(query, clientAddr)
+	if trace == nil {
+		return logger, nil
+	}
+
+	traced := logrus.NewEntry(lb.tracer.logger).WithContext(logger.Context).WithFields(logger.Data).WithField("trace", trace.id)
+	msg := new(dns.Msg)
+	if err := msg.Unpack(query); err == nil && len(msg.Question) > 0 {
+		traced.WithFields(logrus.Fields{
+			"qname": msg.Question[0].Name,
+			"qtype": dns.Type(msg.Question[0].Qtype).String(),
+			"id":    msg.Id,
+			"size":  len(query),
+		}).Debug("Trace: query received")
+	}
+
+	start := time.Now()
+	return traced, func(response []byte) {
+		logger := traced.WithField("duration", time.Since(start))
+		if len(response) < 4 {
+			logger.Debug("Trace: query dropped")
+			return
+		}
+		logger.WithFields(logrus.Fields{
+			"rcode": responseRcode(response),
+			"size":  len(response),
+		}).Debug("Trace: response sent")
+	}
+}
+
+// responseRcode names the response code in a response's header
+func responseRcode(response []byte) string {
+	if len(response) < 4 {
+		return ""
+	}
+	return rcodeName(int(response[3] & 0x0f))
+}
+
+// TraceStats returns the traces running, or an empty list if there are
+// none
+func (lb *LoadBalancer) TraceStats() []map[string]interface{} {
+	t := lb.tracer
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	now := time.Now()
+	t.expire(now)
+
+	traces := make([]map[string]interface{}, len(t.traces))
+	for i, trace := range t.traces {
+		entry := map[string]interface{}{
+			"id":        trace.id,
+			"expires":   trace.expires.UTC().Format(time.RFC3339),
+			"remaining": trace.expires.Sub(now).Round(time.Second).String(),
+			"matched":   atomic.LoadUint64(&trace.matched),
+		}
+		if trace.client != nil {
+			entry["client"] = trace.client.String()
+		}
+		if !trace.anyName {
+			entry["domain"] = trace.domain
+		}
+		traces[i] = entry
+	}
+	return traces
+}
@@ -0,0 +1,55 @@
+package lb
+
+import (
+	"github.com/miekg/dns"
+)
+
+// udpResponseLimit returns the largest UDP response the client accepts:
+// the payload size advertised in its EDNS0 OPT record, or 512 bytes for
+// clients without EDNS (RFC 1035)
+func udpResponseLimit(query []byte) int {
+	msg := new(dns.Msg)
+	if err := msg.Unpack(query); err != nil {
+		return dns.MinMsgSize
+	}
+
+	if opt := msg.IsEdns0(); opt != nil && int(opt.UDPSize()) > dns.MinMsgSize {
+		return int(opt.UDPSize())
+	}
+
+	return dns.MinMsgSize
+}
+
+// truncateResponse shrinks a response to fit in limit bytes by dropping
+// whole RRsets and setting the TC flag, so the client retries over TCP
+func truncateResponse(response []byte, limit int) []byte {
+	if len(response) <= limit {
+		return response
+	}
+
+	msg := new(dns.Msg)
+	if err := msg.Unpack(response); err != nil {
+		// Can't truncate cleanly; an empty TC reply is better than a
+		// datagram the client will fail to parse
+		if len(response) < 12 {
+			return nil
+		}
+		header := make([]byte, 12)
+		copy(header, response[:12])
+		header[2] |= 0x02             // TC
+		header[4], header[5] = 0, 0   // QDCOUNT
+		header[6], header[7] = 0, 0   // ANCOUNT
+		header[8], header[9] = 0, 0   // NSCOUNT
+		header[10], header[11] = 0, 0 // ARCOUNT
+		return header
+	}
+
+	msg.Truncate(limit)
+
+	truncated, err := msg.Pack()
+	if err != nil {
+		return nil
+	}
+
+	return truncated
+}
@@ -0,0 +1,138 @@
+package lb
+
+import (
+	"fmt"
+	"sort"
+	"sync/atomic"
+	"time"
+
+	"github.com/aram535/dnsbalancer/config"
+	"github.com/miekg/dns"
+)
+
+// ttlRules rewrites the TTLs of the answers backends give for names under
+// their domains, e.g. to keep CDN names cached longer than they ask for
+// or internal names from being held past a quick failover. A domain's rule
+// replaces the cache's own TTL floor and ceiling for its names.
+type ttlRules struct {
+	rules     map[string]*ttlRule // By routeTable key of the domain
+	rewritten uint64              // Answers with TTLs changed
+}
+
+// ttlRule is the TTL floor and ceiling of one domain
+type ttlRule struct {
+	domain string
+	minTTL uint32
+	maxTTL uint32 // 0 = no ceiling
+}
+
+// newTTLRules creates the TTL rewriter, or returns nil when no rules are
+// configured
+func newTTLRules(cfg []config.TTLRuleConfig) (*ttlRules, error) {
+	if len(cfg) == 0 {
+		return nil, nil
+	}
+
+	t := &ttlRules{rules: make(map[string]*ttlRule, len(cfg))}
+	for _, rc := range cfg {
+		key, err := routeKey(rc.Domain)
+		if err != nil {
+			return nil, fmt.Errorf("ttl_rule domain %q: %w", rc.Domain, err)
+		}
+		t.rules[key] = &ttlRule{
+			domain: dns.Fqdn(rc.Domain),
+			minTTL: uint32(rc.MinTTL / time.Second),
+			maxTTL: uint32(rc.MaxTTL / time.Second),
+		}
+	}
+	return t, nil
+}
+
+// match returns the rule of the longest domain a name is in, given as a
+// routeTable key, or nil if there is none
+func (t *ttlRules) match(name []byte) *ttlRule {
+	if t == nil || name == nil {
+		return nil
+	}
+
+	for off := 0; ; off += 1 + int(name[off]) {
+		if rule, ok := t.rules[string(name[off:])]; ok {
+			return rule
+		}
+		if off >= len(name) {
+			return nil
+		}
+	}
+}
+
+// clamp applies the rule's TTL floor and ceiling
+func (r *ttlRule) clamp(ttl uint32) uint32 {
+	if ttl < r.minTTL {
+		ttl = r.minTTL
+	}
+	if r.maxTTL > 0 && ttl > r.maxTTL {
+		ttl = r.maxTTL
+	}
+	return ttl
+}
+
+// rewriteTTLs clamps the TTLs of a backend's answer to the rule of the
+// query name's domain, including the SOA that sets how long a negative
+// answer is cached
+func (lb *LoadBalancer) rewriteTTLs(query, response []byte) []byte {
+	rule := lb.ttlRules.match(queryName(query))
+	if rule == nil || response == nil {
+		return response
+	}
+
+	msg := new(dns.Msg)
+	if err := msg.Unpack(response); err != nil {
+		return response
+	}
+	changed := false
+	for _, rr := range cacheRecords(msg) {
+		if ttl := rule.clamp(rr.Header().Ttl); ttl != rr.Header().Ttl {
+			rr.Header().Ttl = ttl
+			changed = true
+		}
+	}
+	if soa := negativeSOA(msg); soa != nil && len(msg.Answer) == 0 && soa.Minttl != rule.clamp(soa.Minttl) {
+		soa.Minttl = rule.clamp(soa.Minttl)
+		changed = true
+	}
+	if !changed {
+		return response
+	}
+
+	rewritten, err := msg.Pack()
+	if err != nil {
+		return response
+	}
+	atomic.AddUint64(&lb.ttlRules.rewritten, 1)
+	return rewritten
+}
+
+// TTLRuleStats returns each rule's domain and bounds and the number of
+// answers rewritten, or nil if no rules are configured
+func (lb *LoadBalancer) TTLRuleStats() map[string]interface{} {
+	t := lb.ttlRules
+	if t == nil {
+		return nil
+	}
+
+	rules := make([]map[string]interface{}, 0, len(t.rules))
+	for _, rule := range t.rules {
+		rules = append(rules, map[string]interface{}{
+			"domain":  rule.domain,
+			"min_ttl": rule.minTTL,
+			"max_ttl": rule.maxTTL,
+		})
+	}
+	sort.Slice(rules, func(i, j int) bool {
+		return rules[i]["domain"].(string) < rules[j]["domain"].(string)
+	})
+	return map[string]interface{}{
+		"rules":     rules,
+		"rewritten": atomic.LoadUint64(&t.rewritten),
+	}
+}
@@ -0,0 +1,124 @@
+package lb
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"strconv"
+
+	"github.com/sirupsen/logrus"
+)
+
+// startUnix starts the unix domain socket listener for local clients
+func (lb *LoadBalancer) startUnix() error {
+	cfg := lb.unixConfig
+
+	// Remove a socket left behind by an unclean shutdown, but never
+	// anything that isn't a socket
+	if info, err := os.Lstat(cfg.Path); err == nil {
+		if info.Mode()&os.ModeSocket == 0 {
+			return fmt.Errorf("unix socket path %s exists and is not a socket", cfg.Path)
+		}
+		if err := os.Remove(cfg.Path); err != nil {
+			return fmt.Errorf("failed to remove stale unix socket: %w", err)
+		}
+	}
+
+	if cfg.Type == "datagram" {
+		conn, err := net.ListenUnixgram("unixgram", &net.UnixAddr{Name: cfg.Path, Net: "unixgram"})
+		if err != nil {
+			return fmt.Errorf("failed to listen on %s (unixgram): %w", cfg.Path, err)
+		}
+		lb.unixConn = conn
+	} else {
+		listener, err := net.Listen("unix", cfg.Path)
+		if err != nil {
+			return fmt.Errorf("failed to listen on %s (unix): %w", cfg.Path, err)
+		}
+		lb.unixListener = listener
+	}
+
+	if cfg.Permissions != "" {
+		mode, _ := strconv.ParseUint(cfg.Permissions, 8, 32)
+		if err := os.Chmod(cfg.Path, os.FileMode(mode)); err != nil {
+			lb.stopUnix()
+			return fmt.Errorf("failed to set unix socket permissions: %w", err)
+		}
+	}
+
+	lb.wg.Add(1)
+	if lb.unixConn != nil {
+		go lb.acceptUnixgram()
+	} else {
+		go lb.acceptTCP(lb.unixListener, lb.resolve)
+	}
+
+	socketType := "stream"
+	if lb.unixConn != nil {
+		socketType = "datagram"
+	}
+	lb.logger.WithFields(logrus.Fields{
+		"path": cfg.Path,
+		"type": socketType,
+	}).Info("Unix socket listener started")
+
+	return nil
+}
+
+// stopUnix closes the unix socket listener and removes the socket file
+func (lb *LoadBalancer) stopUnix() {
+	if lb.unixListener != nil {
+		// Closing a stream listener unlinks its socket file
+		if err := lb.unixListener.Close(); err != nil {
+			lb.logger.WithError(err).Error("Error closing unix socket listener")
+		}
+	}
+	if lb.unixConn != nil {
+		if err := lb.unixConn.Close(); err != nil {
+			lb.logger.WithError(err).Error("Error closing unix socket listener")
+		}
+		os.Remove(lb.unixConfig.Path)
+	}
+}
+
+// acceptUnixgram reads queries from the unix datagram socket. Clients
+// must bind their own socket to receive a reply.
+func (lb *LoadBalancer) acceptUnixgram() {
+	defer lb.wg.Done()
+
+	buffer := make([]byte, 65535)
+
+	for {
+		n, clientAddr, err := lb.unixConn.ReadFromUnix(buffer)
+		if err != nil {
+			select {
+			case <-lb.ctx.Done():
+				return
+			default:
+				lb.logger.WithError(err).Error("Error reading from unix socket")
+				continue
+			}
+		}
+
+		if clientAddr == nil || clientAddr.Name == "" {
+			lb.logger.Debug("Dropping query from unbound unix datagram client")
+			continue
+		}
+
+		query := make([]byte, n)
+		copy(query, buffer[:n])
+
+		lb.wg.Add(1)
+		go func() {
+			defer lb.wg.Done()
+
+			response := lb.resolve(query, clientAddr)
+			if response == nil {
+				return
+			}
+			if _, err := lb.unixConn.WriteToUnix(response, clientAddr); err != nil {
+				lb.logger.WithError(err).WithField("client", clientAddr.Name).Error("Failed to send response to client")
+			}
+		}()
+	}
+}
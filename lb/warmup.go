@@ -0,0 +1,203 @@
+package lb
+
+import (
+	"bufio"
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/miekg/dns"
+	"github.com/sirupsen/logrus"
+)
+
+// warmUpWorkers is how many warm-up queries are in flight at once
+const warmUpWorkers = 16
+
+// localClient is the client the balancer's own queries are resolved as.
+// Queries from a stream client go upstream over TCP, so large answers
+// aren't truncated.
+var localClient = &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1)}
+
+// warmUpQuestion is a name and type to resolve while warming up the cache
+type warmUpQuestion struct {
+	name  string
+	qtype uint16
+}
+
+// readWarmUp reads a warm-up list: one name per line, optionally followed
+// by a record type (default A). Blank lines and lines starting with # are
+// skipped.
+func readWarmUp(path string) ([]warmUpQuestion, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	var questions []warmUpQuestion
+	scanner := bufio.NewScanner(file)
+	for line := 1; scanner.Scan(); line++ {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) == 0 || strings.HasPrefix(fields[0], "#") {
+			continue
+		}
+
+		q := warmUpQuestion{name: dns.Fqdn(fields[0]), qtype: dns.TypeA}
+		if _, ok := dns.IsDomainName(q.name); !ok {
+			return nil, fmt.Errorf("%s:%d: invalid name %q", path, line, fields[0])
+		}
+		if len(fields) > 1 {
+			qtype, ok := dns.StringToType[strings.ToUpper(fields[1])]
+			if !ok {
+				return nil, fmt.Errorf("%s:%d: unknown record type %q", path, line, fields[1])
+			}
+			q.qtype = qtype
+		}
+		questions = append(questions, q)
+	}
+	return questions, scanner.Err()
+}
+
+// warmUp resolves the names of the warm-up list, if any, so their answers
+// are cached before clients arrive. A missing or broken list only delays
+// the cache getting hot, so it is logged rather than stopping startup.
+func (lb *LoadBalancer) warmUp() {
+	c := lb.cache
+	if c == nil || c.warmUpFile == "" {
+		return
+	}
+
+	logger := lb.logger.WithField("file", c.warmUpFile)
+	questions, err := readWarmUp(c.warmUpFile)
+	if os.IsNotExist(err) && c.warmUpTop > 0 {
+		logger.Info("No cache warm-up list yet, one will be saved at shutdown")
+		return
+	}
+	if err != nil {
+		logger.WithError(err).Warn("Failed to read cache warm-up list")
+		return
+	}
+	if len(questions) == 0 {
+		return
+	}
+
+	start := time.Now()
+	logger.WithField("names", len(questions)).Info("Warming up the cache")
+
+	work := make(chan warmUpQuestion)
+	var wg sync.WaitGroup
+	var mu sync.Mutex
+	failed := 0
+	for i := 0; i < min(warmUpWorkers, len(questions)); i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for q := range work {
+				if !lb.warmUpQuery(q) {
+					mu.Lock()
+					failed++
+					mu.Unlock()
+				}
+			}
+		}()
+	}
+	for _, q := range questions {
+		work <- q
+	}
+	close(work)
+	wg.Wait()
+
+	logger.WithFields(logrus.Fields{
+		"resolved": len(questions) - failed,
+		"failed":   failed,
+		"took":     time.Since(start).Round(time.Millisecond),
+	}).Info("Cache warmed up")
+}
+
+// warmUpQuery resolves a question the way a client using EDNS without
+// DNSSEC would ask it, reporting whether an answer came back
+func (lb *LoadBalancer) warmUpQuery(q warmUpQuestion) bool {
+	msg := new(dns.Msg)
+	msg.SetQuestion(q.name, q.qtype)
+	msg.SetEdns0(dns.DefaultMsgSize, false)
+	query, err := msg.Pack()
+	if err != nil {
+		return false
+	}
+	return lb.resolve(query, localClient) != nil
+}
+
+// saveWarmUp rewrites the warm-up list with the most requested names in
+// the cache, so the next run starts with them hot
+func (lb *LoadBalancer) saveWarmUp() error {
+	c := lb.cache
+	if c == nil || c.warmUpFile == "" || c.warmUpTop == 0 {
+		return nil
+	}
+
+	// Sum the hits of each name and type over flags, subnets and pools
+	hits := make(map[warmUpQuestion]uint64)
+	for _, shard := range c.shards {
+		shard.mu.Lock()
+		for key, entry := range shard.entries {
+			if _, ok := dns.TypeToString[key.qtype]; !ok {
+				continue // Couldn't be read back
+			}
+			hits[warmUpQuestion{name: key.name, qtype: key.qtype}] += entry.hits
+		}
+		shard.mu.Unlock()
+	}
+
+	// Keep the last list rather than empty it, e.g. after a quick restart
+	if len(hits) == 0 {
+		return nil
+	}
+
+	questions := make([]warmUpQuestion, 0, len(hits))
+	for q := range hits {
+		questions = append(questions, q)
+	}
+	sort.Slice(questions, func(i, j int) bool {
+		if hits[questions[i]] != hits[questions[j]] {
+			return hits[questions[i]] > hits[questions[j]]
+		}
+		return questions[i].name < questions[j].name
+	})
+	if len(questions) > c.warmUpTop {
+		questions = questions[:c.warmUpTop]
+	}
+
+	var b strings.Builder
+	fmt.Fprintf(&b, "# The %d most requested names at shutdown, saved by dnsbalancer\n", len(questions))
+	for _, q := range questions {
+		fmt.Fprintf(&b, "%s %s\n", q.name, dns.TypeToString[q.qtype])
+	}
+
+	// Replace the list in one step so a crash can't leave half of it
+	tmp, err := os.CreateTemp(filepath.Dir(c.warmUpFile), ".warmup-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.WriteString(b.String()); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	if err := os.Rename(tmp.Name(), c.warmUpFile); err != nil {
+		return err
+	}
+
+	lb.logger.WithFields(logrus.Fields{
+		"file":  c.warmUpFile,
+		"names": len(questions),
+	}).Info("Saved cache warm-up list")
+	return nil
+}
@@ -0,0 +1,342 @@
+package lb
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/aram535/dnsbalancer/config"
+	"github.com/sirupsen/logrus"
+)
+
+// Webhook defaults and formats
+const (
+	defaultWebhookTimeout = 5 * time.Second
+	defaultWebhookRetries = 3
+
+	webhookQueueSize  = 64 // Events waiting for a target before new ones are dropped
+	webhookMinBackoff = time.Second
+	webhookMaxBackoff = 30 * time.Second
+
+	webhookGeneric   = "generic"
+	webhookSlack     = "slack"
+	webhookPagerDuty = "pagerduty"
+
+	pagerDutyEventsURL = "https://events.pagerduty.com/v2/enqueue"
+)
+
+// Webhook event names
+const (
+	eventBackendUnhealthy = "backend_unhealthy"
+	eventBackendHealthy   = "backend_healthy"
+	eventQuorumLost       = "quorum_lost"
+	eventQuorumRestored   = "quorum_restored"
+)
+
+// webhookEvent is a backend health or quorum change, as the generic format
+// posts it
+type webhookEvent struct {
+	Event      string    `json:"event"`
+	Backend    string    `json:"backend,omitempty"`
+	Healthy    int       `json:"healthy"` // Healthy backends after the change
+	Total      int       `json:"total"`
+	MinHealthy int       `json:"min_healthy,omitempty"`
+	Time       time.Time `json:"time"`
+	Host       string    `json:"host"`
+	Message    string    `json:"message"`
+}
+
+// webhooks posts backend health and quorum changes to the configured
+// URLs. Each target has its own queue and goroutine, so a slow or
+// unreachable one neither holds up the others nor the health checks;
+// deliveries that fail on a network error, a 5xx or a 429 are tried
+// again with exponential backoff.
+type webhooks struct {
+	targets []*webhook
+	client  *http.Client
+	timeout time.Duration
+	retries int
+	host    string
+	logger  *logrus.Logger
+}
+
+// webhook is one target events are posted to
+type webhook struct {
+	url        string
+	format     string
+	routingKey string
+	headers    map[string]string
+	queue      chan webhookEvent
+
+	sent    uint64 // Events delivered
+	failed  uint64 // Events given up on after the last retry
+	dropped uint64 // Events not queued because the queue was full
+}
+
+// newWebhooks creates the webhook notifier, or returns nil when it is not
+// enabled
+func newWebhooks(cfg *config.WebhooksConfig, logger *logrus.Logger) *webhooks {
+	if cfg == nil || !cfg.Enabled {
+		return nil
+	}
+
+	w := &webhooks{
+		timeout: cfg.Timeout,
+		retries: cfg.Retries,
+		logger:  logger,
+	}
+	if w.timeout == 0 {
+		w.timeout = defaultWebhookTimeout
+	}
+	if w.retries == 0 {
+		w.retries = defaultWebhookRetries
+	}
+	w.client = &http.Client{Timeout: w.timeout}
+	w.host, _ = os.Hostname()
+
+	for _, target := range cfg.Targets {
+		t := &webhook{
+			url:        target.URL,
+			format:     target.Format,
+			routingKey: target.RoutingKey,
+			headers:    target.Headers,
+			queue:      make(chan webhookEvent, webhookQueueSize),
+		}
+		if t.format == "" {
+			t.format = webhookGeneric
+		}
+		if t.url == "" {
+			t.url = pagerDutyEventsURL
+		}
+		w.targets = append(w.targets, t)
+	}
+	return w
+}
+
+// start delivers queued events to each target until ctx is done
+func (w *webhooks) start(ctx context.Context, wg *sync.WaitGroup) {
+	if w == nil {
+		return
+	}
+
+	for _, t := range w.targets {
+		wg.Add(1)
+		go func(t *webhook) {
+			defer wg.Done()
+			for {
+				select {
+				case <-ctx.Done():
+					return
+				case event := <-t.queue:
+					w.deliver(ctx, t, event)
+				}
+			}
+		}(t)
+	}
+}
+
+// backendChanged notifies the targets of a backend marked healthy or
+// unhealthy
+func (w *webhooks) backendChanged(address string, healthy bool, healthyCount, total int) {
+	if w == nil {
+		return
+	}
+
+	event := webhookEvent{Event: eventBackendUnhealthy, Backend: address, Healthy: healthyCount, Total: total}
+	event.Message = fmt.Sprintf("Backend %s marked unhealthy (%d of %d backends healthy)", address, healthyCount, total)
+	if healthy {
+		event.Event = eventBackendHealthy
+		event.Message = fmt.Sprintf("Backend %s recovered (%d of %d backends healthy)", address, healthyCount, total)
+	}
+	w.notify(event)
+}
+
+// quorumChanged notifies the targets of the quorum being lost or restored
+func (w *webhooks) quorumChanged(lost bool, healthy, total, minHealthy int) {
+	if w == nil {
+		return
+	}
+
+	event := webhookEvent{Event: eventQuorumRestored, Healthy: healthy, Total: total, MinHealthy: minHealthy}
+	event.Message = fmt.Sprintf("Healthy backends back at quorum (%d of %d healthy, %d needed)", healthy, total, minHealthy)
+	if lost {
+		event.Event = eventQuorumLost
+		event.Message = fmt.Sprintf("Healthy backends below quorum (%d of %d healthy, %d needed)", healthy, total, minHealthy)
+	}
+	w.notify(event)
+}
+
+// notify queues an event for every target, dropping it for those whose
+// queue is full
+func (w *webhooks) notify(event webhookEvent) {
+	event.Time = time.Now().UTC()
+	event.Host = w.host
+	for _, t := range w.targets {
+		select {
+		case t.queue <- event:
+		default:
+			atomic.AddUint64(&t.dropped, 1)
+		}
+	}
+}
+
+// deliver posts an event to a target, retrying with backoff while the
+// failure is one worth retrying
+func (w *webhooks) deliver(ctx context.Context, t *webhook, event webhookEvent) {
+	body, err := t.payload(event)
+	if err != nil {
+		atomic.AddUint64(&t.failed, 1)
+		return
+	}
+
+	logger := w.logger.WithFields(logrus.Fields{
+		"webhook": t.host(),
+		"event":   event.Event,
+	})
+	backoff := webhookMinBackoff
+	for attempt := 0; ; attempt++ {
+		retry, err := w.post(ctx, t, body)
+		if err == nil {
+			atomic.AddUint64(&t.sent, 1)
+			return
+		}
+		if !retry || attempt == w.retries {
+			atomic.AddUint64(&t.failed, 1)
+			logger.WithError(err).Warn("Failed to deliver webhook")
+			return
+		}
+		logger.WithError(err).WithField("retry_in", backoff).Debug("Webhook delivery failed, retrying")
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(backoff):
+		}
+		backoff = min(2*backoff, webhookMaxBackoff)
+	}
+}
+
+// post sends an event's body once, reporting whether a failure is worth
+// retrying: network errors, server errors and rate limiting are, other
+// rejections aren't
+func (w *webhooks) post(ctx context.Context, t *webhook, body []byte) (bool, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, t.url, bytes.NewReader(body))
+	if err != nil {
+		return false, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("User-Agent", "dnsbalancer")
+	for name, value := range t.headers {
+		req.Header.Set(name, value)
+	}
+
+	resp, err := w.client.Do(req)
+	if err != nil {
+		return true, err
+	}
+	defer resp.Body.Close()
+	io.Copy(io.Discard, io.LimitReader(resp.Body, 64<<10))
+
+	switch {
+	case resp.StatusCode >= 200 && resp.StatusCode < 300:
+		return false, nil
+	case resp.StatusCode >= 500 || resp.StatusCode == http.StatusTooManyRequests:
+		return true, fmt.Errorf("server returned %s", resp.Status)
+	}
+	return false, fmt.Errorf("server returned %s", resp.Status)
+}
+
+// payload encodes an event in the target's format
+func (t *webhook) payload(event webhookEvent) ([]byte, error) {
+	switch t.format {
+	case webhookSlack:
+		return json.Marshal(map[string]string{
+			"text": fmt.Sprintf("dnsbalancer on %s: %s", event.Host, event.Message),
+		})
+	case webhookPagerDuty:
+		return json.Marshal(pagerDutyEvent(t.routingKey, event))
+	}
+	return json.Marshal(event)
+}
+
+// pagerDutyEvent builds a PagerDuty Events API v2 event: backends turning
+// unhealthy and the quorum being lost trigger an incident, recovery
+// resolves it. Each backend and the quorum have their own dedup key, so
+// one incident is opened and closed per subject.
+func pagerDutyEvent(routingKey string, event webhookEvent) map[string]interface{} {
+	dedupKey := "dnsbalancer/" + event.Host + "/quorum"
+	if event.Backend != "" {
+		dedupKey = "dnsbalancer/" + event.Host + "/backend/" + event.Backend
+	}
+	pd := map[string]interface{}{
+		"routing_key":  routingKey,
+		"event_action": "resolve",
+		"dedup_key":    dedupKey,
+	}
+	if event.Event != eventBackendUnhealthy && event.Event != eventQuorumLost {
+		return pd
+	}
+
+	severity := "error"
+	if event.Event == eventQuorumLost {
+		severity = "critical"
+	}
+	payload := map[string]interface{}{
+		"summary":        event.Message,
+		"source":         event.Host,
+		"severity":       severity,
+		"timestamp":      event.Time.Format(time.RFC3339),
+		"group":          "dnsbalancer",
+		"custom_details": event,
+	}
+	if event.Backend != "" {
+		payload["component"] = event.Backend
+	}
+	pd["event_action"] = "trigger"
+	pd["payload"] = payload
+	return pd
+}
+
+// host returns the target's host, which is all of its URL reported:
+// webhook URLs often carry a secret in their path or query
+func (t *webhook) host() string {
+	u, err := url.Parse(t.url)
+	if err != nil {
+		return ""
+	}
+	return u.Host
+}
+
+// WebhookStats returns each target's host, format and delivery counts,
+// or nil if webhooks are not enabled
+func (lb *LoadBalancer) WebhookStats() map[string]interface{} {
+	w := lb.webhooks
+	if w == nil {
+		return nil
+	}
+
+	targets := make([]map[string]interface{}, len(w.targets))
+	for i, t := range w.targets {
+		targets[i] = map[string]interface{}{
+			"host":    t.host(),
+			"format":  t.format,
+			"queued":  len(t.queue),
+			"sent":    atomic.LoadUint64(&t.sent),
+			"failed":  atomic.LoadUint64(&t.failed),
+			"dropped": atomic.LoadUint64(&t.dropped),
+		}
+	}
+	return map[string]interface{}{
+		"timeout": w.timeout.String(),
+		"retries": w.retries,
+		"targets": targets,
+	}
+}
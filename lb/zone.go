@@ -0,0 +1,378 @@
+package lb
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"sort"
+	"strings"
+	"sync/atomic"
+
+	"github.com/aram535/dnsbalancer/config"
+	"github.com/miekg/dns"
+	"github.com/sirupsen/logrus"
+)
+
+// maxZoneCNAMEs bounds the CNAME chain followed for one query
+const maxZoneCNAMEs = 8
+
+// localZones maps the origin of each zone loaded from a zone file,
+// lowercased and fully qualified, to the zone
+type localZones map[string]*authZone
+
+// authZone is a zone answered authoritatively from its zone file
+type authZone struct {
+	origin  string
+	file    string
+	soa     *dns.SOA
+	names   map[string]map[uint16][]dns.RR // By lowercased owner; empty non-terminals have no records
+	records int
+
+	answers   uint64 // Queries answered with records
+	nodata    uint64 // Queries for names without records of the type
+	nxdomain  uint64 // Queries for names not in the zone
+	referrals uint64 // Queries for names below a delegation
+}
+
+// zoneAnswer is what a zone holds for one name and type
+type zoneAnswer struct {
+	answer        []dns.RR
+	ns            []dns.RR
+	extra         []dns.RR
+	rcode         int
+	authoritative bool
+}
+
+// newLocalZones loads every configured zone file, or returns nil when
+// there are none
+func newLocalZones(cfg []config.ZoneConfig) (localZones, error) {
+	if len(cfg) == 0 {
+		return nil, nil
+	}
+
+	zones := make(localZones, len(cfg))
+	for _, zc := range cfg {
+		zone, err := loadZone(zc)
+		if err != nil {
+			return nil, fmt.Errorf("zone %q: %w", zc.Name, err)
+		}
+		zones[zone.origin] = zone
+	}
+	return zones, nil
+}
+
+// loadZone reads a zone file in the standard master file format
+func loadZone(cfg config.ZoneConfig) (*authZone, error) {
+	file, err := os.Open(cfg.File)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	z := &authZone{
+		origin: strings.ToLower(dns.Fqdn(cfg.Name)),
+		file:   cfg.File,
+		names:  make(map[string]map[uint16][]dns.RR),
+	}
+
+	parser := dns.NewZoneParser(file, z.origin, cfg.File)
+	parser.SetIncludeAllowed(true)
+	for rr, ok := parser.Next(); ok; rr, ok = parser.Next() {
+		name := strings.ToLower(rr.Header().Name)
+		if !dns.IsSubDomain(z.origin, name) {
+			return nil, fmt.Errorf("%s: %s is outside the zone", cfg.File, rr.Header().Name)
+		}
+		if rr.Header().Class != dns.ClassINET {
+			continue
+		}
+		if soa, ok := rr.(*dns.SOA); ok && name == z.origin {
+			if z.soa != nil {
+				return nil, fmt.Errorf("%s: more than one SOA record", cfg.File)
+			}
+			z.soa = soa
+		}
+		z.add(name, rr)
+	}
+	if err := parser.Err(); err != nil {
+		return nil, err
+	}
+
+	if z.soa == nil {
+		return nil, fmt.Errorf("%s: no SOA record at the zone apex", cfg.File)
+	}
+	if len(z.names[z.origin][dns.TypeNS]) == 0 {
+		return nil, fmt.Errorf("%s: no NS records at the zone apex", cfg.File)
+	}
+	return z, nil
+}
+
+// add stores a record under its owner, creating the empty non-terminals
+// between the owner and the apex
+func (z *authZone) add(name string, rr dns.RR) {
+	for n := name; ; n = parentName(n) {
+		if _, ok := z.names[n]; ok || n == z.origin {
+			break
+		}
+		z.names[n] = make(map[uint16][]dns.RR)
+	}
+	if z.names[name] == nil {
+		z.names[name] = make(map[uint16][]dns.RR)
+	}
+
+	rrtype := rr.Header().Rrtype
+	z.names[name][rrtype] = append(z.names[name][rrtype], rr)
+	z.records++
+}
+
+// parentName returns a name with its first label removed
+func parentName(name string) string {
+	off, end := dns.NextLabel(name, 0)
+	if end {
+		return "."
+	}
+	return name[off:]
+}
+
+// zoneFor returns the zone a name falls in, the one with the longest
+// origin, or nil if it is in none
+func (zones localZones) zoneFor(name string) *authZone {
+	name = strings.ToLower(name)
+	for off := 0; ; {
+		if zone, ok := zones[name[off:]]; ok {
+			return zone
+		}
+		next, end := dns.NextLabel(name, off)
+		if end {
+			return nil
+		}
+		off = next
+	}
+}
+
+// lookup finds what the zone holds for a name and type: the records, a
+// CNAME, a referral to a delegated child zone, or a negative answer with
+// the SOA
+func (z *authZone) lookup(name string, qtype uint16) zoneAnswer {
+	key := strings.ToLower(name)
+
+	if cut := z.cut(key, qtype); cut != "" {
+		atomic.AddUint64(&z.referrals, 1)
+		return z.referral(cut)
+	}
+
+	rrsets, ok := z.names[key]
+	if !ok {
+		if rrsets, ok = z.wildcard(key); !ok {
+			atomic.AddUint64(&z.nxdomain, 1)
+			return zoneAnswer{ns: z.negative(), rcode: dns.RcodeNameError, authoritative: true}
+		}
+	}
+
+	var answer []dns.RR
+	switch {
+	case qtype == dns.TypeANY:
+		types := make([]int, 0, len(rrsets))
+		for rrtype := range rrsets {
+			types = append(types, int(rrtype))
+		}
+		sort.Ints(types)
+		for _, rrtype := range types {
+			answer = append(answer, withOwner(rrsets[uint16(rrtype)], name)...)
+		}
+	case len(rrsets[qtype]) > 0:
+		answer = withOwner(rrsets[qtype], name)
+	case len(rrsets[dns.TypeCNAME]) > 0:
+		answer = withOwner(rrsets[dns.TypeCNAME], name)
+	}
+
+	if len(answer) == 0 {
+		atomic.AddUint64(&z.nodata, 1)
+		return zoneAnswer{ns: z.negative(), authoritative: true}
+	}
+	atomic.AddUint64(&z.answers, 1)
+	return zoneAnswer{answer: answer, authoritative: true}
+}
+
+// cut returns the delegation closest to the apex on the way to a name, or
+// "" if the name isn't below one. The DS records of a delegation are the
+// parent's, so a DS query for the delegated name itself isn't referred.
+func (z *authZone) cut(name string, qtype uint16) string {
+	cut := ""
+	for n := name; n != z.origin; n = parentName(n) {
+		if n == name && qtype == dns.TypeDS {
+			continue
+		}
+		if len(z.names[n][dns.TypeNS]) > 0 {
+			cut = n
+		}
+	}
+	return cut
+}
+
+// referral hands a query over to a delegated zone's name servers, with
+// their addresses when the zone has them (glue)
+func (z *authZone) referral(cut string) zoneAnswer {
+	ns := z.names[cut][dns.TypeNS]
+	var extra []dns.RR
+	for _, rr := range ns {
+		host := strings.ToLower(rr.(*dns.NS).Ns)
+		extra = append(extra, z.names[host][dns.TypeA]...)
+		extra = append(extra, z.names[host][dns.TypeAAAA]...)
+	}
+	return zoneAnswer{ns: ns, extra: extra}
+}
+
+// wildcard returns the records of the wildcard at the closest existing
+// ancestor of a name missing from the zone (RFC 4592), if there is one
+func (z *authZone) wildcard(name string) (map[uint16][]dns.RR, bool) {
+	encloser := parentName(name)
+	for {
+		if _, ok := z.names[encloser]; ok {
+			break
+		}
+		encloser = parentName(encloser)
+	}
+	rrsets, ok := z.names["*."+encloser]
+	return rrsets, ok
+}
+
+// negative returns the SOA for the authority section of NXDOMAIN and
+// NODATA answers, its TTL capped at the negative caching TTL (RFC 2308)
+func (z *authZone) negative() []dns.RR {
+	soa := dns.Copy(z.soa)
+	soa.Header().Ttl = min(soa.Header().Ttl, z.soa.Minttl)
+	return []dns.RR{soa}
+}
+
+// withOwner returns copies of records carrying the name as asked, which
+// synthesizes wildcard answers and keeps the client's case
+func withOwner(rrs []dns.RR, name string) []dns.RR {
+	copies := make([]dns.RR, len(rrs))
+	for i, rr := range rrs {
+		copies[i] = dns.Copy(rr)
+		copies[i].Header().Name = name
+	}
+	return copies
+}
+
+// cnameTarget returns where the last record of an answer for name points
+// when it is a CNAME to be followed for qtype, or ""
+func cnameTarget(answer []dns.RR, name string, qtype uint16) string {
+	if len(answer) == 0 || qtype == dns.TypeCNAME || qtype == dns.TypeANY {
+		return ""
+	}
+	cname, ok := answer[len(answer)-1].(*dns.CNAME)
+	if !ok || !strings.EqualFold(cname.Hdr.Name, name) {
+		return ""
+	}
+	return cname.Target
+}
+
+// answerFromZone answers a query for a name in a local zone, returning
+// false for queries to forward. CNAMEs are followed through the local
+// zones, and resolved upstream once they leave them.
+func (lb *LoadBalancer) answerFromZone(query []byte, clientAddr net.Addr, logger *logrus.Entry) ([]byte, bool) {
+	if len(lb.zones) == 0 {
+		return nil, false
+	}
+
+	msg := new(dns.Msg)
+	if err := msg.Unpack(query); err != nil || len(msg.Question) != 1 {
+		return nil, false
+	}
+	q := msg.Question[0]
+	zone := lb.zones.zoneFor(q.Name)
+	if zone == nil || q.Qclass != dns.ClassINET {
+		return nil, false
+	}
+	logger.WithField("zone", zone.origin).Debug("Answering from local zone")
+
+	reply := new(dns.Msg)
+	reply.SetReply(msg)
+	reply.RecursionAvailable = true
+
+	name := q.Name
+	for hops := 0; ; hops++ {
+		result := zone.lookup(name, q.Qtype)
+		if hops == 0 {
+			reply.Authoritative = result.authoritative
+		}
+		reply.Answer = append(reply.Answer, result.answer...)
+		reply.Ns = result.ns
+		reply.Extra = result.extra
+		reply.Rcode = result.rcode
+
+		target := cnameTarget(result.answer, name, q.Qtype)
+		if target == "" || hops == maxZoneCNAMEs {
+			break
+		}
+		name = target
+		if zone = lb.zones.zoneFor(target); zone == nil {
+			lb.chaseUpstream(reply, msg, target, clientAddr, logger)
+			break
+		}
+	}
+
+	if opt := msg.IsEdns0(); opt != nil {
+		reply.SetEdns0(dns.DefaultMsgSize, opt.Do())
+	}
+	response, err := reply.Pack()
+	if err != nil {
+		return rcodeResponse(query, dns.RcodeServerFailure), true
+	}
+	return response, true
+}
+
+// chaseUpstream resolves the target of a CNAME leading out of the local
+// zones through the backends, adding its answer to the reply
+func (lb *LoadBalancer) chaseUpstream(reply, msg *dns.Msg, target string, clientAddr net.Addr, logger *logrus.Entry) {
+	chase := msg.Copy()
+	chase.Id = dns.Id()
+	chase.Question[0].Name = target
+	query, err := chase.Pack()
+	if err != nil {
+		reply.Rcode = dns.RcodeServerFailure
+		return
+	}
+
+	upstream := new(dns.Msg)
+	response := lb.resolveUpstream(query, clientAddr, logger)
+	if response == nil || upstream.Unpack(response) != nil {
+		reply.Rcode = dns.RcodeServerFailure
+		return
+	}
+	reply.Answer = append(reply.Answer, upstream.Answer...)
+	reply.Ns = upstream.Ns
+	reply.Extra = nil
+	reply.Rcode = upstream.Rcode
+}
+
+// ZoneStats returns each local zone with its record count and the queries
+// it answered, or nil if no zones are loaded
+func (lb *LoadBalancer) ZoneStats() []map[string]interface{} {
+	if len(lb.zones) == 0 {
+		return nil
+	}
+
+	origins := make([]string, 0, len(lb.zones))
+	for origin := range lb.zones {
+		origins = append(origins, origin)
+	}
+	sort.Strings(origins)
+
+	stats := make([]map[string]interface{}, 0, len(origins))
+	for _, origin := range origins {
+		z := lb.zones[origin]
+		stats = append(stats, map[string]interface{}{
+			"zone":      z.origin,
+			"file":      z.file,
+			"serial":    z.soa.Serial,
+			"records":   z.records,
+			"answers":   atomic.LoadUint64(&z.answers),
+			"nodata":    atomic.LoadUint64(&z.nodata),
+			"nxdomain":  atomic.LoadUint64(&z.nxdomain),
+			"referrals": atomic.LoadUint64(&z.referrals),
+		})
+	}
+	return stats
+}
@@ -0,0 +1,181 @@
+package logging
+
+import (
+	"bytes"
+	"compress/gzip"
+	"crypto/tls"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"math/rand"
+	"net"
+	"os"
+	"strings"
+
+	"github.com/aram535/dnsbalancer/config"
+	"github.com/sirupsen/logrus"
+)
+
+// GELF UDP chunking
+const (
+	gelfChunkSize   = 1420 // UDP datagram size, chunk header included
+	gelfChunkHeader = 12
+	gelfMaxChunks   = 128 // Most chunks a GELF 1.1 message may have
+)
+
+// gelfHook sends every log entry to Graylog as a GELF 1.1 message: over
+// UDP gzipped, and chunked when larger than a datagram, or over TCP
+// (optionally TLS) delimited by a null byte
+type gelfHook struct {
+	host   string
+	fields map[string]interface{} // Configured extra fields, "_" prefixed
+	sender *sender
+}
+
+// newGELFHook creates the GELF hook and starts sending
+func newGELFHook(cfg *config.GELFConfig, logger *logrus.Logger) (*gelfHook, error) {
+	h := &gelfHook{
+		host:   cfg.Host,
+		fields: make(map[string]interface{}, len(cfg.Fields)),
+	}
+	if h.host == "" {
+		h.host, _ = os.Hostname()
+	}
+	for name, value := range cfg.Fields {
+		h.fields["_"+name] = value
+	}
+
+	var tlsConfig *tls.Config
+	if cfg.TLS != nil {
+		var err error
+		if tlsConfig, err = tlsClientConfig(cfg.Address, cfg.TLS); err != nil {
+			return nil, fmt.Errorf("GELF TLS: %w", err)
+		}
+	}
+
+	dial := func() (net.Conn, error) {
+		if tlsConfig != nil {
+			return tls.DialWithDialer(dialer(), "tcp", cfg.Address, tlsConfig)
+		}
+		return dialer().Dial(cfg.Protocol, cfg.Address)
+	}
+	write := func(conn net.Conn, msg []byte) error {
+		_, err := conn.Write(append(msg, 0))
+		return err
+	}
+	if cfg.Protocol == "udp" {
+		write = h.writeUDP
+	}
+	h.sender = newSender("GELF", cfg.Address, dial, write, logger)
+	return h, nil
+}
+
+// Levels sends entries of every level the logger lets through
+func (h *gelfHook) Levels() []logrus.Level {
+	return logrus.AllLevels
+}
+
+// Fire queues an entry to be sent
+func (h *gelfHook) Fire(entry *logrus.Entry) error {
+	msg, err := h.message(entry)
+	if err != nil {
+		h.sender.drop()
+		return nil
+	}
+	h.sender.enqueue(msg)
+	return nil
+}
+
+// message encodes an entry as GELF. The entry's fields, such as the
+// client and backend of a query, become additional fields.
+func (h *gelfHook) message(entry *logrus.Entry) ([]byte, error) {
+	msg := make(map[string]interface{}, len(h.fields)+len(entry.Data)+6)
+	for name, value := range h.fields {
+		msg[name] = value
+	}
+	for key, value := range entry.Data {
+		msg[gelfFieldName(key)] = fieldValue(value)
+	}
+
+	short, _, multiline := strings.Cut(entry.Message, "\n")
+	msg["version"] = "1.1"
+	msg["host"] = h.host
+	msg["short_message"] = short
+	if multiline {
+		msg["full_message"] = entry.Message
+	}
+	msg["timestamp"] = float64(entry.Time.UnixMicro()) / 1e6
+	msg["level"] = syslogSeverity(entry.Level)
+	return json.Marshal(msg)
+}
+
+// gelfFieldName turns a log field name into an additional field name,
+// replacing the characters GELF doesn't allow and steering clear of the
+// reserved "_id"
+func gelfFieldName(key string) string {
+	name := strings.Map(func(r rune) rune {
+		if r >= 'a' && r <= 'z' || r >= 'A' && r <= 'Z' || r >= '0' && r <= '9' || r == '_' || r == '-' || r == '.' {
+			return r
+		}
+		return '_'
+	}, key)
+	if name == "id" {
+		name = "_id"
+	}
+	return "_" + name
+}
+
+// fieldValue converts a log field value to a string or number, the
+// types GELF fields may have and what syslog prints
+func fieldValue(value interface{}) interface{} {
+	switch v := value.(type) {
+	case string, int, int8, int16, int32, int64, uint, uint8, uint16, uint32, uint64, float32, float64:
+		return v
+	case error:
+		return v.Error()
+	case fmt.Stringer:
+		return v.String()
+	}
+	return fmt.Sprint(value)
+}
+
+// writeUDP gzips a message and sends it in one datagram, or in chunks
+// sharing a random message ID when it doesn't fit
+func (h *gelfHook) writeUDP(conn net.Conn, msg []byte) error {
+	var buf bytes.Buffer
+	zw := gzip.NewWriter(&buf)
+	zw.Write(msg)
+	zw.Close()
+	payload := buf.Bytes()
+
+	if len(payload) <= gelfChunkSize {
+		_, err := conn.Write(payload)
+		return err
+	}
+
+	size := gelfChunkSize - gelfChunkHeader
+	count := (len(payload) + size - 1) / size
+	if count > gelfMaxChunks {
+		// Too large to send at all; not a connection problem
+		h.sender.drop()
+		return nil
+	}
+
+	chunk := make([]byte, gelfChunkSize)
+	chunk[0], chunk[1] = 0x1e, 0x0f
+	binary.BigEndian.PutUint64(chunk[2:10], rand.Uint64())
+	chunk[11] = byte(count)
+	for i := 0; i < count; i++ {
+		chunk[10] = byte(i)
+		n := copy(chunk[gelfChunkHeader:], payload[i*size:])
+		if _, err := conn.Write(chunk[:gelfChunkHeader+n]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// close stops sending, waiting a little for queued messages to go out
+func (h *gelfHook) close() {
+	h.sender.close()
+}
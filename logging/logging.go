@@ -52,6 +52,18 @@ func SetupLogger(cfg *config.Config, debug bool) (*logrus.Logger, error) {
 		}
 	}
 
+	// Setup syslog if enabled
+	if cfg.Syslog != nil && cfg.Syslog.Enabled {
+		if err := setupSyslogLogging(logger, cfg.Syslog); err != nil {
+			logger.WithError(err).Warn("Failed to setup syslog logging, continuing without it")
+		} else {
+			logger.WithFields(logrus.Fields{
+				"address":  cfg.Syslog.Address,
+				"protocol": cfg.Syslog.Protocol,
+			}).Info("Syslog logging enabled")
+		}
+	}
+
 	return logger, nil
 }
 
@@ -75,20 +87,44 @@ func setupFileLogging(logger *logrus.Logger, logDir string) error {
 	return nil
 }
 
-// setupGELFLogging configures GELF output (placeholder for v1.0)
-// TODO: Implement actual GELF support with graylog/gelf-go or similar
+// setupGELFLogging sends log entries to a GELF server as well
 func setupGELFLogging(logger *logrus.Logger, cfg *config.GELFConfig) error {
-	// Placeholder for GELF implementation
-	// This would use a library like:
-	// - github.com/gemnasium/logrus-graylog-hook
-	// - Or custom TCP/UDP GELF writer
-	
-	logger.WithFields(logrus.Fields{
-		"address":  cfg.Address,
-		"protocol": cfg.Protocol,
-	}).Warn("GELF logging requested but not yet implemented in v1.0")
-	
-	return fmt.Errorf("GELF support is planned for future release")
+	hook, err := newGELFHook(cfg, logger)
+	if err != nil {
+		return err
+	}
+	logger.AddHook(hook)
+	return nil
+}
+
+// setupSyslogLogging sends log entries to syslog as well
+func setupSyslogLogging(logger *logrus.Logger, cfg *config.SyslogConfig) error {
+	hook, err := newSyslogHook(cfg, logger)
+	if err != nil {
+		return err
+	}
+	logger.AddHook(hook)
+	return nil
+}
+
+// closingHook is a log output that sends entries elsewhere from a queue
+type closingHook interface {
+	logrus.Hook
+	close()
+}
+
+// Close flushes the log outputs that send entries elsewhere, such as
+// GELF and syslog, waiting a little for queued entries to go out
+func Close(logger *logrus.Logger) {
+	closed := make(map[logrus.Hook]bool)
+	for _, hooks := range logger.Hooks {
+		for _, hook := range hooks {
+			if h, ok := hook.(closingHook); ok && !closed[h] {
+				h.close()
+				closed[h] = true
+			}
+		}
+	}
 }
 
 // RotateLog provides a simple log rotation mechanism
@@ -0,0 +1,183 @@
+package logging
+
+import (
+	"crypto/tls"
+	"fmt"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/aram535/dnsbalancer/backend"
+	"github.com/aram535/dnsbalancer/config"
+	"github.com/sirupsen/logrus"
+)
+
+// Network log output settings
+const (
+	senderQueueSize    = 1024 // Messages waiting to be sent before new ones are dropped
+	senderDialTimeout  = 5 * time.Second
+	senderWriteTimeout = 5 * time.Second
+	senderMinBackoff   = time.Second
+	senderMaxBackoff   = 30 * time.Second
+	senderCloseTimeout = 2 * time.Second
+)
+
+// sender delivers encoded log messages to a log server from a goroutine,
+// so a slow or unreachable server never holds up logging; when its queue
+// is full, messages are dropped. A lost connection is dialled again,
+// backing off while the server stays unreachable.
+type sender struct {
+	name    string // Output name for its own log messages, e.g. "GELF"
+	address string
+	dial    func() (net.Conn, error)
+	write   func(conn net.Conn, msg []byte) error
+	logger  *logrus.Logger
+
+	mu     sync.RWMutex
+	closed bool
+	queue  chan []byte
+	done   chan struct{}
+
+	// Used by the sending goroutine only
+	conn    net.Conn
+	backoff time.Duration
+	retryAt time.Time
+
+	dropped uint64 // Messages not sent
+}
+
+// newSender starts a sender. The connection is made when the first
+// message is sent.
+func newSender(name, address string, dial func() (net.Conn, error), write func(net.Conn, []byte) error, logger *logrus.Logger) *sender {
+	s := &sender{
+		name:    name,
+		address: address,
+		dial:    dial,
+		write:   write,
+		logger:  logger,
+		queue:   make(chan []byte, senderQueueSize),
+		done:    make(chan struct{}),
+	}
+	go s.run()
+	return s
+}
+
+// dialer returns the dialer network log outputs connect with
+func dialer() *net.Dialer {
+	return &net.Dialer{Timeout: senderDialTimeout}
+}
+
+// enqueue queues a message to be sent, or drops it if the queue is full
+func (s *sender) enqueue(msg []byte) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	if s.closed {
+		return
+	}
+	select {
+	case s.queue <- msg:
+	default:
+		s.drop()
+	}
+}
+
+// drop counts a message that won't be sent
+func (s *sender) drop() {
+	atomic.AddUint64(&s.dropped, 1)
+}
+
+// run sends queued messages until the sender is closed
+func (s *sender) run() {
+	defer close(s.done)
+	for msg := range s.queue {
+		s.send(msg)
+	}
+	if s.conn != nil {
+		s.conn.Close()
+	}
+}
+
+// send writes a message, connecting first if need be. A message that fails
+// to write is tried once more on a new connection before it is dropped.
+func (s *sender) send(msg []byte) {
+	for attempt := 0; attempt < 2; attempt++ {
+		if s.conn == nil && !s.connect() {
+			break
+		}
+		s.conn.SetWriteDeadline(time.Now().Add(senderWriteTimeout))
+		err := s.write(s.conn, msg)
+		if err == nil {
+			return
+		}
+		s.conn.Close()
+		s.conn = nil
+		s.logger.WithError(err).Warnf("Lost %s connection, reconnecting", s.name)
+	}
+	s.drop()
+}
+
+// connect dials the log server, unless the last attempt failed too
+// recently. Failures back off exponentially up to senderMaxBackoff.
+func (s *sender) connect() bool {
+	if time.Now().Before(s.retryAt) {
+		return false
+	}
+
+	conn, err := s.dial()
+	if err != nil {
+		if s.backoff == 0 {
+			s.logger.WithError(err).WithField("address", s.address).Warnf("Failed to connect to %s server", s.name)
+		}
+		s.backoff = min(max(2*s.backoff, senderMinBackoff), senderMaxBackoff)
+		s.retryAt = time.Now().Add(s.backoff)
+		return false
+	}
+
+	if s.backoff > 0 {
+		s.logger.WithField("address", s.address).Infof("Reconnected to %s server", s.name)
+	}
+	s.conn = conn
+	s.backoff = 0
+	s.retryAt = time.Time{}
+	return true
+}
+
+// close stops taking messages and waits a little for those queued to go
+// out
+func (s *sender) close() {
+	s.mu.Lock()
+	if s.closed {
+		s.mu.Unlock()
+		return
+	}
+	s.closed = true
+	close(s.queue)
+	s.mu.Unlock()
+
+	select {
+	case <-s.done:
+	case <-time.After(senderCloseTimeout):
+	}
+	if dropped := atomic.LoadUint64(&s.dropped); dropped > 0 {
+		s.logger.WithField("dropped", dropped).Warnf("Some log messages were not sent to the %s server", s.name)
+	}
+}
+
+// tlsClientConfig builds the TLS settings for connecting to a log server,
+// from the same options a backend takes
+func tlsClientConfig(address string, cfg *config.BackendTLSConfig) (*tls.Config, error) {
+	host, _, err := net.SplitHostPort(address)
+	if err != nil {
+		return nil, fmt.Errorf("invalid address: %w", err)
+	}
+	opts := &backend.TLSOptions{
+		ServerName:         cfg.ServerName,
+		CAFile:             cfg.CAFile,
+		InsecureSkipVerify: cfg.InsecureSkipVerify,
+		CertFile:           cfg.CertFile,
+		KeyFile:            cfg.KeyFile,
+		SPKIPins:           cfg.SPKIPins,
+	}
+	return opts.ClientConfig(host)
+}
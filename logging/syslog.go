@@ -0,0 +1,152 @@
+package logging
+
+import (
+	"crypto/tls"
+	"fmt"
+	"net"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/aram535/dnsbalancer/config"
+	"github.com/sirupsen/logrus"
+)
+
+// defaultSyslogTag is the app name messages are sent with
+const defaultSyslogTag = "dnsbalancer"
+
+// syslogHook sends every log entry to syslog: to the local daemon's socket
+// in its traditional format, or to a remote server as RFC 5424 over UDP,
+// or TCP (optionally TLS) with octet-counting framing (RFC 6587). The
+// entry's fields follow the message as key=value pairs.
+type syslogHook struct {
+	local    bool
+	facility int
+	tag      string
+	hostname string
+	pid      int
+	sender   *sender
+}
+
+// newSyslogHook creates the syslog hook and starts sending
+func newSyslogHook(cfg *config.SyslogConfig, logger *logrus.Logger) (*syslogHook, error) {
+	h := &syslogHook{
+		local:    cfg.Protocol == "unix",
+		facility: config.SyslogFacilities[cfg.Facility],
+		tag:      cfg.Tag,
+		pid:      os.Getpid(),
+	}
+	if h.tag == "" {
+		h.tag = defaultSyslogTag
+	}
+	h.hostname, _ = os.Hostname()
+	if h.hostname == "" {
+		h.hostname = "-"
+	}
+
+	var tlsConfig *tls.Config
+	if cfg.TLS != nil {
+		var err error
+		if tlsConfig, err = tlsClientConfig(cfg.Address, cfg.TLS); err != nil {
+			return nil, fmt.Errorf("syslog TLS: %w", err)
+		}
+	}
+
+	stream := false
+	dial := func() (net.Conn, error) {
+		switch {
+		case h.local:
+			// Datagram sockets are the norm; some daemons listen on a
+			// stream socket instead
+			conn, err := net.Dial("unixgram", cfg.Address)
+			if err != nil {
+				conn, err = dialer().Dial("unix", cfg.Address)
+				stream = err == nil
+			}
+			return conn, err
+		case tlsConfig != nil:
+			return tls.DialWithDialer(dialer(), "tcp", cfg.Address, tlsConfig)
+		}
+		return dialer().Dial(cfg.Protocol, cfg.Address)
+	}
+	write := func(conn net.Conn, msg []byte) error {
+		switch {
+		case h.local && stream:
+			msg = append(msg, '\n')
+		case cfg.Protocol == "tcp":
+			msg = append([]byte(strconv.Itoa(len(msg))+" "), msg...)
+		}
+		_, err := conn.Write(msg)
+		return err
+	}
+	h.sender = newSender("syslog", cfg.Address, dial, write, logger)
+	return h, nil
+}
+
+// Levels sends entries of every level the logger lets through
+func (h *syslogHook) Levels() []logrus.Level {
+	return logrus.AllLevels
+}
+
+// Fire queues an entry to be sent
+func (h *syslogHook) Fire(entry *logrus.Entry) error {
+	h.sender.enqueue(h.message(entry))
+	return nil
+}
+
+// message formats an entry for the local daemon or as RFC 5424
+func (h *syslogHook) message(entry *logrus.Entry) []byte {
+	pri := h.facility*8 + syslogSeverity(entry.Level)
+	text := syslogText(entry)
+	if h.local {
+		return []byte(fmt.Sprintf("<%d>%s %s[%d]: %s",
+			pri, entry.Time.Format(time.Stamp), h.tag, h.pid, text))
+	}
+	return []byte(fmt.Sprintf("<%d>1 %s %s %s %d - - %s",
+		pri, entry.Time.Format("2006-01-02T15:04:05.000000Z07:00"), h.hostname, h.tag, h.pid, text))
+}
+
+// syslogText returns an entry's message on one line, followed by its
+// fields in key order
+func syslogText(entry *logrus.Entry) string {
+	var b strings.Builder
+	b.WriteString(strings.ReplaceAll(entry.Message, "\n", " "))
+
+	keys := make([]string, 0, len(entry.Data))
+	for key := range entry.Data {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		value := fmt.Sprint(fieldValue(entry.Data[key]))
+		if value == "" || strings.ContainsAny(value, " \"=\n") {
+			value = strconv.Quote(value)
+		}
+		b.WriteString(" " + key + "=" + value)
+	}
+	return b.String()
+}
+
+// syslogSeverity maps a log level to its syslog severity
+func syslogSeverity(level logrus.Level) int {
+	switch level {
+	case logrus.PanicLevel:
+		return 0
+	case logrus.FatalLevel:
+		return 2
+	case logrus.ErrorLevel:
+		return 3
+	case logrus.WarnLevel:
+		return 4
+	case logrus.InfoLevel:
+		return 6
+	}
+	return 7
+}
+
+// close stops sending, waiting a little for queued messages to go out
+func (h *syslogHook) close() {
+	h.sender.close()
+}